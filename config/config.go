@@ -9,13 +9,42 @@ import (
 )
 
 type Config struct {
-	MetadataDB        MySQL         `json:"metadata_db"`
-	QueryDB           ElasticSearch `json:"query_db"`
-	FileStore         GoogleDrive   `json:"file_store"`
-	SMTP              Brevo         `json:"smtp"`
-	WebPage           WebPage       `json:"web_page"`
-	InternalSender    string        `json:"internal_sender"`
-	TrialAccountToken string        `json:"trial_account_token"`
+	MetadataDB        MySQL          `json:"metadata_db"`
+	QueryDB           ElasticSearch  `json:"query_db"`
+	LocalQueryDB      LocalQueryDB   `json:"local_query_db"`
+	FileStore         GoogleDrive    `json:"file_store"`
+	SMTP              Brevo          `json:"smtp"`
+	WebPage           WebPage        `json:"web_page"`
+	InternalSender    string         `json:"internal_sender"`
+	TrialAccountToken string         `json:"trial_account_token"`
+	UdHashSecret      string         `json:"ud_hash_secret"` // keys the hashes of erased uds
+	FileUploadTask    FileUploadTask `json:"file_upload_task"`
+	Ingestion         Ingestion      `json:"ingestion"`
+}
+
+type FileUploadTask struct {
+	// MaxInvalidRowPercent fails a task if the percentage of invalid rows exceeds it, 0 means no invalid row is tolerated.
+	MaxInvalidRowPercent float64 `json:"max_invalid_row_percent"`
+}
+
+// Ingestion configures the consumer writing ud tag values from Kafka.
+type Ingestion struct {
+	Brokers           []string `json:"brokers"`
+	Topic             string   `json:"topic"`
+	ConsumerGroup     string   `json:"consumer_group"`
+	BalanceStrategy   string   `json:"balance_strategy"`
+	InitialOffset     string   `json:"initial_offset"`
+	ChannelBufferSize int      `json:"channel_buffer_size"`
+	FetchDefaultBytes int32    `json:"fetch_default_bytes"`
+
+	// BatchSize is the max number of uds validated and written together.
+	BatchSize int `json:"batch_size"`
+	// FlushIntervalMillis flushes a partial batch, so that uds of a quiet topic are not held back.
+	FlushIntervalMillis int `json:"flush_interval_millis"`
+	// QueueSize is the max number of uds waiting for a batch, the consumer stops fetching when it is full.
+	QueueSize int `json:"queue_size"`
+	// DeadLetterTopic receives the uds whose write keeps failing, without it failed writes are retried until they succeed.
+	DeadLetterTopic string `json:"dead_letter_topic"`
 }
 
 type ElasticSearch struct {
@@ -28,6 +57,13 @@ type ElasticSearch struct {
 	ScrollTimeoutSeconds int      `json:"scroll_timeout_seconds"`
 }
 
+// LocalQueryDB replaces QueryDB with in-process stores when enabled, for local development without Elasticsearch.
+type LocalQueryDB struct {
+	Enabled bool `json:"enabled"`
+	// Dir persists each tenant store into a file under it, stores are kept in memory only if it is empty.
+	Dir string `json:"dir"`
+}
+
 type GoogleDrive struct {
 	BaseFolderID string `json:"base_folder_id"`
 	AdminEmail   string `json:"admin_email"`
@@ -123,6 +159,16 @@ func NewConfig() *Config {
 			},
 		},
 		TrialAccountToken: "",
+		FileUploadTask: FileUploadTask{
+			MaxInvalidRowPercent: 0,
+		},
+		Ingestion: Ingestion{
+			Brokers:             []string{},
+			ConsumerGroup:       "mirror-ingestion",
+			BatchSize:           500,
+			FlushIntervalMillis: 1000,
+			QueueSize:           5000,
+		},
 	}
 }
 
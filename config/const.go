@@ -5,47 +5,67 @@ import (
 )
 
 const (
-	PathHealthCheck          = "/"
-	PathCreateTag            = "/create_tag"
-	PathGetTags              = "/get_tags"
-	PathGetTag               = "/get_tag"
-	PathCountTags            = "/count_tags"
-	PathCreateSegment        = "/create_segment"
-	PathGetSegment           = "/get_segment"
-	PathGetSegments          = "/get_segments"
-	PathCountUd              = "/count_ud"
-	PathDownloadUds          = "/download_uds"
-	PathPreviewUd            = "/preview_ud"
-	PathCountSegments        = "/count_segments"
-	PathCreateEmail          = "/create_email"
-	PathUpdateEmail          = "/update_email"
-	PathGetEmails            = "/get_emails"
-	PathGetEmail             = "/get_email"
-	PathCreateCampaign       = "/create_campaign"
-	PathOnEmailAction        = "/on_email_action"
-	PathGetCampaigns         = "/get_campaigns"
-	PathGetCampaign          = "/get_campaign"
-	PathCreateTenant         = "/create_tenant"
-	PathGetTenant            = "/get_tenant"
-	PathInitUser             = "/init_user"
-	PathLogIn                = "/log_in"
-	PathLogOut               = "/log_out"
-	PathIsLoggedIn           = "/is_logged_in"
-	PathCreateFileUploadTask = "/create_file_upload_task"
-	PathGetFileUploadTasks   = "/get_file_upload_tasks"
-	PathCreateTrialAccount   = "/create_trial_account"
-	PathGetActions           = "/get_actions"
-	PathCreateRole           = "/create_role"
-	PathUpdateRoles          = "/update_roles"
-	PathGetRoles             = "/get_roles"
-	PathCreateUsers          = "/create_users"
-	PathGetUsers             = "/get_users"
-	PathMe                   = "/me"
-	PathGetDistinctTagValues = "/get_distinct_tag_values"
-	PathCreateDomain         = "/create_domain"
-	PathUpdateDnsRecords     = "/update_dns_records"
-	PathCreateSender         = "/create_sender"
-	PathGetSenders           = "/get_senders"
+	PathHealthCheck           = "/"
+	PathCreateTag             = "/create_tag"
+	PathGetTags               = "/get_tags"
+	PathGetTag                = "/get_tag"
+	PathCountTags             = "/count_tags"
+	PathUpdateTag             = "/update_tag"
+	PathDeleteTag             = "/delete_tag"
+	PathGetTagStats           = "/get_tag_stats"
+	PathGetTagValHistory      = "/get_tag_val_history"
+	PathGetUdProfile          = "/get_ud_profile"
+	PathUpsertUds             = "/upsert_uds"
+	PathDeleteUd              = "/delete_ud"
+	PathGetErasures           = "/get_erasures"
+	PathCreateSegment         = "/create_segment"
+	PathGetSegment            = "/get_segment"
+	PathGetSegments           = "/get_segments"
+	PathCountUd               = "/count_ud"
+	PathDownloadUds           = "/download_uds"
+	PathPreviewUd             = "/preview_ud"
+	PathCountSegments         = "/count_segments"
+	PathUpdateSegment         = "/update_segment"
+	PathDeleteSegment         = "/delete_segment"
+	PathGetSegmentVersions    = "/get_segment_versions"
+	PathRestoreSegment        = "/restore_segment"
+	PathGetSegmentSizes       = "/get_segment_size_history"
+	PathGetSegmentOverlaps    = "/get_segment_overlaps"
+	PathSnapshotSegment       = "/snapshot_segment"
+	PathSplitSegment          = "/split_segment"
+	PathCreateEmail           = "/create_email"
+	PathUpdateEmail           = "/update_email"
+	PathGetEmails             = "/get_emails"
+	PathGetEmail              = "/get_email"
+	PathCreateCampaign        = "/create_campaign"
+	PathOnEmailAction         = "/on_email_action"
+	PathGetCampaigns          = "/get_campaigns"
+	PathGetCampaign           = "/get_campaign"
+	PathCreateTenant          = "/create_tenant"
+	PathGetTenant             = "/get_tenant"
+	PathInitUser              = "/init_user"
+	PathLogIn                 = "/log_in"
+	PathLogOut                = "/log_out"
+	PathIsLoggedIn            = "/is_logged_in"
+	PathCreateFileUploadTask  = "/create_file_upload_task"
+	PathGetFileUploadTasks    = "/get_file_upload_tasks"
+	PathCreateSegmentExport   = "/create_segment_export_task"
+	PathGetSegmentExports     = "/get_segment_export_tasks"
+	PathDownloadSegmentExport = "/download_segment_export"
+	PathCreateTrialAccount    = "/create_trial_account"
+	PathGetActions            = "/get_actions"
+	PathCreateRole            = "/create_role"
+	PathUpdateRoles           = "/update_roles"
+	PathGetRoles              = "/get_roles"
+	PathCreateUsers           = "/create_users"
+	PathGetUsers              = "/get_users"
+	PathMe                    = "/me"
+	PathGetDistinctTagValues  = "/get_distinct_tag_values"
+	PathCreateDomain          = "/create_domain"
+	PathUpdateDnsRecords      = "/update_dns_records"
+	PathCreateSender          = "/create_sender"
+	PathGetSenders            = "/get_senders"
+	PathFlushQueryCache       = "/flush_query_cache"
 )
 
 const (
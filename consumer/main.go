@@ -0,0 +1,186 @@
+package main
+
+import (
+	"cdp/config"
+	"cdp/consumer/upsert_ud"
+	"cdp/pkg/logutil"
+	"cdp/pkg/mq"
+	"cdp/pkg/service"
+	"cdp/repo"
+	"context"
+	"github.com/rs/zerolog/log"
+)
+
+type consumer struct {
+	ctx context.Context
+	opt *config.Option
+	cfg *config.Config
+
+	// base repos
+	baseRepo  repo.BaseRepo
+	queryRepo repo.QueryRepo
+
+	// payload handlers
+	upsertUd *upsert_ud.UpsertUd
+
+	mqConsumer         *mq.Consumer
+	deadLetterProducer *mq.Producer
+}
+
+func main() {
+	c := new(consumer)
+	if err := service.Run(c); err != nil {
+		log.Fatal().Msg(err.Error())
+	}
+}
+
+func (c *consumer) Init() error {
+	c.opt = config.NewOptions()
+	return nil
+}
+
+func (c *consumer) Start() error {
+	var err error
+
+	// ====== init logger ===== //
+
+	c.ctx = logutil.InitZeroLog(context.Background(), c.opt.LogLevel)
+
+	// ===== init config ===== //
+
+	c.cfg = config.NewConfig()
+	if err = c.cfg.Load(c.ctx, c.opt.ConfigPath); err != nil {
+		log.Ctx(c.ctx).Error().Msgf("load config failed, err: %v", err)
+		return err
+	}
+
+	// ===== init repos =====
+
+	// base repo
+	c.baseRepo, err = repo.NewBaseRepo(c.ctx, c.cfg.MetadataDB)
+	if err != nil {
+		log.Ctx(c.ctx).Error().Msgf("init base repo failed, err: %v", err)
+		return err
+	}
+	defer func() {
+		if err != nil && c.baseRepo != nil {
+			if err := c.baseRepo.Close(c.ctx); err != nil {
+				log.Ctx(c.ctx).Error().Msgf("close base repo failed, err: %v", err)
+				return
+			}
+		}
+	}()
+
+	// query repo
+	c.queryRepo, err = repo.NewQueryRepo(c.ctx, c.cfg, c.baseRepo)
+	if err != nil {
+		log.Ctx(c.ctx).Error().Msgf("init query repo failed, err: %v", err)
+		return err
+	}
+	defer func() {
+		if err != nil && c.queryRepo != nil {
+			if err := c.queryRepo.Close(c.ctx); err != nil {
+				log.Ctx(c.ctx).Error().Msgf("close query repo failed, err: %v", err)
+				return
+			}
+		}
+	}()
+
+	// tenant repo
+	tenantRepo, err := repo.NewTenantRepo(c.ctx, c.baseRepo)
+	if err != nil {
+		log.Ctx(c.ctx).Error().Msgf("init tenant repo failed, err: %v", err)
+		return err
+	}
+
+	// tag repo
+	tagRepo := repo.NewTagRepo(c.ctx, c.baseRepo)
+
+	// erasure repo
+	erasureRepo, err := repo.NewErasureRepo(c.ctx, c.baseRepo, c.cfg.UdHashSecret)
+	if err != nil {
+		log.Ctx(c.ctx).Error().Msgf("init erasure repo failed, err: %v", err)
+		return err
+	}
+
+	// mapping id repo
+	mappingIDRepo := repo.NewMappingIDRepo(c.ctx, c.baseRepo)
+
+	// ===== init payload handlers ===== //
+
+	// dead letter producer
+	if topic := c.cfg.Ingestion.DeadLetterTopic; topic != "" {
+		c.deadLetterProducer, err = mq.NewProducer(c.ctx, mq.ProducerConfig{
+			Brokers: c.cfg.Ingestion.Brokers,
+			Topics: map[uint32]string{
+				uint32(mq.PayloadUpsertUd): topic,
+			},
+		})
+		if err != nil {
+			log.Ctx(c.ctx).Error().Msgf("init dead letter producer failed, err: %v", err)
+			return err
+		}
+	}
+
+	c.upsertUd = upsert_ud.New(c.cfg.Ingestion, tenantRepo, tagRepo, c.queryRepo, erasureRepo, mappingIDRepo, c.deadLetterProducer)
+	c.upsertUd.Start(c.ctx)
+
+	mq.RegisterHandler(mq.PayloadUpsertUd, c.upsertUd.Handle)
+
+	// ===== start consumer ===== //
+
+	ingestion := c.cfg.Ingestion
+	c.mqConsumer, err = mq.NewConsumer(c.ctx, mq.ConsumerConfig{
+		Brokers:           ingestion.Brokers,
+		Topic:             ingestion.Topic,
+		ConsumerGroup:     ingestion.ConsumerGroup,
+		BalanceStrategy:   ingestion.BalanceStrategy,
+		InitialOffset:     ingestion.InitialOffset,
+		ChannelBufferSize: ingestion.ChannelBufferSize,
+		FetchDefaultBytes: ingestion.FetchDefaultBytes,
+	})
+	if err != nil {
+		log.Ctx(c.ctx).Error().Msgf("init consumer failed, err: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func (c *consumer) Stop() error {
+	// stop consuming first, so that no message is queued after the queue is closed
+	if c.mqConsumer != nil {
+		if err := c.mqConsumer.Close(); err != nil {
+			log.Ctx(c.ctx).Error().Msgf("close consumer failed, err: %v", err)
+			return err
+		}
+	}
+
+	if c.upsertUd != nil {
+		c.upsertUd.Close()
+	}
+
+	if c.deadLetterProducer != nil {
+		if err := c.deadLetterProducer.Close(); err != nil {
+			log.Ctx(c.ctx).Error().Msgf("close dead letter producer failed, err: %v", err)
+			return err
+		}
+	}
+
+	// closing the query repo flushes the uds left in the bulk indexer
+	if c.queryRepo != nil {
+		if err := c.queryRepo.Close(c.ctx); err != nil {
+			log.Ctx(c.ctx).Error().Msgf("close query repo failed, err: %v", err)
+			return err
+		}
+	}
+
+	if c.baseRepo != nil {
+		if err := c.baseRepo.Close(c.ctx); err != nil {
+			log.Ctx(c.ctx).Error().Msgf("close base repo failed, err: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
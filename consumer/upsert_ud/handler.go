@@ -0,0 +1,329 @@
+package upsert_ud
+
+import (
+	"cdp/config"
+	"cdp/entity"
+	"cdp/handler"
+	"cdp/pkg/mq"
+	"cdp/repo"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchSize           = 500
+	defaultFlushIntervalMillis = 1000
+	defaultQueueSize           = 5000
+
+	// deadLetterAfter is how long a failed batch is retried before it is sent to the dead-letter topic
+	deadLetterAfter = time.Minute
+)
+
+type item struct {
+	msg      *mq.Message
+	tenantID uint64
+	udTagVal *entity.UdTagVal
+}
+
+// UpsertUd writes the ud tag values consumed from Kafka. Messages are queued and written in batches,
+// so that tenants, tags and erased uds are looked up once per batch, and the query store gets large requests.
+// The queue is bounded, once it is full the consumer blocks and stops fetching until the writer catches up.
+// Offsets are committed only once a batch is written. A failed batch is retried, and sent to the dead-letter
+// topic if the write keeps failing, without a dead-letter topic it is retried until it is written.
+type UpsertUd struct {
+	tenantRepo    repo.TenantRepo
+	tagRepo       repo.TagRepo
+	queryRepo     repo.QueryRepo
+	erasureRepo   repo.ErasureRepo
+	mappingIDRepo repo.MappingIDRepo
+
+	// deadLetterProducer is nil if no dead-letter topic is configured
+	deadLetterProducer *mq.Producer
+
+	batchSize     int
+	flushInterval time.Duration
+
+	queue chan *item
+	wg    *sync.WaitGroup
+}
+
+func New(cfg config.Ingestion, tenantRepo repo.TenantRepo, tagRepo repo.TagRepo, queryRepo repo.QueryRepo,
+	erasureRepo repo.ErasureRepo, mappingIDRepo repo.MappingIDRepo, deadLetterProducer *mq.Producer) *UpsertUd {
+	batchSize := cfg.BatchSize
+	if batchSize == 0 {
+		batchSize = defaultBatchSize
+	}
+
+	flushIntervalMillis := cfg.FlushIntervalMillis
+	if flushIntervalMillis == 0 {
+		flushIntervalMillis = defaultFlushIntervalMillis
+	}
+
+	queueSize := cfg.QueueSize
+	if queueSize == 0 {
+		queueSize = defaultQueueSize
+	}
+
+	return &UpsertUd{
+		tenantRepo:         tenantRepo,
+		tagRepo:            tagRepo,
+		queryRepo:          queryRepo,
+		erasureRepo:        erasureRepo,
+		mappingIDRepo:      mappingIDRepo,
+		deadLetterProducer: deadLetterProducer,
+		batchSize:          batchSize,
+		flushInterval:      time.Duration(flushIntervalMillis) * time.Millisecond,
+		queue:              make(chan *item, queueSize),
+		wg:                 new(sync.WaitGroup),
+	}
+}
+
+// Start starts the batch writer, it must be called before messages are consumed.
+func (h *UpsertUd) Start(ctx context.Context) {
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.write(ctx)
+	}()
+}
+
+// Close writes the queued uds, it must be called after the consumer is closed.
+// Their offsets can no longer be committed, so they are consumed again, and rewritten, once the group rebalances.
+func (h *UpsertUd) Close() {
+	close(h.queue)
+	h.wg.Wait()
+}
+
+// Handle validates the message envelope and queues it, the tenant and tag values are checked by the writer.
+func (h *UpsertUd) Handle(ctx context.Context, msg *mq.Message) error {
+	body := new(mq.UpsertUd)
+	if err := msg.ParseBody(body); err != nil {
+		return err
+	}
+
+	if body.GetTenantID() == 0 {
+		return errors.New("empty tenant id")
+	}
+
+	select {
+	case h.queue <- &item{
+		msg:      msg,
+		tenantID: body.GetTenantID(),
+		udTagVal: body.ToUdTagVal(),
+	}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *UpsertUd) write(ctx context.Context) {
+	ticker := time.NewTicker(h.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*item, 0, h.batchSize)
+	for {
+		select {
+		case it, ok := <-h.queue:
+			if !ok {
+				h.flush(ctx, batch)
+				return
+			}
+
+			batch = append(batch, it)
+			if len(batch) < h.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		h.flush(ctx, batch)
+		batch = make([]*item, 0, h.batchSize)
+	}
+}
+
+// flush writes the batch tenant by tenant, and commits the messages once all of them are written
+// or sent to the dead-letter topic. Messages left uncommitted are consumed again.
+func (h *UpsertUd) flush(ctx context.Context, batch []*item) {
+	var (
+		tenantIDs = make([]uint64, 0)
+		items     = make(map[uint64][]*item)
+	)
+	for _, it := range batch {
+		if _, ok := items[it.tenantID]; !ok {
+			tenantIDs = append(tenantIDs, it.tenantID)
+		}
+		items[it.tenantID] = append(items[it.tenantID], it)
+	}
+
+	for _, tenantID := range tenantIDs {
+		if err := h.writeWithRetry(ctx, tenantID, items[tenantID]); err != nil {
+			log.Ctx(ctx).Error().Msgf("write ud tag vals failed, messages are not committed, tenant: %d, uds: %d, err: %v",
+				tenantID, len(items[tenantID]), err)
+			return
+		}
+	}
+
+	msgs := make([]*mq.Message, 0, len(batch))
+	for _, it := range batch {
+		msgs = append(msgs, it.msg)
+	}
+	mq.Commit(msgs)
+}
+
+// writeWithRetry writes the uds of a tenant, retrying failed writes. The uds are sent to the dead-letter topic
+// if the write keeps failing, an error is returned only if the context is done before they are written.
+func (h *UpsertUd) writeWithRetry(ctx context.Context, tenantID uint64, items []*item) error {
+	udTagVals := make([]*entity.UdTagVal, 0, len(items))
+	for _, it := range items {
+		udTagVals = append(udTagVals, it.udTagVal)
+	}
+
+	write := func() error {
+		tenant, err := h.tenantRepo.GetByID(ctx, tenantID)
+		if err != nil {
+			if errors.Is(err, repo.ErrTenantNotFound) {
+				return backoff.Permanent(err)
+			}
+			return err
+		}
+		return h.writeTenant(ctx, tenant, udTagVals)
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0
+	if h.deadLetterProducer != nil {
+		b.MaxElapsedTime = deadLetterAfter
+	}
+
+	err := backoff.RetryNotify(write, backoff.WithContext(b, ctx), func(err error, next time.Duration) {
+		log.Ctx(ctx).Warn().Msgf("write ud tag vals failed, retry in %v, tenant: %d, err: %v", next, tenantID, err)
+	})
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// the messages of a missing tenant can never be written
+	if errors.Is(err, repo.ErrTenantNotFound) {
+		log.Ctx(ctx).Error().Msgf("tenant not found, uds are dropped, tenant: %d, uds: %d", tenantID, len(items))
+		return nil
+	}
+
+	// without a dead-letter topic the write is retried until the context is done
+	if h.deadLetterProducer == nil {
+		return err
+	}
+
+	// a message that cannot be sent is dropped, keeping it uncommitted would not stop later batches committing past it
+	for _, it := range items {
+		if err := h.deadLetterProducer.SendMessage(it.msg); err != nil {
+			log.Ctx(ctx).Error().Msgf("send to dead-letter topic failed, ud is dropped, tenant: %d, offset: %d, err: %v",
+				tenantID, it.msg.GetOffset(), err)
+		}
+	}
+
+	log.Ctx(ctx).Error().Msgf("ud tag vals sent to dead-letter topic, tenant: %d, uds: %d, err: %v", tenantID, len(items), err)
+
+	return nil
+}
+
+func (h *UpsertUd) writeTenant(ctx context.Context, tenant *entity.Tenant, udTagVals []*entity.UdTagVal) error {
+	var (
+		tagIDs   = make([]uint64, 0)
+		seenTags = make(map[uint64]bool)
+	)
+	for _, udTagVal := range udTagVals {
+		for _, tagVal := range udTagVal.GetTagVals() {
+			if !seenTags[tagVal.GetTagID()] {
+				seenTags[tagVal.GetTagID()] = true
+				tagIDs = append(tagIDs, tagVal.GetTagID())
+			}
+		}
+	}
+
+	tags, err := h.tagRepo.GetManyByIDs(ctx, tenant.GetID(), tagIDs)
+	if err != nil {
+		return err
+	}
+
+	tagsByID := make(map[uint64]*entity.Tag, len(tags))
+	for _, tag := range tags {
+		tagsByID[tag.GetID()] = tag
+	}
+
+	var (
+		valid = make([]*entity.UdTagVal, 0, len(udTagVals))
+		uds   = make([]*entity.Ud, 0, len(udTagVals))
+	)
+	for _, udTagVal := range udTagVals {
+		v, err := handler.ToUdTagVal(udTagVal, tagsByID)
+		if err != nil {
+			log.Ctx(ctx).Warn().Msgf("invalid ud tag val, tenant: %d, err: %v", tenant.GetID(), err)
+			continue
+		}
+
+		valid = append(valid, v)
+		uds = append(uds, v.GetUd())
+	}
+
+	// erased uds must not be brought back
+	suppressed, err := h.erasureRepo.GetSuppressedUds(ctx, tenant.GetID(), uds)
+	if err != nil {
+		return err
+	}
+
+	unsuppressed := make([]*entity.UdTagVal, 0, len(valid))
+	for _, udTagVal := range valid {
+		if !suppressed[udTagVal.GetUd().ToDocID()] {
+			unsuppressed = append(unsuppressed, udTagVal)
+		}
+	}
+
+	if err := handler.SetProfileIDs(ctx, h.mappingIDRepo, tenant.GetID(), unsuppressed); err != nil {
+		return err
+	}
+
+	if len(unsuppressed) > 0 {
+		errs, err := h.queryRepo.Upsert(ctx, tenant.GetName(), unsuppressed)
+		if err != nil {
+			return err
+		}
+
+		var (
+			failed   int
+			firstErr error
+		)
+		for _, err := range errs {
+			if err != nil {
+				failed++
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d uds failed, first err: %v", failed, len(unsuppressed), firstErr)
+		}
+
+		for tagID := range seenTags {
+			h.queryRepo.InvalidateTagCache(ctx, tenant.GetID(), tagID)
+		}
+	}
+
+	log.Ctx(ctx).Info().Msgf("ud tag vals written, tenant: %d, total: %d, invalid: %d, suppressed: %d",
+		tenant.GetID(), len(udTagVals), len(udTagVals)-len(valid), len(valid)-len(unsuppressed))
+
+	return nil
+}
@@ -23,9 +23,30 @@ type CampaignLog struct {
 	CreateTime      *uint64 `json:"create_time,omitempty"`
 }
 
+func (e *CampaignLog) GetID() uint64 {
+	if e != nil && e.ID != nil {
+		return *e.ID
+	}
+	return 0
+}
+
 func (e *CampaignLog) GetEvent() Event {
 	if e != nil {
 		return e.Event
 	}
 	return EventUnknown
 }
+
+func (e *CampaignLog) GetCampaignEmailID() uint64 {
+	if e != nil && e.CampaignEmailID != nil {
+		return *e.CampaignEmailID
+	}
+	return 0
+}
+
+func (e *CampaignLog) GetEmail() string {
+	if e != nil && e.Email != nil {
+		return *e.Email
+	}
+	return ""
+}
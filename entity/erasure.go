@@ -0,0 +1,252 @@
+package entity
+
+import (
+	"cdp/pkg/goutil"
+	"encoding/json"
+	"time"
+)
+
+type ErasureStatus uint32
+
+const (
+	ErasureStatusUnknown ErasureStatus = iota
+	ErasureStatusPending
+	ErasureStatusRunning
+	ErasureStatusSuccess
+	ErasureStatusFailed
+)
+
+// ErasedUd identifies an erased ud without keeping its ID.
+type ErasedUd struct {
+	IDType IDType  `json:"id_type,omitempty"`
+	UdHash *string `json:"ud_hash,omitempty"`
+}
+
+type ErasureExtInfo struct {
+	// UdID is the ID to be erased, it is cleared once the erasure succeeds.
+	UdID *string `json:"ud_id,omitempty"`
+
+	// results of the erasure, uds linked into the same profile are erased together
+	ErasedUds            []*ErasedUd `json:"erased_uds,omitempty"`
+	DeletedDocs          *uint64     `json:"deleted_docs,omitempty"`
+	RedactedCampaignLogs *uint64     `json:"redacted_campaign_logs,omitempty"`
+	DeletedMappingIDs    *uint64     `json:"deleted_mapping_ids,omitempty"`
+	FailReason           *string     `json:"fail_reason,omitempty"`
+
+	// Attempts is the number of failed runs, the erasure is retried until it reaches the max attempts.
+	Attempts *uint32 `json:"attempts,omitempty"`
+}
+
+func (e *ErasureExtInfo) GetUdID() string {
+	if e != nil && e.UdID != nil {
+		return *e.UdID
+	}
+	return ""
+}
+
+func (e *ErasureExtInfo) GetDeletedDocs() uint64 {
+	if e != nil && e.DeletedDocs != nil {
+		return *e.DeletedDocs
+	}
+	return 0
+}
+
+func (e *ErasureExtInfo) GetRedactedCampaignLogs() uint64 {
+	if e != nil && e.RedactedCampaignLogs != nil {
+		return *e.RedactedCampaignLogs
+	}
+	return 0
+}
+
+func (e *ErasureExtInfo) GetDeletedMappingIDs() uint64 {
+	if e != nil && e.DeletedMappingIDs != nil {
+		return *e.DeletedMappingIDs
+	}
+	return 0
+}
+
+func (e *ErasureExtInfo) GetFailReason() string {
+	if e != nil && e.FailReason != nil {
+		return *e.FailReason
+	}
+	return ""
+}
+
+func (e *ErasureExtInfo) GetAttempts() uint32 {
+	if e != nil && e.Attempts != nil {
+		return *e.Attempts
+	}
+	return 0
+}
+
+func (e *ErasureExtInfo) ToString() (string, error) {
+	if e == nil {
+		return "{}", nil
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// Erasure is the audit record of a right-to-erasure request.
+type Erasure struct {
+	ID        *uint64         `json:"id,omitempty"`
+	TenantID  *uint64         `json:"tenant_id,omitempty"`
+	IDType    IDType          `json:"id_type,omitempty"`
+	UdHash    *string         `json:"ud_hash,omitempty"`
+	Status    ErasureStatus   `json:"status,omitempty"`
+	ExtInfo   *ErasureExtInfo `json:"ext_info,omitempty"`
+	CreatorID *uint64         `json:"creator_id,omitempty"`
+	// EraseTime is when the data was removed, nil if the erasure has not succeeded.
+	EraseTime  *uint64 `json:"erase_time,omitempty"`
+	CreateTime *uint64 `json:"create_time,omitempty"`
+	UpdateTime *uint64 `json:"update_time,omitempty"`
+}
+
+func (e *Erasure) GetID() uint64 {
+	if e != nil && e.ID != nil {
+		return *e.ID
+	}
+	return 0
+}
+
+func (e *Erasure) GetTenantID() uint64 {
+	if e != nil && e.TenantID != nil {
+		return *e.TenantID
+	}
+	return 0
+}
+
+func (e *Erasure) GetIDType() IDType {
+	if e != nil {
+		return e.IDType
+	}
+	return IDTypeUnknown
+}
+
+func (e *Erasure) GetUdHash() string {
+	if e != nil && e.UdHash != nil {
+		return *e.UdHash
+	}
+	return ""
+}
+
+func (e *Erasure) GetStatus() ErasureStatus {
+	if e != nil {
+		return e.Status
+	}
+	return ErasureStatusUnknown
+}
+
+func (e *Erasure) GetExtInfo() *ErasureExtInfo {
+	if e != nil && e.ExtInfo != nil {
+		return e.ExtInfo
+	}
+	return nil
+}
+
+func (e *Erasure) GetEraseTime() uint64 {
+	if e != nil && e.EraseTime != nil {
+		return *e.EraseTime
+	}
+	return 0
+}
+
+// ToUd returns the ud to be erased, nil if the ID is already cleared.
+func (e *Erasure) ToUd() *Ud {
+	if e.GetExtInfo().GetUdID() == "" {
+		return nil
+	}
+	return &Ud{
+		ID:     goutil.String(e.GetExtInfo().GetUdID()),
+		IDType: e.GetIDType(),
+	}
+}
+
+func (e *Erasure) Update(newErasure *Erasure) bool {
+	var hasChange bool
+
+	if newErasure.Status != ErasureStatusUnknown && e.Status != newErasure.Status {
+		hasChange = true
+		e.Status = newErasure.Status
+	}
+
+	if newErasure.EraseTime != nil && e.GetEraseTime() != newErasure.GetEraseTime() {
+		hasChange = true
+		e.EraseTime = newErasure.EraseTime
+	}
+
+	if newErasure.ExtInfo != nil {
+		oldExtInfo := e.ExtInfo
+		if oldExtInfo == nil {
+			oldExtInfo = new(ErasureExtInfo)
+		}
+
+		// an empty ID clears the stored ID
+		if newErasure.ExtInfo.UdID != nil && oldExtInfo.GetUdID() != newErasure.ExtInfo.GetUdID() {
+			hasChange = true
+			oldExtInfo.UdID = newErasure.ExtInfo.UdID
+			if oldExtInfo.GetUdID() == "" {
+				oldExtInfo.UdID = nil
+			}
+		}
+
+		if newErasure.ExtInfo.ErasedUds != nil {
+			hasChange = true
+			oldExtInfo.ErasedUds = newErasure.ExtInfo.ErasedUds
+		}
+
+		if newErasure.ExtInfo.DeletedDocs != nil && oldExtInfo.GetDeletedDocs() != newErasure.ExtInfo.GetDeletedDocs() {
+			hasChange = true
+			oldExtInfo.DeletedDocs = newErasure.ExtInfo.DeletedDocs
+		}
+
+		if newErasure.ExtInfo.RedactedCampaignLogs != nil && oldExtInfo.GetRedactedCampaignLogs() != newErasure.ExtInfo.GetRedactedCampaignLogs() {
+			hasChange = true
+			oldExtInfo.RedactedCampaignLogs = newErasure.ExtInfo.RedactedCampaignLogs
+		}
+
+		if newErasure.ExtInfo.DeletedMappingIDs != nil && oldExtInfo.GetDeletedMappingIDs() != newErasure.ExtInfo.GetDeletedMappingIDs() {
+			hasChange = true
+			oldExtInfo.DeletedMappingIDs = newErasure.ExtInfo.DeletedMappingIDs
+		}
+
+		if newErasure.ExtInfo.FailReason != nil && oldExtInfo.GetFailReason() != newErasure.ExtInfo.GetFailReason() {
+			hasChange = true
+			oldExtInfo.FailReason = newErasure.ExtInfo.FailReason
+		}
+
+		if newErasure.ExtInfo.Attempts != nil && oldExtInfo.GetAttempts() != newErasure.ExtInfo.GetAttempts() {
+			hasChange = true
+			oldExtInfo.Attempts = newErasure.ExtInfo.Attempts
+		}
+
+		e.ExtInfo = oldExtInfo
+	}
+
+	if hasChange {
+		e.UpdateTime = goutil.Uint64(uint64(time.Now().Unix()))
+	}
+
+	return hasChange
+}
+
+// SuppressedUd is an erased ud that must not be imported again, only the hash of the ud is kept.
+type SuppressedUd struct {
+	ID         *uint64 `json:"id,omitempty"`
+	TenantID   *uint64 `json:"tenant_id,omitempty"`
+	UdHash     *string `json:"ud_hash,omitempty"`
+	ErasureID  *uint64 `json:"erasure_id,omitempty"`
+	CreateTime *uint64 `json:"create_time,omitempty"`
+}
+
+func (e *SuppressedUd) GetUdHash() string {
+	if e != nil && e.UdHash != nil {
+		return *e.UdHash
+	}
+	return ""
+}
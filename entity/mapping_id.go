@@ -1,8 +1,14 @@
 package entity
 
+// MappingID links a ud to the unified profile it belongs to.
+// Uds of the same profile, e.g. an email and a phone of one customer, share the same ProfileID.
 type MappingID struct {
-	ID   *uint64 `json:"id,omitempty"`
-	UdID *string `json:"ud_id,omitempty"`
+	ID         *uint64 `json:"id,omitempty"`
+	TenantID   *uint64 `json:"tenant_id,omitempty"`
+	UdID       *string `json:"ud_id,omitempty"` // doc ID of the ud, see Ud.ToDocID
+	ProfileID  *uint64 `json:"profile_id,omitempty"`
+	CreateTime *uint64 `json:"create_time,omitempty"`
+	UpdateTime *uint64 `json:"update_time,omitempty"`
 }
 
 func (e *MappingID) GetID() uint64 {
@@ -12,9 +18,36 @@ func (e *MappingID) GetID() uint64 {
 	return 0
 }
 
+func (e *MappingID) GetTenantID() uint64 {
+	if e != nil && e.TenantID != nil {
+		return *e.TenantID
+	}
+	return 0
+}
+
 func (e *MappingID) GetUdID() string {
 	if e != nil && e.UdID != nil {
 		return *e.UdID
 	}
 	return ""
 }
+
+func (e *MappingID) GetProfileID() uint64 {
+	if e != nil && e.ProfileID != nil {
+		return *e.ProfileID
+	}
+	return 0
+}
+
+func (e *MappingID) ToUd() (*Ud, error) {
+	ud, err := ToUd(e.GetUdID())
+	if err != nil {
+		return nil, err
+	}
+
+	if e.ProfileID != nil {
+		ud.ProfileID = e.ProfileID
+	}
+
+	return ud, nil
+}
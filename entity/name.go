@@ -0,0 +1,17 @@
+package entity
+
+import "fmt"
+
+// maxNameLen is the width of the name columns of resources.
+const maxNameLen = 64
+
+// DeletedName renames a deleted resource to free its name, as the unique key on
+// (tenant_id, name, status) allows only one deleted row per name. The suffix holds
+// a character names cannot have, so it never collides with a live name.
+func DeletedName(name string, id uint64) string {
+	suffix := fmt.Sprintf("#%d", id)
+	if len(name)+len(suffix) > maxNameLen {
+		name = name[:maxNameLen-len(suffix)]
+	}
+	return name + suffix
+}
@@ -0,0 +1,42 @@
+package entity
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestDeletedName(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource string
+		id       uint64
+		want     string
+	}{
+		{name: "short name", resource: "VIP users", id: 7, want: "VIP users#7"},
+		{name: "empty name", resource: "", id: 7, want: "#7"},
+		{name: "fits exactly", resource: strings.Repeat("a", 62), id: 7, want: strings.Repeat("a", 62) + "#7"},
+		{name: "truncated by one", resource: strings.Repeat("a", 63), id: 7, want: strings.Repeat("a", 62) + "#7"},
+		{name: "longest valid name", resource: strings.Repeat("a", 60), id: 12345, want: strings.Repeat("a", 58) + "#12345"},
+		{name: "largest id", resource: strings.Repeat("a", 60), id: math.MaxUint64, want: strings.Repeat("a", 43) + "#18446744073709551615"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DeletedName(tt.resource, tt.id)
+			if got != tt.want {
+				t.Errorf("DeletedName(%q, %d) = %q, want %q", tt.resource, tt.id, got, tt.want)
+			}
+			if len(got) > maxNameLen {
+				t.Errorf("DeletedName(%q, %d) is %d long, want at most %d", tt.resource, tt.id, len(got), maxNameLen)
+			}
+		})
+	}
+}
+
+func TestDeletedNameIsUniquePerID(t *testing.T) {
+	name := strings.Repeat("a", 60)
+	if DeletedName(name, 1) == DeletedName(name, 2) {
+		t.Errorf("DeletedName(%q, ...) is the same for different ids", name)
+	}
+}
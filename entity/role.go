@@ -10,9 +10,12 @@ import (
 type ActionCode string
 
 var (
-	ActionUnknown  ActionCode = ""
-	ActionEditUser ActionCode = "edit_user"
-	ActionEditRole ActionCode = "edit_role"
+	ActionUnknown    ActionCode = ""
+	ActionEditUser   ActionCode = "edit_user"
+	ActionEditRole   ActionCode = "edit_role"
+	ActionViewPII    ActionCode = "view_pii"
+	ActionFlushCache ActionCode = "flush_cache"
+	ActionEraseUd    ActionCode = "erase_ud"
 )
 
 var Actions = map[string][]*Action{
@@ -28,6 +31,23 @@ var Actions = map[string][]*Action{
 			ActionDesc: "Can add, edit, or delete a role and its actions",
 		},
 	},
+	"Data Access": {
+		{
+			Name:       "View PII",
+			Code:       ActionViewPII,
+			ActionDesc: "Can view unmasked ud IDs and values of PII tags",
+		},
+		{
+			Name:       "Flush Cache",
+			Code:       ActionFlushCache,
+			ActionDesc: "Can flush the cached query results of the tenant",
+		},
+		{
+			Name:       "Erase Ud",
+			Code:       ActionEraseUd,
+			ActionDesc: "Can erase all data of a ud and view the erasure records",
+		},
+	},
 }
 
 type Action struct {
@@ -91,6 +111,18 @@ func (e *Role) GetStatus() RoleStatus {
 	return RoleStatusUnknown
 }
 
+func (e *Role) HasAction(code ActionCode) bool {
+	if e == nil {
+		return false
+	}
+	for _, action := range e.Actions {
+		if action == code {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *Role) Update(newRole *Role) bool {
 	var hasChange bool
 
@@ -1,7 +1,15 @@
 package entity
 
 import (
+	"cdp/pkg/goutil"
 	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrInvalidSegmentType = errors.New("invalid segment type")
 )
 
 type LookupOp string
@@ -13,6 +21,25 @@ const (
 	LookupOpGte LookupOp = ">="
 	LookupOpLte LookupOp = "<="
 	LookupOpIn  LookupOp = "in"
+
+	// LookupOpNotIn matches uds having a value none of Val, unlike Not with LookupOpIn, uds without a value are not matched.
+	LookupOpNotIn LookupOp = "not_in"
+
+	// LookupOpBetween matches values within Val, a [from, to] array, both ends inclusive.
+	LookupOpBetween LookupOp = "between"
+
+	// LookupOpExists and LookupOpMissing match uds having or lacking a value of the tag, they take no Val.
+	LookupOpExists  LookupOp = "exists"
+	LookupOpMissing LookupOp = "missing"
+
+	// LookupOpPrefix and LookupOpContains match string values starting with or containing Val, case-sensitive.
+	LookupOpPrefix   LookupOp = "prefix"
+	LookupOpContains LookupOp = "contains"
+
+	LookupOpContainsAny LookupOp = "contains_any"
+
+	// LookupOpChangedWithin matches uds whose tag value changed in the last Val days, for tags keeping history only.
+	LookupOpChangedWithin LookupOp = "changed_within"
 )
 
 var SupportedLookupOps = []LookupOp{
@@ -22,6 +49,14 @@ var SupportedLookupOps = []LookupOp{
 	LookupOpGte,
 	LookupOpLte,
 	LookupOpIn,
+	LookupOpNotIn,
+	LookupOpBetween,
+	LookupOpExists,
+	LookupOpMissing,
+	LookupOpPrefix,
+	LookupOpContains,
+	LookupOpContainsAny,
+	LookupOpChangedWithin,
 }
 
 type QueryOp string
@@ -39,11 +74,64 @@ const (
 	SegmentStatusDeleted
 )
 
+// SegmentType tells how the uds of a segment are decided.
+type SegmentType uint32
+
+const (
+	SegmentTypeUnknown SegmentType = iota
+	SegmentTypeDynamic             // uds matching the criteria at query time
+	SegmentTypeStatic              // uds frozen when the segment is populated, from a file upload or a snapshot
+)
+
+var SegmentTypes = map[uint32]string{
+	uint32(SegmentTypeDynamic): "Dynamic",
+	uint32(SegmentTypeStatic):  "Static",
+}
+
+func CheckSegmentType(value uint32) error {
+	_, ok := SegmentTypes[value]
+	if !ok {
+		return ErrInvalidSegmentType
+	}
+	return nil
+}
+
+// StaticSegmentKey is the keyword in UdSegmentIDsField marking the uds of a static segment.
+func StaticSegmentKey(segmentID uint64) string {
+	return strconv.FormatUint(segmentID, 10)
+}
+
 type Lookup struct {
+	// SegmentID matches the uds of another segment instead of a tag value, the lookup has no tag, op or val then.
+	// The criteria of the segment is expanded at query time, so that its changes carry through.
+	SegmentID *uint64 `json:"segment_id,omitempty"`
+
 	TagID *uint64     `json:"tag_id,omitempty"`
 	Op    LookupOp    `json:"op,omitempty"`
 	Not   *bool       `json:"not,omitempty"`
 	Val   interface{} `json:"val,omitempty"`
+
+	// AsOf matches the tag value at the unix time instead of the current value, for tags keeping history only.
+	AsOf *uint64 `json:"as_of,omitempty"`
+
+	// Split matches a random but fixed share of all uds instead of a tag value, the lookup has no tag, op or val then.
+	// It is meant to be combined with a segment reference, to split the segment.
+	Split *Split `json:"split,omitempty"`
+}
+
+func (e *Lookup) GetSegmentID() uint64 {
+	if e != nil && e.SegmentID != nil {
+		return *e.SegmentID
+	}
+	return 0
+}
+
+func (e *Lookup) IsSegmentRef() bool {
+	return e != nil && e.SegmentID != nil
+}
+
+func (e *Lookup) IsSplit() bool {
+	return e != nil && e.Split != nil
 }
 
 func (e *Lookup) GetTagID() uint64 {
@@ -67,11 +155,28 @@ func (e *Lookup) GetNot() bool {
 	return false
 }
 
+func (e *Lookup) GetAsOf() uint64 {
+	if e != nil && e.AsOf != nil {
+		return *e.AsOf
+	}
+	return 0
+}
+
 type Query struct {
 	Lookups []*Lookup `json:"lookups,omitempty"`
 	Queries []*Query  `json:"queries,omitempty"`
 	Op      QueryOp   `json:"op,omitempty"`
 	Not     *bool     `json:"not,omitempty"`
+
+	// IDType limits the query to uds of the ID type, all ID types are matched if unset.
+	IDType IDType `json:"id_type,omitempty"`
+}
+
+func (e *Query) GetIDType() IDType {
+	if e != nil {
+		return e.IDType
+	}
+	return IDTypeUnknown
 }
 
 func (e *Query) GetOp() QueryOp {
@@ -88,6 +193,101 @@ func (e *Query) GetNot() bool {
 	return false
 }
 
+// HasTagID checks if any lookup in the query, including nested queries, references the tag.
+func (e *Query) HasTagID(tagID uint64) bool {
+	if e == nil {
+		return false
+	}
+
+	for _, lookup := range e.Lookups {
+		if lookup.GetTagID() == tagID {
+			return true
+		}
+	}
+
+	for _, query := range e.Queries {
+		if query.HasTagID(tagID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetTagIDs returns the distinct tags looked up by the query, including nested queries, but not the
+// tags of the referenced segments.
+func (e *Query) GetTagIDs() []uint64 {
+	if e == nil {
+		return nil
+	}
+
+	var (
+		tagIDs = make([]uint64, 0)
+		seen   = make(map[uint64]bool)
+		walk   func(query *Query)
+	)
+	walk = func(query *Query) {
+		for _, lookup := range query.Lookups {
+			if tagID := lookup.GetTagID(); tagID != 0 && !seen[tagID] {
+				seen[tagID] = true
+				tagIDs = append(tagIDs, tagID)
+			}
+		}
+		for _, query := range query.Queries {
+			walk(query)
+		}
+	}
+	walk(e)
+
+	return tagIDs
+}
+
+// IsEqual checks if both queries serialize to the same criteria.
+func (e *Query) IsEqual(other *Query) bool {
+	a, err := e.ToString()
+	if err != nil {
+		return false
+	}
+
+	b, err := other.ToString()
+	if err != nil {
+		return false
+	}
+
+	return a == b
+}
+
+// GetSegmentIDs returns the segments referenced by the query, including nested queries, but not the
+// references of the referenced segments.
+func (e *Query) GetSegmentIDs() []uint64 {
+	if e == nil {
+		return nil
+	}
+
+	segmentIDs := make([]uint64, 0)
+	for _, lookup := range e.Lookups {
+		if lookup.IsSegmentRef() {
+			segmentIDs = append(segmentIDs, lookup.GetSegmentID())
+		}
+	}
+
+	for _, query := range e.Queries {
+		segmentIDs = append(segmentIDs, query.GetSegmentIDs()...)
+	}
+
+	return segmentIDs
+}
+
+// HasSegmentID checks if any lookup in the query, including nested queries, references the segment.
+func (e *Query) HasSegmentID(segmentID uint64) bool {
+	for _, id := range e.GetSegmentIDs() {
+		if id == segmentID {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *Query) ToString() (string, error) {
 	if e == nil {
 		return "{}", nil
@@ -106,7 +306,9 @@ type Segment struct {
 	Name        *string       `json:"name,omitempty"`
 	SegmentDesc *string       `json:"segment_desc,omitempty"`
 	Criteria    *Query        `json:"criteria,omitempty"`
+	SegmentType SegmentType   `json:"segment_type,omitempty"`
 	Status      SegmentStatus `json:"status,omitempty"`
+	Version     *uint32       `json:"version,omitempty"` // version of the criteria
 	CreatorID   *uint64       `json:"creator_id,omitempty"`
 	TenantID    *uint64       `json:"tenant_id,omitempty"`
 	CreateTime  *uint64       `json:"create_time,omitempty"`
@@ -120,6 +322,13 @@ func (e *Segment) GetID() uint64 {
 	return 0
 }
 
+func (e *Segment) GetTenantID() uint64 {
+	if e != nil && e.TenantID != nil {
+		return *e.TenantID
+	}
+	return 0
+}
+
 func (e *Segment) GetName() string {
 	if e != nil && e.Name != nil {
 		return *e.Name
@@ -127,13 +336,35 @@ func (e *Segment) GetName() string {
 	return ""
 }
 
+// GetCriteria returns the query matching the uds of the segment. A static segment has no criteria,
+// it references itself instead, which the query store resolves to the frozen uds.
 func (e *Segment) GetCriteria() *Query {
+	if e.IsStatic() {
+		return &Query{
+			Lookups: []*Lookup{
+				{SegmentID: e.ID},
+			},
+		}
+	}
+
 	if e != nil && e.Criteria != nil {
 		return e.Criteria
 	}
 	return nil
 }
 
+// GetSegmentType defaults to dynamic, the only type of segments created earlier.
+func (e *Segment) GetSegmentType() SegmentType {
+	if e != nil && e.SegmentType != SegmentTypeUnknown {
+		return e.SegmentType
+	}
+	return SegmentTypeDynamic
+}
+
+func (e *Segment) IsStatic() bool {
+	return e.GetSegmentType() == SegmentTypeStatic
+}
+
 func (e *Segment) GetSegmentDesc() string {
 	if e != nil && e.SegmentDesc != nil {
 		return *e.SegmentDesc
@@ -161,3 +392,145 @@ func (e *Segment) GetUpdateTime() uint64 {
 	}
 	return 0
 }
+
+func (e *Segment) GetVersion() uint32 {
+	if e != nil && e.Version != nil {
+		return *e.Version
+	}
+	return 0
+}
+
+func (e *Segment) Update(newSegment *Segment) bool {
+	var hasChange bool
+
+	if newSegment.Name != nil && newSegment.GetName() != e.GetName() {
+		hasChange = true
+		e.Name = newSegment.Name
+	}
+
+	if newSegment.SegmentDesc != nil && newSegment.GetSegmentDesc() != e.GetSegmentDesc() {
+		hasChange = true
+		e.SegmentDesc = newSegment.SegmentDesc
+	}
+
+	if newSegment.Criteria != nil && !newSegment.Criteria.IsEqual(e.GetCriteria()) {
+		hasChange = true
+		e.Criteria = newSegment.Criteria
+	}
+
+	if newSegment.Version != nil && newSegment.GetVersion() != e.GetVersion() {
+		hasChange = true
+		e.Version = newSegment.Version
+	}
+
+	if newSegment.Status != SegmentStatusUnknown && newSegment.GetStatus() != e.GetStatus() {
+		hasChange = true
+		e.Status = newSegment.Status
+	}
+
+	if hasChange {
+		e.UpdateTime = goutil.Uint64(uint64(time.Now().Unix()))
+	}
+
+	return hasChange
+}
+
+// SegmentVersion is the criteria of a segment at a version, kept so that edits can be reviewed and restored.
+type SegmentVersion struct {
+	ID        *uint64 `json:"id,omitempty"`
+	SegmentID *uint64 `json:"segment_id,omitempty"`
+	Version   *uint32 `json:"version,omitempty"`
+	Criteria  *Query  `json:"criteria,omitempty"`
+
+	// RestoredFrom is the older version whose criteria was restored, nil if the criteria was edited.
+	RestoredFrom *uint32 `json:"restored_from,omitempty"`
+
+	CreatorID  *uint64 `json:"creator_id,omitempty"`
+	TenantID   *uint64 `json:"tenant_id,omitempty"`
+	CreateTime *uint64 `json:"create_time,omitempty"`
+}
+
+func (e *SegmentVersion) GetID() uint64 {
+	if e != nil && e.ID != nil {
+		return *e.ID
+	}
+	return 0
+}
+
+func (e *SegmentVersion) GetSegmentID() uint64 {
+	if e != nil && e.SegmentID != nil {
+		return *e.SegmentID
+	}
+	return 0
+}
+
+func (e *SegmentVersion) GetVersion() uint32 {
+	if e != nil && e.Version != nil {
+		return *e.Version
+	}
+	return 0
+}
+
+func (e *SegmentVersion) GetCriteria() *Query {
+	if e != nil && e.Criteria != nil {
+		return e.Criteria
+	}
+	return nil
+}
+
+func (e *SegmentVersion) GetRestoredFrom() uint32 {
+	if e != nil && e.RestoredFrom != nil {
+		return *e.RestoredFrom
+	}
+	return 0
+}
+
+// SegmentOverlap counts the profiles of a combination of segments compared together.
+type SegmentOverlap struct {
+	SegmentIDs   []uint64 `json:"segment_ids"`
+	Intersection *uint64  `json:"intersection,omitempty"` // in all of SegmentIDs
+	Exclusive    *uint64  `json:"exclusive,omitempty"`    // in all of SegmentIDs, and none of the other segments
+}
+
+func (e *SegmentOverlap) GetIntersection() uint64 {
+	if e != nil && e.Intersection != nil {
+		return *e.Intersection
+	}
+	return 0
+}
+
+func (e *SegmentOverlap) GetExclusive() uint64 {
+	if e != nil && e.Exclusive != nil {
+		return *e.Exclusive
+	}
+	return 0
+}
+
+// LookupPreview tells how many profiles a lookup of a criteria matches on its own, or why it is invalid.
+type LookupPreview struct {
+	Path   *string `json:"path,omitempty"` // position of the lookup in the criteria, e.g. queries[1].lookups[0]
+	Lookup *Lookup `json:"lookup,omitempty"`
+	Count  *uint64 `json:"count,omitempty"`
+	Error  *string `json:"error,omitempty"`
+}
+
+func (e *LookupPreview) GetPath() string {
+	if e != nil && e.Path != nil {
+		return *e.Path
+	}
+	return ""
+}
+
+func (e *LookupPreview) GetCount() uint64 {
+	if e != nil && e.Count != nil {
+		return *e.Count
+	}
+	return 0
+}
+
+func (e *LookupPreview) GetError() string {
+	if e != nil && e.Error != nil {
+		return *e.Error
+	}
+	return ""
+}
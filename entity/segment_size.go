@@ -0,0 +1,49 @@
+package entity
+
+// SegmentSize is the size of a segment recorded on a day.
+type SegmentSize struct {
+	ID        *uint64 `json:"id,omitempty"`
+	TenantID  *uint64 `json:"tenant_id,omitempty"`
+	SegmentID *uint64 `json:"segment_id,omitempty"`
+	Size      *uint64 `json:"size,omitempty"`
+	// Day is the unix time of the start of the day in UTC.
+	Day        *uint64 `json:"day,omitempty"`
+	CreateTime *uint64 `json:"create_time,omitempty"`
+	UpdateTime *uint64 `json:"update_time,omitempty"`
+}
+
+func (e *SegmentSize) GetID() uint64 {
+	if e != nil && e.ID != nil {
+		return *e.ID
+	}
+	return 0
+}
+
+func (e *SegmentSize) GetSegmentID() uint64 {
+	if e != nil && e.SegmentID != nil {
+		return *e.SegmentID
+	}
+	return 0
+}
+
+func (e *SegmentSize) GetSize() uint64 {
+	if e != nil && e.Size != nil {
+		return *e.Size
+	}
+	return 0
+}
+
+func (e *SegmentSize) GetDay() uint64 {
+	if e != nil && e.Day != nil {
+		return *e.Day
+	}
+	return 0
+}
+
+// SegmentSizePoint is a point in the size history of a segment.
+type SegmentSizePoint struct {
+	Day  *uint64 `json:"day,omitempty"`
+	Size *uint64 `json:"size,omitempty"`
+	// Delta is the change from the day before, nil if the size of the day before was not recorded.
+	Delta *int64 `json:"delta,omitempty"`
+}
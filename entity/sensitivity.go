@@ -0,0 +1,90 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidSensitivity = errors.New("invalid sensitivity")
+)
+
+// Sensitivity classifies how sensitive a piece of ud data is.
+// Data classified as PII is masked for users without ActionViewPII.
+type Sensitivity uint32
+
+const (
+	SensitivityUnknown Sensitivity = iota
+	SensitivityPublic
+	SensitivityInternal
+	SensitivityPII
+)
+
+var Sensitivities = map[uint32]string{
+	uint32(SensitivityPublic):   "Public",
+	uint32(SensitivityInternal): "Internal",
+	uint32(SensitivityPII):      "PII",
+}
+
+// IDTypeSensitivities classifies the ud ID of each ID type.
+var IDTypeSensitivities = map[IDType]Sensitivity{
+	IDTypeEmail:      SensitivityPII,
+	IDTypePhone:      SensitivityPII,
+	IDTypeExternalID: SensitivityInternal,
+	IDTypeDeviceID:   SensitivityInternal,
+}
+
+func CheckSensitivity(value uint32) error {
+	_, ok := Sensitivities[value]
+	if !ok {
+		return ErrInvalidSensitivity
+	}
+	return nil
+}
+
+const maskChar = "*"
+
+// MaskStr keeps only the first character of s, e.g. "john" becomes "j***".
+// The domain of an email is kept, e.g. "john@abc.com" becomes "j***@abc.com".
+func MaskStr(s string) string {
+	if s == "" {
+		return s
+	}
+
+	var domain string
+	if i := strings.LastIndex(s, "@"); i > 0 {
+		s, domain = s[:i], s[i:]
+	}
+
+	r := []rune(s)
+	if len(r) == 1 {
+		return maskChar + domain
+	}
+
+	return string(r[0]) + strings.Repeat(maskChar, len(r)-1) + domain
+}
+
+// MaskTagVal masks a formatted tag value, list values are masked item by item.
+func MaskTagVal(v interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return MaskStr(val)
+	case []string:
+		masked := make([]string, len(val))
+		for i, item := range val {
+			masked[i] = MaskStr(item)
+		}
+		return masked
+	case []interface{}:
+		masked := make([]interface{}, len(val))
+		for i, item := range val {
+			masked[i] = MaskTagVal(item)
+		}
+		return masked
+	default:
+		return MaskStr(fmt.Sprint(val))
+	}
+}
@@ -0,0 +1,105 @@
+package entity
+
+import (
+	"cdp/pkg/goutil"
+	"reflect"
+	"testing"
+)
+
+func TestMaskStr(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{s: "", want: ""},
+		{s: "j", want: "*"},
+		{s: "john", want: "j***"},
+		{s: "john@abc.com", want: "j***@abc.com"},
+		{s: "j@abc.com", want: "*@abc.com"},
+		{s: "john.doe@mail.abc.com", want: "j*******@mail.abc.com"},
+		{s: "a@b@abc.com", want: "a**@abc.com"},
+		{s: "@abc.com", want: "@*******"},
+		{s: "+6591234567", want: "+**********"},
+		{s: "zoë", want: "z**"},
+		{s: "名前太郎", want: "名***"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			if got := MaskStr(tt.s); got != tt.want {
+				t.Errorf("MaskStr(%q) = %q, want %q", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskTagVal(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want interface{}
+	}{
+		{name: "nil", v: nil, want: nil},
+		{name: "string", v: "john@abc.com", want: "j***@abc.com"},
+		{name: "number", v: int64(12345), want: "1****"},
+		{name: "bool", v: true, want: "t***"},
+		{name: "string list", v: []string{"john", "amy"}, want: []string{"j***", "a**"}},
+		{name: "decoded list", v: []interface{}{"john", float64(42)}, want: []interface{}{"j***", "4*"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MaskTagVal(tt.v); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MaskTagVal(%#v) = %#v, want %#v", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskTagValKeepsInput(t *testing.T) {
+	v := []string{"john", "amy"}
+	MaskTagVal(v)
+	if !reflect.DeepEqual(v, []string{"john", "amy"}) {
+		t.Errorf("MaskTagVal changed its input to %v", v)
+	}
+}
+
+func TestUdMaskByIDType(t *testing.T) {
+	tests := []struct {
+		name    string
+		ud      *Ud
+		wantPII bool
+		wantID  string
+	}{
+		{name: "email", ud: &Ud{ID: goutil.String("john@abc.com"), IDType: IDTypeEmail}, wantPII: true, wantID: "j***@abc.com"},
+		{name: "phone", ud: &Ud{ID: goutil.String("+6591234567"), IDType: IDTypePhone}, wantPII: true, wantID: "+**********"},
+		{name: "external id", ud: &Ud{ID: goutil.String("cust-42"), IDType: IDTypeExternalID}, wantPII: false},
+		{name: "device id", ud: &Ud{ID: goutil.String("a1b2c3"), IDType: IDTypeDeviceID}, wantPII: false},
+		{name: "unknown id type", ud: &Ud{ID: goutil.String("john")}, wantPII: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ud.IsPII(); got != tt.wantPII {
+				t.Fatalf("IsPII() = %v, want %v", got, tt.wantPII)
+			}
+			if !tt.wantPII {
+				return
+			}
+
+			id := tt.ud.GetID()
+			tt.ud.ProfileID = goutil.Uint64(7)
+
+			masked := tt.ud.Mask()
+			if masked.GetID() != tt.wantID {
+				t.Errorf("Mask().ID = %q, want %q", masked.GetID(), tt.wantID)
+			}
+			if masked.GetIDType() != tt.ud.GetIDType() || masked.GetProfileID() != 7 {
+				t.Errorf("Mask() = %+v, want the ID type and profile kept", masked)
+			}
+			if tt.ud.GetID() != id {
+				t.Errorf("Mask() changed the ud ID to %q", tt.ud.GetID())
+			}
+		})
+	}
+}
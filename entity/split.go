@@ -0,0 +1,62 @@
+package entity
+
+import (
+	"unicode/utf16"
+)
+
+// SplitScale is the number of split points uds are hashed into, a split of [From, To) holds (To-From)/SplitScale of the uds.
+const SplitScale = 10_000
+
+// Split matches the uds whose split point falls in [From, To). The split point of a ud is a hash of its
+// split key and Seed, so a ud always lands in the same split for the same seed, while different seeds are independent.
+// The uds of a profile share a split key, so a profile always lands in a single split.
+type Split struct {
+	Seed *uint32 `json:"seed,omitempty"`
+	From *uint32 `json:"from,omitempty"`
+	To   *uint32 `json:"to,omitempty"`
+}
+
+func (e *Split) GetSeed() uint32 {
+	if e != nil && e.Seed != nil {
+		return *e.Seed
+	}
+	return 0
+}
+
+func (e *Split) GetFrom() uint32 {
+	if e != nil && e.From != nil {
+		return *e.From
+	}
+	return 0
+}
+
+func (e *Split) GetTo() uint32 {
+	if e != nil && e.To != nil {
+		return *e.To
+	}
+	return 0
+}
+
+// Contains tells whether the ud with the split key, see Ud.ToSplitKey, is in the split.
+func (e *Split) Contains(splitKey string) bool {
+	point := SplitPoint(splitKey, e.GetSeed())
+	return point >= e.GetFrom() && point < e.GetTo()
+}
+
+// SplitPoint hashes the split key into [0, SplitScale). The hash is Java's String.hashCode of the key mixed with
+// the seed by the murmur3 finalizer, so that it can be computed the same way by the search engine scripts.
+func SplitPoint(splitKey string, seed uint32) uint32 {
+	var h uint32
+	for _, c := range utf16.Encode([]rune(splitKey)) {
+		h = 31*h + uint32(c)
+	}
+
+	h ^= seed
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h % SplitScale
+}
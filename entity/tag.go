@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type floatFrac float64
@@ -36,6 +38,14 @@ const (
 	TagStatusDeleted
 )
 
+type TagKind uint32
+
+const (
+	TagKindUnknown TagKind = iota
+	TagKindUpload
+	TagKindDerived
+)
+
 type TagValueType uint32
 
 const (
@@ -43,12 +53,43 @@ const (
 	TagValueTypeInt
 	TagValueTypeStr
 	TagValueTypeFloat
+	TagValueTypeBool
+	TagValueTypeTimestamp
+	TagValueTypeStrList
 )
 
 var TagValueTypes = map[uint32]string{
-	uint32(TagValueTypeInt):   "Int",
-	uint32(TagValueTypeStr):   "Str",
-	uint32(TagValueTypeFloat): "Float",
+	uint32(TagValueTypeInt):       "Int",
+	uint32(TagValueTypeStr):       "Str",
+	uint32(TagValueTypeFloat):     "Float",
+	uint32(TagValueTypeBool):      "Bool",
+	uint32(TagValueTypeTimestamp): "Timestamp",
+	uint32(TagValueTypeStrList):   "StrList",
+}
+
+// TagValueTypeLookupOps lists the lookup ops allowed on each tag value type.
+var TagValueTypeLookupOps = map[TagValueType][]LookupOp{
+	TagValueTypeInt: {LookupOpEq, LookupOpGt, LookupOpLt, LookupOpGte, LookupOpLte, LookupOpIn, LookupOpNotIn,
+		LookupOpBetween, LookupOpExists, LookupOpMissing},
+	TagValueTypeStr: {LookupOpEq, LookupOpGt, LookupOpLt, LookupOpGte, LookupOpLte, LookupOpIn, LookupOpNotIn,
+		LookupOpBetween, LookupOpExists, LookupOpMissing, LookupOpPrefix, LookupOpContains},
+	TagValueTypeFloat: {LookupOpEq, LookupOpGt, LookupOpLt, LookupOpGte, LookupOpLte, LookupOpIn, LookupOpNotIn,
+		LookupOpBetween, LookupOpExists, LookupOpMissing},
+	TagValueTypeBool: {LookupOpEq, LookupOpExists, LookupOpMissing},
+	TagValueTypeTimestamp: {LookupOpEq, LookupOpGt, LookupOpLt, LookupOpGte, LookupOpLte, LookupOpBetween,
+		LookupOpExists, LookupOpMissing},
+	TagValueTypeStrList: {LookupOpEq, LookupOpIn, LookupOpNotIn, LookupOpContainsAny, LookupOpExists, LookupOpMissing,
+		LookupOpPrefix, LookupOpContains},
+}
+
+// TagValueListSeparator separates the items of a StrList tag value in raw input, e.g. CSV.
+const TagValueListSeparator = ","
+
+// Accepted layouts of a Timestamp tag value, on top of unix seconds.
+var timestampLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02",
 }
 
 func CheckTagValueType(value uint32) error {
@@ -59,7 +100,167 @@ func CheckTagValueType(value uint32) error {
 	return nil
 }
 
-type TagExtInfo struct{}
+type TagBucket struct {
+	Label *string  `json:"label,omitempty"`
+	Min   *float64 `json:"min,omitempty"` // inclusive, nil means unbounded
+	Max   *float64 `json:"max,omitempty"` // exclusive, nil means unbounded
+}
+
+func (e *TagBucket) GetLabel() string {
+	if e != nil && e.Label != nil {
+		return *e.Label
+	}
+	return ""
+}
+
+func (e *TagBucket) Contains(v float64) bool {
+	if e.Min != nil && v < *e.Min {
+		return false
+	}
+	if e.Max != nil && v >= *e.Max {
+		return false
+	}
+	return true
+}
+
+// TagDerivation defines how the values of a derived tag are computed, only one of the fields is set.
+type TagDerivation struct {
+	// SegmentID derives a Bool tag, true if the ud is in the segment.
+	SegmentID *uint64 `json:"segment_id,omitempty"`
+
+	// SourceTagID and Buckets derive a Str tag, the label of the first bucket containing the source tag value.
+	SourceTagID *uint64      `json:"source_tag_id,omitempty"`
+	Buckets     []*TagBucket `json:"buckets,omitempty"`
+
+	// Expr derives a Float tag, an arithmetic expression over numeric tags, e.g. "tag_1 * 2 + tag_2".
+	Expr *string `json:"expr,omitempty"`
+}
+
+func (e *TagDerivation) GetSegmentID() uint64 {
+	if e != nil && e.SegmentID != nil {
+		return *e.SegmentID
+	}
+	return 0
+}
+
+func (e *TagDerivation) GetSourceTagID() uint64 {
+	if e != nil && e.SourceTagID != nil {
+		return *e.SourceTagID
+	}
+	return 0
+}
+
+func (e *TagDerivation) GetExpr() string {
+	if e != nil && e.Expr != nil {
+		return *e.Expr
+	}
+	return ""
+}
+
+// GetValueType returns the value type of the derived tag.
+func (e *TagDerivation) GetValueType() TagValueType {
+	switch {
+	case e == nil:
+		return TagValueTypeUnknown
+	case e.SegmentID != nil:
+		return TagValueTypeBool
+	case e.SourceTagID != nil:
+		return TagValueTypeStr
+	case e.Expr != nil:
+		return TagValueTypeFloat
+	default:
+		return TagValueTypeUnknown
+	}
+}
+
+// GetTagIDs returns the tags the derivation reads from.
+func (e *TagDerivation) GetTagIDs() ([]uint64, error) {
+	switch {
+	case e == nil:
+		return nil, nil
+	case e.SourceTagID != nil:
+		return []uint64{e.GetSourceTagID()}, nil
+	case e.Expr != nil:
+		expr, err := ParseTagExpr(e.GetExpr())
+		if err != nil {
+			return nil, err
+		}
+		return expr.TagIDs(), nil
+	default:
+		return nil, nil
+	}
+}
+
+// GetBucketLabel returns the label of the first bucket containing v, or an empty string if there is none.
+func (e *TagDerivation) GetBucketLabel(v float64) string {
+	for _, bucket := range e.Buckets {
+		if bucket.Contains(v) {
+			return bucket.GetLabel()
+		}
+	}
+	return ""
+}
+
+type TagExtInfo struct {
+	Derivation *TagDerivation `json:"derivation,omitempty"`
+
+	// LastMaterializeTime is the last time the values of a derived tag are computed.
+	LastMaterializeTime *uint64 `json:"last_materialize_time,omitempty"`
+
+	// LastUploadTime is the last time a file upload task of the tag succeeds.
+	LastUploadTime *uint64 `json:"last_upload_time,omitempty"`
+
+	// KeepHistory records every change of the tag value of a ud.
+	KeepHistory *bool `json:"keep_history,omitempty"`
+
+	// HistoryStartTime is the time the values set before the tag kept history got their first history entry,
+	// unset until the start-tag-history job has written them.
+	HistoryStartTime *uint64 `json:"history_start_time,omitempty"`
+
+	Sensitivity Sensitivity `json:"sensitivity,omitempty"`
+}
+
+func (e *TagExtInfo) GetSensitivity() Sensitivity {
+	if e != nil {
+		return e.Sensitivity
+	}
+	return SensitivityUnknown
+}
+
+func (e *TagExtInfo) GetKeepHistory() bool {
+	if e != nil && e.KeepHistory != nil {
+		return *e.KeepHistory
+	}
+	return false
+}
+
+func (e *TagExtInfo) GetHistoryStartTime() uint64 {
+	if e != nil && e.HistoryStartTime != nil {
+		return *e.HistoryStartTime
+	}
+	return 0
+}
+
+func (e *TagExtInfo) GetDerivation() *TagDerivation {
+	if e != nil && e.Derivation != nil {
+		return e.Derivation
+	}
+	return nil
+}
+
+func (e *TagExtInfo) GetLastMaterializeTime() uint64 {
+	if e != nil && e.LastMaterializeTime != nil {
+		return *e.LastMaterializeTime
+	}
+	return 0
+}
+
+func (e *TagExtInfo) GetLastUploadTime() uint64 {
+	if e != nil && e.LastUploadTime != nil {
+		return *e.LastUploadTime
+	}
+	return 0
+}
 
 func (e *TagExtInfo) ToString() (string, error) {
 	if e == nil {
@@ -74,12 +275,47 @@ func (e *TagExtInfo) ToString() (string, error) {
 	return string(b), nil
 }
 
+type TagValueCount struct {
+	Value *string `json:"value,omitempty"`
+	Count *uint64 `json:"count,omitempty"`
+}
+
+func (e *TagValueCount) GetValue() string {
+	if e != nil && e.Value != nil {
+		return *e.Value
+	}
+	return ""
+}
+
+type TagHistogramBucket struct {
+	From  *float64 `json:"from,omitempty"` // inclusive
+	To    *float64 `json:"to,omitempty"`   // exclusive, except for the last bucket
+	Count *uint64  `json:"count,omitempty"`
+}
+
+type TagStats struct {
+	Count   *uint64 `json:"count,omitempty"`   // number of uds with the tag
+	Missing *uint64 `json:"missing,omitempty"` // number of uds without the tag
+
+	// numeric tags only
+	Min         *float64              `json:"min,omitempty"`
+	Max         *float64              `json:"max,omitempty"`
+	Avg         *float64              `json:"avg,omitempty"`
+	Percentiles map[string]float64    `json:"percentiles,omitempty"`
+	Histogram   []*TagHistogramBucket `json:"histogram,omitempty"`
+
+	// non-numeric tags only
+	Cardinality *uint64          `json:"cardinality,omitempty"`
+	TopValues   []*TagValueCount `json:"top_values,omitempty"`
+}
+
 type Tag struct {
 	ID         *uint64      `json:"id,omitempty"`
 	Name       *string      `json:"name,omitempty"`
 	TagDesc    *string      `json:"tag_desc,omitempty"`
 	Enum       []string     `json:"enum,omitempty"`
 	ValueType  TagValueType `json:"value_type,omitempty"`
+	Kind       TagKind      `json:"kind,omitempty"`
 	Status     TagStatus    `json:"status,omitempty"`
 	ExtInfo    *TagExtInfo  `json:"ext_info,omitempty"`
 	CreatorID  *uint64      `json:"creator_id,omitempty"`
@@ -123,6 +359,25 @@ func (e *Tag) GetValueType() TagValueType {
 	return TagValueTypeUnknown
 }
 
+func (e *Tag) GetKind() TagKind {
+	if e != nil {
+		return e.Kind
+	}
+	return TagKindUnknown
+}
+
+func (e *Tag) IsPII() bool {
+	return e.GetExtInfo().GetSensitivity() == SensitivityPII
+}
+
+func (e *Tag) IsDerived() bool {
+	return e.GetKind() == TagKindDerived
+}
+
+func (e *Tag) KeepsHistory() bool {
+	return e.GetExtInfo().GetKeepHistory()
+}
+
 func (e *Tag) GetStatus() TagStatus {
 	if e != nil {
 		return e.Status
@@ -165,6 +420,65 @@ func (e *Tag) GetUpdateTime() uint64 {
 	return 0
 }
 
+func (e *Tag) Update(newTag *Tag) bool {
+	var hasChange bool
+
+	if newTag.Name != nil && newTag.GetName() != e.GetName() {
+		hasChange = true
+		e.Name = newTag.Name
+	}
+
+	if newTag.TagDesc != nil && newTag.GetTagDesc() != e.GetTagDesc() {
+		hasChange = true
+		e.TagDesc = newTag.TagDesc
+	}
+
+	if newTag.Enum != nil && !goutil.IsStrArrEqual(newTag.GetEnum(), e.GetEnum()) {
+		hasChange = true
+		e.Enum = newTag.Enum
+	}
+
+	if newTag.Status != TagStatusUnknown && newTag.GetStatus() != e.GetStatus() {
+		hasChange = true
+		e.Status = newTag.Status
+	}
+
+	if newTag.ExtInfo != nil {
+		oldExtInfo := e.ExtInfo
+		if oldExtInfo == nil {
+			oldExtInfo = new(TagExtInfo)
+		}
+
+		if newTag.ExtInfo.LastMaterializeTime != nil && oldExtInfo.GetLastMaterializeTime() != newTag.ExtInfo.GetLastMaterializeTime() {
+			hasChange = true
+			oldExtInfo.LastMaterializeTime = newTag.ExtInfo.LastMaterializeTime
+		}
+
+		if newTag.ExtInfo.LastUploadTime != nil && oldExtInfo.GetLastUploadTime() != newTag.ExtInfo.GetLastUploadTime() {
+			hasChange = true
+			oldExtInfo.LastUploadTime = newTag.ExtInfo.LastUploadTime
+		}
+
+		if newTag.ExtInfo.KeepHistory != nil && oldExtInfo.GetKeepHistory() != newTag.ExtInfo.GetKeepHistory() {
+			hasChange = true
+			oldExtInfo.KeepHistory = newTag.ExtInfo.KeepHistory
+		}
+
+		if newTag.ExtInfo.Sensitivity != SensitivityUnknown && oldExtInfo.GetSensitivity() != newTag.ExtInfo.GetSensitivity() {
+			hasChange = true
+			oldExtInfo.Sensitivity = newTag.ExtInfo.Sensitivity
+		}
+
+		e.ExtInfo = oldExtInfo
+	}
+
+	if hasChange {
+		e.UpdateTime = goutil.Uint64(uint64(time.Now().Unix()))
+	}
+
+	return hasChange
+}
+
 func (e *Tag) InEnum(tagValue string) bool {
 	if len(e.GetEnum()) > 0 && !goutil.ContainsStr(e.GetEnum(), tagValue) {
 		return false
@@ -177,6 +491,19 @@ func (e *Tag) IsValidTagValue(v string) bool {
 	return err == nil
 }
 
+func (e *Tag) IsValidLookupOp(op LookupOp) bool {
+	if op == LookupOpChangedWithin {
+		return e.KeepsHistory()
+	}
+
+	for _, lookupOp := range TagValueTypeLookupOps[e.GetValueType()] {
+		if lookupOp == op {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *Tag) FormatTagValue(v string) (interface{}, error) {
 	switch e.GetValueType() {
 	case TagValueTypeStr:
@@ -193,11 +520,156 @@ func (e *Tag) FormatTagValue(v string) (interface{}, error) {
 		} else {
 			return floatFrac(f), nil
 		}
+	case TagValueTypeBool:
+		if b, err := strconv.ParseBool(v); err != nil {
+			return nil, err
+		} else {
+			return b, nil
+		}
+	case TagValueTypeTimestamp:
+		return ParseTimestamp(v)
+	case TagValueTypeStrList:
+		items := make([]string, 0)
+		for _, item := range strings.Split(v, TagValueListSeparator) {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		if len(items) == 0 {
+			return nil, errors.New("empty list")
+		}
+		return items, nil
+	default:
+		return nil, errors.New("unsupported tag value type")
+	}
+}
+
+// ParseTagValue formats a tag value decoded from JSON input, e.g. an API request, and checks it against the enum.
+// Lists are only accepted by StrList tags.
+func (e *Tag) ParseTagValue(v interface{}) (interface{}, error) {
+	var raw string
+	switch val := v.(type) {
+	case string:
+		raw = val
+	case float64:
+		raw = strconv.FormatFloat(val, 'f', -1, 64)
+	case json.Number:
+		raw = val.String()
+	case bool:
+		raw = strconv.FormatBool(val)
+	case []interface{}:
+		if e.GetValueType() != TagValueTypeStrList {
+			return nil, ErrInvalidTagValueType
+		}
+		items := make([]string, 0, len(val))
+		for _, item := range val {
+			s, ok := item.(string)
+			if !ok {
+				return nil, ErrInvalidTagValueType
+			}
+			items = append(items, s)
+		}
+		raw = strings.Join(items, TagValueListSeparator)
+	default:
+		return nil, ErrInvalidTagValueType
+	}
+
+	tagVal, err := e.FormatTagValue(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag value: %v", err)
+	}
+
+	// list values are checked item by item
+	items := []string{raw}
+	if list, ok := tagVal.([]string); ok {
+		items = list
+	}
+	for _, item := range items {
+		if !e.InEnum(item) {
+			return nil, fmt.Errorf("tag value %s is not in enum", item)
+		}
+	}
+
+	return tagVal, nil
+}
+
+// ToTagValue converts a tag value decoded from a stored JSON document to the value type of the tag.
+func (e *Tag) ToTagValue(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	switch e.GetValueType() {
+	case TagValueTypeStr:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case TagValueTypeInt, TagValueTypeTimestamp:
+		switch n := v.(type) {
+		case float64:
+			return int64(n), nil
+		case json.Number:
+			return n.Int64()
+		}
+	case TagValueTypeFloat:
+		switch n := v.(type) {
+		case float64:
+			return floatFrac(n), nil
+		case json.Number:
+			f, err := n.Float64()
+			if err != nil {
+				return nil, err
+			}
+			return floatFrac(f), nil
+		}
+	case TagValueTypeBool:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case TagValueTypeStrList:
+		switch l := v.(type) {
+		case string:
+			// a single item list may be stored as a plain string
+			return []string{l}, nil
+		case []interface{}:
+			items := make([]string, 0, len(l))
+			for _, item := range l {
+				s, ok := item.(string)
+				if !ok {
+					return nil, ErrInvalidTagValueType
+				}
+				items = append(items, s)
+			}
+			return items, nil
+		}
 	default:
 		return nil, errors.New("unsupported tag value type")
 	}
+
+	return nil, ErrInvalidTagValueType
+}
+
+func (e *Tag) IsNumeric() bool {
+	return e.GetValueType() == TagValueTypeInt || e.GetValueType() == TagValueTypeFloat
 }
 
 func (e *Tag) CanDistinctTagValues() bool {
-	return e.GetValueType() == TagValueTypeStr
+	return e.GetValueType() == TagValueTypeStr || e.GetValueType() == TagValueTypeStrList
+}
+
+// ParseTimestamp converts v to unix seconds. v can be unix seconds or a date in one of timestampLayouts.
+func ParseTimestamp(v string) (int64, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.Unix(), nil
+		}
+	}
+
+	// numbers decoded from JSON are float64, which may be printed in exponent form
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp: %s", v)
+	}
+
+	return int64(f), nil
 }
@@ -0,0 +1,260 @@
+package entity
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrDivideByZero  = errors.New("divide by zero")
+	ErrMissingTagVal = errors.New("missing tag value")
+)
+
+const tagRefPrefix = "tag_"
+
+// TagExpr is an arithmetic expression over numeric tags, supporting + - * / and parentheses.
+// Tags are referenced by "tag_<id>", e.g. "(tag_1 + tag_2) / 2".
+type TagExpr struct {
+	root exprNode
+}
+
+type exprNode interface {
+	eval(vals map[uint64]float64) (float64, error)
+	tagIDs(ids map[uint64]struct{})
+}
+
+type numNode float64
+
+func (n numNode) eval(_ map[uint64]float64) (float64, error) {
+	return float64(n), nil
+}
+
+func (n numNode) tagIDs(_ map[uint64]struct{}) {}
+
+type tagNode uint64
+
+func (n tagNode) eval(vals map[uint64]float64) (float64, error) {
+	v, ok := vals[uint64(n)]
+	if !ok {
+		return 0, ErrMissingTagVal
+	}
+	return v, nil
+}
+
+func (n tagNode) tagIDs(ids map[uint64]struct{}) {
+	ids[uint64(n)] = struct{}{}
+}
+
+type binaryNode struct {
+	op          byte
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(vals map[uint64]float64) (float64, error) {
+	l, err := n.left.eval(vals)
+	if err != nil {
+		return 0, err
+	}
+
+	r, err := n.right.eval(vals)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	default:
+		if r == 0 {
+			return 0, ErrDivideByZero
+		}
+		return l / r, nil
+	}
+}
+
+func (n *binaryNode) tagIDs(ids map[uint64]struct{}) {
+	n.left.tagIDs(ids)
+	n.right.tagIDs(ids)
+}
+
+type negNode struct {
+	node exprNode
+}
+
+func (n *negNode) eval(vals map[uint64]float64) (float64, error) {
+	v, err := n.node.eval(vals)
+	if err != nil {
+		return 0, err
+	}
+	return -v, nil
+}
+
+func (n *negNode) tagIDs(ids map[uint64]struct{}) {
+	n.node.tagIDs(ids)
+}
+
+func ParseTagExpr(s string) (*TagExpr, error) {
+	p := &exprParser{s: s}
+
+	root, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	if p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.s[p.pos], p.pos)
+	}
+
+	return &TagExpr{root: root}, nil
+}
+
+// Eval evaluates the expression with vals, a map of tag ID to tag value.
+func (e *TagExpr) Eval(vals map[uint64]float64) (float64, error) {
+	return e.root.eval(vals)
+}
+
+// TagIDs returns the distinct tags referenced in the expression.
+func (e *TagExpr) TagIDs() []uint64 {
+	ids := make(map[uint64]struct{})
+	e.root.tagIDs(ids)
+
+	tagIDs := make([]uint64, 0, len(ids))
+	for id := range ids {
+		tagIDs = append(tagIDs, id)
+	}
+	return tagIDs
+}
+
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.s) && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() byte {
+	p.skipSpaces()
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+// sum = product { ("+" | "-") product }
+func (p *exprParser) parseSum() (exprNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+// product = unary { ("*" | "/") unary }
+func (p *exprParser) parseProduct() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return left, nil
+		}
+		p.pos++
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+// unary = "-" unary | primary
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &negNode{node: node}, nil
+	}
+	return p.parsePrimary()
+}
+
+// primary = number | tag | "(" sum ")"
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	c := p.peek()
+
+	switch {
+	case c == 0:
+		return nil, errors.New("unexpected end of expression")
+	case c == '(':
+		p.pos++
+
+		node, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' at position %d", p.pos)
+		}
+		p.pos++
+
+		return node, nil
+	case c == '.' || unicode.IsDigit(rune(c)):
+		start := p.pos
+		for p.pos < len(p.s) && (p.s[p.pos] == '.' || unicode.IsDigit(rune(p.s[p.pos]))) {
+			p.pos++
+		}
+
+		f, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number at position %d", start)
+		}
+		return numNode(f), nil
+	case strings.HasPrefix(p.s[p.pos:], tagRefPrefix):
+		start := p.pos
+		p.pos += len(tagRefPrefix)
+		for p.pos < len(p.s) && unicode.IsDigit(rune(p.s[p.pos])) {
+			p.pos++
+		}
+
+		id, err := strconv.ParseUint(p.s[start+len(tagRefPrefix):p.pos], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag reference at position %d", start)
+		}
+		return tagNode(id), nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+	}
+}
@@ -0,0 +1,124 @@
+package entity
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseTagValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		valueType TagValueType
+		enum      []string
+		v         interface{}
+		want      interface{}
+		wantErr   bool
+	}{
+		{name: "int from number", valueType: TagValueTypeInt, v: float64(42), want: 42},
+		{name: "int from string", valueType: TagValueTypeInt, v: "42", want: 42},
+		{name: "int from fraction", valueType: TagValueTypeInt, v: 4.5, wantErr: true},
+		{name: "float from number", valueType: TagValueTypeFloat, v: 1.5, want: floatFrac(1.5)},
+		{name: "float from json number", valueType: TagValueTypeFloat, v: json.Number("2"), want: floatFrac(2)},
+		{name: "str from string", valueType: TagValueTypeStr, v: "gold", want: "gold"},
+		{name: "str in enum", valueType: TagValueTypeStr, enum: []string{"gold", "silver"}, v: "gold", want: "gold"},
+		{name: "str not in enum", valueType: TagValueTypeStr, enum: []string{"gold", "silver"}, v: "bronze", wantErr: true},
+		{name: "str from list", valueType: TagValueTypeStr, v: []interface{}{"gold"}, wantErr: true},
+
+		{name: "bool from bool", valueType: TagValueTypeBool, v: true, want: true},
+		{name: "bool from string", valueType: TagValueTypeBool, v: "false", want: false},
+		{name: "bool from invalid string", valueType: TagValueTypeBool, v: "yes", wantErr: true},
+		{name: "bool from number", valueType: TagValueTypeBool, v: float64(2), wantErr: true},
+
+		{name: "timestamp from unix seconds", valueType: TagValueTypeTimestamp, v: float64(1700000000), want: int64(1700000000)},
+		{name: "timestamp from exponent form", valueType: TagValueTypeTimestamp, v: "1.7e+09", want: int64(1700000000)},
+		{name: "timestamp from date", valueType: TagValueTypeTimestamp, v: "2024-01-02", want: int64(1704153600)},
+		{name: "timestamp from date time", valueType: TagValueTypeTimestamp, v: "2024-01-02 03:04:05", want: int64(1704164645)},
+		{name: "timestamp from RFC 3339", valueType: TagValueTypeTimestamp, v: "2024-01-02T11:04:05+08:00", want: int64(1704164645)},
+		{name: "timestamp from invalid date", valueType: TagValueTypeTimestamp, v: "yesterday", wantErr: true},
+
+		{name: "str list from list", valueType: TagValueTypeStrList, v: []interface{}{"a", "b"}, want: []string{"a", "b"}},
+		{name: "str list from string", valueType: TagValueTypeStrList, v: " a, b ,,c ", want: []string{"a", "b", "c"}},
+		{name: "str list from one item", valueType: TagValueTypeStrList, v: "a", want: []string{"a"}},
+		{name: "str list with non-string item", valueType: TagValueTypeStrList, v: []interface{}{"a", float64(1)}, wantErr: true},
+		{name: "empty str list", valueType: TagValueTypeStrList, v: []interface{}{}, wantErr: true},
+		{name: "blank str list", valueType: TagValueTypeStrList, v: " , ", wantErr: true},
+		{name: "str list in enum", valueType: TagValueTypeStrList, enum: []string{"a", "b"}, v: []interface{}{"b", "a"}, want: []string{"b", "a"}},
+		{name: "str list item not in enum", valueType: TagValueTypeStrList, enum: []string{"a", "b"}, v: []interface{}{"a", "c"}, wantErr: true},
+
+		{name: "nil", valueType: TagValueTypeStr, v: nil, wantErr: true},
+		{name: "object", valueType: TagValueTypeStr, v: map[string]interface{}{}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := &Tag{ValueType: tt.valueType, Enum: tt.enum}
+
+			got, err := tag.ParseTagValue(tt.v)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseTagValue(%#v) = %#v, want error", tt.v, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseTagValue(%#v) failed: %v", tt.v, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseTagValue(%#v) = %#v, want %#v", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToTagValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		valueType TagValueType
+		v         interface{}
+		want      interface{}
+		wantErr   bool
+	}{
+		{name: "nil", valueType: TagValueTypeInt, v: nil, want: nil},
+		{name: "str", valueType: TagValueTypeStr, v: "gold", want: "gold"},
+		{name: "str from number", valueType: TagValueTypeStr, v: float64(1), wantErr: true},
+		{name: "int", valueType: TagValueTypeInt, v: float64(42), want: int64(42)},
+		{name: "int from json number", valueType: TagValueTypeInt, v: json.Number("42"), want: int64(42)},
+		{name: "float", valueType: TagValueTypeFloat, v: 1.5, want: floatFrac(1.5)},
+		{name: "float from json number", valueType: TagValueTypeFloat, v: json.Number("1.5"), want: floatFrac(1.5)},
+
+		{name: "bool", valueType: TagValueTypeBool, v: true, want: true},
+		{name: "bool from string", valueType: TagValueTypeBool, v: "true", wantErr: true},
+
+		{name: "timestamp", valueType: TagValueTypeTimestamp, v: float64(1700000000), want: int64(1700000000)},
+		{name: "timestamp from json number", valueType: TagValueTypeTimestamp, v: json.Number("1700000000"), want: int64(1700000000)},
+		{name: "timestamp from date", valueType: TagValueTypeTimestamp, v: "2024-01-02", wantErr: true},
+
+		{name: "str list", valueType: TagValueTypeStrList, v: []interface{}{"a", "b"}, want: []string{"a", "b"}},
+		{name: "str list stored as string", valueType: TagValueTypeStrList, v: "a", want: []string{"a"}},
+		{name: "str list with non-string item", valueType: TagValueTypeStrList, v: []interface{}{"a", float64(1)}, wantErr: true},
+		{name: "str list from number", valueType: TagValueTypeStrList, v: float64(1), wantErr: true},
+
+		{name: "unknown value type", valueType: TagValueTypeUnknown, v: "a", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := &Tag{ValueType: tt.valueType}
+
+			got, err := tag.ToTagValue(tt.v)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ToTagValue(%#v) = %#v, want error", tt.v, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ToTagValue(%#v) failed: %v", tt.v, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ToTagValue(%#v) = %#v, want %#v", tt.v, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package entity
 import (
 	"cdp/pkg/goutil"
 	"encoding/json"
+	"io"
 	"mime/multipart"
 	"time"
 )
@@ -12,15 +13,26 @@ type FileMeta struct {
 	FileHeader *multipart.FileHeader
 }
 
+// FileData is a file returned in place of a JSON response, Body is closed once it is written.
+type FileData struct {
+	Name        string
+	ContentType string
+	Body        io.ReadCloser
+}
+
 type ResourceType uint32
 
 const (
 	ResourceTypeUnknown ResourceType = iota
 	ResourceTypeTag
+	ResourceTypeIdentity // identity mappings linking uds into profiles
+	ResourceTypeSegment
 )
 
 var ResourceTypes = map[ResourceType]string{
-	ResourceTypeTag: "tag",
+	ResourceTypeTag:      "tag",
+	ResourceTypeIdentity: "identity",
+	ResourceTypeSegment:  "segment",
 }
 
 type TaskType uint32
@@ -28,6 +40,8 @@ type TaskType uint32
 const (
 	TaskTypeUnknown TaskType = iota
 	TaskTypeFileUpload
+	TaskTypeSegmentExport
+	TaskTypeSegmentSnapshot // populates a static segment with the uds of another segment
 )
 
 type TaskStatus uint32
@@ -45,6 +59,39 @@ type TaskExtInfo struct {
 	OriFileName *string `json:"ori_file_name,omitempty"`
 	Size        *uint64 `json:"size,omitempty"`
 	Progress    *uint64 `json:"progress,omitempty"`
+
+	// IDType is the ID type of the uds in a file upload.
+	IDType IDType `json:"id_type,omitempty"`
+
+	// row level results of a file upload
+	ValidRows      *uint64 `json:"valid_rows,omitempty"`
+	InvalidRows    *uint64 `json:"invalid_rows,omitempty"`
+	SkippedRows    *uint64 `json:"skipped_rows,omitempty"`
+	SuppressedRows *uint64 `json:"suppressed_rows,omitempty"` // rows of erased uds
+	RejectedFileID *string `json:"rejected_file_id,omitempty"`
+	FailReason     *string `json:"fail_reason,omitempty"`
+
+	// segment export, TagIDs are exported as columns after the ud.
+	TagIDs       []uint64 `json:"tag_ids,omitempty"`
+	MaskPII      *bool    `json:"mask_pii,omitempty"` // set if the creator cannot view PII
+	ExportedRows *uint64  `json:"exported_rows,omitempty"`
+
+	// SourceSegmentID is the segment whose uds are frozen into the static segment by a segment snapshot.
+	SourceSegmentID *uint64 `json:"source_segment_id,omitempty"`
+}
+
+func (e *TaskExtInfo) GetFileID() string {
+	if e != nil && e.FileID != nil {
+		return *e.FileID
+	}
+	return ""
+}
+
+func (e *TaskExtInfo) GetSize() uint64 {
+	if e != nil && e.Size != nil {
+		return *e.Size
+	}
+	return 0
 }
 
 func (e *TaskExtInfo) GetProgress() uint64 {
@@ -54,6 +101,91 @@ func (e *TaskExtInfo) GetProgress() uint64 {
 	return 0
 }
 
+// GetIDType defaults to email, the only ID type supported by earlier tasks.
+func (e *TaskExtInfo) GetIDType() IDType {
+	if e != nil && e.IDType != IDTypeUnknown {
+		return e.IDType
+	}
+	return IDTypeEmail
+}
+
+func (e *TaskExtInfo) GetOriFileName() string {
+	if e != nil && e.OriFileName != nil {
+		return *e.OriFileName
+	}
+	return ""
+}
+
+func (e *TaskExtInfo) GetValidRows() uint64 {
+	if e != nil && e.ValidRows != nil {
+		return *e.ValidRows
+	}
+	return 0
+}
+
+func (e *TaskExtInfo) GetInvalidRows() uint64 {
+	if e != nil && e.InvalidRows != nil {
+		return *e.InvalidRows
+	}
+	return 0
+}
+
+func (e *TaskExtInfo) GetSkippedRows() uint64 {
+	if e != nil && e.SkippedRows != nil {
+		return *e.SkippedRows
+	}
+	return 0
+}
+
+func (e *TaskExtInfo) GetSuppressedRows() uint64 {
+	if e != nil && e.SuppressedRows != nil {
+		return *e.SuppressedRows
+	}
+	return 0
+}
+
+func (e *TaskExtInfo) GetRejectedFileID() string {
+	if e != nil && e.RejectedFileID != nil {
+		return *e.RejectedFileID
+	}
+	return ""
+}
+
+func (e *TaskExtInfo) GetFailReason() string {
+	if e != nil && e.FailReason != nil {
+		return *e.FailReason
+	}
+	return ""
+}
+
+func (e *TaskExtInfo) GetTagIDs() []uint64 {
+	if e != nil && e.TagIDs != nil {
+		return e.TagIDs
+	}
+	return nil
+}
+
+func (e *TaskExtInfo) GetMaskPII() bool {
+	if e != nil && e.MaskPII != nil {
+		return *e.MaskPII
+	}
+	return false
+}
+
+func (e *TaskExtInfo) GetExportedRows() uint64 {
+	if e != nil && e.ExportedRows != nil {
+		return *e.ExportedRows
+	}
+	return 0
+}
+
+func (e *TaskExtInfo) GetSourceSegmentID() uint64 {
+	if e != nil && e.SourceSegmentID != nil {
+		return *e.SourceSegmentID
+	}
+	return 0
+}
+
 func (e *TaskExtInfo) ToString() (string, error) {
 	if e == nil {
 		return "{}", nil
@@ -157,10 +289,57 @@ func (e *Task) Update(newTask *Task) bool {
 			oldExtInfo = new(TaskExtInfo)
 		}
 
+		if newTask.ExtInfo.FileID != nil && oldExtInfo.GetFileID() != newTask.ExtInfo.GetFileID() {
+			hasChange = true
+			oldExtInfo.FileID = newTask.ExtInfo.FileID
+		}
+
+		if newTask.ExtInfo.Size != nil && oldExtInfo.GetSize() != newTask.ExtInfo.GetSize() {
+			hasChange = true
+			oldExtInfo.Size = newTask.ExtInfo.Size
+		}
+
 		if newTask.ExtInfo.Progress != nil && oldExtInfo.GetProgress() != newTask.ExtInfo.GetProgress() {
 			hasChange = true
 			oldExtInfo.Progress = newTask.ExtInfo.Progress
 		}
+
+		if newTask.ExtInfo.ValidRows != nil && oldExtInfo.GetValidRows() != newTask.ExtInfo.GetValidRows() {
+			hasChange = true
+			oldExtInfo.ValidRows = newTask.ExtInfo.ValidRows
+		}
+
+		if newTask.ExtInfo.InvalidRows != nil && oldExtInfo.GetInvalidRows() != newTask.ExtInfo.GetInvalidRows() {
+			hasChange = true
+			oldExtInfo.InvalidRows = newTask.ExtInfo.InvalidRows
+		}
+
+		if newTask.ExtInfo.SkippedRows != nil && oldExtInfo.GetSkippedRows() != newTask.ExtInfo.GetSkippedRows() {
+			hasChange = true
+			oldExtInfo.SkippedRows = newTask.ExtInfo.SkippedRows
+		}
+
+		if newTask.ExtInfo.SuppressedRows != nil && oldExtInfo.GetSuppressedRows() != newTask.ExtInfo.GetSuppressedRows() {
+			hasChange = true
+			oldExtInfo.SuppressedRows = newTask.ExtInfo.SuppressedRows
+		}
+
+		if newTask.ExtInfo.RejectedFileID != nil && oldExtInfo.GetRejectedFileID() != newTask.ExtInfo.GetRejectedFileID() {
+			hasChange = true
+			oldExtInfo.RejectedFileID = newTask.ExtInfo.RejectedFileID
+		}
+
+		if newTask.ExtInfo.FailReason != nil && oldExtInfo.GetFailReason() != newTask.ExtInfo.GetFailReason() {
+			hasChange = true
+			oldExtInfo.FailReason = newTask.ExtInfo.FailReason
+		}
+
+		if newTask.ExtInfo.ExportedRows != nil && oldExtInfo.GetExportedRows() != newTask.ExtInfo.GetExportedRows() {
+			hasChange = true
+			oldExtInfo.ExportedRows = newTask.ExtInfo.ExportedRows
+		}
+
+		e.ExtInfo = oldExtInfo
 	}
 
 	if hasChange {
@@ -0,0 +1,50 @@
+package entity
+
+// UdProfile is everything stored about a ud, used to trace why a ud was picked by a segment or a campaign.
+type UdProfile struct {
+	Ud *Ud `json:"ud,omitempty"`
+	// LinkedUds are the other uds of the same unified profile.
+	LinkedUds      []*Ud            `json:"linked_uds"`
+	TagVals        []*ProfileTagVal `json:"tag_vals"`
+	CampaignEvents []*CampaignEvent `json:"campaign_events"`
+}
+
+type ProfileTagVal struct {
+	TagID     *uint64      `json:"tag_id,omitempty"`
+	TagName   *string      `json:"tag_name,omitempty"`
+	ValueType TagValueType `json:"value_type,omitempty"`
+	TagVal    interface{}  `json:"tag_val,omitempty"`
+}
+
+func (e *ProfileTagVal) GetTagName() string {
+	if e != nil && e.TagName != nil {
+		return *e.TagName
+	}
+	return ""
+}
+
+// CampaignEvent is a campaign log of a ud, with the campaign it belongs to.
+type CampaignEvent struct {
+	CampaignID      *uint64 `json:"campaign_id,omitempty"`
+	CampaignName    *string `json:"campaign_name,omitempty"`
+	CampaignEmailID *uint64 `json:"campaign_email_id,omitempty"`
+	Subject         *string `json:"subject,omitempty"`
+	Email           *string `json:"email,omitempty"`
+	Event           Event   `json:"event,omitempty"`
+	Link            *string `json:"link,omitempty"`
+	EventTime       *uint64 `json:"event_time,omitempty"`
+}
+
+func (e *CampaignEvent) GetEmail() string {
+	if e != nil && e.Email != nil {
+		return *e.Email
+	}
+	return ""
+}
+
+func (e *CampaignEvent) GetEventTime() uint64 {
+	if e != nil && e.EventTime != nil {
+		return *e.EventTime
+	}
+	return 0
+}
@@ -3,27 +3,83 @@ package entity
 import (
 	"cdp/pkg/goutil"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
 const docIDSeparator = ":"
 
+// UdIDTypeField is the doc field holding the ID type, so that uds can be filtered by it.
+const UdIDTypeField = "id_type"
+
+// UdProfileIDField is the doc field holding the profile ID, so that uds can be deduped by profile.
+const UdProfileIDField = "profile_id"
+
+// UdSplitKeyField is the doc field holding the key the ud is hashed by into splits, see Ud.ToSplitKey.
+const UdSplitKeyField = "split_key"
+
+// UdSegmentIDsField is the doc field holding the keywords of the static segments of the ud, see StaticSegmentKey.
+const UdSegmentIDsField = "segment_ids"
+
 type IDType uint32
 
 const (
 	IDTypeUnknown IDType = iota
 	IDTypeEmail
+	IDTypePhone
+	IDTypeExternalID // customer ID in the tenant's own system
+	IDTypeDeviceID
 )
 
 var IDTypes = map[IDType]string{
-	IDTypeEmail: "email",
+	IDTypeEmail:      "email",
+	IDTypePhone:      "phone",
+	IDTypeExternalID: "external_id",
+	IDTypeDeviceID:   "device_id",
+}
+
+var (
+	emailRegex = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	phoneRegex = regexp.MustCompile(`^\+?[0-9]{6,15}$`)
+
+	// separators commonly used to format phone numbers, e.g. "+65 9123-4567"
+	phoneReplacer = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "")
+)
+
+// NormalizeUdID validates the ID against its ID type, and returns it in the form stored.
+func NormalizeUdID(idType IDType, id string) (string, error) {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return "", errors.New("empty id")
+	}
+
+	switch idType {
+	case IDTypeEmail:
+		if !emailRegex.MatchString(id) {
+			return "", fmt.Errorf("invalid email: %s", id)
+		}
+	case IDTypePhone:
+		id = phoneReplacer.Replace(id)
+		if !phoneRegex.MatchString(id) {
+			return "", fmt.Errorf("invalid phone: %s", id)
+		}
+	case IDTypeExternalID, IDTypeDeviceID:
+	default:
+		return "", fmt.Errorf("invalid id type: %d", idType)
+	}
+
+	return id, nil
 }
 
 type Ud struct {
 	ID     *string `json:"id,omitempty"`
 	IDType IDType  `json:"id_type,omitempty"`
+
+	// ProfileID is the unified profile of the ud, nil if it is not linked to other uds.
+	ProfileID *uint64 `json:"profile_id,omitempty"`
 }
 
 func (e *Ud) GetID() string {
@@ -40,6 +96,29 @@ func (e *Ud) GetIDType() IDType {
 	return IDTypeUnknown
 }
 
+func (e *Ud) GetProfileID() uint64 {
+	if e != nil && e.ProfileID != nil {
+		return *e.ProfileID
+	}
+	return 0
+}
+
+func (e *Ud) IsPII() bool {
+	return IDTypeSensitivities[e.GetIDType()] == SensitivityPII
+}
+
+// Mask returns a copy of the ud with its ID masked.
+func (e *Ud) Mask() *Ud {
+	if e == nil {
+		return nil
+	}
+	return &Ud{
+		ID:        goutil.String(MaskStr(e.GetID())),
+		IDType:    e.GetIDType(),
+		ProfileID: e.ProfileID,
+	}
+}
+
 func (e *Ud) ToDocID() string {
 	if e == nil {
 		return ""
@@ -47,24 +126,41 @@ func (e *Ud) ToDocID() string {
 	return fmt.Sprintf("%s%s%d", e.GetID(), docIDSeparator, e.GetIDType())
 }
 
+// ToSplitKey returns the key the ud is hashed by into splits. The uds of a profile share the profile ID as key,
+// so that the profile is not torn across splits, a ud without a profile is keyed by its doc ID.
+func (e *Ud) ToSplitKey() string {
+	if e.GetProfileID() != 0 {
+		return strconv.FormatUint(e.GetProfileID(), 10)
+	}
+	return e.ToDocID()
+}
+
+// ToHash identifies the ud without revealing its ID, used to remember erased uds.
+// The hash is keyed by the secret, so that it cannot be reversed by hashing guessed IDs.
+func (e *Ud) ToHash(secret string) string {
+	return goutil.HmacSha256(secret, e.ToDocID())
+}
+
+// ToUd parses a doc ID built by ToDocID. The ID type is always the last part,
+// so that IDs containing the separator, e.g. device IDs, are kept intact.
 func ToUd(docID string) (*Ud, error) {
-	parts := strings.Split(docID, docIDSeparator)
-	if len(parts) != 2 {
+	i := strings.LastIndex(docID, docIDSeparator)
+	if i <= 0 {
 		return nil, fmt.Errorf("invalid doc id format: %s", docID)
 	}
 
-	i, err := strconv.Atoi(parts[1])
+	t, err := strconv.Atoi(docID[i+len(docIDSeparator):])
 	if err != nil {
 		return nil, fmt.Errorf("invalid id type, docID: %s, err: %v", docID, err)
 	}
 
-	idType := IDType(i)
+	idType := IDType(t)
 	if idType == IDTypeUnknown {
-		return nil, fmt.Errorf("id type should not be Unknown, docID: %s, err: %v", docID, err)
+		return nil, fmt.Errorf("id type should not be Unknown, docID: %s", docID)
 	}
 
 	return &Ud{
-		ID:     goutil.String(parts[0]),
+		ID:     goutil.String(docID[:i]),
 		IDType: idType,
 	}, nil
 }
@@ -72,6 +168,10 @@ func ToUd(docID string) (*Ud, error) {
 type TagVal struct {
 	TagID  *uint64     `json:"tag_id,omitempty"`
 	TagVal interface{} `json:"tag_val,omitempty"`
+
+	// KeepHistory and TaskID are used to record the change in the tag value history.
+	KeepHistory bool    `json:"-"`
+	TaskID      *uint64 `json:"-"`
 }
 
 func (e *TagVal) GetTagID() uint64 {
@@ -81,6 +181,13 @@ func (e *TagVal) GetTagID() uint64 {
 	return 0
 }
 
+func (e *TagVal) GetTaskID() uint64 {
+	if e != nil && e.TaskID != nil {
+		return *e.TaskID
+	}
+	return 0
+}
+
 func (e *TagVal) GetTagVal() interface{} {
 	if e != nil && e.TagVal != nil {
 		return e.TagVal
@@ -88,9 +195,20 @@ func (e *TagVal) GetTagVal() interface{} {
 	return nil
 }
 
+// TagValHistory is a past or current tag value of a ud, valid within [FromTime, ToTime).
+type TagValHistory struct {
+	TagVal   interface{} `json:"tag_val,omitempty"`
+	FromTime *uint64     `json:"from_time,omitempty"`
+	ToTime   *uint64     `json:"to_time,omitempty"` // nil if it is the current value
+	TaskID   *uint64     `json:"task_id,omitempty"`
+}
+
 type UdTagVal struct {
 	Ud      *Ud       `json:"ud,omitempty"`
 	TagVals []*TagVal `json:"tag_vals,omitempty"`
+
+	// SegmentIDs adds the ud to static segments.
+	SegmentIDs []uint64 `json:"segment_ids,omitempty"`
 }
 
 func (e *UdTagVal) GetUd() *Ud {
@@ -100,12 +218,49 @@ func (e *UdTagVal) GetUd() *Ud {
 	return e.Ud
 }
 
+func (e *UdTagVal) GetTagVals() []*TagVal {
+	if e == nil {
+		return nil
+	}
+	return e.TagVals
+}
+
+func (e *UdTagVal) HasHistory() bool {
+	for _, tagVal := range e.TagVals {
+		if tagVal.KeepHistory {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSegmentKeys returns the keywords of the static segments the ud is added to.
+func (e *UdTagVal) GetSegmentKeys() []string {
+	if e == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(e.SegmentIDs))
+	for _, segmentID := range e.SegmentIDs {
+		keys = append(keys, StaticSegmentKey(segmentID))
+	}
+	return keys
+}
+
+// ToDoc returns the fields of the doc overwritten by the upsert, the static segments are added to the doc separately.
 func (e *UdTagVal) ToDoc() (string, error) {
 	if e == nil || e.Ud == nil {
 		return "", nil
 	}
 
-	tagVals := make(map[string]interface{})
+	// the profile of the ud is set on every write, so the split key follows the profile the ud is linked to
+	tagVals := map[string]interface{}{
+		UdIDTypeField:   e.Ud.GetIDType(),
+		UdSplitKeyField: e.Ud.ToSplitKey(),
+	}
+	if e.Ud.ProfileID != nil {
+		tagVals[UdProfileIDField] = e.Ud.GetProfileID()
+	}
 	for _, tagVal := range e.TagVals {
 		tagVals[fmt.Sprintf("tag_%d", tagVal.GetTagID())] = tagVal.GetTagVal()
 	}
@@ -99,6 +99,13 @@ func (e *User) GetID() uint64 {
 	return 0
 }
 
+func (e *User) GetRole() *Role {
+	if e != nil && e.Role != nil {
+		return e.Role
+	}
+	return nil
+}
+
 func (e *User) GetTenantID() uint64 {
 	if e != nil && e.TenantID != nil {
 		return *e.TenantID
@@ -24,31 +24,37 @@ type CampaignHandler interface {
 
 type campaignHandler struct {
 	cfg             *config.Config
+	txService       repo.TxService
 	campaignRepo    repo.CampaignRepo
 	emailService    dep.EmailService
 	segmentHandler  SegmentHandler
 	campaignLogRepo repo.CampaignLogRepo
 	emailHandler    EmailHandler
 	senderRepo      repo.SenderRepo
+	segmentRepo     repo.SegmentRepo
 }
 
 func NewCampaignHandler(
 	cfg *config.Config,
+	txService repo.TxService,
 	campaignRepo repo.CampaignRepo,
 	emailService dep.EmailService,
 	segmentHandler SegmentHandler,
 	campaignLogRepo repo.CampaignLogRepo,
 	emailHandler EmailHandler,
 	senderRepo repo.SenderRepo,
+	segmentRepo repo.SegmentRepo,
 ) CampaignHandler {
 	return &campaignHandler{
 		cfg,
+		txService,
 		campaignRepo,
 		emailService,
 		segmentHandler,
 		campaignLogRepo,
 		emailHandler,
 		senderRepo,
+		segmentRepo,
 	}
 }
 
@@ -231,13 +237,24 @@ func (h *campaignHandler) CreateCampaign(ctx context.Context, req *CreateCampaig
 		}
 	}
 
-	id, err := h.campaignRepo.Create(ctx, campaign)
-	if err != nil {
+	// the segment is locked, so that it is not deleted before the campaign is created, see DeleteSegment
+	if err := h.txService.RunTx(ctx, func(ctx context.Context) error {
+		if err := lockSegments(ctx, h.segmentRepo, req.GetTenantID(), []uint64{campaign.GetSegmentID()}); err != nil {
+			return err
+		}
+
+		id, err := h.campaignRepo.Create(ctx, campaign)
+		if err != nil {
+			return err
+		}
+		campaign.ID = goutil.Uint64(id)
+
+		return nil
+	}); err != nil {
 		log.Ctx(ctx).Error().Msgf("create campaign failed: %v", err)
 		return err
 	}
 
-	campaign.ID = goutil.Uint64(id)
 	res.Campaign = campaign
 
 	return nil
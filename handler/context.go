@@ -5,8 +5,9 @@ import (
 )
 
 type ContextInfo struct {
-	User   *entity.User
-	Tenant *entity.Tenant
+	User    *entity.User
+	Tenant  *entity.Tenant
+	ViewPII bool `json:"-"`
 }
 
 func (c *ContextInfo) SetUser(u *entity.User) {
@@ -17,10 +18,18 @@ func (c *ContextInfo) SetTenant(t *entity.Tenant) {
 	c.Tenant = t
 }
 
+func (c *ContextInfo) SetViewPII(viewPII bool) {
+	c.ViewPII = viewPII
+}
+
 func (c *ContextInfo) GetUserID() uint64 {
 	return c.User.GetID()
 }
 
+func (c *ContextInfo) GetTenant() *entity.Tenant {
+	return c.Tenant
+}
+
 func (c *ContextInfo) GetTenantID() uint64 {
 	return c.Tenant.GetID()
 }
@@ -32,3 +41,8 @@ func (c *ContextInfo) GetTenantName() string {
 func (c *ContextInfo) GetTenantFolder() string {
 	return c.Tenant.GetExtInfo().GetFolderID()
 }
+
+// CanViewPII tells whether PII may be returned unmasked, as resolved by the session middleware.
+func (c *ContextInfo) CanViewPII() bool {
+	return c.ViewPII
+}
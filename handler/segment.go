@@ -5,11 +5,15 @@ import (
 	"cdp/entity"
 	"cdp/pkg/errutil"
 	"cdp/pkg/goutil"
+	"cdp/pkg/querylang"
 	"cdp/pkg/validator"
 	"cdp/repo"
 	"context"
 	"errors"
+	"fmt"
 	"github.com/rs/zerolog/log"
+	"math/rand"
+	"sort"
 	"time"
 )
 
@@ -21,21 +25,38 @@ type SegmentHandler interface {
 	GetSegments(ctx context.Context, req *GetSegmentsRequest, res *GetSegmentsResponse) error
 	PreviewUd(ctx context.Context, req *PreviewUdRequest, res *PreviewUdResponse) error
 	CountSegments(ctx context.Context, req *CountSegmentsRequest, res *CountSegmentsResponse) error
+	UpdateSegment(ctx context.Context, req *UpdateSegmentRequest, res *UpdateSegmentResponse) error
+	DeleteSegment(ctx context.Context, req *DeleteSegmentRequest, res *DeleteSegmentResponse) error
+	GetSegmentVersions(ctx context.Context, req *GetSegmentVersionsRequest, res *GetSegmentVersionsResponse) error
+	RestoreSegment(ctx context.Context, req *RestoreSegmentRequest, res *RestoreSegmentResponse) error
+	GetSegmentSizeHistory(ctx context.Context, req *GetSegmentSizeHistoryRequest, res *GetSegmentSizeHistoryResponse) error
+	GetSegmentOverlaps(ctx context.Context, req *GetSegmentOverlapsRequest, res *GetSegmentOverlapsResponse) error
+	SnapshotSegment(ctx context.Context, req *SnapshotSegmentRequest, res *SnapshotSegmentResponse) error
+	SplitSegment(ctx context.Context, req *SplitSegmentRequest, res *SplitSegmentResponse) error
 }
 
 type segmentHandler struct {
-	cfg         *config.Config
-	segmentRepo repo.SegmentRepo
-	tagRepo     repo.TagRepo
-	queryRepo   repo.QueryRepo
+	cfg             *config.Config
+	txService       repo.TxService
+	segmentRepo     repo.SegmentRepo
+	tagRepo         repo.TagRepo
+	queryRepo       repo.QueryRepo
+	campaignRepo    repo.CampaignRepo
+	segmentSizeRepo repo.SegmentSizeRepo
+	taskRepo        repo.TaskRepo
 }
 
-func NewSegmentHandler(cfg *config.Config, tagRepo repo.TagRepo, segmentRepo repo.SegmentRepo, queryRepo repo.QueryRepo) SegmentHandler {
+func NewSegmentHandler(cfg *config.Config, txService repo.TxService, tagRepo repo.TagRepo, segmentRepo repo.SegmentRepo,
+	queryRepo repo.QueryRepo, campaignRepo repo.CampaignRepo, segmentSizeRepo repo.SegmentSizeRepo, taskRepo repo.TaskRepo) SegmentHandler {
 	return &segmentHandler{
-		cfg:         cfg,
-		tagRepo:     tagRepo,
-		segmentRepo: segmentRepo,
-		queryRepo:   queryRepo,
+		cfg:             cfg,
+		txService:       txService,
+		tagRepo:         tagRepo,
+		segmentRepo:     segmentRepo,
+		queryRepo:       queryRepo,
+		campaignRepo:    campaignRepo,
+		segmentSizeRepo: segmentSizeRepo,
+		taskRepo:        taskRepo,
 	}
 }
 
@@ -81,6 +102,8 @@ func (r *GetSegmentRequest) GetSegmentID() uint64 {
 
 type GetSegmentResponse struct {
 	Segment *entity.Segment `json:"segment,omitempty"`
+	// CriteriaText is the criteria in the text query language, unset for static segments.
+	CriteriaText *string `json:"criteria_text,omitempty"`
 }
 
 var GetSegmentValidator = validator.MustForm(map[string]validator.Validator{
@@ -101,6 +124,92 @@ func (h *segmentHandler) GetSegment(ctx context.Context, req *GetSegmentRequest,
 
 	res.Segment = segment
 
+	if !segment.IsStatic() {
+		text, err := h.printCriteria(ctx, req.GetTenantID(), segment.GetCriteria())
+		if err != nil {
+			// the criteria is still returned as JSON
+			log.Ctx(ctx).Warn().Msgf("print segment criteria failed, segment ID: %d, err: %v", segment.GetID(), err)
+		} else {
+			res.CriteriaText = goutil.String(text)
+		}
+	}
+
+	return nil
+}
+
+// parseCriteria parses a criteria in the text query language, the tags are looked up by name in the tenant.
+// Errors in the text are returned as a *querylang.Error.
+func (h *segmentHandler) parseCriteria(ctx context.Context, tenantID uint64, text string) (*entity.Query, error) {
+	tagIDs := make(map[string]uint64)
+
+	query, err := querylang.Parse(text, func(name string) (uint64, error) {
+		if tagID, ok := tagIDs[name]; ok {
+			return tagID, nil
+		}
+
+		tag, err := h.tagRepo.GetByName(ctx, tenantID, name)
+		if err != nil {
+			if errors.Is(err, repo.ErrTagNotFound) {
+				return 0, querylang.ErrUnknownTag
+			}
+			return 0, err
+		}
+
+		tagIDs[name] = tag.GetID()
+		return tag.GetID(), nil
+	})
+	if err != nil {
+		var langErr *querylang.Error
+		if !errors.As(err, &langErr) {
+			log.Ctx(ctx).Error().Msgf("parse criteria failed: %v", err)
+		}
+		return nil, err
+	}
+
+	return query, nil
+}
+
+// printCriteria prints a criteria in the text query language.
+func (h *segmentHandler) printCriteria(ctx context.Context, tenantID uint64, query *entity.Query) (string, error) {
+	tags, err := h.tagRepo.GetManyByIDs(ctx, tenantID, query.GetTagIDs())
+	if err != nil {
+		return "", err
+	}
+
+	tagNames := make(map[uint64]string, len(tags))
+	for _, tag := range tags {
+		tagNames[tag.GetID()] = tag.GetName()
+	}
+
+	return querylang.Print(query, func(tagID uint64) (string, error) {
+		name, ok := tagNames[tagID]
+		if !ok {
+			return "", fmt.Errorf("tag %d not found", tagID)
+		}
+		return name, nil
+	})
+}
+
+// resolveCriteriaText sets the criteria from the criteria text if there is one, only one of them can be given.
+func (h *segmentHandler) resolveCriteriaText(ctx context.Context, tenantID uint64, criteria **entity.Query, text *string) error {
+	if text == nil {
+		return nil
+	}
+
+	if *criteria != nil {
+		return errutil.ValidationError(errors.New("criteria and criteria_text cannot both be given"))
+	}
+
+	query, err := h.parseCriteria(ctx, tenantID, *text)
+	if err != nil {
+		var langErr *querylang.Error
+		if errors.As(err, &langErr) {
+			return errutil.ValidationError(fmt.Errorf("criteria_text: %v", err))
+		}
+		return err
+	}
+	*criteria = query
+
 	return nil
 }
 
@@ -158,6 +267,16 @@ type CreateSegmentRequest struct {
 	Name        *string       `json:"name,omitempty"`
 	SegmentDesc *string       `json:"segment_desc,omitempty"`
 	Criteria    *entity.Query `json:"criteria,omitempty"`
+	SegmentType *uint32       `json:"segment_type,omitempty"`
+	// CriteriaText is the criteria in the text query language, given instead of Criteria.
+	CriteriaText *string `json:"criteria_text,omitempty"`
+}
+
+func (req *CreateSegmentRequest) GetSegmentType() entity.SegmentType {
+	if req != nil && req.SegmentType != nil {
+		return entity.SegmentType(*req.SegmentType)
+	}
+	return entity.SegmentTypeDynamic
 }
 
 func (req *CreateSegmentRequest) ToSegment() *entity.Segment {
@@ -169,7 +288,9 @@ func (req *CreateSegmentRequest) ToSegment() *entity.Segment {
 		Name:        req.Name,
 		SegmentDesc: req.SegmentDesc,
 		Criteria:    req.Criteria,
+		SegmentType: req.GetSegmentType(),
 		Status:      entity.SegmentStatusNormal,
+		Version:     goutil.Uint32(1),
 		CreatorID:   goutil.Uint64(req.GetUserID()),
 		TenantID:    goutil.Uint64(req.GetTenantID()),
 		CreateTime:  goutil.Uint64(uint64(now.Unix())),
@@ -185,6 +306,10 @@ var CreateSegmentValidator = validator.MustForm(map[string]validator.Validator{
 	"ContextInfo":  ContextInfoValidator(false, false),
 	"name":         ResourceNameValidator(false),
 	"segment_desc": ResourceDescValidator(false),
+	"segment_type": &validator.UInt32{
+		Optional:   true,
+		Validators: []validator.UInt32Func{entity.CheckSegmentType},
+	},
 })
 
 func (h *segmentHandler) CreateSegment(ctx context.Context, req *CreateSegmentRequest, res *CreateSegmentResponse) error {
@@ -192,11 +317,129 @@ func (h *segmentHandler) CreateSegment(ctx context.Context, req *CreateSegmentRe
 		return errutil.ValidationError(err)
 	}
 
-	v := NewQueryValidator(req.GetTenantID(), h.tagRepo, false)
-	if err := v.Validate(ctx, req.Criteria); err != nil {
+	if err := h.resolveCriteriaText(ctx, req.GetTenantID(), &req.Criteria, req.CriteriaText); err != nil {
+		return err
+	}
+
+	// the uds of a static segment come from a file upload or a snapshot
+	if req.GetSegmentType() == entity.SegmentTypeStatic {
+		if req.Criteria != nil {
+			return errutil.ValidationError(errors.New("static segment takes no criteria"))
+		}
+	} else {
+		v := NewQueryValidator(req.GetTenantID(), h.tagRepo, h.segmentRepo, false)
+		if err := v.Validate(ctx, req.Criteria); err != nil {
+			return errutil.ValidationError(err)
+		}
+	}
+
+	segment := req.ToSegment()
+
+	_, err := h.segmentRepo.GetByName(ctx, req.GetTenantID(), segment.GetName())
+	if err == nil {
+		return errutil.ConflictError(errors.New("segment already exists"))
+	}
+
+	if !errors.Is(err, repo.ErrSegmentNotFound) {
+		log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+		return err
+	}
+
+	if err := h.txService.RunTx(ctx, func(ctx context.Context) error {
+		if err := lockSegments(ctx, h.segmentRepo, req.GetTenantID(), req.Criteria.GetSegmentIDs()); err != nil {
+			return err
+		}
+
+		id, err := h.segmentRepo.Create(ctx, segment)
+		if err != nil {
+			return err
+		}
+		segment.ID = goutil.Uint64(id)
+
+		return nil
+	}); err != nil {
+		log.Ctx(ctx).Error().Msgf("create segment failed: %v", err)
+		return err
+	}
+
+	res.Segment = segment
+
+	return nil
+}
+
+type SnapshotSegmentRequest struct {
+	ContextInfo
+
+	SegmentID   *uint64 `json:"segment_id,omitempty"`
+	Name        *string `json:"name,omitempty"`
+	SegmentDesc *string `json:"segment_desc,omitempty"`
+}
+
+func (req *SnapshotSegmentRequest) GetSegmentID() uint64 {
+	if req != nil && req.SegmentID != nil {
+		return *req.SegmentID
+	}
+	return 0
+}
+
+func (req *SnapshotSegmentRequest) ToSegment() *entity.Segment {
+	now := time.Now()
+	return &entity.Segment{
+		Name:        req.Name,
+		SegmentDesc: req.SegmentDesc,
+		Criteria:    new(entity.Query),
+		SegmentType: entity.SegmentTypeStatic,
+		Status:      entity.SegmentStatusNormal,
+		Version:     goutil.Uint32(1),
+		CreatorID:   goutil.Uint64(req.GetUserID()),
+		TenantID:    goutil.Uint64(req.GetTenantID()),
+		CreateTime:  goutil.Uint64(uint64(now.Unix())),
+		UpdateTime:  goutil.Uint64(uint64(now.Unix())),
+	}
+}
+
+func (req *SnapshotSegmentRequest) ToTask(segmentID uint64) *entity.Task {
+	now := time.Now()
+	return &entity.Task{
+		ResourceID:   goutil.Uint64(segmentID),
+		TenantID:     goutil.Uint64(req.GetTenantID()),
+		ResourceType: entity.ResourceTypeSegment,
+		Status:       entity.TaskStatusPending,
+		TaskType:     entity.TaskTypeSegmentSnapshot,
+		ExtInfo: &entity.TaskExtInfo{
+			Progress:        goutil.Uint64(0),
+			SourceSegmentID: req.SegmentID,
+		},
+		CreatorID:  goutil.Uint64(req.GetUserID()),
+		CreateTime: goutil.Uint64(uint64(now.Unix())),
+		UpdateTime: goutil.Uint64(uint64(now.Unix())),
+	}
+}
+
+type SnapshotSegmentResponse struct {
+	Segment *entity.Segment `json:"segment,omitempty"`
+	Task    *entity.Task    `json:"task,omitempty"`
+}
+
+var SnapshotSegmentValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo":  ContextInfoValidator(false, false),
+	"segment_id":   &validator.UInt64{},
+	"name":         ResourceNameValidator(false),
+	"segment_desc": ResourceDescValidator(false),
+})
+
+// SnapshotSegment creates a static segment with the uds of another segment, the uds are
+// frozen into it by the run-segment-snapshot-tasks job.
+func (h *segmentHandler) SnapshotSegment(ctx context.Context, req *SnapshotSegmentRequest, res *SnapshotSegmentResponse) error {
+	if err := SnapshotSegmentValidator.Validate(req); err != nil {
 		return errutil.ValidationError(err)
 	}
 
+	if _, err := h.segmentRepo.GetByID(ctx, req.GetTenantID(), req.GetSegmentID()); err != nil {
+		log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+		return err
+	}
+
 	segment := req.ToSegment()
 
 	_, err := h.segmentRepo.GetByName(ctx, req.GetTenantID(), segment.GetName())
@@ -214,13 +457,660 @@ func (h *segmentHandler) CreateSegment(ctx context.Context, req *CreateSegmentRe
 		log.Ctx(ctx).Error().Msgf("create segment failed: %v", err)
 		return err
 	}
-
 	segment.ID = goutil.Uint64(id)
+
+	// the segment is left empty if the task is not created, its uds can still be uploaded
+	task := req.ToTask(id)
+	taskID, err := h.taskRepo.Create(ctx, task)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("create segment snapshot task failed: %v", err)
+		return err
+	}
+	task.ID = goutil.Uint64(taskID)
+
+	res.Segment = segment
+	res.Task = task
+
+	return nil
+}
+
+const (
+	// maxSegmentSplits limits the splits of a segment created at once.
+	maxSegmentSplits = 10
+	// maxSplitWeight keeps the weights small enough that no split rounds down to an empty share.
+	maxSplitWeight = 100
+)
+
+type SegmentSplit struct {
+	Name        *string `json:"name,omitempty"`
+	SegmentDesc *string `json:"segment_desc,omitempty"`
+	// Weight is the share of the uds in the split, relative to the weights of the other splits.
+	Weight *uint32 `json:"weight,omitempty"`
+}
+
+func (e *SegmentSplit) GetName() string {
+	if e != nil && e.Name != nil {
+		return *e.Name
+	}
+	return ""
+}
+
+func (e *SegmentSplit) GetWeight() uint32 {
+	if e != nil && e.Weight != nil {
+		return *e.Weight
+	}
+	return 0
+}
+
+type SplitSegmentRequest struct {
+	ContextInfo
+
+	SegmentID *uint64 `json:"segment_id,omitempty"`
+	// Seed decides which split each ud lands in, a random seed is picked if unset.
+	// Reuse a seed to split another segment the same way.
+	Seed   *uint32         `json:"seed,omitempty"`
+	Splits []*SegmentSplit `json:"splits,omitempty"`
+}
+
+func (req *SplitSegmentRequest) GetSegmentID() uint64 {
+	if req != nil && req.SegmentID != nil {
+		return *req.SegmentID
+	}
+	return 0
+}
+
+// ToSegments builds a segment for each split, matching the uds of the segment whose split point
+// falls in the share of the split.
+func (req *SplitSegmentRequest) ToSegments(seed uint32) []*entity.Segment {
+	var total uint64
+	for _, split := range req.Splits {
+		total += uint64(split.GetWeight())
+	}
+
+	var (
+		now      = time.Now()
+		segments = make([]*entity.Segment, 0, len(req.Splits))
+		weight   uint64
+	)
+	for _, split := range req.Splits {
+		from := uint32(weight * entity.SplitScale / total)
+		weight += uint64(split.GetWeight())
+		to := uint32(weight * entity.SplitScale / total)
+
+		segments = append(segments, &entity.Segment{
+			Name:        split.Name,
+			SegmentDesc: split.SegmentDesc,
+			Criteria: &entity.Query{
+				Op: entity.QueryOpAnd,
+				Lookups: []*entity.Lookup{
+					{SegmentID: req.SegmentID},
+					{Split: &entity.Split{
+						Seed: goutil.Uint32(seed),
+						From: goutil.Uint32(from),
+						To:   goutil.Uint32(to),
+					}},
+				},
+			},
+			SegmentType: entity.SegmentTypeDynamic,
+			Status:      entity.SegmentStatusNormal,
+			Version:     goutil.Uint32(1),
+			CreatorID:   goutil.Uint64(req.GetUserID()),
+			TenantID:    goutil.Uint64(req.GetTenantID()),
+			CreateTime:  goutil.Uint64(uint64(now.Unix())),
+			UpdateTime:  goutil.Uint64(uint64(now.Unix())),
+		})
+	}
+
+	return segments
+}
+
+type SplitSegmentResponse struct {
+	Segments []*entity.Segment `json:"segments"`
+}
+
+var SplitSegmentValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+	"segment_id":  &validator.UInt64{},
+	"seed": &validator.UInt32{
+		Optional: true,
+	},
+	"splits": &validator.Slice{
+		MinLen: 2,
+		MaxLen: maxSegmentSplits,
+		Validator: validator.MustForm(map[string]validator.Validator{
+			"name":         ResourceNameValidator(false),
+			"segment_desc": ResourceDescValidator(false),
+			"weight": &validator.UInt32{
+				Min: goutil.Uint32(1),
+				Max: goutil.Uint32(maxSplitWeight),
+			},
+		}),
+	},
+})
+
+// SplitSegment creates a segment for each split of a segment, e.g. a treatment and a holdout group.
+// The splits reference the segment, so they follow its changes, while each ud stays in the same split.
+func (h *segmentHandler) SplitSegment(ctx context.Context, req *SplitSegmentRequest, res *SplitSegmentResponse) error {
+	if err := SplitSegmentValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	if _, err := h.segmentRepo.GetByID(ctx, req.GetTenantID(), req.GetSegmentID()); err != nil {
+		log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+		return err
+	}
+
+	names := make(map[string]bool, len(req.Splits))
+	for _, split := range req.Splits {
+		if names[split.GetName()] {
+			return errutil.ValidationError(fmt.Errorf("duplicate split name: %s", split.GetName()))
+		}
+		names[split.GetName()] = true
+	}
+
+	seed := rand.Uint32()
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+
+	segments := req.ToSegments(seed)
+
+	v := NewQueryValidator(req.GetTenantID(), h.tagRepo, h.segmentRepo, false)
+	for _, segment := range segments {
+		// a split of a deeply nested segment may exceed the max depth of references
+		if err := v.Validate(ctx, segment.GetCriteria()); err != nil {
+			return errutil.ValidationError(err)
+		}
+
+		_, err := h.segmentRepo.GetByName(ctx, req.GetTenantID(), segment.GetName())
+		if err == nil {
+			return errutil.ConflictError(fmt.Errorf("segment %s already exists", segment.GetName()))
+		}
+
+		if !errors.Is(err, repo.ErrSegmentNotFound) {
+			log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+			return err
+		}
+	}
+
+	if err := h.txService.RunTx(ctx, func(ctx context.Context) error {
+		for _, segment := range segments {
+			if err := lockSegments(ctx, h.segmentRepo, req.GetTenantID(), segment.GetCriteria().GetSegmentIDs()); err != nil {
+				return err
+			}
+
+			id, err := h.segmentRepo.Create(ctx, segment)
+			if err != nil {
+				return err
+			}
+			segment.ID = goutil.Uint64(id)
+		}
+		return nil
+	}); err != nil {
+		log.Ctx(ctx).Error().Msgf("create segment splits failed: %v", err)
+		return err
+	}
+
+	res.Segments = segments
+
+	return nil
+}
+
+type UpdateSegmentRequest struct {
+	ContextInfo
+
+	SegmentID   *uint64       `json:"segment_id,omitempty"`
+	Name        *string       `json:"name,omitempty"`
+	SegmentDesc *string       `json:"segment_desc,omitempty"`
+	Criteria    *entity.Query `json:"criteria,omitempty"`
+	// CriteriaText is the criteria in the text query language, given instead of Criteria.
+	CriteriaText *string `json:"criteria_text,omitempty"`
+}
+
+func (r *UpdateSegmentRequest) GetSegmentID() uint64 {
+	if r != nil && r.SegmentID != nil {
+		return *r.SegmentID
+	}
+	return 0
+}
+
+func (r *UpdateSegmentRequest) ToSegment() *entity.Segment {
+	return &entity.Segment{
+		Name:        r.Name,
+		SegmentDesc: r.SegmentDesc,
+		Criteria:    r.Criteria,
+	}
+}
+
+type UpdateSegmentResponse struct {
+	Segment *entity.Segment `json:"segment,omitempty"`
+}
+
+var UpdateSegmentValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo":  ContextInfoValidator(false, false),
+	"segment_id":   &validator.UInt64{},
+	"name":         ResourceNameValidator(true),
+	"segment_desc": ResourceDescValidator(true),
+})
+
+func (h *segmentHandler) UpdateSegment(ctx context.Context, req *UpdateSegmentRequest, res *UpdateSegmentResponse) error {
+	if err := UpdateSegmentValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	if err := h.resolveCriteriaText(ctx, req.GetTenantID(), &req.Criteria, req.CriteriaText); err != nil {
+		return err
+	}
+
+	segment, err := h.segmentRepo.GetByID(ctx, req.GetTenantID(), req.GetSegmentID())
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+		return err
+	}
+
+	if req.Criteria != nil {
+		if segment.IsStatic() {
+			return errutil.ValidationError(errors.New("criteria of a static segment cannot be updated"))
+		}
+
+		v := NewQueryValidator(req.GetTenantID(), h.tagRepo, h.segmentRepo, false)
+		if err := v.ValidateSegment(ctx, segment.GetID(), req.Criteria); err != nil {
+			return errutil.ValidationError(err)
+		}
+	}
+
+	newSegment := req.ToSegment()
+
+	if newSegment.Name != nil && newSegment.GetName() != segment.GetName() {
+		_, err := h.segmentRepo.GetByName(ctx, req.GetTenantID(), newSegment.GetName())
+		if err == nil {
+			return errutil.ConflictError(errors.New("segment already exists"))
+		}
+
+		if !errors.Is(err, repo.ErrSegmentNotFound) {
+			log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+			return err
+		}
+	}
+
+	if err := h.updateSegment(ctx, req.GetTenantID(), req.GetUserID(), segment, newSegment, nil); err != nil {
+		return err
+	}
+
+	res.Segment = segment
+
+	return nil
+}
+
+// updateSegment applies newSegment to segment, a new version is recorded if the criteria changes.
+func (h *segmentHandler) updateSegment(ctx context.Context, tenantID, userID uint64, segment, newSegment *entity.Segment,
+	restoredFrom *uint32) error {
+	versions := make([]*entity.SegmentVersion, 0)
+
+	if newSegment.Criteria != nil && !newSegment.Criteria.IsEqual(segment.GetCriteria()) {
+		// segments created before versioning have no version recorded, keep their criteria as the first version
+		_, err := h.segmentRepo.GetVersion(ctx, tenantID, segment.GetID(), segment.GetVersion())
+		if err != nil && !errors.Is(err, repo.ErrSegmentVersionNotFound) {
+			log.Ctx(ctx).Error().Msgf("get segment version failed: %v", err)
+			return err
+		}
+
+		if errors.Is(err, repo.ErrSegmentVersionNotFound) {
+			versions = append(versions, &entity.SegmentVersion{
+				Version:    goutil.Uint32(segment.GetVersion()),
+				Criteria:   segment.GetCriteria(),
+				CreatorID:  segment.CreatorID,
+				TenantID:   segment.TenantID,
+				CreateTime: segment.UpdateTime,
+			})
+		}
+
+		newSegment.Version = goutil.Uint32(segment.GetVersion() + 1)
+		versions = append(versions, &entity.SegmentVersion{
+			Version:      newSegment.Version,
+			Criteria:     newSegment.Criteria,
+			RestoredFrom: restoredFrom,
+			CreatorID:    goutil.Uint64(userID),
+			TenantID:     goutil.Uint64(tenantID),
+			CreateTime:   goutil.Uint64(uint64(time.Now().Unix())),
+		})
+	}
+
+	if !segment.Update(newSegment) {
+		return nil
+	}
+
+	if err := h.txService.RunTx(ctx, func(ctx context.Context) error {
+		if err := lockSegments(ctx, h.segmentRepo, tenantID, newSegment.Criteria.GetSegmentIDs()); err != nil {
+			return err
+		}
+		return h.segmentRepo.Update(ctx, segment, versions...)
+	}); err != nil {
+		log.Ctx(ctx).Error().Msgf("update segment failed: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+type DeleteSegmentRequest struct {
+	ContextInfo
+
+	SegmentID *uint64 `json:"segment_id,omitempty"`
+}
+
+func (r *DeleteSegmentRequest) GetSegmentID() uint64 {
+	if r != nil && r.SegmentID != nil {
+		return *r.SegmentID
+	}
+	return 0
+}
+
+type DeleteSegmentResponse struct {
+	// Pending Campaigns, derived Tags and Segments that still use the segment, deletion is refused if any is non-empty.
+	Campaigns []*entity.Campaign `json:"campaigns,omitempty"`
+	Tags      []*entity.Tag      `json:"tags,omitempty"`
+	Segments  []*entity.Segment  `json:"segments,omitempty"`
+}
+
+var DeleteSegmentValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+	"segment_id":  &validator.UInt64{},
+})
+
+func (h *segmentHandler) DeleteSegment(ctx context.Context, req *DeleteSegmentRequest, res *DeleteSegmentResponse) error {
+	if err := DeleteSegmentValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	// the segment row is locked before the checks, and campaigns, tags and segments lock the rows of the segments
+	// they reference when created, so that no one starts using the segment until it is deleted, see lockSegments.
+	// The lock must be the first read of the transaction, the checks then see the references committed while waiting.
+	return h.txService.RunTx(ctx, func(ctx context.Context) error {
+		segment, err := h.segmentRepo.LockByID(ctx, req.GetTenantID(), req.GetSegmentID())
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+			return err
+		}
+
+		campaigns, err := h.campaignRepo.GetPendingBySegmentID(ctx, req.GetTenantID(), segment.GetID())
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("get pending campaigns failed: %v", err)
+			return err
+		}
+
+		derivedTags, err := h.tagRepo.GetDerivedTags(ctx, req.GetTenantID())
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("get derived tags failed: %v", err)
+			return err
+		}
+
+		tagBlockers := make([]*entity.Tag, 0)
+		for _, derivedTag := range derivedTags {
+			if derivedTag.GetExtInfo().GetDerivation().GetSegmentID() == segment.GetID() {
+				tagBlockers = append(tagBlockers, derivedTag)
+			}
+		}
+
+		segments, err := h.segmentRepo.GetManyByTenantID(ctx, req.GetTenantID())
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("get segments failed: %v", err)
+			return err
+		}
+
+		segmentBlockers := make([]*entity.Segment, 0)
+		for _, s := range segments {
+			// a static segment references itself, see entity.Segment.GetCriteria
+			if s.GetID() != segment.GetID() && s.GetCriteria().HasSegmentID(segment.GetID()) {
+				segmentBlockers = append(segmentBlockers, s)
+			}
+		}
+
+		if len(campaigns) > 0 || len(tagBlockers) > 0 || len(segmentBlockers) > 0 {
+			res.Campaigns = campaigns
+			res.Tags = tagBlockers
+			res.Segments = segmentBlockers
+			return errutil.ConflictError(fmt.Errorf("segment is used by %d pending campaign(s), %d derived tag(s) and %d segment(s)",
+				len(campaigns), len(tagBlockers), len(segmentBlockers)))
+		}
+
+		segment.Update(&entity.Segment{
+			Name:   goutil.String(entity.DeletedName(segment.GetName(), segment.GetID())),
+			Status: entity.SegmentStatusDeleted,
+		})
+
+		if err := h.segmentRepo.Update(ctx, segment); err != nil {
+			log.Ctx(ctx).Error().Msgf("delete segment failed: %v", err)
+			return err
+		}
+
+		return nil
+	})
+}
+
+// lockSegments locks the rows of the segments referenced until the transaction ends, so that they are not deleted
+// meanwhile, see DeleteSegment. It fails with repo.ErrSegmentNotFound if any of them is deleted already.
+func lockSegments(ctx context.Context, segmentRepo repo.SegmentRepo, tenantID uint64, segmentIDs []uint64) error {
+	// the rows are locked in the order of their IDs, so that two transactions do not wait on each other
+	ids := append([]uint64(nil), segmentIDs...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for i, id := range ids {
+		if i > 0 && id == ids[i-1] {
+			continue
+		}
+		if _, err := segmentRepo.LockByID(ctx, tenantID, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type GetSegmentVersionsRequest struct {
+	ContextInfo
+
+	SegmentID  *uint64          `json:"segment_id,omitempty"`
+	Pagination *repo.Pagination `json:"pagination,omitempty"`
+}
+
+func (r *GetSegmentVersionsRequest) GetSegmentID() uint64 {
+	if r != nil && r.SegmentID != nil {
+		return *r.SegmentID
+	}
+	return 0
+}
+
+type GetSegmentVersionsResponse struct {
+	Versions   []*entity.SegmentVersion `json:"versions"`
+	Pagination *repo.Pagination         `json:"pagination,omitempty"`
+}
+
+var GetSegmentVersionsValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, true),
+	"segment_id":  &validator.UInt64{},
+	"pagination":  PaginationValidator(),
+})
+
+// GetSegmentVersions gets the versions of the segment criteria, latest first.
+func (h *segmentHandler) GetSegmentVersions(ctx context.Context, req *GetSegmentVersionsRequest, res *GetSegmentVersionsResponse) error {
+	if err := GetSegmentVersionsValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	if _, err := h.segmentRepo.GetByID(ctx, req.GetTenantID(), req.GetSegmentID()); err != nil {
+		log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+		return err
+	}
+
+	if req.Pagination == nil {
+		req.Pagination = new(repo.Pagination)
+	}
+
+	versions, pagination, err := h.segmentRepo.GetVersions(ctx, req.GetTenantID(), req.GetSegmentID(), req.Pagination)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get segment versions failed: %v", err)
+		return err
+	}
+
+	res.Versions = versions
+	res.Pagination = pagination
+
+	return nil
+}
+
+type RestoreSegmentRequest struct {
+	ContextInfo
+
+	SegmentID *uint64 `json:"segment_id,omitempty"`
+	Version   *uint32 `json:"version,omitempty"`
+}
+
+func (r *RestoreSegmentRequest) GetSegmentID() uint64 {
+	if r != nil && r.SegmentID != nil {
+		return *r.SegmentID
+	}
+	return 0
+}
+
+func (r *RestoreSegmentRequest) GetVersion() uint32 {
+	if r != nil && r.Version != nil {
+		return *r.Version
+	}
+	return 0
+}
+
+type RestoreSegmentResponse struct {
+	Segment *entity.Segment `json:"segment,omitempty"`
+}
+
+var RestoreSegmentValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+	"segment_id":  &validator.UInt64{},
+	"version":     &validator.UInt32{},
+})
+
+// RestoreSegment sets the criteria back to an older version, recorded as a new version.
+func (h *segmentHandler) RestoreSegment(ctx context.Context, req *RestoreSegmentRequest, res *RestoreSegmentResponse) error {
+	if err := RestoreSegmentValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	segment, err := h.segmentRepo.GetByID(ctx, req.GetTenantID(), req.GetSegmentID())
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+		return err
+	}
+
+	if segment.IsStatic() {
+		return errutil.ValidationError(errors.New("static segment has no criteria to restore"))
+	}
+
+	version, err := h.segmentRepo.GetVersion(ctx, req.GetTenantID(), segment.GetID(), req.GetVersion())
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get segment version failed: %v", err)
+		return err
+	}
+
+	// tags and segments referenced by the old criteria may have been changed or deleted since
+	v := NewQueryValidator(req.GetTenantID(), h.tagRepo, h.segmentRepo, false)
+	if err := v.ValidateSegment(ctx, segment.GetID(), version.GetCriteria()); err != nil {
+		return errutil.ValidationError(fmt.Errorf("version %d is no longer valid: %v", version.GetVersion(), err))
+	}
+
+	if err := h.updateSegment(ctx, req.GetTenantID(), req.GetUserID(), segment, &entity.Segment{
+		Criteria: version.GetCriteria(),
+	}, version.Version); err != nil {
+		return err
+	}
+
 	res.Segment = segment
 
 	return nil
 }
 
+const (
+	defaultSegmentSizeHistoryDays = 30
+	maxSegmentSizeHistoryDays     = 365
+)
+
+type GetSegmentSizeHistoryRequest struct {
+	ContextInfo
+
+	SegmentID *uint64 `json:"segment_id,omitempty"`
+	Days      *uint32 `json:"days,omitempty"` // number of days up to today
+}
+
+func (r *GetSegmentSizeHistoryRequest) GetSegmentID() uint64 {
+	if r != nil && r.SegmentID != nil {
+		return *r.SegmentID
+	}
+	return 0
+}
+
+func (r *GetSegmentSizeHistoryRequest) GetDays() uint32 {
+	if r != nil && r.Days != nil {
+		return *r.Days
+	}
+	return defaultSegmentSizeHistoryDays
+}
+
+type GetSegmentSizeHistoryResponse struct {
+	Points []*entity.SegmentSizePoint `json:"points"`
+}
+
+var GetSegmentSizeHistoryValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, true),
+	"segment_id":  &validator.UInt64{},
+	"days": &validator.UInt32{
+		Optional: true,
+		Min:      goutil.Uint32(1),
+		Max:      goutil.Uint32(maxSegmentSizeHistoryDays),
+	},
+})
+
+// GetSegmentSizeHistory gets the daily sizes recorded by the record-segment-sizes job, oldest first.
+func (h *segmentHandler) GetSegmentSizeHistory(ctx context.Context, req *GetSegmentSizeHistoryRequest, res *GetSegmentSizeHistoryResponse) error {
+	if err := GetSegmentSizeHistoryValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	if _, err := h.segmentRepo.GetByID(ctx, req.GetTenantID(), req.GetSegmentID()); err != nil {
+		log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+		return err
+	}
+
+	var (
+		today   = uint64(time.Now().UTC().Truncate(24 * time.Hour).Unix())
+		daySecs = uint64((24 * time.Hour).Seconds())
+		fromDay = today - uint64(req.GetDays()-1)*daySecs
+	)
+
+	segmentSizes, err := h.segmentSizeRepo.GetManyBySegmentID(ctx, req.GetTenantID(), req.GetSegmentID(), fromDay, today)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get segment sizes failed: %v", err)
+		return err
+	}
+
+	points := make([]*entity.SegmentSizePoint, 0, len(segmentSizes))
+	for i, segmentSize := range segmentSizes {
+		point := &entity.SegmentSizePoint{
+			Day:  segmentSize.Day,
+			Size: segmentSize.Size,
+		}
+
+		if i > 0 && segmentSizes[i-1].GetDay()+daySecs == segmentSize.GetDay() {
+			point.Delta = goutil.Int64(int64(segmentSize.GetSize()) - int64(segmentSizes[i-1].GetSize()))
+		}
+
+		points = append(points, point)
+	}
+
+	res.Points = points
+
+	return nil
+}
+
 type DownloadUdsRequest struct {
 	ContextInfo
 
@@ -273,12 +1163,20 @@ func (h *segmentHandler) DownloadUds(ctx context.Context, req *DownloadUdsReques
 		}
 	}
 
-	uds, newPage, err := h.queryRepo.Download(ctx, req.GetTenantName(), segment.GetCriteria(), req.Pagination)
+	uds, newPage, err := h.queryRepo.DownloadProfiles(ctx, req.GetTenant(), segment.GetCriteria(), req.Pagination)
 	if err != nil {
 		log.Ctx(ctx).Error().Msgf("download uds failed: %v", err)
 		return err
 	}
 
+	if !req.CanViewPII() {
+		for i, ud := range uds {
+			if ud.IsPII() {
+				uds[i] = ud.Mask()
+			}
+		}
+	}
+
 	res.Uds = uds
 	res.Pagination = newPage
 
@@ -320,7 +1218,7 @@ func (h *segmentHandler) CountUd(ctx context.Context, req *CountUdRequest, res *
 		return err
 	}
 
-	count, err := h.queryRepo.Count(ctx, req.GetTenantName(), segment.GetCriteria())
+	count, err := h.queryRepo.CountProfiles(ctx, req.GetTenant(), segment.GetCriteria())
 	if err != nil {
 		log.Ctx(ctx).Error().Msgf("get segment count failed: %v", err)
 		return err
@@ -331,18 +1229,114 @@ func (h *segmentHandler) CountUd(ctx context.Context, req *CountUdRequest, res *
 	return nil
 }
 
+type GetSegmentOverlapsRequest struct {
+	ContextInfo
+
+	SegmentIDs []uint64 `json:"segment_ids,omitempty"`
+}
+
+type GetSegmentOverlapsResponse struct {
+	Overlaps []*entity.SegmentOverlap `json:"overlaps"`
+}
+
+var GetSegmentOverlapsValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, true),
+	"segment_ids": &validator.Slice{
+		MinLen: 2,
+		MaxLen: repo.MaxOverlapSegments,
+	},
+})
+
+// GetSegmentOverlaps counts the profiles in every intersection of the segments,
+// and in every region exclusive to a combination of them.
+func (h *segmentHandler) GetSegmentOverlaps(ctx context.Context, req *GetSegmentOverlapsRequest, res *GetSegmentOverlapsResponse) error {
+	if err := GetSegmentOverlapsValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	seen := make(map[uint64]bool, len(req.SegmentIDs))
+	for _, segmentID := range req.SegmentIDs {
+		if seen[segmentID] {
+			return errutil.ValidationError(fmt.Errorf("duplicate segment id: %d", segmentID))
+		}
+		seen[segmentID] = true
+	}
+
+	segments, err := h.segmentRepo.GetManyByIDs(ctx, req.GetTenantID(), req.SegmentIDs)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get segments failed: %v", err)
+		return err
+	}
+
+	// keep the order of the request, so that the combinations are listed in the same order
+	segmentsByID := make(map[uint64]*entity.Segment, len(segments))
+	for _, segment := range segments {
+		segmentsByID[segment.GetID()] = segment
+	}
+
+	ordered := make([]*entity.Segment, 0, len(req.SegmentIDs))
+	for _, segmentID := range req.SegmentIDs {
+		segment, ok := segmentsByID[segmentID]
+		if !ok {
+			return repo.ErrSegmentNotFound
+		}
+		ordered = append(ordered, segment)
+	}
+
+	overlaps, err := h.queryRepo.GetSegmentOverlaps(ctx, req.GetTenant(), ordered)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get segment overlaps failed: %v", err)
+		return err
+	}
+
+	res.Overlaps = overlaps
+
+	return nil
+}
+
+const (
+	defaultPreviewSampleSize = 10
+	maxPreviewSampleSize     = 50
+)
+
 type PreviewUdRequest struct {
 	ContextInfo
 
-	Criteria *entity.Query `json:"criteria,omitempty"`
+	Criteria   *entity.Query `json:"criteria,omitempty"`
+	SampleSize *uint32       `json:"sample_size,omitempty"`
+	// CriteriaText is the criteria in the text query language, given instead of Criteria.
+	CriteriaText *string `json:"criteria_text,omitempty"`
+}
+
+func (req *PreviewUdRequest) GetCriteriaText() string {
+	if req != nil && req.CriteriaText != nil {
+		return *req.CriteriaText
+	}
+	return ""
+}
+
+func (req *PreviewUdRequest) GetSampleSize() uint32 {
+	if req != nil && req.SampleSize != nil {
+		return *req.SampleSize
+	}
+	return defaultPreviewSampleSize
 }
 
 type PreviewUdResponse struct {
+	// Count is -1 if the criteria is invalid, see Errors for why.
 	Count *int64 `json:"count,omitempty"`
+	// Sample is a random sample of the matching uds, with the values of the tags looked up by the criteria.
+	Sample  []*entity.UdProfile     `json:"sample"`
+	Lookups []*entity.LookupPreview `json:"lookups"`
+	Errors  []string                `json:"errors"`
 }
 
 var PreviewUdValidator = validator.MustForm(map[string]validator.Validator{
 	"ContextInfo": ContextInfoValidator(false, true),
+	"sample_size": &validator.UInt32{
+		Optional: true,
+		Max:      goutil.Uint32(maxPreviewSampleSize),
+	},
 })
 
 func (h *segmentHandler) PreviewUd(ctx context.Context, req *PreviewUdRequest, res *PreviewUdResponse) error {
@@ -350,13 +1344,75 @@ func (h *segmentHandler) PreviewUd(ctx context.Context, req *PreviewUdRequest, r
 		return errutil.ValidationError(err)
 	}
 
-	v := NewQueryValidator(req.GetTenantID(), h.tagRepo, false)
-	if err := v.Validate(ctx, req.Criteria); err != nil {
+	res.Sample = make([]*entity.UdProfile, 0)
+
+	if req.CriteriaText != nil {
+		if req.Criteria != nil {
+			return errutil.ValidationError(errors.New("criteria and criteria_text cannot both be given"))
+		}
+
+		query, err := h.parseCriteria(ctx, req.GetTenantID(), req.GetCriteriaText())
+		if err != nil {
+			// a text which does not parse is reported like an invalid criteria
+			var langErr *querylang.Error
+			if errors.As(err, &langErr) {
+				res.Count = goutil.Int64(-1)
+				res.Lookups = make([]*entity.LookupPreview, 0)
+				res.Errors = []string{fmt.Sprintf("criteria_text: %v", err)}
+				return nil
+			}
+			return err
+		}
+		req.Criteria = query
+	}
+
+	v := NewQueryValidator(req.GetTenantID(), h.tagRepo, h.segmentRepo, false)
+	results, errs := v.ValidateEach(ctx, req.Criteria)
+
+	// the valid lookups are counted even if others are not, to help fixing the criteria,
+	// each within the ID type of its enclosing queries
+	lookupQueries := make([]*entity.Query, 0, len(results))
+	for _, result := range results {
+		if result.Err == nil {
+			lookupQueries = append(lookupQueries, &entity.Query{
+				Lookups: []*entity.Lookup{result.Lookup},
+				IDType:  result.IDType,
+			})
+		}
+	}
+
+	counts, err := h.queryRepo.CountQueries(ctx, req.GetTenant(), lookupQueries)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("preview lookup counts failed: %v", err)
+		return err
+	}
+
+	res.Lookups = make([]*entity.LookupPreview, 0, len(results))
+	for _, result := range results {
+		lookupPreview := &entity.LookupPreview{
+			Path:   goutil.String(result.Path),
+			Lookup: result.Lookup,
+		}
+		if result.Err != nil {
+			lookupPreview.Error = goutil.String(result.Err.Error())
+		} else {
+			lookupPreview.Count = goutil.Uint64(counts[0])
+			counts = counts[1:]
+		}
+		res.Lookups = append(res.Lookups, lookupPreview)
+	}
+
+	res.Errors = make([]string, 0, len(errs))
+	for _, err := range errs {
+		res.Errors = append(res.Errors, err.Error())
+	}
+
+	if len(errs) > 0 {
 		res.Count = goutil.Int64(-1)
 		return nil
 	}
 
-	count, err := h.queryRepo.Count(ctx, req.GetTenantName(), req.Criteria)
+	count, err := h.queryRepo.CountProfiles(ctx, req.GetTenant(), req.Criteria)
 	if err != nil {
 		log.Ctx(ctx).Error().Msgf("preview segment count failed: %v", err)
 		return err
@@ -364,5 +1420,32 @@ func (h *segmentHandler) PreviewUd(ctx context.Context, req *PreviewUdRequest, r
 
 	res.Count = goutil.Int64(int64(count))
 
+	if count == 0 || req.GetSampleSize() == 0 {
+		return nil
+	}
+
+	udTagVals, err := h.queryRepo.SampleTagVals(ctx, req.GetTenant(), req.Criteria, req.Criteria.GetTagIDs(), req.GetSampleSize())
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("sample segment uds failed: %v", err)
+		return err
+	}
+
+	profileTagVals, err := getProfileTagVals(ctx, h.tagRepo, req.GetTenantID(), udTagVals, req.CanViewPII())
+	if err != nil {
+		return err
+	}
+
+	for i, udTagVal := range udTagVals {
+		ud := udTagVal.GetUd()
+		if !req.CanViewPII() && ud.IsPII() {
+			ud = ud.Mask()
+		}
+
+		res.Sample = append(res.Sample, &entity.UdProfile{
+			Ud:      ud,
+			TagVals: profileTagVals[i],
+		})
+	}
+
 	return nil
 }
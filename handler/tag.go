@@ -8,6 +8,7 @@ import (
 	"cdp/repo"
 	"context"
 	"errors"
+	"fmt"
 	"github.com/rs/zerolog/log"
 	"time"
 )
@@ -18,20 +19,392 @@ type TagHandler interface {
 	GetTag(ctx context.Context, req *GetTagRequest, res *GetTagResponse) error
 	CountTags(ctx context.Context, req *CountTagsRequest, res *CountTagsResponse) error
 	GetDistinctTagValues(ctx context.Context, req *GetDistinctTagValuesRequest, res *GetDistinctTagValuesResponse) error
+	UpdateTag(ctx context.Context, req *UpdateTagRequest, res *UpdateTagResponse) error
+	DeleteTag(ctx context.Context, req *DeleteTagRequest, res *DeleteTagResponse) error
+	GetTagStats(ctx context.Context, req *GetTagStatsRequest, res *GetTagStatsResponse) error
+	GetTagValHistory(ctx context.Context, req *GetTagValHistoryRequest, res *GetTagValHistoryResponse) error
 }
 
 type tagHandler struct {
-	tagRepo   repo.TagRepo
-	queryRepo repo.QueryRepo
+	txService   repo.TxService
+	tagRepo     repo.TagRepo
+	segmentRepo repo.SegmentRepo
+	queryRepo   repo.QueryRepo
 }
 
-func NewTagHandler(tagRepo repo.TagRepo, queryRepo repo.QueryRepo) TagHandler {
+func NewTagHandler(txService repo.TxService, tagRepo repo.TagRepo, segmentRepo repo.SegmentRepo, queryRepo repo.QueryRepo) TagHandler {
 	return &tagHandler{
-		tagRepo:   tagRepo,
-		queryRepo: queryRepo,
+		txService:   txService,
+		tagRepo:     tagRepo,
+		segmentRepo: segmentRepo,
+		queryRepo:   queryRepo,
 	}
 }
 
+type DeleteTagRequest struct {
+	ContextInfo
+
+	TagID *uint64 `json:"tag_id,omitempty"`
+}
+
+func (r *DeleteTagRequest) GetTagID() uint64 {
+	if r != nil && r.TagID != nil {
+		return *r.TagID
+	}
+	return 0
+}
+
+type DeleteTagResponse struct {
+	// Segments and derived Tags that still reference the tag, deletion is refused if any is non-empty.
+	Segments []*entity.Segment `json:"segments,omitempty"`
+	Tags     []*entity.Tag     `json:"tags,omitempty"`
+}
+
+var DeleteTagValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+	"tag_id":      &validator.UInt64{},
+})
+
+func (h *tagHandler) DeleteTag(ctx context.Context, req *DeleteTagRequest, res *DeleteTagResponse) error {
+	if err := DeleteTagValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	tag, err := h.tagRepo.GetByID(ctx, req.GetTenantID(), req.GetTagID())
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get tag failed: %v", err)
+		return err
+	}
+
+	segments, err := h.segmentRepo.GetManyByTenantID(ctx, req.GetTenantID())
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get segments failed: %v", err)
+		return err
+	}
+
+	blockers := make([]*entity.Segment, 0)
+	for _, segment := range segments {
+		if segment.GetCriteria().HasTagID(tag.GetID()) {
+			blockers = append(blockers, segment)
+		}
+	}
+
+	derivedTags, err := h.tagRepo.GetDerivedTags(ctx, req.GetTenantID())
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get derived tags failed: %v", err)
+		return err
+	}
+
+	tagBlockers := make([]*entity.Tag, 0)
+	for _, derivedTag := range derivedTags {
+		tagIDs, err := derivedTag.GetExtInfo().GetDerivation().GetTagIDs()
+		if err != nil {
+			log.Ctx(ctx).Warn().Msgf("get tag ids of derived tag failed: %v, tag_id: %d", err, derivedTag.GetID())
+			continue
+		}
+
+		for _, tagID := range tagIDs {
+			if tagID == tag.GetID() {
+				tagBlockers = append(tagBlockers, derivedTag)
+				break
+			}
+		}
+	}
+
+	if len(blockers) > 0 || len(tagBlockers) > 0 {
+		res.Segments = blockers
+		res.Tags = tagBlockers
+		return errutil.ConflictError(fmt.Errorf("tag is used by %d segment(s) and %d derived tag(s)", len(blockers), len(tagBlockers)))
+	}
+
+	tag.Update(&entity.Tag{
+		Name:   goutil.String(entity.DeletedName(tag.GetName(), tag.GetID())),
+		Status: entity.TagStatusDeleted,
+	})
+
+	if err := h.tagRepo.Update(ctx, tag); err != nil {
+		log.Ctx(ctx).Error().Msgf("delete tag failed: %v", err)
+		return err
+	}
+
+	h.queryRepo.InvalidateTagCache(ctx, req.GetTenantID(), tag.GetID())
+
+	return nil
+}
+
+type UpdateTagRequest struct {
+	ContextInfo
+
+	TagID       *uint64  `json:"tag_id,omitempty"`
+	Name        *string  `json:"name,omitempty"`
+	TagDesc     *string  `json:"tag_desc,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+	KeepHistory *bool    `json:"keep_history,omitempty"`
+	Sensitivity *uint32  `json:"sensitivity,omitempty"`
+}
+
+func (r *UpdateTagRequest) GetTagID() uint64 {
+	if r != nil && r.TagID != nil {
+		return *r.TagID
+	}
+	return 0
+}
+
+func (r *UpdateTagRequest) GetSensitivity() uint32 {
+	if r != nil && r.Sensitivity != nil {
+		return *r.Sensitivity
+	}
+	return 0
+}
+
+func (r *UpdateTagRequest) ToTag() *entity.Tag {
+	tag := &entity.Tag{
+		Name:    r.Name,
+		TagDesc: r.TagDesc,
+		Enum:    r.Enum,
+	}
+	if r.KeepHistory != nil || r.Sensitivity != nil {
+		tag.ExtInfo = &entity.TagExtInfo{
+			KeepHistory: r.KeepHistory,
+			Sensitivity: entity.Sensitivity(r.GetSensitivity()),
+		}
+	}
+	return tag
+}
+
+type UpdateTagResponse struct {
+	Tag *entity.Tag `json:"tag,omitempty"`
+}
+
+var UpdateTagValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+	"tag_id":      &validator.UInt64{},
+	"name":        ResourceNameValidator(true),
+	"tag_desc":    ResourceDescValidator(true),
+	"enum": &validator.Slice{
+		Optional: true,
+		MaxLen:   20,
+	},
+	"sensitivity": &validator.UInt32{
+		Optional:   true,
+		Validators: []validator.UInt32Func{entity.CheckSensitivity},
+	},
+})
+
+func (h *tagHandler) UpdateTag(ctx context.Context, req *UpdateTagRequest, res *UpdateTagResponse) error {
+	if err := UpdateTagValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	tag, err := h.tagRepo.GetByID(ctx, req.GetTenantID(), req.GetTagID())
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get tag failed: %v", err)
+		return err
+	}
+
+	newTag := req.ToTag()
+	for _, v := range newTag.Enum {
+		if ok := tag.IsValidTagValue(v); !ok {
+			return errutil.ValidationError(errors.New("invalid tag value enum"))
+		}
+	}
+
+	if newTag.Name != nil && newTag.GetName() != tag.GetName() {
+		_, err := h.tagRepo.GetByName(ctx, req.GetTenantID(), newTag.GetName())
+		if err == nil {
+			return errutil.ConflictError(errors.New("tag already exists"))
+		}
+
+		if !errors.Is(err, repo.ErrTagNotFound) {
+			log.Ctx(ctx).Error().Msgf("get tag failed: %v", err)
+			return err
+		}
+	}
+
+	keptHistory := tag.KeepsHistory()
+
+	if tag.Update(newTag) {
+		// history fields have to be mapped before any history is written
+		if !keptHistory && tag.KeepsHistory() {
+			if err := h.queryRepo.PutTagMapping(ctx, req.GetTenantName(), tag); err != nil {
+				log.Ctx(ctx).Error().Msgf("put tag mapping failed: %v", err)
+				return err
+			}
+
+			// uds written from now on get history, the values set before are started by the start-tag-history job
+			tag.ExtInfo.HistoryStartTime = nil
+		}
+
+		if err := h.tagRepo.Update(ctx, tag); err != nil {
+			log.Ctx(ctx).Error().Msgf("update tag failed: %v", err)
+			return err
+		}
+
+		h.queryRepo.InvalidateTagCache(ctx, req.GetTenantID(), tag.GetID())
+	}
+
+	res.Tag = tag
+
+	return nil
+}
+
+type GetTagValHistoryRequest struct {
+	ContextInfo
+
+	TagID  *uint64 `json:"tag_id,omitempty"`
+	UdID   *string `json:"ud_id,omitempty"`
+	IDType *uint32 `json:"id_type,omitempty"`
+}
+
+func (r *GetTagValHistoryRequest) GetTagID() uint64 {
+	if r != nil && r.TagID != nil {
+		return *r.TagID
+	}
+	return 0
+}
+
+func (r *GetTagValHistoryRequest) GetIDType() uint32 {
+	if r != nil && r.IDType != nil {
+		return *r.IDType
+	}
+	return 0
+}
+
+func (r *GetTagValHistoryRequest) ToUd() *entity.Ud {
+	return &entity.Ud{
+		ID:     r.UdID,
+		IDType: entity.IDType(r.GetIDType()),
+	}
+}
+
+type GetTagValHistoryResponse struct {
+	History []*entity.TagValHistory `json:"history"`
+}
+
+var GetTagValHistoryValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+	"tag_id":      &validator.UInt64{},
+	"ud_id":       &validator.String{},
+	"id_type": &validator.UInt32{
+		Validators: []validator.UInt32Func{CheckIDType},
+	},
+})
+
+func (h *tagHandler) GetTagValHistory(ctx context.Context, req *GetTagValHistoryRequest, res *GetTagValHistoryResponse) error {
+	if err := GetTagValHistoryValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	tag, err := h.tagRepo.GetByID(ctx, req.GetTenantID(), req.GetTagID())
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get tag failed: %v", err)
+		return err
+	}
+
+	if !tag.KeepsHistory() {
+		return errutil.ValidationError(errors.New("tag does not keep history"))
+	}
+
+	history, err := h.queryRepo.GetTagValHistory(ctx, req.GetTenantName(), req.ToUd(), tag.GetID())
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get tag value history failed: %v", err)
+		return err
+	}
+
+	if tag.IsPII() && !req.CanViewPII() {
+		for _, v := range history {
+			v.TagVal = entity.MaskTagVal(v.TagVal)
+		}
+	}
+
+	res.History = history
+
+	return nil
+}
+
+type GetTagStatsRequest struct {
+	ContextInfo
+
+	TagID            *uint64 `json:"tag_id,omitempty"`
+	TopN             *uint32 `json:"top_n,omitempty"`
+	HistogramBuckets *uint32 `json:"histogram_buckets,omitempty"`
+}
+
+func (r *GetTagStatsRequest) GetTagID() uint64 {
+	if r != nil && r.TagID != nil {
+		return *r.TagID
+	}
+	return 0
+}
+
+func (r *GetTagStatsRequest) GetTopN() uint32 {
+	if r != nil && r.TopN != nil {
+		return *r.TopN
+	}
+	return 10
+}
+
+func (r *GetTagStatsRequest) GetHistogramBuckets() uint32 {
+	if r != nil && r.HistogramBuckets != nil {
+		return *r.HistogramBuckets
+	}
+	return 10
+}
+
+type GetTagStatsResponse struct {
+	Stats *entity.TagStats `json:"stats,omitempty"`
+}
+
+var GetTagStatsValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+	"tag_id":      &validator.UInt64{},
+	"top_n": &validator.UInt32{
+		Optional: true,
+		Min:      goutil.Uint32(1),
+		Max:      goutil.Uint32(100),
+	},
+	"histogram_buckets": &validator.UInt32{
+		Optional: true,
+		Min:      goutil.Uint32(1),
+		Max:      goutil.Uint32(100),
+	},
+})
+
+func (h *tagHandler) GetTagStats(ctx context.Context, req *GetTagStatsRequest, res *GetTagStatsResponse) error {
+	if err := GetTagStatsValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	tag, err := h.tagRepo.GetByID(ctx, req.GetTenantID(), req.GetTagID())
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get tag failed: %v", err)
+		return err
+	}
+
+	if tag.GetValueType() == entity.TagValueTypeTimestamp {
+		return errutil.ValidationError(errors.New("stats are not supported for timestamp tags"))
+	}
+
+	stats, err := h.queryRepo.GetTagStats(ctx, req.GetTenantName(), tag, &repo.TagStatsOption{
+		TopN:             req.GetTopN(),
+		HistogramBuckets: req.GetHistogramBuckets(),
+	})
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get tag stats failed: %v", err)
+		return err
+	}
+
+	if tag.IsPII() && !req.CanViewPII() {
+		for _, v := range stats.TopValues {
+			v.Value = goutil.String(entity.MaskStr(v.GetValue()))
+		}
+	}
+
+	res.Stats = stats
+
+	return nil
+}
+
 type GetDistinctTagValuesRequest struct {
 	ContextInfo
 
@@ -76,6 +449,15 @@ func (h *tagHandler) GetDistinctTagValues(ctx context.Context, req *GetDistinctT
 		return err
 	}
 
+	// values may be shared with the cache, so they are masked into a copy
+	if tag.IsPII() && !req.CanViewPII() {
+		masked := make([]string, len(values))
+		for i, v := range values {
+			masked[i] = entity.MaskStr(v)
+		}
+		values = masked
+	}
+
 	res.TagValues = values
 
 	return nil
@@ -201,6 +583,11 @@ type CreateTagRequest struct {
 	TagDesc   *string  `json:"tag_desc,omitempty"`
 	Enum      []string `json:"enum,omitempty"`
 	ValueType *uint32  `json:"value_type,omitempty"`
+
+	// Derivation is set for derived tags only.
+	Derivation  *entity.TagDerivation `json:"derivation,omitempty"`
+	KeepHistory *bool                 `json:"keep_history,omitempty"`
+	Sensitivity *uint32               `json:"sensitivity,omitempty"`
 }
 
 func (req *CreateTagRequest) GetEnum() []string {
@@ -217,15 +604,40 @@ func (req *CreateTagRequest) GetValueType() uint32 {
 	return 0
 }
 
+func (req *CreateTagRequest) GetSensitivity() uint32 {
+	if req != nil && req.Sensitivity != nil {
+		return *req.Sensitivity
+	}
+	return uint32(entity.SensitivityInternal)
+}
+
 func (req *CreateTagRequest) ToTag() *entity.Tag {
 	now := time.Now()
+
+	kind := entity.TagKindUpload
+	if req.Derivation != nil {
+		kind = entity.TagKindDerived
+	}
+
+	// a new tag has no values set before its history starts
+	var historyStartTime *uint64
+	if req.KeepHistory != nil && *req.KeepHistory {
+		historyStartTime = goutil.Uint64(uint64(now.Unix()))
+	}
+
 	return &entity.Tag{
-		Name:       req.Name,
-		TagDesc:    req.TagDesc,
-		Enum:       req.Enum,
-		ValueType:  entity.TagValueType(req.GetValueType()),
-		Status:     entity.TagStatusNormal,
-		ExtInfo:    &entity.TagExtInfo{},
+		Name:      req.Name,
+		TagDesc:   req.TagDesc,
+		Enum:      req.Enum,
+		ValueType: entity.TagValueType(req.GetValueType()),
+		Kind:      kind,
+		Status:    entity.TagStatusNormal,
+		ExtInfo: &entity.TagExtInfo{
+			Derivation:       req.Derivation,
+			KeepHistory:      req.KeepHistory,
+			HistoryStartTime: historyStartTime,
+			Sensitivity:      entity.Sensitivity(req.GetSensitivity()),
+		},
 		TenantID:   goutil.Uint64(req.GetTenantID()),
 		CreatorID:  goutil.Uint64(req.GetUserID()),
 		CreateTime: goutil.Uint64(uint64(now.Unix())),
@@ -249,6 +661,10 @@ var CreateTagValidator = validator.MustForm(map[string]validator.Validator{
 		Optional: true,
 		MaxLen:   20,
 	},
+	"sensitivity": &validator.UInt32{
+		Optional:   true,
+		Validators: []validator.UInt32Func{entity.CheckSensitivity},
+	},
 })
 
 func (h *tagHandler) CreateTag(ctx context.Context, req *CreateTagRequest, res *CreateTagResponse) error {
@@ -257,6 +673,13 @@ func (h *tagHandler) CreateTag(ctx context.Context, req *CreateTagRequest, res *
 	}
 
 	tag := req.ToTag()
+
+	if tag.IsDerived() {
+		if err := h.validateDerivation(ctx, req.GetTenantID(), tag); err != nil {
+			return err
+		}
+	}
+
 	for _, v := range tag.Enum {
 		if ok := tag.IsValidTagValue(v); !ok {
 			return errutil.ValidationError(errors.New("invalid tag value enum"))
@@ -273,14 +696,104 @@ func (h *tagHandler) CreateTag(ctx context.Context, req *CreateTagRequest, res *
 		return err
 	}
 
-	id, err := h.tagRepo.Create(ctx, tag)
-	if err != nil {
-		log.Ctx(ctx).Error().Msgf("create tag failed: %v", err)
+	// the mapping needs the tag ID, the tag row is rolled back if the mapping fails
+	if err := h.txService.RunTx(ctx, func(ctx context.Context) error {
+		if segmentID := tag.GetExtInfo().GetDerivation().GetSegmentID(); segmentID != 0 {
+			if err := lockSegments(ctx, h.segmentRepo, req.GetTenantID(), []uint64{segmentID}); err != nil {
+				log.Ctx(ctx).Error().Msgf("lock segment failed: %v", err)
+				return err
+			}
+		}
+
+		id, err := h.tagRepo.Create(ctx, tag)
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("create tag failed: %v", err)
+			return err
+		}
+
+		tag.ID = goutil.Uint64(id)
+
+		if err := h.queryRepo.PutTagMapping(ctx, req.GetTenantName(), tag); err != nil {
+			log.Ctx(ctx).Error().Msgf("put tag mapping failed: %v", err)
+			return err
+		}
+
+		return nil
+	}); err != nil {
 		return err
 	}
 
-	tag.ID = goutil.Uint64(id)
 	res.Tag = tag
 
 	return nil
 }
+
+func (h *tagHandler) validateDerivation(ctx context.Context, tenantID uint64, tag *entity.Tag) error {
+	derivation := tag.GetExtInfo().GetDerivation()
+
+	var defined int
+	for _, ok := range []bool{derivation.SegmentID != nil, derivation.SourceTagID != nil, derivation.Expr != nil} {
+		if ok {
+			defined++
+		}
+	}
+	if defined != 1 {
+		return errutil.ValidationError(errors.New("derivation must have exactly one of segment_id, source_tag_id or expr"))
+	}
+
+	if tag.GetValueType() != derivation.GetValueType() {
+		return errutil.ValidationError(fmt.Errorf("value type of derived tag must be %s",
+			entity.TagValueTypes[uint32(derivation.GetValueType())]))
+	}
+
+	if derivation.SegmentID != nil {
+		if _, err := h.segmentRepo.GetByID(ctx, tenantID, derivation.GetSegmentID()); err != nil {
+			log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+			return err
+		}
+		return nil
+	}
+
+	if derivation.SourceTagID != nil {
+		if len(derivation.Buckets) == 0 {
+			return errutil.ValidationError(errors.New("missing buckets"))
+		}
+
+		labels := make([]string, 0, len(derivation.Buckets))
+		for _, bucket := range derivation.Buckets {
+			if bucket.GetLabel() == "" {
+				return errutil.ValidationError(errors.New("missing bucket label"))
+			}
+			if bucket.Min != nil && bucket.Max != nil && *bucket.Min >= *bucket.Max {
+				return errutil.ValidationError(fmt.Errorf("bucket %s has min not less than max", bucket.GetLabel()))
+			}
+			labels = append(labels, bucket.GetLabel())
+		}
+
+		// bucket labels are the only possible values
+		tag.Enum = goutil.RemoveStrDuplicates(labels)
+	}
+
+	tagIDs, err := derivation.GetTagIDs()
+	if err != nil {
+		return errutil.ValidationError(fmt.Errorf("invalid expr: %v", err))
+	}
+
+	if len(tagIDs) == 0 {
+		return errutil.ValidationError(errors.New("derivation must reference at least one tag"))
+	}
+
+	for _, tagID := range tagIDs {
+		sourceTag, err := h.tagRepo.GetByID(ctx, tenantID, tagID)
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("get source tag failed: %v, tag_id: %d", err, tagID)
+			return err
+		}
+
+		if !sourceTag.IsNumeric() {
+			return errutil.ValidationError(fmt.Errorf("source tag %s is not numeric", sourceTag.GetName()))
+		}
+	}
+
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"cdp/pkg/validator"
 	"cdp/repo"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/rs/zerolog/log"
 	"mime/multipart"
@@ -17,23 +18,29 @@ import (
 type TaskHandler interface {
 	CreateFileUploadTask(ctx context.Context, req *CreateFileUploadTaskRequest, res *CreateFileUploadTaskResponse) error
 	GetFileUploadTasks(ctx context.Context, req *GetFileUploadTasksRequest, res *GetFileUploadTasksResponse) error
+	CreateSegmentExportTask(ctx context.Context, req *CreateSegmentExportTaskRequest, res *CreateSegmentExportTaskResponse) error
+	GetSegmentExportTasks(ctx context.Context, req *GetSegmentExportTasksRequest, res *GetSegmentExportTasksResponse) error
+	DownloadSegmentExport(ctx context.Context, req *DownloadSegmentExportRequest, res *DownloadSegmentExportResponse) error
 }
 
 type taskHandler struct {
-	taskRepo   repo.TaskRepo
-	fileRepo   repo.FileRepo
-	queryRepo  repo.QueryRepo
-	tenantRepo repo.TenantRepo
-	tagRepo    repo.TagRepo
+	taskRepo    repo.TaskRepo
+	fileRepo    repo.FileRepo
+	queryRepo   repo.QueryRepo
+	tenantRepo  repo.TenantRepo
+	tagRepo     repo.TagRepo
+	segmentRepo repo.SegmentRepo
 }
 
-func NewTaskHandler(taskRepo repo.TaskRepo, fileRepo repo.FileRepo, queryRepo repo.QueryRepo, tenantRepo repo.TenantRepo, tagRepo repo.TagRepo) TaskHandler {
+func NewTaskHandler(taskRepo repo.TaskRepo, fileRepo repo.FileRepo, queryRepo repo.QueryRepo, tenantRepo repo.TenantRepo, tagRepo repo.TagRepo,
+	segmentRepo repo.SegmentRepo) TaskHandler {
 	return &taskHandler{
 		taskRepo,
 		fileRepo,
 		queryRepo,
 		tenantRepo,
 		tagRepo,
+		segmentRepo,
 	}
 }
 
@@ -67,7 +74,7 @@ type GetFileUploadTasksResponse struct {
 var GetFileUploadTasksValidator = validator.MustForm(map[string]validator.Validator{
 	"ContextInfo": ContextInfoValidator(false, true),
 	"resource_id": &validator.UInt64{
-		Optional: false,
+		Optional: true,
 	},
 	"resource_type": &validator.UInt32{
 		Optional: false,
@@ -80,11 +87,16 @@ func (h *taskHandler) GetFileUploadTasks(ctx context.Context, req *GetFileUpload
 		return errutil.ValidationError(err)
 	}
 
+	if err := checkTaskResourceID(req.GetResourceID(), entity.ResourceType(req.GetResourceType())); err != nil {
+		return errutil.ValidationError(err)
+	}
+
 	if req.Pagination == nil {
 		req.Pagination = new(repo.Pagination)
 	}
 
-	tasks, pagination, err := h.taskRepo.GetByResourceIDAndType(ctx, req.GetResourceID(), entity.ResourceType(req.GetResourceType()), req.Pagination)
+	tasks, pagination, err := h.taskRepo.GetByResourceIDAndType(ctx, req.GetTenantID(), req.GetResourceID(), entity.ResourceType(req.GetResourceType()),
+		entity.TaskTypeFileUpload, req.Pagination)
 	if err != nil {
 		log.Ctx(ctx).Error().Msgf("get tasks failed: %v", err)
 		return err
@@ -100,8 +112,23 @@ type CreateFileUploadTaskRequest struct {
 	ContextInfo
 	FileUpload
 
-	ResourceID   *uint64 `schema:"resource_id,required"`
+	ResourceID   *uint64 `schema:"resource_id"` // not set for identity mappings, which belong to no resource
 	ResourceType *uint32 `schema:"resource_type,required"`
+	IDType       *uint32 `schema:"id_type" json:"id_type,omitempty"`
+}
+
+func (req *CreateFileUploadTaskRequest) GetIDType() uint32 {
+	if req != nil && req.IDType != nil {
+		return *req.IDType
+	}
+	return uint32(entity.IDTypeEmail)
+}
+
+func (req *CreateFileUploadTaskRequest) GetResourceID() uint64 {
+	if req != nil && req.ResourceID != nil {
+		return *req.ResourceID
+	}
+	return 0
 }
 
 func (req *CreateFileUploadTaskRequest) GetResourceType() uint32 {
@@ -118,7 +145,7 @@ func (req *CreateFileUploadTaskRequest) ToTask(extInfo *entity.TaskExtInfo) *ent
 
 	now := time.Now()
 	return &entity.Task{
-		ResourceID:   req.ResourceID,
+		ResourceID:   goutil.Uint64(req.GetResourceID()),
 		TenantID:     req.Tenant.ID,
 		ResourceType: entity.ResourceType(req.GetResourceType()),
 		Status:       entity.TaskStatusPending,
@@ -141,12 +168,16 @@ var CreateFileUploadTaskValidator = validator.MustForm(map[string]validator.Vali
 		"text/plain",
 	}),
 	"resource_id": &validator.UInt64{
-		Optional: false,
+		Optional: true,
 	},
 	"resource_type": &validator.UInt32{
 		Optional:   false,
 		Validators: []validator.UInt32Func{CheckResourceType},
 	},
+	"id_type": &validator.UInt32{
+		Optional:   true,
+		Validators: []validator.UInt32Func{CheckIDType},
+	},
 })
 
 func (h *taskHandler) CreateFileUploadTask(ctx context.Context, req *CreateFileUploadTaskRequest, res *CreateFileUploadTaskResponse) error {
@@ -154,6 +185,28 @@ func (h *taskHandler) CreateFileUploadTask(ctx context.Context, req *CreateFileU
 		return errutil.ValidationError(err)
 	}
 
+	if err := checkTaskResourceID(req.GetResourceID(), entity.ResourceType(req.GetResourceType())); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	if entity.ResourceType(req.GetResourceType()) == entity.ResourceTypeSegment {
+		if err := h.checkStaticSegment(ctx, req.GetTenantID(), req.GetResourceID()); err != nil {
+			return err
+		}
+	}
+
+	if entity.ResourceType(req.GetResourceType()) == entity.ResourceTypeTag {
+		tag, err := h.tagRepo.GetByID(ctx, req.GetTenantID(), req.GetResourceID())
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("get tag failed: %v", err)
+			return err
+		}
+
+		if tag.IsDerived() {
+			return errutil.ValidationError(errors.New("cannot upload values of a derived tag"))
+		}
+	}
+
 	fileName := fmt.Sprintf("%s:%d",
 		req.GetFileName(),
 		time.Now().Unix(),
@@ -176,6 +229,7 @@ func (h *taskHandler) CreateFileUploadTask(ctx context.Context, req *CreateFileU
 		OriFileName: goutil.String(req.GetFileName()),
 		Progress:    goutil.Uint64(0),
 		Size:        goutil.Uint64(size - 1), // exclude header
+		IDType:      entity.IDType(req.GetIDType()),
 	})
 	id, err := h.taskRepo.Create(ctx, task)
 	if err != nil {
@@ -189,6 +243,271 @@ func (h *taskHandler) CreateFileUploadTask(ctx context.Context, req *CreateFileU
 	return nil
 }
 
+// checkTaskResourceID checks that the task has a resource ID unless it is an identity mapping upload,
+// which has no resource.
+func checkTaskResourceID(resourceID uint64, resourceType entity.ResourceType) error {
+	if resourceType == entity.ResourceTypeIdentity {
+		if resourceID != 0 {
+			return errors.New("resource_id must be empty for identity mappings")
+		}
+		return nil
+	}
+
+	if resourceID == 0 {
+		return errors.New("resource_id is required")
+	}
+
+	return nil
+}
+
+// checkStaticSegment checks that uds can be uploaded to the segment, i.e. it is a static segment not populated yet.
+func (h *taskHandler) checkStaticSegment(ctx context.Context, tenantID, segmentID uint64) error {
+	segment, err := h.segmentRepo.GetByID(ctx, tenantID, segmentID)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+		return err
+	}
+
+	if !segment.IsStatic() {
+		return errutil.ValidationError(errors.New("uds can only be uploaded to a static segment"))
+	}
+
+	// a failed task may be retried, the uds written before it failed are written again
+	count, err := h.taskRepo.CountByResource(ctx, segmentID, entity.ResourceTypeSegment,
+		[]entity.TaskType{entity.TaskTypeFileUpload, entity.TaskTypeSegmentSnapshot},
+		[]entity.TaskStatus{entity.TaskStatusPending, entity.TaskStatusRunning, entity.TaskStatusSuccess})
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("count segment tasks failed: %v", err)
+		return err
+	}
+
+	if count > 0 {
+		return errutil.ConflictError(errors.New("uds of a static segment are frozen once populated"))
+	}
+
+	return nil
+}
+
+// maxExportTags limits the tag columns of a segment export.
+const maxExportTags = 50
+
+type CreateSegmentExportTaskRequest struct {
+	ContextInfo
+
+	SegmentID *uint64  `json:"segment_id,omitempty"`
+	TagIDs    []uint64 `json:"tag_ids,omitempty"`
+}
+
+func (req *CreateSegmentExportTaskRequest) GetSegmentID() uint64 {
+	if req != nil && req.SegmentID != nil {
+		return *req.SegmentID
+	}
+	return 0
+}
+
+func (req *CreateSegmentExportTaskRequest) ToTask() *entity.Task {
+	now := time.Now()
+	return &entity.Task{
+		ResourceID:   req.SegmentID,
+		TenantID:     req.Tenant.ID,
+		ResourceType: entity.ResourceTypeSegment,
+		Status:       entity.TaskStatusPending,
+		TaskType:     entity.TaskTypeSegmentExport,
+		ExtInfo: &entity.TaskExtInfo{
+			Progress: goutil.Uint64(0),
+			TagIDs:   req.TagIDs,
+			MaskPII:  goutil.Bool(!req.CanViewPII()),
+		},
+		CreatorID:  goutil.Uint64(req.GetUserID()),
+		CreateTime: goutil.Uint64(uint64(now.Unix())),
+		UpdateTime: goutil.Uint64(uint64(now.Unix())),
+	}
+}
+
+type CreateSegmentExportTaskResponse struct {
+	Task *entity.Task `json:"task,omitempty"`
+}
+
+var CreateSegmentExportTaskValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+	"segment_id": &validator.UInt64{
+		Optional: false,
+	},
+	"tag_ids": &validator.Slice{
+		Optional: true,
+		MaxLen:   maxExportTags,
+	},
+})
+
+// CreateSegmentExportTask creates a task exporting the uds of a segment, with the values of the chosen tags,
+// into a CSV file. The file is written by the run-segment-export-tasks job.
+func (h *taskHandler) CreateSegmentExportTask(ctx context.Context, req *CreateSegmentExportTaskRequest, res *CreateSegmentExportTaskResponse) error {
+	if err := CreateSegmentExportTaskValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	if _, err := h.segmentRepo.GetByID(ctx, req.GetTenantID(), req.GetSegmentID()); err != nil {
+		log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+		return err
+	}
+
+	if len(req.TagIDs) > 0 {
+		tags, err := h.tagRepo.GetManyByIDs(ctx, req.GetTenantID(), req.TagIDs)
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("get tags failed: %v", err)
+			return err
+		}
+
+		found := make(map[uint64]bool, len(tags))
+		for _, tag := range tags {
+			found[tag.GetID()] = true
+		}
+		for _, tagID := range req.TagIDs {
+			if !found[tagID] {
+				return errutil.ValidationError(fmt.Errorf("tag %d not found", tagID))
+			}
+		}
+	}
+
+	task := req.ToTask()
+	id, err := h.taskRepo.Create(ctx, task)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("create segment export task failed: %v", err)
+		return err
+	}
+
+	task.ID = goutil.Uint64(id)
+	res.Task = task
+
+	return nil
+}
+
+type GetSegmentExportTasksRequest struct {
+	ContextInfo
+
+	SegmentID  *uint64          `json:"segment_id,omitempty"`
+	Pagination *repo.Pagination `json:"pagination,omitempty"`
+}
+
+func (req *GetSegmentExportTasksRequest) GetSegmentID() uint64 {
+	if req != nil && req.SegmentID != nil {
+		return *req.SegmentID
+	}
+	return 0
+}
+
+type GetSegmentExportTasksResponse struct {
+	Tasks      []*entity.Task   `json:"tasks"`
+	Pagination *repo.Pagination `json:"pagination,omitempty"`
+}
+
+var GetSegmentExportTasksValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, true),
+	"segment_id": &validator.UInt64{
+		Optional: false,
+	},
+	"pagination": PaginationValidator(),
+})
+
+// GetSegmentExportTasks returns the export tasks of a segment, with their progress.
+// The file of a successful task is downloaded with DownloadSegmentExport.
+func (h *taskHandler) GetSegmentExportTasks(ctx context.Context, req *GetSegmentExportTasksRequest, res *GetSegmentExportTasksResponse) error {
+	if err := GetSegmentExportTasksValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	// the segment must belong to the tenant
+	if _, err := h.segmentRepo.GetByID(ctx, req.GetTenantID(), req.GetSegmentID()); err != nil {
+		log.Ctx(ctx).Error().Msgf("get segment failed: %v", err)
+		return err
+	}
+
+	if req.Pagination == nil {
+		req.Pagination = new(repo.Pagination)
+	}
+
+	tasks, pagination, err := h.taskRepo.GetByResourceIDAndType(ctx, req.GetTenantID(), req.GetSegmentID(), entity.ResourceTypeSegment,
+		entity.TaskTypeSegmentExport, req.Pagination)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get tasks failed: %v", err)
+		return err
+	}
+
+	res.Tasks = tasks
+	res.Pagination = pagination
+
+	return nil
+}
+
+type DownloadSegmentExportRequest struct {
+	ContextInfo
+
+	TaskID *uint64 `schema:"task_id" json:"task_id,omitempty"`
+}
+
+func (req *DownloadSegmentExportRequest) GetTaskID() uint64 {
+	if req != nil && req.TaskID != nil {
+		return *req.TaskID
+	}
+	return 0
+}
+
+type DownloadSegmentExportResponse struct {
+	file *entity.FileData
+}
+
+func (res *DownloadSegmentExportResponse) GetFileData() *entity.FileData {
+	return res.file
+}
+
+var DownloadSegmentExportValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+	"task_id": &validator.UInt64{
+		Optional: false,
+	},
+})
+
+// DownloadSegmentExport streams the file of a successful export task. The file is only shared with the
+// admin account in Drive, so it is read by the server on behalf of the session user.
+func (h *taskHandler) DownloadSegmentExport(ctx context.Context, req *DownloadSegmentExportRequest, res *DownloadSegmentExportResponse) error {
+	if err := DownloadSegmentExportValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	task, err := h.taskRepo.GetByID(ctx, req.GetTenantID(), req.GetTaskID())
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get task failed: %v", err)
+		return err
+	}
+
+	if task.GetTaskType() != entity.TaskTypeSegmentExport {
+		return repo.ErrTaskNotFound
+	}
+
+	if task.GetStatus() != entity.TaskStatusSuccess {
+		return errutil.ValidationError(errors.New("export is not finished"))
+	}
+
+	// an export made by a user who can view PII is not masked
+	if !task.GetExtInfo().GetMaskPII() && !req.CanViewPII() {
+		return errutil.ForbiddenError(errors.New("export contains PII"))
+	}
+
+	body, err := h.fileRepo.OpenFile(ctx, task.GetExtInfo().GetFileID())
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("open file failed: %v", err)
+		return err
+	}
+
+	res.file = &entity.FileData{
+		Name:        fmt.Sprintf("segment_%d_export_%d.csv", task.GetResourceID(), task.GetID()),
+		ContentType: "text/csv",
+		Body:        body,
+	}
+
+	return nil
+}
+
 func (h *taskHandler) countRows(file multipart.File) (uint64, error) {
 	var (
 		scanner = bufio.NewScanner(file)
@@ -22,6 +22,7 @@ type TenantHandler interface {
 	UpdateDnsRecords(ctx context.Context, req *UpdateDnsRecordsRequest, res *UpdateDnsRecordsResponse) error
 	CreateSender(ctx context.Context, req *CreateSenderRequest, res *CreateSenderResponse) error
 	GetSenders(ctx context.Context, req *GetSendersRequest, res *GetSendersResponse) error
+	FlushQueryCache(ctx context.Context, req *FlushQueryCacheRequest, res *FlushQueryCacheResponse) error
 }
 
 type tenantHandler struct {
@@ -172,6 +173,9 @@ func (h *tenantHandler) CreateTenant(ctx context.Context, req *CreateTenantReque
 				Actions: []entity.ActionCode{
 					entity.ActionEditRole,
 					entity.ActionEditUser,
+					entity.ActionViewPII,
+					entity.ActionFlushCache,
+					entity.ActionEraseUd,
 				},
 				TenantID:   tenant.ID,
 				CreateTime: tenant.CreateTime,
@@ -481,3 +485,25 @@ func (h *tenantHandler) UpdateDnsRecords(ctx context.Context, req *UpdateDnsReco
 
 	return nil
 }
+
+type FlushQueryCacheRequest struct {
+	ContextInfo
+}
+
+type FlushQueryCacheResponse struct{}
+
+var FlushQueryCacheValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+})
+
+func (h *tenantHandler) FlushQueryCache(ctx context.Context, req *FlushQueryCacheRequest, _ *FlushQueryCacheResponse) error {
+	if err := FlushQueryCacheValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	h.queryRepo.FlushCache(ctx, req.GetTenantID())
+
+	log.Ctx(ctx).Info().Msgf("query cache is flushed, tenant_id: %v, user_id: %v", req.GetTenantID(), req.GetUserID())
+
+	return nil
+}
@@ -0,0 +1,677 @@
+package handler
+
+import (
+	"cdp/entity"
+	"cdp/pkg/errutil"
+	"cdp/pkg/goutil"
+	"cdp/pkg/validator"
+	"cdp/repo"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"time"
+)
+
+type UdHandler interface {
+	GetUdProfile(ctx context.Context, req *GetUdProfileRequest, res *GetUdProfileResponse) error
+	DeleteUd(ctx context.Context, req *DeleteUdRequest, res *DeleteUdResponse) error
+	GetErasures(ctx context.Context, req *GetErasuresRequest, res *GetErasuresResponse) error
+	UpsertUds(ctx context.Context, req *UpsertUdsRequest, res *UpsertUdsResponse) error
+}
+
+type udHandler struct {
+	txService       repo.TxService
+	tagRepo         repo.TagRepo
+	queryRepo       repo.QueryRepo
+	mappingIDRepo   repo.MappingIDRepo
+	campaignRepo    repo.CampaignRepo
+	campaignLogRepo repo.CampaignLogRepo
+	erasureRepo     repo.ErasureRepo
+}
+
+func NewUdHandler(txService repo.TxService, tagRepo repo.TagRepo, queryRepo repo.QueryRepo, mappingIDRepo repo.MappingIDRepo,
+	campaignRepo repo.CampaignRepo, campaignLogRepo repo.CampaignLogRepo, erasureRepo repo.ErasureRepo) UdHandler {
+	return &udHandler{
+		txService:       txService,
+		tagRepo:         tagRepo,
+		queryRepo:       queryRepo,
+		mappingIDRepo:   mappingIDRepo,
+		campaignRepo:    campaignRepo,
+		campaignLogRepo: campaignLogRepo,
+		erasureRepo:     erasureRepo,
+	}
+}
+
+// maxUpsertUds caps the batch size of UpsertUds, larger imports should go through file upload tasks.
+const maxUpsertUds = 1_000
+
+type UpsertUdsRequest struct {
+	ContextInfo
+
+	UdTagVals []*entity.UdTagVal `json:"ud_tag_vals,omitempty"`
+}
+
+type UpsertUdsResponse struct {
+	// Results are in the same order as the UdTagVals of the request.
+	Results []*UpsertUdResult `json:"results"`
+}
+
+type UpsertUdResult struct {
+	Success bool    `json:"success"`
+	Error   *string `json:"error,omitempty"`
+}
+
+var UpsertUdsValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+	"ud_tag_vals": &validator.Slice{
+		MinLen: 1,
+		MaxLen: maxUpsertUds,
+	},
+})
+
+// UpsertUds validates each ud tag val against its tag and writes the valid ones to the query store.
+// It writes them in one request and waits until they are searchable, so each item gets its own result,
+// and one bad item does not fail the batch.
+func (h *udHandler) UpsertUds(ctx context.Context, req *UpsertUdsRequest, res *UpsertUdsResponse) error {
+	if err := UpsertUdsValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	tagIDs := make([]uint64, 0)
+	for _, udTagVal := range req.UdTagVals {
+		for _, tagVal := range udTagVal.GetTagVals() {
+			tagIDs = append(tagIDs, tagVal.GetTagID())
+		}
+	}
+
+	tags, err := h.tagRepo.GetManyByIDs(ctx, req.GetTenantID(), tagIDs)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get tags failed: %v", err)
+		return err
+	}
+
+	tagsByID := make(map[uint64]*entity.Tag, len(tags))
+	for _, tag := range tags {
+		tagsByID[tag.GetID()] = tag
+	}
+
+	var (
+		results = make([]*UpsertUdResult, len(req.UdTagVals))
+		valid   = make([]*entity.UdTagVal, 0, len(req.UdTagVals))
+		// indexes of the valid items in the request
+		indexes = make([]int, 0, len(req.UdTagVals))
+	)
+	for i, udTagVal := range req.UdTagVals {
+		v, err := ToUdTagVal(udTagVal, tagsByID)
+		if err != nil {
+			results[i] = &UpsertUdResult{
+				Error: goutil.String(err.Error()),
+			}
+			continue
+		}
+
+		valid = append(valid, v)
+		indexes = append(indexes, i)
+	}
+
+	// erased uds must not be brought back
+	uds := make([]*entity.Ud, 0, len(valid))
+	for _, udTagVal := range valid {
+		uds = append(uds, udTagVal.GetUd())
+	}
+
+	suppressed, err := h.erasureRepo.GetSuppressedUds(ctx, req.GetTenantID(), uds)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get suppressed uds failed: %v", err)
+		return err
+	}
+
+	var (
+		unsuppressed        = make([]*entity.UdTagVal, 0, len(valid))
+		unsuppressedIndexes = make([]int, 0, len(valid))
+	)
+	for i, udTagVal := range valid {
+		if suppressed[udTagVal.GetUd().ToDocID()] {
+			results[indexes[i]] = &UpsertUdResult{
+				Error: goutil.String("ud is erased"),
+			}
+			continue
+		}
+
+		unsuppressed = append(unsuppressed, udTagVal)
+		unsuppressedIndexes = append(unsuppressedIndexes, indexes[i])
+	}
+
+	if err := SetProfileIDs(ctx, h.mappingIDRepo, req.GetTenantID(), unsuppressed); err != nil {
+		log.Ctx(ctx).Error().Msgf("set profile ids failed: %v", err)
+		return err
+	}
+
+	if len(unsuppressed) > 0 {
+		errs, err := h.queryRepo.Upsert(ctx, req.GetTenantName(), unsuppressed)
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("upsert failed: %v", err)
+			return err
+		}
+
+		for i, err := range errs {
+			result := &UpsertUdResult{
+				Success: err == nil,
+			}
+			if err != nil {
+				result.Error = goutil.String(err.Error())
+			}
+			results[unsuppressedIndexes[i]] = result
+		}
+
+		upsertedTagIDs := make(map[uint64]struct{})
+		for _, udTagVal := range unsuppressed {
+			for _, tagVal := range udTagVal.GetTagVals() {
+				upsertedTagIDs[tagVal.GetTagID()] = struct{}{}
+			}
+		}
+		for tagID := range upsertedTagIDs {
+			h.queryRepo.InvalidateTagCache(ctx, req.GetTenantID(), tagID)
+		}
+	}
+
+	res.Results = results
+
+	return nil
+}
+
+// SetProfileIDs sets the profile ID of the uds linked by identity mappings, as the mappings are synced
+// only to the uds already stored. It is shared by upsert_uds, the ingestion consumer and file uploads.
+func SetProfileIDs(ctx context.Context, mappingIDRepo repo.MappingIDRepo, tenantID uint64, udTagVals []*entity.UdTagVal) error {
+	uds := make([]*entity.Ud, 0, len(udTagVals))
+	for _, udTagVal := range udTagVals {
+		uds = append(uds, udTagVal.GetUd())
+	}
+
+	profileIDs, err := mappingIDRepo.GetProfileIDs(ctx, tenantID, uds)
+	if err != nil {
+		return err
+	}
+
+	for _, ud := range uds {
+		if profileID, ok := profileIDs[ud.ToDocID()]; ok {
+			ud.ProfileID = goutil.Uint64(profileID)
+		}
+	}
+
+	return nil
+}
+
+// ToUdTagVal validates a ud tag val written in real time, and formats the ID and tag values for writing.
+// It is shared by upsert_uds and the ingestion consumer.
+func ToUdTagVal(udTagVal *entity.UdTagVal, tagsByID map[uint64]*entity.Tag) (*entity.UdTagVal, error) {
+	ud := udTagVal.GetUd()
+	if ud == nil {
+		return nil, errors.New("empty ud")
+	}
+
+	if err := CheckIDType(uint32(ud.GetIDType())); err != nil {
+		return nil, err
+	}
+
+	udID, err := entity.NormalizeUdID(ud.GetIDType(), ud.GetID())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(udTagVal.GetTagVals()) == 0 {
+		return nil, errors.New("empty tag vals")
+	}
+
+	tagVals := make([]*entity.TagVal, 0, len(udTagVal.GetTagVals()))
+	for _, tagVal := range udTagVal.GetTagVals() {
+		tag, ok := tagsByID[tagVal.GetTagID()]
+		if !ok {
+			return nil, fmt.Errorf("tag %d not found", tagVal.GetTagID())
+		}
+
+		// derived tags are written by the materialize-derived-tags job only
+		if tag.IsDerived() {
+			return nil, fmt.Errorf("tag %d is derived", tag.GetID())
+		}
+
+		v, err := tag.ParseTagValue(tagVal.TagVal)
+		if err != nil {
+			return nil, fmt.Errorf("tag %d: %v", tag.GetID(), err)
+		}
+
+		tagVals = append(tagVals, &entity.TagVal{
+			TagID:       tag.ID,
+			TagVal:      v,
+			KeepHistory: tag.KeepsHistory(),
+		})
+	}
+
+	return &entity.UdTagVal{
+		Ud: &entity.Ud{
+			ID:     goutil.String(udID),
+			IDType: ud.GetIDType(),
+		},
+		TagVals: tagVals,
+	}, nil
+}
+
+type DeleteUdRequest struct {
+	ContextInfo
+
+	UdID   *string `json:"ud_id,omitempty"`
+	IDType *uint32 `json:"id_type,omitempty"`
+}
+
+func (r *DeleteUdRequest) GetUdID() string {
+	if r != nil && r.UdID != nil {
+		return *r.UdID
+	}
+	return ""
+}
+
+func (r *DeleteUdRequest) GetIDType() uint32 {
+	if r != nil && r.IDType != nil {
+		return *r.IDType
+	}
+	return 0
+}
+
+type DeleteUdResponse struct {
+	Erasure *entity.Erasure `json:"erasure,omitempty"`
+}
+
+var DeleteUdValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+	"ud_id":       &validator.String{},
+	"id_type": &validator.UInt32{
+		Validators: []validator.UInt32Func{CheckIDType},
+	},
+})
+
+// DeleteUd records an erasure request, the data is removed by the run-erasures job.
+// The ud is suppressed right away, so that uploads running before the job do not bring it back.
+func (h *udHandler) DeleteUd(ctx context.Context, req *DeleteUdRequest, res *DeleteUdResponse) error {
+	if err := DeleteUdValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	idType := entity.IDType(req.GetIDType())
+
+	udID, err := entity.NormalizeUdID(idType, req.GetUdID())
+	if err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	ud := &entity.Ud{
+		ID:     goutil.String(udID),
+		IDType: idType,
+	}
+
+	now := uint64(time.Now().Unix())
+	erasure := &entity.Erasure{
+		TenantID: goutil.Uint64(req.GetTenantID()),
+		IDType:   idType,
+		UdHash:   goutil.String(h.erasureRepo.HashUd(ud)),
+		Status:   entity.ErasureStatusPending,
+		ExtInfo: &entity.ErasureExtInfo{
+			UdID: ud.ID,
+		},
+		CreatorID:  goutil.Uint64(req.GetUserID()),
+		EraseTime:  goutil.Uint64(0),
+		CreateTime: goutil.Uint64(now),
+		UpdateTime: goutil.Uint64(now),
+	}
+
+	if err := h.txService.RunTx(ctx, func(ctx context.Context) error {
+		erasureID, err := h.erasureRepo.Create(ctx, erasure)
+		if err != nil {
+			return err
+		}
+		erasure.ID = goutil.Uint64(erasureID)
+
+		return h.erasureRepo.Suppress(ctx, req.GetTenantID(), erasureID, []*entity.Ud{ud})
+	}); err != nil {
+		log.Ctx(ctx).Error().Msgf("create erasure failed: %v", err)
+		return err
+	}
+
+	if !req.CanViewPII() {
+		maskErasure(erasure)
+	}
+
+	res.Erasure = erasure
+
+	return nil
+}
+
+type GetErasuresRequest struct {
+	ContextInfo
+
+	Pagination *repo.Pagination `json:"pagination,omitempty"`
+}
+
+type GetErasuresResponse struct {
+	Erasures   []*entity.Erasure `json:"erasures"`
+	Pagination *repo.Pagination  `json:"pagination,omitempty"`
+}
+
+var GetErasuresValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+	"pagination":  PaginationValidator(),
+})
+
+func (h *udHandler) GetErasures(ctx context.Context, req *GetErasuresRequest, res *GetErasuresResponse) error {
+	if err := GetErasuresValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	if req.Pagination == nil {
+		req.Pagination = new(repo.Pagination)
+	}
+
+	erasures, pagination, err := h.erasureRepo.GetManyByTenantID(ctx, req.GetTenantID(), req.Pagination)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get erasures failed: %v", err)
+		return err
+	}
+
+	if !req.CanViewPII() {
+		for _, erasure := range erasures {
+			maskErasure(erasure)
+		}
+	}
+
+	res.Erasures = erasures
+	res.Pagination = pagination
+
+	return nil
+}
+
+// maskErasure masks the ID kept by a pending erasure.
+func maskErasure(erasure *entity.Erasure) {
+	if ud := erasure.ToUd(); ud != nil && ud.IsPII() {
+		erasure.ExtInfo.UdID = ud.Mask().ID
+	}
+}
+
+type GetUdProfileRequest struct {
+	ContextInfo
+
+	UdID   *string `json:"ud_id,omitempty"`
+	IDType *uint32 `json:"id_type,omitempty"`
+
+	// CampaignEventPagination pages the campaign events, the latest first
+	CampaignEventPagination *repo.Pagination `json:"campaign_event_pagination,omitempty"`
+}
+
+func (r *GetUdProfileRequest) GetUdID() string {
+	if r != nil && r.UdID != nil {
+		return *r.UdID
+	}
+	return ""
+}
+
+func (r *GetUdProfileRequest) GetIDType() uint32 {
+	if r != nil && r.IDType != nil {
+		return *r.IDType
+	}
+	return 0
+}
+
+type GetUdProfileResponse struct {
+	UdProfile               *entity.UdProfile `json:"ud_profile,omitempty"`
+	CampaignEventPagination *repo.Pagination  `json:"campaign_event_pagination,omitempty"`
+}
+
+// defaultCampaignEventLimit is the number of campaign events returned when the request sets no limit.
+const defaultCampaignEventLimit = 100
+
+var GetUdProfileValidator = validator.MustForm(map[string]validator.Validator{
+	"ContextInfo": ContextInfoValidator(false, false),
+	"ud_id":       &validator.String{},
+	"id_type": &validator.UInt32{
+		Validators: []validator.UInt32Func{CheckIDType},
+	},
+	"campaign_event_pagination": PaginationValidator(),
+})
+
+func (h *udHandler) GetUdProfile(ctx context.Context, req *GetUdProfileRequest, res *GetUdProfileResponse) error {
+	if err := GetUdProfileValidator.Validate(req); err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	if req.CampaignEventPagination == nil {
+		req.CampaignEventPagination = new(repo.Pagination)
+	}
+	if req.CampaignEventPagination.GetLimit() == 0 {
+		req.CampaignEventPagination.Limit = goutil.Uint32(defaultCampaignEventLimit)
+	}
+
+	idType := entity.IDType(req.GetIDType())
+
+	udID, err := entity.NormalizeUdID(idType, req.GetUdID())
+	if err != nil {
+		return errutil.ValidationError(err)
+	}
+
+	udTagVal, err := h.queryRepo.GetUdTagVals(ctx, req.GetTenantName(), &entity.Ud{
+		ID:     goutil.String(udID),
+		IDType: idType,
+	})
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get ud tag vals failed: %v", err)
+		return err
+	}
+
+	ud := udTagVal.GetUd()
+
+	profileTagVals, err := getProfileTagVals(ctx, h.tagRepo, req.GetTenantID(), []*entity.UdTagVal{udTagVal}, req.CanViewPII())
+	if err != nil {
+		return err
+	}
+	tagVals := profileTagVals[0]
+
+	linkedUds, err := h.getLinkedUds(ctx, req.GetTenantID(), ud)
+	if err != nil {
+		return err
+	}
+
+	campaignEvents, campaignEventPagination, err := h.getCampaignEvents(ctx, req.GetTenantID(),
+		append([]*entity.Ud{ud}, linkedUds...), req.CampaignEventPagination)
+	if err != nil {
+		return err
+	}
+
+	if !req.CanViewPII() {
+		if ud.IsPII() {
+			ud = ud.Mask()
+		}
+		for i, linkedUd := range linkedUds {
+			if linkedUd.IsPII() {
+				linkedUds[i] = linkedUd.Mask()
+			}
+		}
+		for _, campaignEvent := range campaignEvents {
+			campaignEvent.Email = goutil.String(entity.MaskStr(campaignEvent.GetEmail()))
+		}
+	}
+
+	res.UdProfile = &entity.UdProfile{
+		Ud:             ud,
+		LinkedUds:      linkedUds,
+		TagVals:        tagVals,
+		CampaignEvents: campaignEvents,
+	}
+	res.CampaignEventPagination = campaignEventPagination
+
+	return nil
+}
+
+// getProfileTagVals resolves the tag values of each ud to their tags, in the order of udTagVals, values of deleted tags
+// are dropped. The tags are fetched once for all uds.
+func getProfileTagVals(ctx context.Context, tagRepo repo.TagRepo, tenantID uint64, udTagVals []*entity.UdTagVal,
+	canViewPII bool) ([][]*entity.ProfileTagVal, error) {
+	var (
+		tagIDs   = make([]uint64, 0)
+		seenTags = make(map[uint64]bool)
+	)
+	for _, udTagVal := range udTagVals {
+		for _, tagVal := range udTagVal.GetTagVals() {
+			if !seenTags[tagVal.GetTagID()] {
+				seenTags[tagVal.GetTagID()] = true
+				tagIDs = append(tagIDs, tagVal.GetTagID())
+			}
+		}
+	}
+
+	tags, err := tagRepo.GetManyByIDs(ctx, tenantID, tagIDs)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get tags failed: %v", err)
+		return nil, err
+	}
+
+	tagsByID := make(map[uint64]*entity.Tag, len(tags))
+	for _, tag := range tags {
+		tagsByID[tag.GetID()] = tag
+	}
+
+	profileTagVals := make([][]*entity.ProfileTagVal, 0, len(udTagVals))
+	for _, udTagVal := range udTagVals {
+		profileTagVals = append(profileTagVals, toProfileTagVals(ctx, tagsByID, udTagVal.GetTagVals(), canViewPII))
+	}
+
+	return profileTagVals, nil
+}
+
+// toProfileTagVals resolves the tag values to the tags in tagsByID, values of other tags are dropped.
+func toProfileTagVals(ctx context.Context, tagsByID map[uint64]*entity.Tag, tagVals []*entity.TagVal, canViewPII bool) []*entity.ProfileTagVal {
+	profileTagVals := make([]*entity.ProfileTagVal, 0, len(tagVals))
+	for _, tagVal := range tagVals {
+		tag, ok := tagsByID[tagVal.GetTagID()]
+		if !ok {
+			continue
+		}
+
+		v, err := tag.ToTagValue(tagVal.TagVal)
+		if err != nil {
+			log.Ctx(ctx).Warn().Msgf("invalid tag value, tag ID: %d, err: %v", tag.GetID(), err)
+			continue
+		}
+
+		if tag.IsPII() && !canViewPII {
+			v = entity.MaskTagVal(v)
+		}
+
+		profileTagVals = append(profileTagVals, &entity.ProfileTagVal{
+			TagID:     tag.ID,
+			TagName:   tag.Name,
+			ValueType: tag.GetValueType(),
+			TagVal:    v,
+		})
+	}
+
+	sort.Slice(profileTagVals, func(i, j int) bool {
+		return profileTagVals[i].GetTagName() < profileTagVals[j].GetTagName()
+	})
+
+	return profileTagVals
+}
+
+// getLinkedUds gets the other uds in the profile of ud.
+func (h *udHandler) getLinkedUds(ctx context.Context, tenantID uint64, ud *entity.Ud) ([]*entity.Ud, error) {
+	linkedUds := make([]*entity.Ud, 0)
+	if ud.GetProfileID() == 0 {
+		return linkedUds, nil
+	}
+
+	mappingIDs, err := h.mappingIDRepo.GetManyByProfileIDs(ctx, tenantID, []uint64{ud.GetProfileID()})
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get mapping ids failed: %v", err)
+		return nil, err
+	}
+
+	for _, mappingID := range mappingIDs {
+		if mappingID.GetUdID() == ud.ToDocID() {
+			continue
+		}
+
+		linkedUd, err := mappingID.ToUd()
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("invalid mapping id: %v", err)
+			return nil, err
+		}
+		linkedUds = append(linkedUds, linkedUd)
+	}
+
+	return linkedUds, nil
+}
+
+// getCampaignEvents gets a page of the campaign logs of the email uds in the tenant campaigns.
+func (h *udHandler) getCampaignEvents(ctx context.Context, tenantID uint64, uds []*entity.Ud, p *repo.Pagination) ([]*entity.CampaignEvent, *repo.Pagination, error) {
+	emails := make([]string, 0)
+	for _, ud := range uds {
+		if ud.GetIDType() == entity.IDTypeEmail {
+			emails = append(emails, ud.GetID())
+		}
+	}
+
+	campaignLogs, pagination, err := h.campaignLogRepo.GetManyByEmails(ctx, tenantID, emails, p)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get campaign logs failed: %v", err)
+		return nil, nil, err
+	}
+
+	campaignEmailIDs := make([]uint64, 0, len(campaignLogs))
+	for _, campaignLog := range campaignLogs {
+		campaignEmailIDs = append(campaignEmailIDs, campaignLog.GetCampaignEmailID())
+	}
+
+	campaigns, err := h.campaignRepo.GetManyByCampaignEmailIDs(ctx, tenantID, campaignEmailIDs)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get campaigns failed: %v", err)
+		return nil, nil, err
+	}
+
+	type campaignEmailOwner struct {
+		campaign      *entity.Campaign
+		campaignEmail *entity.CampaignEmail
+	}
+
+	owners := make(map[uint64]*campaignEmailOwner)
+	for _, campaign := range campaigns {
+		for _, campaignEmail := range campaign.CampaignEmails {
+			owners[campaignEmail.GetID()] = &campaignEmailOwner{
+				campaign:      campaign,
+				campaignEmail: campaignEmail,
+			}
+		}
+	}
+
+	campaignEvents := make([]*entity.CampaignEvent, 0, len(campaignLogs))
+	for _, campaignLog := range campaignLogs {
+		owner, ok := owners[campaignLog.GetCampaignEmailID()]
+		if !ok {
+			continue
+		}
+
+		campaignEvents = append(campaignEvents, &entity.CampaignEvent{
+			CampaignID:      owner.campaign.ID,
+			CampaignName:    owner.campaign.Name,
+			CampaignEmailID: campaignLog.CampaignEmailID,
+			Subject:         owner.campaignEmail.Subject,
+			Email:           campaignLog.Email,
+			Event:           campaignLog.GetEvent(),
+			Link:            campaignLog.Link,
+			EventTime:       campaignLog.EventTime,
+		})
+	}
+
+	sort.Slice(campaignEvents, func(i, j int) bool {
+		return campaignEvents[i].GetEventTime() > campaignEvents[j].GetEventTime()
+	})
+
+	return campaignEvents, pagination, nil
+}
@@ -10,6 +10,8 @@ import (
 	"fmt"
 	"net/mail"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -174,23 +176,43 @@ func DomainValidator(optional bool) validator.Validator {
 
 type QueryValidator interface {
 	Validate(ctx context.Context, query *entity.Query) error
+	// ValidateSegment validates the criteria of an existing segment, references leading back to it are rejected.
+	ValidateSegment(ctx context.Context, segmentID uint64, query *entity.Query) error
+	// ValidateEach validates the query like Validate, but does not stop at the first error.
+	// It returns every lookup of the query with its own error, and all the errors found, prefixed with their path.
+	ValidateEach(ctx context.Context, query *entity.Query) ([]*LookupResult, []error)
+}
+
+// LookupResult is a lookup of a query validated by ValidateEach, Err is nil if the lookup is valid.
+type LookupResult struct {
+	Path   string
+	Lookup *entity.Lookup
+	// IDType is the ID type the lookup is limited to by its enclosing queries, the innermost one set wins.
+	IDType entity.IDType
+	Err    error
 }
 
 type queryValidator struct {
-	tenantID uint64
-	tagRepo  repo.TagRepo
-	optional bool
+	tenantID    uint64
+	tagRepo     repo.TagRepo
+	segmentRepo repo.SegmentRepo
+	optional    bool
 }
 
-func NewQueryValidator(tenantID uint64, tagRepo repo.TagRepo, optional bool) QueryValidator {
+func NewQueryValidator(tenantID uint64, tagRepo repo.TagRepo, segmentRepo repo.SegmentRepo, optional bool) QueryValidator {
 	return &queryValidator{
-		tenantID: tenantID,
-		tagRepo:  tagRepo,
-		optional: optional,
+		tenantID:    tenantID,
+		tagRepo:     tagRepo,
+		segmentRepo: segmentRepo,
+		optional:    optional,
 	}
 }
 
 func (v *queryValidator) Validate(ctx context.Context, query *entity.Query) error {
+	return v.ValidateSegment(ctx, 0, query)
+}
+
+func (v *queryValidator) ValidateSegment(ctx context.Context, segmentID uint64, query *entity.Query) error {
 	if query == nil {
 		if !v.optional {
 			return errors.New("missing query")
@@ -199,6 +221,139 @@ func (v *queryValidator) Validate(ctx context.Context, query *entity.Query) erro
 		if err := v.validateQuery(ctx, query, 0); err != nil {
 			return err
 		}
+
+		path := make([]uint64, 0)
+		if segmentID != 0 {
+			path = append(path, segmentID)
+		}
+
+		if err := v.validateSegmentRefs(ctx, query, path); err != nil {
+			return err
+		}
+
+		// a new segment has no tag derived from it yet
+		if segmentID != 0 {
+			if err := v.validateDerivedTagRefs(ctx, segmentID, query); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateDerivedTagRefs rejects criteria using a tag derived from the segment itself, directly or through
+// referenced segments and other derived tags, as the tag would then be materialized from its own values.
+func (v *queryValidator) validateDerivedTagRefs(ctx context.Context, segmentID uint64, query *entity.Query) error {
+	var (
+		seenTags     = make(map[uint64]bool)
+		seenSegments = make(map[uint64]bool)
+		walkQuery    func(query *entity.Query) error
+		walkSegment  func(id uint64) error
+		walkTag      func(tagID uint64) error
+	)
+	walkQuery = func(query *entity.Query) error {
+		for _, tagID := range query.GetTagIDs() {
+			if err := walkTag(tagID); err != nil {
+				return err
+			}
+		}
+		for _, id := range query.GetSegmentIDs() {
+			if err := walkSegment(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	walkSegment = func(id uint64) error {
+		// references back to the segment are rejected by validateSegmentRefs
+		if id == segmentID || seenSegments[id] {
+			return nil
+		}
+		seenSegments[id] = true
+
+		segment, err := v.segmentRepo.GetByID(ctx, v.tenantID, id)
+		if err != nil {
+			return err
+		}
+
+		// a static segment references nothing, its uds are frozen
+		if segment.IsStatic() {
+			return nil
+		}
+
+		return walkQuery(segment.GetCriteria())
+	}
+	walkTag = func(tagID uint64) error {
+		if seenTags[tagID] {
+			return nil
+		}
+		seenTags[tagID] = true
+
+		tag, err := v.tagRepo.GetByID(ctx, v.tenantID, tagID)
+		if err != nil {
+			return err
+		}
+
+		if !tag.IsDerived() {
+			return nil
+		}
+
+		derivation := tag.GetExtInfo().GetDerivation()
+		if derivation.SegmentID != nil {
+			if derivation.GetSegmentID() == segmentID {
+				return fmt.Errorf("tag %s is derived from the segment itself", tag.GetName())
+			}
+			return walkSegment(derivation.GetSegmentID())
+		}
+
+		tagIDs, err := derivation.GetTagIDs()
+		if err != nil {
+			return err
+		}
+
+		for _, tagID := range tagIDs {
+			if err := walkTag(tagID); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return walkQuery(query)
+}
+
+// validateSegmentRefs follows the segment references of the query, path holds the segments referencing it.
+func (v *queryValidator) validateSegmentRefs(ctx context.Context, query *entity.Query, path []uint64) error {
+	for _, segmentID := range query.GetSegmentIDs() {
+		for i, id := range path {
+			if id == segmentID {
+				cycle := make([]string, 0, len(path)-i+1)
+				for _, id := range append(path[i:], segmentID) {
+					cycle = append(cycle, strconv.FormatUint(id, 10))
+				}
+				return fmt.Errorf("segment reference cycle: %s", strings.Join(cycle, " -> "))
+			}
+		}
+
+		segment, err := v.segmentRepo.GetByID(ctx, v.tenantID, segmentID)
+		if err != nil {
+			return err
+		}
+
+		// a static segment references nothing, its uds are frozen
+		if segment.IsStatic() {
+			continue
+		}
+
+		if len(path) >= repo.MaxSegmentRefDepth {
+			return fmt.Errorf("segment references exceed max depth (%d)", repo.MaxSegmentRefDepth)
+		}
+
+		if err := v.validateSegmentRefs(ctx, segment.GetCriteria(), append(path[:len(path):len(path)], segmentID)); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -209,6 +364,27 @@ func (v *queryValidator) validateQuery(ctx context.Context, query *entity.Query,
 		return nil
 	}
 
+	if err := checkQuery(query, depth); err != nil {
+		return err
+	}
+
+	for _, query := range query.Queries {
+		if err := v.validateQuery(ctx, query, depth+1); err != nil {
+			return err
+		}
+	}
+
+	for _, lookup := range query.Lookups {
+		if err := v.validateLookup(ctx, lookup); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkQuery checks the query itself, but not its sub-queries or lookups.
+func checkQuery(query *entity.Query, depth int) error {
 	if depth > MaxQueryDepth {
 		return fmt.Errorf("query depth exceeds max depth (%d)", MaxQueryDepth)
 	}
@@ -221,19 +397,81 @@ func (v *queryValidator) validateQuery(ctx context.Context, query *entity.Query,
 		return fmt.Errorf("invalid query op, only %s or %s are supported", entity.QueryOpAnd, entity.QueryOpOr)
 	}
 
-	for _, query := range query.Queries {
-		if err := v.validateQuery(ctx, query, depth+1); err != nil {
+	if query.IDType != entity.IDTypeUnknown {
+		if err := CheckIDType(uint32(query.GetIDType())); err != nil {
 			return err
 		}
 	}
 
-	for _, lookup := range query.Lookups {
-		if err := v.validateLookup(ctx, lookup); err != nil {
-			return err
+	return nil
+}
+
+func (v *queryValidator) ValidateEach(ctx context.Context, query *entity.Query) ([]*LookupResult, []error) {
+	var (
+		results = make([]*LookupResult, 0)
+		errs    = make([]error, 0)
+	)
+
+	if query == nil {
+		if !v.optional {
+			errs = append(errs, errors.New("missing query"))
 		}
+		return results, errs
 	}
 
-	return nil
+	var walk func(query *entity.Query, path string, depth int, idType entity.IDType)
+	walk = func(query *entity.Query, path string, depth int, idType entity.IDType) {
+		if query == nil {
+			return
+		}
+
+		if query.GetIDType() != entity.IDTypeUnknown {
+			idType = query.GetIDType()
+		}
+
+		if err := checkQuery(query, depth); err != nil {
+			at := strings.TrimSuffix(path, ".")
+			if at == "" {
+				at = "criteria"
+			}
+			errs = append(errs, fmt.Errorf("%s: %v", at, err))
+
+			// the sub-queries would only repeat the depth error
+			if depth > MaxQueryDepth {
+				return
+			}
+		}
+
+		for i, lookup := range query.Lookups {
+			if lookup == nil {
+				continue
+			}
+
+			result := &LookupResult{
+				Path:   fmt.Sprintf("%slookups[%d]", path, i),
+				Lookup: lookup,
+				IDType: idType,
+				Err:    v.validateLookup(ctx, lookup),
+			}
+
+			// references are followed one lookup at a time, so that a bad reference is told apart
+			if result.Err == nil && lookup.IsSegmentRef() {
+				result.Err = v.validateSegmentRefs(ctx, &entity.Query{Lookups: []*entity.Lookup{lookup}}, make([]uint64, 0))
+			}
+
+			if result.Err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", result.Path, result.Err))
+			}
+			results = append(results, result)
+		}
+
+		for i, query := range query.Queries {
+			walk(query, fmt.Sprintf("%squeries[%d].", path, i), depth+1, idType)
+		}
+	}
+	walk(query, "", 0, entity.IDTypeUnknown)
+
+	return results, errs
 }
 
 func (v *queryValidator) validateLookup(ctx context.Context, lookup *entity.Lookup) error {
@@ -241,6 +479,28 @@ func (v *queryValidator) validateLookup(ctx context.Context, lookup *entity.Look
 		return nil
 	}
 
+	if lookup.IsSegmentRef() {
+		if lookup.TagID != nil || lookup.Op != "" || lookup.Val != nil || lookup.AsOf != nil || lookup.Split != nil {
+			return errors.New("segment lookup cannot have tag id, op, val, as_of or split")
+		}
+		return nil
+	}
+
+	if lookup.IsSplit() {
+		if lookup.TagID != nil || lookup.Op != "" || lookup.Val != nil || lookup.AsOf != nil {
+			return errors.New("split lookup cannot have tag id, op, val or as_of")
+		}
+
+		split := lookup.Split
+		if split.Seed == nil || split.From == nil || split.To == nil {
+			return errors.New("split lookup expects a seed, from and to")
+		}
+		if split.GetFrom() >= split.GetTo() || split.GetTo() > entity.SplitScale {
+			return fmt.Errorf("split lookup expects 0 <= from < to <= %d", entity.SplitScale)
+		}
+		return nil
+	}
+
 	if lookup.TagID == nil {
 		return errors.New("missing tag id in lookup")
 	}
@@ -262,18 +522,80 @@ func (v *queryValidator) validateLookup(ctx context.Context, lookup *entity.Look
 		return errors.New("invalid lookup op")
 	}
 
+	if !tag.IsValidLookupOp(lookup.Op) {
+		return fmt.Errorf("lookup op %s is not supported by tag %s", lookup.Op, tag.GetName())
+	}
+
+	if lookup.AsOf != nil && !tag.KeepsHistory() {
+		return fmt.Errorf("tag %s does not keep history, 'as_of' is not supported", tag.GetName())
+	}
+
+	if lookup.Op == entity.LookupOpExists || lookup.Op == entity.LookupOpMissing {
+		if lookup.Val != nil {
+			return fmt.Errorf("op '%s' takes no val", lookup.Op)
+		}
+
+		// a history entry tells the value at a time, but not the absence of it
+		if lookup.Op == entity.LookupOpMissing && lookup.AsOf != nil {
+			return fmt.Errorf("op '%s' cannot be used with 'as_of', use '%s' with 'not' instead",
+				lookup.Op, entity.LookupOpExists)
+		}
+
+		return nil
+	}
+
 	if lookup.Val == nil {
 		return errors.New("missing val in lookup")
 	}
 
-	if lookup.Op == entity.LookupOpIn {
+	if lookup.Op == entity.LookupOpChangedWithin {
+		if lookup.AsOf != nil {
+			return fmt.Errorf("op '%s' cannot be used with 'as_of'", lookup.Op)
+		}
+
+		days, err := strconv.ParseUint(fmt.Sprint(lookup.GetVal()), 10, 32)
+		if err != nil || days == 0 {
+			return fmt.Errorf("op '%s' expects a positive number of days", lookup.Op)
+		}
+
+		return nil
+	}
+
+	// prefix and contains match part of a value, so they are not checked against the enum
+	if lookup.Op == entity.LookupOpPrefix || lookup.Op == entity.LookupOpContains {
+		if str, ok := lookup.Val.(string); !ok || str == "" {
+			return fmt.Errorf("op '%s' expects a non-empty string", lookup.Op)
+		}
+		return nil
+	}
+
+	if lookup.Op == entity.LookupOpBetween {
+		arr, ok := lookup.Val.([]interface{})
+		if !ok || len(arr) != 2 {
+			return fmt.Errorf("op '%s' expects an array of [from, to]", lookup.Op)
+		}
+
+		for _, val := range arr {
+			if ok := tag.IsValidTagValue(fmt.Sprint(val)); !ok {
+				return fmt.Errorf("lookup tag value %v is invalid", val)
+			}
+		}
+
+		if isDescending(tag, arr[0], arr[1]) {
+			return fmt.Errorf("op '%s' expects from %v to be no greater than to %v", lookup.Op, arr[0], arr[1])
+		}
+
+		return nil
+	}
+
+	if lookup.Op == entity.LookupOpIn || lookup.Op == entity.LookupOpNotIn || lookup.Op == entity.LookupOpContainsAny {
 		arr, ok := lookup.Val.([]interface{})
 		if !ok {
-			return errors.New("op 'in' expects an array")
+			return fmt.Errorf("op '%s' expects an array", lookup.Op)
 		}
 
 		if len(arr) == 0 {
-			return errors.New("'in' expects a non-empty array")
+			return fmt.Errorf("'%s' expects a non-empty array", lookup.Op)
 		}
 
 		for _, val := range arr {
@@ -290,6 +612,28 @@ func (v *queryValidator) validateLookup(ctx context.Context, lookup *entity.Look
 	return nil
 }
 
+// isDescending tells whether from is greater than to, in the order the values of the tag are compared.
+func isDescending(tag *entity.Tag, from, to interface{}) bool {
+	a, err := tag.FormatTagValue(fmt.Sprint(from))
+	if err != nil {
+		return false
+	}
+
+	b, err := tag.FormatTagValue(fmt.Sprint(to))
+	if err != nil {
+		return false
+	}
+
+	if tag.GetValueType() == entity.TagValueTypeStr {
+		return fmt.Sprint(a) > fmt.Sprint(b)
+	}
+
+	x, errX := strconv.ParseFloat(fmt.Sprint(a), 64)
+	y, errY := strconv.ParseFloat(fmt.Sprint(b), 64)
+
+	return errX == nil && errY == nil && x > y
+}
+
 func FileUploadValidator(optional bool, maxSize int64, contentType []string) validator.Validator {
 	return validator.MustForm(map[string]validator.Validator{
 		"FileMeta": &fileMetaValidator{
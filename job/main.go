@@ -5,8 +5,15 @@ import (
 	"cdp/dep"
 	"cdp/handler"
 	"cdp/job/hello_world"
+	"cdp/job/materialize_derived_tags"
+	"cdp/job/record_segment_sizes"
 	"cdp/job/run_campaigns"
+	"cdp/job/run_erasures"
 	"cdp/job/run_file_upload_tasks"
+	"cdp/job/run_identity_mapping_tasks"
+	"cdp/job/run_segment_export_tasks"
+	"cdp/job/run_segment_snapshot_tasks"
+	"cdp/job/start_tag_history"
 	"cdp/pkg/logutil"
 	"cdp/pkg/service"
 	"cdp/repo"
@@ -43,7 +50,7 @@ func main() {
 	}()
 
 	// query repo
-	queryRepo, err := repo.NewQueryRepo(ctx, cfg.QueryDB)
+	queryRepo, err := repo.NewQueryRepo(ctx, cfg, baseRepo)
 	if err != nil {
 		log.Ctx(ctx).Error().Msgf("init query repo failed, err: %v", err)
 		os.Exit(1)
@@ -111,17 +118,44 @@ func main() {
 	// sender repo
 	senderRepo := repo.NewSenderRepo(ctx, baseRepo)
 
+	// mapping id repo
+	mappingIDRepo := repo.NewMappingIDRepo(ctx, baseRepo)
+
+	// campaign log repo
+	campaignLogRepo := repo.NewCampaignLogRepo(ctx, baseRepo)
+
+	// erasure repo
+	erasureRepo, err := repo.NewErasureRepo(ctx, baseRepo, cfg.UdHashSecret)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("init erasure repo failed, err: %v", err)
+		os.Exit(1)
+	}
+
+	// segment size repo
+	segmentSizeRepo := repo.NewSegmentSizeRepo(ctx, baseRepo)
+
 	// segment handler
-	segmentHandler := handler.NewSegmentHandler(cfg, tagRepo, segmentRepo, queryRepo)
+	segmentHandler := handler.NewSegmentHandler(cfg, baseRepo, tagRepo, segmentRepo, queryRepo, campaignRepo,
+		segmentSizeRepo, taskRepo)
 
 	// email handler
 	emailHandler := handler.NewEmailHandler(emailRepo)
 
 	jobs := map[string]service.Job{
-		"hello-world":           hello_world.New(),
-		"run-file-upload-tasks": run_file_upload_tasks.New(taskRepo, fileRepo, queryRepo, tenantRepo, tagRepo),
+		"hello-world": hello_world.New(),
+		"run-file-upload-tasks": run_file_upload_tasks.New(cfg, taskRepo, fileRepo, queryRepo, tenantRepo, tagRepo,
+			erasureRepo, segmentRepo, mappingIDRepo),
 		"run-campaigns": run_campaigns.New(cfg, campaignRepo, emailService, segmentHandler,
 			emailHandler, tenantRepo, senderRepo),
+		"materialize-derived-tags": materialize_derived_tags.New(tagRepo, segmentRepo, tenantRepo, queryRepo),
+		"run-identity-mapping-tasks": run_identity_mapping_tasks.New(cfg, baseRepo, taskRepo, fileRepo, queryRepo,
+			tenantRepo, mappingIDRepo, erasureRepo),
+		"run-erasures":         run_erasures.New(tenantRepo, queryRepo, erasureRepo, mappingIDRepo, campaignLogRepo),
+		"record-segment-sizes": record_segment_sizes.New(tenantRepo, segmentRepo, segmentSizeRepo, queryRepo),
+		"run-segment-export-tasks": run_segment_export_tasks.New(taskRepo, fileRepo, queryRepo, tenantRepo, tagRepo,
+			segmentRepo),
+		"run-segment-snapshot-tasks": run_segment_snapshot_tasks.New(taskRepo, queryRepo, tenantRepo, segmentRepo),
+		"start-tag-history":          start_tag_history.New(tagRepo, tenantRepo, queryRepo),
 	}
 
 	if len(os.Args) < 2 {
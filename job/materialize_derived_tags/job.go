@@ -0,0 +1,286 @@
+package materialize_derived_tags
+
+import (
+	"cdp/entity"
+	"cdp/pkg/goutil"
+	"cdp/pkg/service"
+	"cdp/repo"
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+	"time"
+)
+
+const (
+	batchSize    = 3_000
+	downloadSize = 1_000
+)
+
+type MaterializeDerivedTags struct {
+	tagRepo     repo.TagRepo
+	segmentRepo repo.SegmentRepo
+	tenantRepo  repo.TenantRepo
+	queryRepo   repo.QueryRepo
+}
+
+func New(tagRepo repo.TagRepo, segmentRepo repo.SegmentRepo, tenantRepo repo.TenantRepo, queryRepo repo.QueryRepo) service.Job {
+	return &MaterializeDerivedTags{
+		tagRepo:     tagRepo,
+		segmentRepo: segmentRepo,
+		tenantRepo:  tenantRepo,
+		queryRepo:   queryRepo,
+	}
+}
+
+func (h *MaterializeDerivedTags) Init(_ context.Context) error {
+	return nil
+}
+
+func (h *MaterializeDerivedTags) Run(ctx context.Context) error {
+	var (
+		g  = new(errgroup.Group)
+		c  = 10
+		ch = make(chan struct{}, c)
+	)
+
+	tags, err := h.tagRepo.GetDerivedTags(ctx, 0)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get derived tags failed: %v", err)
+		return err
+	}
+
+	log.Ctx(ctx).Info().Msgf("number of derived tags to be materialized: %d", len(tags))
+
+	for _, tag := range tags {
+		select {
+		case ch <- struct{}{}:
+		}
+
+		tag := tag
+		g.Go(func() error {
+			// release go routine
+			defer func() {
+				<-ch
+			}()
+
+			tenant, err := h.tenantRepo.GetByID(ctx, tag.GetTenantID())
+			if err != nil {
+				log.Ctx(ctx).Error().Msgf("[tag ID %d] get tenant failed: %v", tag.GetID(), err)
+				return err
+			}
+
+			if err := h.materialize(ctx, tenant, tag); err != nil {
+				log.Ctx(ctx).Error().Msgf("[tag ID %d] materialize failed: %v", tag.GetID(), err)
+				return err
+			}
+
+			if err := h.tagRepo.SetLastMaterializeTime(ctx, tag.GetTenantID(), tag.GetID(), uint64(time.Now().Unix())); err != nil {
+				log.Ctx(ctx).Error().Msgf("[tag ID %d] set last materialize time failed: %v", tag.GetID(), err)
+				return err
+			}
+
+			log.Ctx(ctx).Info().Msgf("derived tag is materialized, tag_id: %v", tag.GetID())
+
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// materialize writes the derived value of every ud page by page, so that the memory used does not grow with the tenant.
+func (h *MaterializeDerivedTags) materialize(ctx context.Context, tenant *entity.Tenant, tag *entity.Tag) error {
+	if tag.GetExtInfo().GetDerivation().SegmentID != nil {
+		return h.materializeSegmentMembership(ctx, tenant, tag)
+	}
+	return h.materializeFromTagVals(ctx, tenant, tag)
+}
+
+// materializeSegmentMembership sets the tag of the members of the segment to true, and of all other uds to false.
+func (h *MaterializeDerivedTags) materializeSegmentMembership(ctx context.Context, tenant *entity.Tenant, tag *entity.Tag) error {
+	derivation := tag.GetExtInfo().GetDerivation()
+
+	segment, err := h.segmentRepo.GetByID(ctx, tenant.GetID(), derivation.GetSegmentID())
+	if err != nil {
+		return fmt.Errorf("get segment failed: %v", err)
+	}
+
+	var (
+		criteria = segment.GetCriteria()
+		queries  = map[bool]*entity.Query{
+			true: criteria,
+			false: {
+				Queries: []*entity.Query{criteria},
+				Op:      entity.QueryOpAnd,
+				Not:     goutil.Bool(true),
+			},
+		}
+	)
+	for isMember, query := range queries {
+		cursor := ""
+		for {
+			uds, page, err := h.queryRepo.Download(ctx, tenant, query, &repo.Pagination{
+				Limit:  goutil.Uint32(downloadSize),
+				Cursor: goutil.String(cursor),
+			})
+			if err != nil {
+				return fmt.Errorf("download uds failed: %v", err)
+			}
+
+			udTagVals := make([]*entity.UdTagVal, 0, len(uds))
+			for _, ud := range uds {
+				udTagVals = append(udTagVals, h.toUdTagVal(ud, tag, isMember))
+			}
+
+			if err := h.upsert(ctx, tenant.GetName(), udTagVals); err != nil {
+				return err
+			}
+
+			cursor = page.GetCursor()
+			if cursor == "" {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// materializeFromTagVals computes the tag from the source tag values of each ud. Uds whose value cannot be
+// computed any more, e.g. a source value was removed, have their old value cleared.
+func (h *MaterializeDerivedTags) materializeFromTagVals(ctx context.Context, tenant *entity.Tenant, tag *entity.Tag) error {
+	derivation := tag.GetExtInfo().GetDerivation()
+
+	tagIDs, err := derivation.GetTagIDs()
+	if err != nil {
+		return fmt.Errorf("get tag ids failed: %v", err)
+	}
+
+	var expr *entity.TagExpr
+	if derivation.Expr != nil {
+		if expr, err = entity.ParseTagExpr(derivation.GetExpr()); err != nil {
+			return fmt.Errorf("parse expr failed: %v", err)
+		}
+	}
+
+	var (
+		// the tag itself is downloaded to tell the uds having a value to clear
+		downloadTagIDs = append(append([]uint64{}, tagIDs...), tag.GetID())
+		cursor         = ""
+	)
+	for {
+		docs, page, err := h.queryRepo.DownloadTagVals(ctx, tenant, nil, downloadTagIDs, &repo.Pagination{
+			Limit:  goutil.Uint32(downloadSize),
+			Cursor: goutil.String(cursor),
+		})
+		if err != nil {
+			return fmt.Errorf("download tag values failed: %v", err)
+		}
+
+		udTagVals := make([]*entity.UdTagVal, 0, len(docs))
+		for _, doc := range docs {
+			var (
+				vals     = make(map[uint64]float64)
+				hasValue bool
+			)
+			for _, tagVal := range doc.TagVals {
+				if tagVal.GetTagID() == tag.GetID() {
+					hasValue = true
+					continue
+				}
+				if v, ok := tagVal.GetTagVal().(float64); ok {
+					vals[tagVal.GetTagID()] = v
+				}
+			}
+
+			v := h.compute(derivation, expr, vals)
+			if v == nil && !hasValue {
+				continue
+			}
+
+			udTagVals = append(udTagVals, h.toUdTagVal(doc.Ud, tag, v))
+		}
+
+		if err := h.upsert(ctx, tenant.GetName(), udTagVals); err != nil {
+			return err
+		}
+
+		cursor = page.GetCursor()
+		if cursor == "" {
+			break
+		}
+	}
+
+	return nil
+}
+
+// compute returns the derived value of a ud, or nil if it cannot be computed from the source values.
+func (h *MaterializeDerivedTags) compute(derivation *entity.TagDerivation, expr *entity.TagExpr, vals map[uint64]float64) interface{} {
+	if expr != nil {
+		f, err := expr.Eval(vals)
+		if err != nil {
+			return nil
+		}
+		return f
+	}
+
+	f, ok := vals[derivation.GetSourceTagID()]
+	if !ok {
+		return nil
+	}
+
+	if label := derivation.GetBucketLabel(f); label != "" {
+		return label
+	}
+
+	return nil
+}
+
+// toUdTagVal sets the tag of the ud to v, a nil v clears the value.
+func (h *MaterializeDerivedTags) toUdTagVal(ud *entity.Ud, tag *entity.Tag, v interface{}) *entity.UdTagVal {
+	return &entity.UdTagVal{
+		Ud: ud,
+		TagVals: []*entity.TagVal{
+			{
+				TagID:       tag.ID,
+				TagVal:      v,
+				KeepHistory: tag.KeepsHistory(),
+			},
+		},
+	}
+}
+
+func (h *MaterializeDerivedTags) upsert(ctx context.Context, tenantName string, udTagVals []*entity.UdTagVal) error {
+	upsertResChan := make(chan repo.UpsertResult, len(udTagVals))
+
+	for i := 0; i < len(udTagVals); i += batchSize {
+		end := min(i+batchSize, len(udTagVals))
+		if err := h.queryRepo.BatchUpsert(ctx, tenantName, udTagVals[i:end], upsertResChan); err != nil {
+			return fmt.Errorf("batch upsert err: %v", err)
+		}
+	}
+
+	// wait for all upserts to be flushed
+	var failed int
+	for range udTagVals {
+		select {
+		case upsertRes := <-upsertResChan:
+			if upsertRes.Error != nil {
+				failed++
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d upserts failed", failed, len(udTagVals))
+	}
+
+	return nil
+}
+
+func (h *MaterializeDerivedTags) CleanUp(_ context.Context) error {
+	return nil
+}
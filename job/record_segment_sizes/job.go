@@ -0,0 +1,117 @@
+package record_segment_sizes
+
+import (
+	"cdp/entity"
+	"cdp/pkg/goutil"
+	"cdp/pkg/service"
+	"cdp/repo"
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+	"sync/atomic"
+	"time"
+)
+
+// RecordSegmentSizes records the size of every segment, it is scheduled to run daily.
+// Running it again on the same day replaces the sizes recorded earlier on that day.
+type RecordSegmentSizes struct {
+	tenantRepo      repo.TenantRepo
+	segmentRepo     repo.SegmentRepo
+	segmentSizeRepo repo.SegmentSizeRepo
+	queryRepo       repo.QueryRepo
+}
+
+func New(tenantRepo repo.TenantRepo, segmentRepo repo.SegmentRepo, segmentSizeRepo repo.SegmentSizeRepo,
+	queryRepo repo.QueryRepo) service.Job {
+	return &RecordSegmentSizes{
+		tenantRepo:      tenantRepo,
+		segmentRepo:     segmentRepo,
+		segmentSizeRepo: segmentSizeRepo,
+		queryRepo:       queryRepo,
+	}
+}
+
+func (h *RecordSegmentSizes) Init(_ context.Context) error {
+	return nil
+}
+
+func (h *RecordSegmentSizes) Run(ctx context.Context) error {
+	var (
+		g  = new(errgroup.Group)
+		c  = 10
+		ch = make(chan struct{}, c)
+
+		day    = uint64(time.Now().UTC().Truncate(24 * time.Hour).Unix())
+		failed atomic.Int64
+	)
+
+	segments, err := h.segmentRepo.GetManyByTenantID(ctx, 0)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get segments failed: %v", err)
+		return err
+	}
+
+	log.Ctx(ctx).Info().Msgf("number of segments to be recorded: %d", len(segments))
+
+	for _, segment := range segments {
+		select {
+		case ch <- struct{}{}:
+		}
+
+		segment := segment
+		g.Go(func() error {
+			// release go routine
+			defer func() {
+				<-ch
+			}()
+
+			// a failed segment, e.g. referencing a tag deleted from the store, should not stop the others
+			if err := h.record(ctx, segment, day); err != nil {
+				log.Ctx(ctx).Error().Msgf("[segment ID %d] record segment size failed: %v", segment.GetID(), err)
+				failed.Add(1)
+			}
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	if n := failed.Load(); n > 0 {
+		return fmt.Errorf("record segment size failed for %d segment(s)", n)
+	}
+
+	return nil
+}
+
+func (h *RecordSegmentSizes) record(ctx context.Context, segment *entity.Segment, day uint64) error {
+	tenant, err := h.tenantRepo.GetByID(ctx, segment.GetTenantID())
+	if err != nil {
+		return fmt.Errorf("get tenant failed: %v", err)
+	}
+
+	size, err := h.queryRepo.CountProfiles(ctx, tenant, segment.GetCriteria())
+	if err != nil {
+		return fmt.Errorf("count segment failed: %v", err)
+	}
+
+	if err := h.segmentSizeRepo.Record(ctx, &entity.SegmentSize{
+		TenantID:  goutil.Uint64(segment.GetTenantID()),
+		SegmentID: goutil.Uint64(segment.GetID()),
+		Size:      goutil.Uint64(size),
+		Day:       goutil.Uint64(day),
+	}); err != nil {
+		return fmt.Errorf("save segment size failed: %v", err)
+	}
+
+	log.Ctx(ctx).Info().Msgf("segment size is recorded, segment_id: %v, size: %v", segment.GetID(), size)
+
+	return nil
+}
+
+func (h *RecordSegmentSizes) CleanUp(_ context.Context) error {
+	return nil
+}
@@ -120,8 +120,10 @@ func (h *RunCampaigns) Run(ctx context.Context) error {
 				return err
 			}
 
+			// emails are sent to the actual ud IDs, so PII must not be masked
 			contextInfo := handler.ContextInfo{
-				Tenant: tenant,
+				Tenant:  tenant,
+				ViewPII: true,
 			}
 
 			var (
@@ -147,7 +149,13 @@ func (h *RunCampaigns) Run(ctx context.Context) error {
 				}
 
 				cursor = downloadUdsRes.GetPagination().GetCursor()
-				uds = append(uds, downloadUdsRes.Uds...)
+
+				// only uds identified by email can be reached
+				for _, ud := range downloadUdsRes.Uds {
+					if ud.GetIDType() == entity.IDTypeEmail {
+						uds = append(uds, ud)
+					}
+				}
 
 				if cursor == "" {
 					break
@@ -0,0 +1,233 @@
+package run_erasures
+
+import (
+	"cdp/entity"
+	"cdp/pkg/goutil"
+	"cdp/pkg/service"
+	"cdp/repo"
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// maxAttempts is the number of times an erasure is run before it is marked as failed.
+const maxAttempts = 3
+
+type RunErasures struct {
+	tenantRepo      repo.TenantRepo
+	queryRepo       repo.QueryRepo
+	erasureRepo     repo.ErasureRepo
+	mappingIDRepo   repo.MappingIDRepo
+	campaignLogRepo repo.CampaignLogRepo
+}
+
+func New(tenantRepo repo.TenantRepo, queryRepo repo.QueryRepo, erasureRepo repo.ErasureRepo, mappingIDRepo repo.MappingIDRepo,
+	campaignLogRepo repo.CampaignLogRepo) service.Job {
+	return &RunErasures{
+		tenantRepo:      tenantRepo,
+		queryRepo:       queryRepo,
+		erasureRepo:     erasureRepo,
+		mappingIDRepo:   mappingIDRepo,
+		campaignLogRepo: campaignLogRepo,
+	}
+}
+
+func (h *RunErasures) Init(_ context.Context) error {
+	return nil
+}
+
+func (h *RunErasures) Run(ctx context.Context) error {
+	erasures, err := h.erasureRepo.GetPendingErasures(ctx)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get pending erasures failed: %v", err)
+		return err
+	}
+
+	log.Ctx(ctx).Info().Msgf("number of erasures to be processed: %d", len(erasures))
+
+	var erasureErr error
+	for _, erasure := range erasures {
+		if err := h.runErasure(ctx, erasure); err != nil {
+			log.Ctx(ctx).Error().Msgf("[erasure ID %d] error encountered: %v", erasure.GetID(), err)
+
+			// a failed erasure goes back to pending to be retried by the next run, once it runs out of
+			// attempts the raw ID is cleared, only the hash is kept
+			var (
+				attempts = erasure.GetExtInfo().GetAttempts() + 1
+				extInfo  = &entity.ErasureExtInfo{
+					FailReason: goutil.String(err.Error()),
+					Attempts:   goutil.Uint32(attempts),
+				}
+				status = entity.ErasureStatusPending
+			)
+			if attempts >= maxAttempts {
+				status = entity.ErasureStatusFailed
+				extInfo.UdID = goutil.String("")
+			}
+
+			_ = h.updateErasure(ctx, erasure, &entity.Erasure{
+				Status:  status,
+				ExtInfo: extInfo,
+			})
+
+			erasureErr = err
+			continue
+		}
+
+		log.Ctx(ctx).Info().Msgf("erasure is success, erasure_id: %v", erasure.GetID())
+	}
+
+	return erasureErr
+}
+
+// runErasure removes the ud, and all uds linked into the same profile, from the query store, the campaign logs,
+// and the identity mappings. The uds stay in the do-not-re-import list, and only their hashes are recorded.
+func (h *RunErasures) runErasure(ctx context.Context, erasure *entity.Erasure) error {
+	ud := erasure.ToUd()
+	if ud == nil {
+		return fmt.Errorf("empty ud id")
+	}
+
+	tenant, err := h.tenantRepo.GetByID(ctx, erasure.GetTenantID())
+	if err != nil {
+		return fmt.Errorf("get tenant failed: %v", err)
+	}
+
+	if err := h.updateErasure(ctx, erasure, &entity.Erasure{
+		Status: entity.ErasureStatusRunning,
+	}); err != nil {
+		return fmt.Errorf("set erasure to running failed: %v", err)
+	}
+
+	uds, mappingIDs, err := h.getProfileUds(ctx, tenant.GetID(), ud)
+	if err != nil {
+		return fmt.Errorf("get profile uds failed: %v", err)
+	}
+
+	if err := h.erasureRepo.Suppress(ctx, tenant.GetID(), erasure.GetID(), uds); err != nil {
+		return fmt.Errorf("suppress uds failed: %v", err)
+	}
+
+	deletedDocs, err := h.queryRepo.DeleteUds(ctx, tenant.GetName(), uds)
+	if err != nil {
+		return fmt.Errorf("delete docs failed: %v", err)
+	}
+
+	redactedCampaignLogs, err := h.redactCampaignLogs(ctx, tenant.GetID(), uds)
+	if err != nil {
+		return fmt.Errorf("redact campaign logs failed: %v", err)
+	}
+
+	ids := make([]uint64, 0, len(mappingIDs))
+	for _, mappingID := range mappingIDs {
+		ids = append(ids, mappingID.GetID())
+	}
+	if err := h.mappingIDRepo.DeleteMany(ctx, tenant.GetID(), ids); err != nil {
+		return fmt.Errorf("delete mapping ids failed: %v", err)
+	}
+
+	erasedUds := make([]*entity.ErasedUd, 0, len(uds))
+	for _, ud := range uds {
+		erasedUds = append(erasedUds, &entity.ErasedUd{
+			IDType: ud.GetIDType(),
+			UdHash: goutil.String(h.erasureRepo.HashUd(ud)),
+		})
+	}
+
+	return h.updateErasure(ctx, erasure, &entity.Erasure{
+		Status:    entity.ErasureStatusSuccess,
+		EraseTime: goutil.Uint64(uint64(time.Now().Unix())),
+		ExtInfo: &entity.ErasureExtInfo{
+			UdID:                 goutil.String(""),
+			ErasedUds:            erasedUds,
+			DeletedDocs:          goutil.Uint64(deletedDocs),
+			RedactedCampaignLogs: goutil.Uint64(redactedCampaignLogs),
+			DeletedMappingIDs:    goutil.Uint64(uint64(len(ids))),
+		},
+	})
+}
+
+// getProfileUds returns ud and the uds linked to it, with their mapping IDs.
+func (h *RunErasures) getProfileUds(ctx context.Context, tenantID uint64, ud *entity.Ud) ([]*entity.Ud, []*entity.MappingID, error) {
+	mappingIDs, err := h.mappingIDRepo.GetManyByUdIDs(ctx, tenantID, []string{ud.ToDocID()})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(mappingIDs) == 0 {
+		return []*entity.Ud{ud}, mappingIDs, nil
+	}
+
+	mappingIDs, err = h.mappingIDRepo.GetManyByProfileIDs(ctx, tenantID, []uint64{mappingIDs[0].GetProfileID()})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uds := []*entity.Ud{ud}
+	for _, mappingID := range mappingIDs {
+		if mappingID.GetUdID() == ud.ToDocID() {
+			continue
+		}
+
+		linkedUd, err := mappingID.ToUd()
+		if err != nil {
+			return nil, nil, err
+		}
+		uds = append(uds, linkedUd)
+	}
+
+	return uds, mappingIDs, nil
+}
+
+// redactCampaignLogRows is the number of campaign logs redacted at a time.
+const redactCampaignLogRows = 1_000
+
+// redactCampaignLogs redacts the logs of the email uds, logs of other tenants are left untouched.
+func (h *RunErasures) redactCampaignLogs(ctx context.Context, tenantID uint64, uds []*entity.Ud) (uint64, error) {
+	emails := make([]string, 0)
+	for _, ud := range uds {
+		if ud.GetIDType() == entity.IDTypeEmail {
+			emails = append(emails, ud.GetID())
+		}
+	}
+
+	// redacted logs no longer match the emails, so the first page always holds the logs left
+	var redacted uint64
+	for {
+		campaignLogs, _, err := h.campaignLogRepo.GetManyByEmails(ctx, tenantID, emails, &repo.Pagination{
+			Limit: goutil.Uint32(redactCampaignLogRows),
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		if len(campaignLogs) == 0 {
+			return redacted, nil
+		}
+
+		campaignLogIDs := make([]uint64, 0, len(campaignLogs))
+		for _, campaignLog := range campaignLogs {
+			campaignLogIDs = append(campaignLogIDs, campaignLog.GetID())
+		}
+
+		if err := h.campaignLogRepo.RedactByIDs(ctx, campaignLogIDs); err != nil {
+			return 0, err
+		}
+
+		redacted += uint64(len(campaignLogIDs))
+	}
+}
+
+func (h *RunErasures) updateErasure(ctx context.Context, erasure, newErasure *entity.Erasure) error {
+	erasure.Update(newErasure)
+	if err := h.erasureRepo.Update(ctx, erasure); err != nil {
+		log.Ctx(ctx).Error().Msgf("[erasure ID %d] update erasure failed: %v", erasure.GetID(), err)
+		return err
+	}
+	return nil
+}
+
+func (h *RunErasures) CleanUp(_ context.Context) error {
+	return nil
+}
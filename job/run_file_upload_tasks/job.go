@@ -1,35 +1,49 @@
 package run_file_upload_tasks
 
 import (
+	"bytes"
+	"cdp/config"
 	"cdp/entity"
+	"cdp/handler"
 	"cdp/pkg/goutil"
 	"cdp/pkg/service"
 	"cdp/repo"
 	"context"
+	"encoding/csv"
 	"fmt"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/sync/errgroup"
+	"strings"
 	"time"
 )
 
 const batchSize = 3_000
 
 type RunFileUploadTask struct {
-	taskRepo   repo.TaskRepo
-	fileRepo   repo.FileRepo
-	queryRepo  repo.QueryRepo
-	tenantRepo repo.TenantRepo
-	tagRepo    repo.TagRepo
+	cfg           *config.Config
+	taskRepo      repo.TaskRepo
+	fileRepo      repo.FileRepo
+	queryRepo     repo.QueryRepo
+	tenantRepo    repo.TenantRepo
+	tagRepo       repo.TagRepo
+	erasureRepo   repo.ErasureRepo
+	segmentRepo   repo.SegmentRepo
+	mappingIDRepo repo.MappingIDRepo
 }
 
-func New(taskRepo repo.TaskRepo, fileRepo repo.FileRepo, queryRepo repo.QueryRepo,
-	tenantRepo repo.TenantRepo, tagRepo repo.TagRepo) service.Job {
+func New(cfg *config.Config, taskRepo repo.TaskRepo, fileRepo repo.FileRepo, queryRepo repo.QueryRepo,
+	tenantRepo repo.TenantRepo, tagRepo repo.TagRepo, erasureRepo repo.ErasureRepo, segmentRepo repo.SegmentRepo,
+	mappingIDRepo repo.MappingIDRepo) service.Job {
 	return &RunFileUploadTask{
-		taskRepo:   taskRepo,
-		fileRepo:   fileRepo,
-		queryRepo:  queryRepo,
-		tenantRepo: tenantRepo,
-		tagRepo:    tagRepo,
+		cfg:           cfg,
+		taskRepo:      taskRepo,
+		fileRepo:      fileRepo,
+		queryRepo:     queryRepo,
+		tenantRepo:    tenantRepo,
+		tagRepo:       tagRepo,
+		erasureRepo:   erasureRepo,
+		segmentRepo:   segmentRepo,
+		mappingIDRepo: mappingIDRepo,
 	}
 }
 
@@ -45,11 +59,15 @@ func (h *RunFileUploadTask) Run(ctx context.Context) error {
 		ch      = make(chan struct{}, c)
 	)
 
-	// get tag resource only
-	tasks, err := h.taskRepo.GetPendingFileUploadTasks(ctx, entity.ResourceTypeTag)
-	if err != nil {
-		log.Ctx(ctx).Error().Msgf("get pending file upload tasks failed: %v", err)
-		return err
+	// get tag and segment resources only, identity mappings are run by run-identity-mapping-tasks
+	tasks := make([]*entity.Task, 0)
+	for _, resourceType := range []entity.ResourceType{entity.ResourceTypeTag, entity.ResourceTypeSegment} {
+		res, err := h.taskRepo.GetPendingFileUploadTasks(ctx, resourceType)
+		if err != nil {
+			log.Ctx(ctx).Error().Msgf("get pending file upload tasks failed: %v", err)
+			return err
+		}
+		tasks = append(tasks, res...)
 	}
 
 	log.Ctx(ctx).Info().Msgf("number of tasks to be processed: %d", len(tasks))
@@ -73,14 +91,22 @@ func (h *RunFileUploadTask) Run(ctx context.Context) error {
 			select {
 			case te := <-statusChan:
 				task := te.task
+
+				newTask := &entity.Task{
+					Status: te.status,
+				}
 				if te.err != nil {
 					log.Ctx(ctx).Error().Msgf("[task ID %d] error encountered: %v", task.GetID(), te.err)
+
+					if te.status == entity.TaskStatusFailed {
+						newTask.ExtInfo = &entity.TaskExtInfo{
+							FailReason: goutil.String(te.err.Error()),
+						}
+					}
 				}
 
-				task.Update(&entity.Task{
-					Status: te.status,
-				})
-				if err = h.taskRepo.Update(ctx, task); err != nil {
+				task.Update(newTask)
+				if err := h.taskRepo.Update(ctx, task); err != nil {
 					log.Ctx(ctx).Error().Msgf("[task ID %d] set campaign status failed err: %v, status: %v", task.GetID(), err, te.status)
 				}
 			case <-doneChan:
@@ -111,11 +137,21 @@ func (h *RunFileUploadTask) Run(ctx context.Context) error {
 				return err
 			}
 
-			// get tag
-			tag, err := h.tagRepo.GetByID(ctx, tenant.GetID(), task.GetResourceID())
-			if err != nil {
-				updateTaskStatus(entity.TaskStatusFailed, task, fmt.Errorf("get tag failed: %v", err))
-				return err
+			// get tag or segment
+			var (
+				tag     *entity.Tag
+				segment *entity.Segment
+			)
+			if task.GetResourceType() == entity.ResourceTypeSegment {
+				if segment, err = h.segmentRepo.GetByID(ctx, tenant.GetID(), task.GetResourceID()); err != nil {
+					updateTaskStatus(entity.TaskStatusFailed, task, fmt.Errorf("get segment failed: %v", err))
+					return err
+				}
+			} else {
+				if tag, err = h.tagRepo.GetByID(ctx, tenant.GetID(), task.GetResourceID()); err != nil {
+					updateTaskStatus(entity.TaskStatusFailed, task, fmt.Errorf("get tag failed: %v", err))
+					return err
+				}
 			}
 
 			// download file data
@@ -134,39 +170,105 @@ func (h *RunFileUploadTask) Run(ctx context.Context) error {
 				return err
 			}
 
-			// split data into batches
+			// validate rows
+			var (
+				udTagVals = make([]*entity.UdTagVal, 0, len(rows))
+				rejected  = make([][]string, 0)
+
+				skippedRows uint64
+			)
+			for _, row := range rows {
+				if tag != nil && len(row) == 2 && strings.TrimSpace(row[1]) == "" {
+					skippedRows++
+					continue
+				}
+
+				var udTagVal *entity.UdTagVal
+				if segment != nil {
+					udTagVal, err = h.toSegmentUd(task, segment, row)
+				} else {
+					udTagVal, err = h.toUdTagVal(task, tag, row)
+				}
+				if err != nil {
+					rejected = append(rejected, h.toRejectedRow(task, row, err))
+					continue
+				}
+
+				udTagVals = append(udTagVals, udTagVal)
+			}
+
+			// split valid rows into batches, erased uds are dropped
 			var (
 				batches = make([][]*entity.UdTagVal, 0)
 				batch   = make([]*entity.UdTagVal, 0)
+
+				validRows, suppressedRows uint64
 			)
-			for i, row := range rows {
-				if len(row) != 2 {
-					updateTaskStatus(entity.TaskStatusFailed, task, fmt.Errorf("invalid row: %v, file: %s", row, fileID))
+			for i := 0; i < len(udTagVals); i += batchSize {
+				end := min(i+batchSize, len(udTagVals))
+
+				unsuppressed, err := h.dropSuppressed(ctx, tenant.GetID(), udTagVals[i:end])
+				if err != nil {
+					updateTaskStatus(entity.TaskStatusFailed, task, fmt.Errorf("get suppressed uds failed: %v", err))
 					return err
 				}
 
-				v, err := tag.FormatTagValue(row[1])
+				suppressedRows += uint64(end - i - len(unsuppressed))
+
+				if err := handler.SetProfileIDs(ctx, h.mappingIDRepo, tenant.GetID(), unsuppressed); err != nil {
+					updateTaskStatus(entity.TaskStatusFailed, task, fmt.Errorf("get profile ids failed: %v", err))
+					return err
+				}
+
+				for _, udTagVal := range unsuppressed {
+					validRows++
+					batch = append(batch, udTagVal)
+
+					if len(batch) >= batchSize {
+						batches = append(batches, batch)
+						batch = make([]*entity.UdTagVal, 0)
+					}
+				}
+			}
+			if len(batch) > 0 {
+				batches = append(batches, batch)
+			}
+
+			extInfo := &entity.TaskExtInfo{
+				ValidRows:      goutil.Uint64(validRows),
+				InvalidRows:    goutil.Uint64(uint64(len(rejected))),
+				SkippedRows:    goutil.Uint64(skippedRows),
+				SuppressedRows: goutil.Uint64(suppressedRows),
+			}
+
+			// write rejected rows back, so that they can be fixed and re-uploaded
+			if len(rejected) > 0 {
+				rejectedFileID, err := h.createRejectedFile(ctx, tenant, task, rejected)
 				if err != nil {
-					updateTaskStatus(entity.TaskStatusFailed, task, fmt.Errorf("invalid tag value: %v, file: %s", rows[1], fileID))
+					updateTaskStatus(entity.TaskStatusFailed, task, fmt.Errorf("create rejected file failed: %v", err))
 					return err
 				}
+				extInfo.RejectedFileID = goutil.String(rejectedFileID)
+			}
 
-				batch = append(batch, &entity.UdTagVal{
-					Ud: &entity.Ud{
-						ID:     goutil.String(row[0]),
-						IDType: entity.IDTypeEmail,
-					},
-					TagVals: []*entity.TagVal{
-						{
-							TagID:  task.ResourceID,
-							TagVal: v,
-						},
-					},
-				})
-
-				if len(batch) >= batchSize || i == len(rows)-1 {
-					batches = append(batches, batch)
-					batch = make([]*entity.UdTagVal, 0)
+			task.Update(&entity.Task{
+				ExtInfo: extInfo,
+			})
+			if err := h.taskRepo.Update(ctx, task); err != nil {
+				updateTaskStatus(entity.TaskStatusFailed, task, fmt.Errorf("set task row counts failed: %v", err))
+				return err
+			}
+
+			if len(rejected) > 0 {
+				var (
+					invalidPercent = float64(len(rejected)) * 100 / float64(len(rows))
+					maxPercent     = h.cfg.FileUploadTask.MaxInvalidRowPercent
+				)
+				if invalidPercent > maxPercent {
+					err := fmt.Errorf("%d of %d rows are invalid (%.2f%%), exceeding the threshold of %.2f%%, file: %s",
+						len(rejected), len(rows), invalidPercent, maxPercent, fileID)
+					updateTaskStatus(entity.TaskStatusFailed, task, err)
+					return err
 				}
 			}
 
@@ -201,8 +303,8 @@ func (h *RunFileUploadTask) Run(ctx context.Context) error {
 				//	}
 				case <-progressTicker.C:
 					var isDone bool
-					if task.GetSize() > 0 {
-						progress := count * 100 / task.GetSize()
+					if validRows > 0 {
+						progress := count * 100 / validRows
 						task.Update(&entity.Task{
 							ExtInfo: &entity.TaskExtInfo{
 								Progress: goutil.Uint64(progress),
@@ -216,7 +318,7 @@ func (h *RunFileUploadTask) Run(ctx context.Context) error {
 							log.Ctx(ctx).Info().Msgf("task_id: %v, count: %v, progress: %v", task.GetID(), count, progress)
 						}
 
-						if count == task.GetSize() {
+						if count == validRows {
 							isDone = true
 						}
 					} else {
@@ -226,6 +328,13 @@ func (h *RunFileUploadTask) Run(ctx context.Context) error {
 					if isDone {
 						log.Ctx(ctx).Info().Msgf("task is success, task_id: %v", task.GetID())
 
+						// bump the tag version, so that query results cached by the server are invalidated
+						if tag != nil {
+							if err := h.tagRepo.SetLastUploadTime(ctx, tag.GetTenantID(), tag.GetID(), uint64(time.Now().Unix())); err != nil {
+								log.Ctx(ctx).Error().Msgf("[task ID %d] set tag last upload time failed: %v", task.GetID(), err)
+							}
+						}
+
 						task.Update(&entity.Task{
 							Status: entity.TaskStatusSuccess,
 							ExtInfo: &entity.TaskExtInfo{
@@ -286,6 +395,135 @@ func (h *RunFileUploadTask) Run(ctx context.Context) error {
 	return taskErr
 }
 
+func (h *RunFileUploadTask) toUdTagVal(task *entity.Task, tag *entity.Tag, row []string) (*entity.UdTagVal, error) {
+	if len(row) != 2 {
+		return nil, fmt.Errorf("expect 2 columns, got %d", len(row))
+	}
+
+	idType := task.GetExtInfo().GetIDType()
+
+	id, err := entity.NormalizeUdID(idType, row[0])
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := tag.FormatTagValue(row[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag value: %v", err)
+	}
+
+	// list values are checked item by item
+	items := []string{row[1]}
+	if list, ok := v.([]string); ok {
+		items = list
+	}
+	for _, item := range items {
+		if !tag.InEnum(item) {
+			return nil, fmt.Errorf("tag value %s is not in enum", item)
+		}
+	}
+
+	return &entity.UdTagVal{
+		Ud: &entity.Ud{
+			ID:     goutil.String(id),
+			IDType: idType,
+		},
+		TagVals: []*entity.TagVal{
+			{
+				TagID:       tag.ID,
+				TagVal:      v,
+				KeepHistory: tag.KeepsHistory(),
+				TaskID:      task.ID,
+			},
+		},
+	}, nil
+}
+
+// toSegmentUd reads a row of a file uploaded to a static segment, which holds the ud ID only.
+func (h *RunFileUploadTask) toSegmentUd(task *entity.Task, segment *entity.Segment, row []string) (*entity.UdTagVal, error) {
+	if len(row) != 1 {
+		return nil, fmt.Errorf("expect 1 column, got %d", len(row))
+	}
+
+	idType := task.GetExtInfo().GetIDType()
+
+	id, err := entity.NormalizeUdID(idType, row[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &entity.UdTagVal{
+		Ud: &entity.Ud{
+			ID:     goutil.String(id),
+			IDType: idType,
+		},
+		SegmentIDs: []uint64{segment.GetID()},
+	}, nil
+}
+
+// dropSuppressed drops the uds in the do-not-re-import list of the tenant.
+func (h *RunFileUploadTask) dropSuppressed(ctx context.Context, tenantID uint64, udTagVals []*entity.UdTagVal) ([]*entity.UdTagVal, error) {
+	uds := make([]*entity.Ud, 0, len(udTagVals))
+	for _, udTagVal := range udTagVals {
+		uds = append(uds, udTagVal.GetUd())
+	}
+
+	suppressed, err := h.erasureRepo.GetSuppressedUds(ctx, tenantID, uds)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(suppressed) == 0 {
+		return udTagVals, nil
+	}
+
+	unsuppressed := make([]*entity.UdTagVal, 0, len(udTagVals))
+	for _, udTagVal := range udTagVals {
+		if !suppressed[udTagVal.GetUd().ToDocID()] {
+			unsuppressed = append(unsuppressed, udTagVal)
+		}
+	}
+
+	return unsuppressed, nil
+}
+
+// rejectedHeader is the header of the rejected file, the columns of an uploaded row followed by the reason.
+func (h *RunFileUploadTask) rejectedHeader(task *entity.Task) []string {
+	if task.GetResourceType() == entity.ResourceTypeSegment {
+		return []string{"id", "reason"}
+	}
+	return []string{"id", "value", "reason"}
+}
+
+// toRejectedRow trims or pads the row to the columns of the rejected file, so that the reason always lands in its column.
+func (h *RunFileUploadTask) toRejectedRow(task *entity.Task, row []string, err error) []string {
+	numCols := len(h.rejectedHeader(task)) - 1
+
+	rejectedRow := make([]string, numCols, numCols+1)
+	copy(rejectedRow, row)
+
+	return append(rejectedRow, err.Error())
+}
+
+func (h *RunFileUploadTask) createRejectedFile(ctx context.Context, tenant *entity.Tenant, task *entity.Task, rejected [][]string) (string, error) {
+	var (
+		buf = new(bytes.Buffer)
+		w   = csv.NewWriter(buf)
+	)
+
+	if err := w.Write(h.rejectedHeader(task)); err != nil {
+		return "", err
+	}
+
+	if err := w.WriteAll(rejected); err != nil {
+		return "", err
+	}
+
+	fileName := fmt.Sprintf("rejected_%s:%d", task.GetExtInfo().GetOriFileName(), time.Now().Unix())
+
+	return h.fileRepo.CreateFile(ctx, goutil.String(tenant.GetExtInfo().GetFolderID()), fileName, buf)
+}
+
 func (h *RunFileUploadTask) CleanUp(_ context.Context) error {
 	return nil
 }
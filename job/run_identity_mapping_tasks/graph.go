@@ -0,0 +1,58 @@
+package run_identity_mapping_tasks
+
+// identityGraph groups linked nodes with union-find, each group becomes one profile.
+type identityGraph struct {
+	parents map[string]string
+}
+
+func newIdentityGraph() *identityGraph {
+	return &identityGraph{
+		parents: make(map[string]string),
+	}
+}
+
+func (g *identityGraph) find(node string) string {
+	parent, ok := g.parents[node]
+	if !ok {
+		g.parents[node] = node
+		return node
+	}
+
+	if parent == node {
+		return node
+	}
+
+	root := g.find(parent)
+	g.parents[node] = root
+
+	return root
+}
+
+func (g *identityGraph) link(a, b string) {
+	rootA, rootB := g.find(a), g.find(b)
+	if rootA != rootB {
+		g.parents[rootA] = rootB
+	}
+}
+
+func (g *identityGraph) nodes() []string {
+	nodes := make([]string, 0, len(g.parents))
+	for node := range g.parents {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func (g *identityGraph) components() [][]string {
+	groups := make(map[string][]string)
+	for node := range g.parents {
+		root := g.find(node)
+		groups[root] = append(groups[root], node)
+	}
+
+	components := make([][]string, 0, len(groups))
+	for _, group := range groups {
+		components = append(components, group)
+	}
+	return components
+}
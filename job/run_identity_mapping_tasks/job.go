@@ -0,0 +1,425 @@
+package run_identity_mapping_tasks
+
+import (
+	"bytes"
+	"cdp/config"
+	"cdp/entity"
+	"cdp/pkg/goutil"
+	"cdp/pkg/service"
+	"cdp/repo"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	batchSize = 1_000
+
+	// rows are id,id_type,linked_id,linked_id_type
+	numColumns = 4
+
+	// profileNodePrefix marks the nodes of existing profiles in the identity graph, it never clashes with doc IDs
+	profileNodePrefix = "#profile:"
+)
+
+type RunIdentityMappingTask struct {
+	cfg           *config.Config
+	txService     repo.TxService
+	taskRepo      repo.TaskRepo
+	fileRepo      repo.FileRepo
+	queryRepo     repo.QueryRepo
+	tenantRepo    repo.TenantRepo
+	mappingIDRepo repo.MappingIDRepo
+	erasureRepo   repo.ErasureRepo
+}
+
+func New(cfg *config.Config, txService repo.TxService, taskRepo repo.TaskRepo, fileRepo repo.FileRepo, queryRepo repo.QueryRepo,
+	tenantRepo repo.TenantRepo, mappingIDRepo repo.MappingIDRepo, erasureRepo repo.ErasureRepo) service.Job {
+	return &RunIdentityMappingTask{
+		cfg:           cfg,
+		txService:     txService,
+		taskRepo:      taskRepo,
+		fileRepo:      fileRepo,
+		queryRepo:     queryRepo,
+		tenantRepo:    tenantRepo,
+		mappingIDRepo: mappingIDRepo,
+		erasureRepo:   erasureRepo,
+	}
+}
+
+func (h *RunIdentityMappingTask) Init(_ context.Context) error {
+	return nil
+}
+
+func (h *RunIdentityMappingTask) Run(ctx context.Context) error {
+	tasks, err := h.taskRepo.GetPendingFileUploadTasks(ctx, entity.ResourceTypeIdentity)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get pending identity mapping tasks failed: %v", err)
+		return err
+	}
+
+	log.Ctx(ctx).Info().Msgf("number of tasks to be processed: %d", len(tasks))
+
+	// tasks are run one by one, as merging profiles of a tenant concurrently may conflict
+	var taskErr error
+	for _, task := range tasks {
+		if err := h.runTask(ctx, task); err != nil {
+			log.Ctx(ctx).Error().Msgf("[task ID %d] error encountered: %v", task.GetID(), err)
+
+			_ = h.updateTaskStatus(ctx, task, entity.TaskStatusFailed, &entity.TaskExtInfo{
+				FailReason: goutil.String(err.Error()),
+			})
+
+			taskErr = err
+			continue
+		}
+
+		log.Ctx(ctx).Info().Msgf("task is success, task_id: %v", task.GetID())
+	}
+
+	return taskErr
+}
+
+func (h *RunIdentityMappingTask) runTask(ctx context.Context, task *entity.Task) error {
+	tenant, err := h.tenantRepo.GetByID(ctx, task.GetTenantID())
+	if err != nil {
+		return fmt.Errorf("get tenant failed: %v", err)
+	}
+
+	rows, err := h.fileRepo.DownloadFile(ctx, task.GetFileID())
+	if err != nil {
+		return fmt.Errorf("get file %s failed: %v", task.GetFileID(), err)
+	}
+
+	if err := h.updateTaskStatus(ctx, task, entity.TaskStatusRunning, nil); err != nil {
+		return fmt.Errorf("set task to running failed: %v", err)
+	}
+
+	// validate all rows first, so that nothing is linked if too many rows are invalid
+	rejected := make([][]string, 0)
+	for _, row := range rows {
+		if _, _, err := h.toUds(row); err != nil {
+			rejected = append(rejected, append(append([]string{}, row...), err.Error()))
+		}
+	}
+
+	extInfo := &entity.TaskExtInfo{
+		InvalidRows: goutil.Uint64(uint64(len(rejected))),
+	}
+
+	if len(rejected) > 0 {
+		rejectedFileID, err := h.createRejectedFile(ctx, tenant, task, rejected)
+		if err != nil {
+			return fmt.Errorf("create rejected file failed: %v", err)
+		}
+		extInfo.RejectedFileID = goutil.String(rejectedFileID)
+	}
+
+	task.Update(&entity.Task{
+		ExtInfo: extInfo,
+	})
+	if err := h.taskRepo.Update(ctx, task); err != nil {
+		return fmt.Errorf("set task row counts failed: %v", err)
+	}
+
+	if len(rejected) > 0 {
+		var (
+			invalidPercent = float64(len(rejected)) * 100 / float64(len(rows))
+			maxPercent     = h.cfg.FileUploadTask.MaxInvalidRowPercent
+		)
+		if invalidPercent > maxPercent {
+			return fmt.Errorf("%d of %d rows are invalid (%.2f%%), exceeding the threshold of %.2f%%, file: %s",
+				len(rejected), len(rows), invalidPercent, maxPercent, task.GetFileID())
+		}
+	}
+
+	// rows are linked chunk by chunk, the profiles resolved by a chunk are stored as mapping IDs,
+	// so that later chunks linking to them merge into them
+	var validRows, suppressedRows uint64
+	for i := 0; i < len(rows); i += batchSize {
+		end := min(i+batchSize, len(rows))
+
+		valid, suppressed, err := h.linkRows(ctx, tenant, rows[i:end])
+		if err != nil {
+			return err
+		}
+		validRows += valid
+		suppressedRows += suppressed
+
+		if end < len(rows) {
+			_ = h.updateTaskStatus(ctx, task, entity.TaskStatusRunning, &entity.TaskExtInfo{
+				Progress: goutil.Uint64(uint64(end * 100 / len(rows))),
+			})
+		}
+	}
+
+	return h.updateTaskStatus(ctx, task, entity.TaskStatusSuccess, &entity.TaskExtInfo{
+		Progress:       goutil.Uint64(100),
+		ValidRows:      goutil.Uint64(validRows),
+		SuppressedRows: goutil.Uint64(suppressedRows),
+	})
+}
+
+// linkRows merges the uds linked by the rows into profiles, and returns the number of valid and suppressed rows.
+// Invalid rows are skipped, as they are already in the rejected file.
+func (h *RunIdentityMappingTask) linkRows(ctx context.Context, tenant *entity.Tenant, rows [][]string) (uint64, uint64, error) {
+	var (
+		links = make([][2]*entity.Ud, 0, len(rows))
+		uds   = make([]*entity.Ud, 0, 2*len(rows))
+	)
+	for _, row := range rows {
+		ud, linkedUd, err := h.toUds(row)
+		if err != nil {
+			continue
+		}
+		links = append(links, [2]*entity.Ud{ud, linkedUd})
+		uds = append(uds, ud, linkedUd)
+	}
+
+	// build the identity graph, links of erased uds are dropped
+	suppressed, err := h.erasureRepo.GetSuppressedUds(ctx, tenant.GetID(), uds)
+	if err != nil {
+		return 0, 0, fmt.Errorf("get suppressed uds failed: %v", err)
+	}
+
+	var (
+		graph          = newIdentityGraph()
+		suppressedRows uint64
+	)
+	for _, link := range links {
+		if suppressed[link[0].ToDocID()] || suppressed[link[1].ToDocID()] {
+			suppressedRows++
+			continue
+		}
+		graph.link(link[0].ToDocID(), link[1].ToDocID())
+	}
+
+	// existing profiles join the graph, so that they are merged with the new links
+	mappingIDs, err := h.mappingIDRepo.GetManyByUdIDs(ctx, tenant.GetID(), graph.nodes())
+	if err != nil {
+		return 0, 0, fmt.Errorf("get mapping ids failed: %v", err)
+	}
+
+	for _, mappingID := range mappingIDs {
+		graph.link(mappingID.GetUdID(), fmt.Sprintf("%s%d", profileNodePrefix, mappingID.GetProfileID()))
+	}
+
+	profileIDs := make([]uint64, 0)
+	for _, component := range graph.components() {
+		profileID, err := h.resolve(ctx, tenant.GetID(), component)
+		if err != nil {
+			return 0, 0, fmt.Errorf("resolve profile failed: %v", err)
+		}
+		profileIDs = append(profileIDs, profileID)
+	}
+
+	if err := h.syncProfiles(ctx, tenant, profileIDs); err != nil {
+		return 0, 0, fmt.Errorf("sync profiles failed: %v", err)
+	}
+
+	return uint64(len(links)) - suppressedRows, suppressedRows, nil
+}
+
+// resolve merges a component of the identity graph into one profile, and returns the profile ID.
+// The smallest existing profile ID is kept, otherwise the smallest mapping ID created becomes the profile ID.
+func (h *RunIdentityMappingTask) resolve(ctx context.Context, tenantID uint64, component []string) (uint64, error) {
+	var (
+		profileIDs = make([]uint64, 0)
+		newUdIDs   = make([]string, 0)
+	)
+	for _, node := range component {
+		if strings.HasPrefix(node, profileNodePrefix) {
+			profileID, err := strconv.ParseUint(strings.TrimPrefix(node, profileNodePrefix), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			profileIDs = append(profileIDs, profileID)
+		} else {
+			newUdIDs = append(newUdIDs, node)
+		}
+	}
+
+	// uds with an existing profile are linked to a profile node, and do not need a new mapping ID
+	existing := make(map[string]struct{})
+	if len(profileIDs) > 0 {
+		mappingIDs, err := h.mappingIDRepo.GetManyByUdIDs(ctx, tenantID, newUdIDs)
+		if err != nil {
+			return 0, err
+		}
+		for _, mappingID := range mappingIDs {
+			existing[mappingID.GetUdID()] = struct{}{}
+		}
+	}
+
+	var profileID uint64
+	err := h.txService.RunTx(ctx, func(ctx context.Context) error {
+		var (
+			now        = goutil.Uint64(uint64(time.Now().Unix()))
+			mappingIDs = make([]*entity.MappingID, 0, len(newUdIDs))
+		)
+		for _, udID := range newUdIDs {
+			if _, ok := existing[udID]; ok {
+				continue
+			}
+			mappingIDs = append(mappingIDs, &entity.MappingID{
+				TenantID:   goutil.Uint64(tenantID),
+				UdID:       goutil.String(udID),
+				ProfileID:  goutil.Uint64(0),
+				CreateTime: now,
+				UpdateTime: now,
+			})
+		}
+
+		var ids []uint64
+		if len(mappingIDs) > 0 {
+			var err error
+			if ids, err = h.mappingIDRepo.CreateMany(ctx, mappingIDs); err != nil {
+				return err
+			}
+		}
+
+		if len(profileIDs) == 0 {
+			profileID = slices.Min(ids)
+		} else {
+			profileID = slices.Min(profileIDs)
+		}
+
+		if err := h.mappingIDRepo.SetProfileID(ctx, tenantID, ids, profileID); err != nil {
+			return err
+		}
+
+		mergedProfileIDs := make([]uint64, 0, len(profileIDs))
+		for _, id := range profileIDs {
+			if id != profileID {
+				mergedProfileIDs = append(mergedProfileIDs, id)
+			}
+		}
+
+		return h.mappingIDRepo.MergeProfiles(ctx, tenantID, mergedProfileIDs, profileID)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return profileID, nil
+}
+
+// syncProfiles writes the profile ID of every stored ud of the profiles to the query store.
+// Uds without tag values are not stored, they get their profile ID once they are upserted.
+func (h *RunIdentityMappingTask) syncProfiles(ctx context.Context, tenant *entity.Tenant, profileIDs []uint64) error {
+	for i := 0; i < len(profileIDs); i += batchSize {
+		end := min(i+batchSize, len(profileIDs))
+
+		mappingIDs, err := h.mappingIDRepo.GetManyByProfileIDs(ctx, tenant.GetID(), profileIDs[i:end])
+		if err != nil {
+			return err
+		}
+
+		uds := make([]*entity.Ud, 0, len(mappingIDs))
+		for _, mappingID := range mappingIDs {
+			ud, err := mappingID.ToUd()
+			if err != nil {
+				return err
+			}
+			uds = append(uds, ud)
+		}
+
+		upsertResChan := make(chan repo.UpsertResult, len(uds))
+		if err := h.queryRepo.LinkProfiles(ctx, tenant.GetName(), uds, upsertResChan); err != nil {
+			return fmt.Errorf("link profiles err: %v", err)
+		}
+
+		// wait for all updates to be flushed
+		for range uds {
+			select {
+			case upsertRes := <-upsertResChan:
+				if upsertRes.Error != nil {
+					return fmt.Errorf("encounter link profiles err: %v", upsertRes.Error)
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	return nil
+}
+
+func (h *RunIdentityMappingTask) toUds(row []string) (*entity.Ud, *entity.Ud, error) {
+	if len(row) != numColumns {
+		return nil, nil, fmt.Errorf("expect %d columns, got %d", numColumns, len(row))
+	}
+
+	ud, err := h.toUd(row[0], row[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	linkedUd, err := h.toUd(row[2], row[3])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ud, linkedUd, nil
+}
+
+func (h *RunIdentityMappingTask) toUd(id, rawIDType string) (*entity.Ud, error) {
+	v, err := strconv.ParseUint(rawIDType, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id type: %s", rawIDType)
+	}
+
+	idType := entity.IDType(v)
+	if _, ok := entity.IDTypes[idType]; !ok {
+		return nil, fmt.Errorf("invalid id type: %s", rawIDType)
+	}
+
+	if id, err = entity.NormalizeUdID(idType, id); err != nil {
+		return nil, err
+	}
+
+	return &entity.Ud{
+		ID:     goutil.String(id),
+		IDType: idType,
+	}, nil
+}
+
+func (h *RunIdentityMappingTask) createRejectedFile(ctx context.Context, tenant *entity.Tenant, task *entity.Task, rejected [][]string) (string, error) {
+	var (
+		buf = new(bytes.Buffer)
+		w   = csv.NewWriter(buf)
+	)
+
+	if err := w.Write([]string{"id", "id_type", "linked_id", "linked_id_type", "reason"}); err != nil {
+		return "", err
+	}
+
+	if err := w.WriteAll(rejected); err != nil {
+		return "", err
+	}
+
+	fileName := fmt.Sprintf("rejected_%s:%d", task.GetExtInfo().GetOriFileName(), time.Now().Unix())
+
+	return h.fileRepo.CreateFile(ctx, goutil.String(tenant.GetExtInfo().GetFolderID()), fileName, buf)
+}
+
+func (h *RunIdentityMappingTask) updateTaskStatus(ctx context.Context, task *entity.Task, status entity.TaskStatus, extInfo *entity.TaskExtInfo) error {
+	task.Update(&entity.Task{
+		Status:  status,
+		ExtInfo: extInfo,
+	})
+	if err := h.taskRepo.Update(ctx, task); err != nil {
+		log.Ctx(ctx).Error().Msgf("[task ID %d] set task status failed err: %v, status: %v", task.GetID(), err, status)
+		return err
+	}
+	return nil
+}
+
+func (h *RunIdentityMappingTask) CleanUp(_ context.Context) error {
+	return nil
+}
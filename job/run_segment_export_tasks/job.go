@@ -0,0 +1,313 @@
+package run_segment_export_tasks
+
+import (
+	"cdp/entity"
+	"cdp/pkg/goutil"
+	"cdp/pkg/service"
+	"cdp/repo"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	downloadSize     = 3_000
+	progressInterval = 2 * time.Second
+)
+
+// RunSegmentExportTask writes the uds of a segment, with the values of the chosen tags, into a CSV file.
+// Pages of uds are streamed into the file as they are scrolled, so that large segments are not held in memory.
+type RunSegmentExportTask struct {
+	taskRepo    repo.TaskRepo
+	fileRepo    repo.FileRepo
+	queryRepo   repo.QueryRepo
+	tenantRepo  repo.TenantRepo
+	tagRepo     repo.TagRepo
+	segmentRepo repo.SegmentRepo
+}
+
+func New(taskRepo repo.TaskRepo, fileRepo repo.FileRepo, queryRepo repo.QueryRepo, tenantRepo repo.TenantRepo,
+	tagRepo repo.TagRepo, segmentRepo repo.SegmentRepo) service.Job {
+	return &RunSegmentExportTask{
+		taskRepo:    taskRepo,
+		fileRepo:    fileRepo,
+		queryRepo:   queryRepo,
+		tenantRepo:  tenantRepo,
+		tagRepo:     tagRepo,
+		segmentRepo: segmentRepo,
+	}
+}
+
+func (h *RunSegmentExportTask) Init(_ context.Context) error {
+	return nil
+}
+
+func (h *RunSegmentExportTask) Run(ctx context.Context) error {
+	var (
+		g  = new(errgroup.Group)
+		c  = 10
+		ch = make(chan struct{}, c)
+	)
+
+	tasks, err := h.taskRepo.GetPendingSegmentExportTasks(ctx)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get pending segment export tasks failed: %v", err)
+		return err
+	}
+
+	log.Ctx(ctx).Info().Msgf("number of tasks to be processed: %d", len(tasks))
+
+	for _, task := range tasks {
+		select {
+		case ch <- struct{}{}:
+		}
+
+		task := task
+		g.Go(func() error {
+			// release go routine
+			defer func() {
+				<-ch
+			}()
+
+			if err := h.export(ctx, task); err != nil {
+				log.Ctx(ctx).Error().Msgf("[task ID %d] error encountered: %v", task.GetID(), err)
+
+				task.Update(&entity.Task{
+					Status: entity.TaskStatusFailed,
+					ExtInfo: &entity.TaskExtInfo{
+						FailReason: goutil.String(err.Error()),
+					},
+				})
+				if err := h.taskRepo.Update(ctx, task); err != nil {
+					log.Ctx(ctx).Error().Msgf("[task ID %d] set task to failed err: %v", task.GetID(), err)
+				}
+
+				return err
+			}
+
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+func (h *RunSegmentExportTask) export(ctx context.Context, task *entity.Task) error {
+	tenant, err := h.tenantRepo.GetByID(ctx, task.GetTenantID())
+	if err != nil {
+		return fmt.Errorf("get tenant failed: %v", err)
+	}
+
+	segment, err := h.segmentRepo.GetByID(ctx, tenant.GetID(), task.GetResourceID())
+	if err != nil {
+		return fmt.Errorf("get segment failed: %v", err)
+	}
+
+	tagIDs := task.GetExtInfo().GetTagIDs()
+
+	tags := make([]*entity.Tag, 0, len(tagIDs))
+	if len(tagIDs) > 0 {
+		res, err := h.tagRepo.GetManyByIDs(ctx, tenant.GetID(), tagIDs)
+		if err != nil {
+			return fmt.Errorf("get tags failed: %v", err)
+		}
+
+		// keep the column order chosen by the user
+		tagsByID := make(map[uint64]*entity.Tag, len(res))
+		for _, tag := range res {
+			tagsByID[tag.GetID()] = tag
+		}
+		for _, tagID := range tagIDs {
+			tag, ok := tagsByID[tagID]
+			if !ok {
+				return fmt.Errorf("tag %d not found", tagID)
+			}
+			tags = append(tags, tag)
+		}
+	}
+
+	// the size is only used for the progress, uds added during the export may push it past 100
+	size, err := h.queryRepo.Count(ctx, tenant, segment.GetCriteria())
+	if err != nil {
+		return fmt.Errorf("count segment failed: %v", err)
+	}
+
+	task.Update(&entity.Task{
+		Status: entity.TaskStatusRunning,
+		ExtInfo: &entity.TaskExtInfo{
+			Size: goutil.Uint64(size),
+		},
+	})
+	if err := h.taskRepo.Update(ctx, task); err != nil {
+		return fmt.Errorf("set task to running failed: %v", err)
+	}
+
+	var (
+		pr, pw   = io.Pipe()
+		writeG   = new(errgroup.Group)
+		exported uint64
+	)
+	writeG.Go(func() error {
+		n, err := h.write(ctx, task, tenant, segment, tags, pw)
+		exported = n
+
+		// unblocks the upload, with the error if there is one
+		_ = pw.CloseWithError(err)
+
+		return err
+	})
+
+	fileName := fmt.Sprintf("segment_%d_%s:%d.csv", segment.GetID(), segment.GetName(), time.Now().Unix())
+
+	fileID, err := h.fileRepo.CreateFile(ctx, goutil.String(tenant.GetExtInfo().GetFolderID()), fileName, pr)
+
+	// stop the writer if the upload fails halfway
+	_ = pr.CloseWithError(err)
+
+	if writeErr := writeG.Wait(); writeErr != nil {
+		return fmt.Errorf("write file failed: %v", writeErr)
+	}
+	if err != nil {
+		return fmt.Errorf("create file failed: %v", err)
+	}
+
+	task.Update(&entity.Task{
+		Status: entity.TaskStatusSuccess,
+		ExtInfo: &entity.TaskExtInfo{
+			FileID:       goutil.String(fileID),
+			ExportedRows: goutil.Uint64(exported),
+			Progress:     goutil.Uint64(100),
+		},
+	})
+	if err := h.taskRepo.Update(ctx, task); err != nil {
+		return fmt.Errorf("set task to 100%% completion err: %v", err)
+	}
+
+	log.Ctx(ctx).Info().Msgf("task is success, task_id: %v, exported rows: %v", task.GetID(), exported)
+
+	return nil
+}
+
+// write scrolls the uds of the segment into w as CSV rows, and returns the number of rows written.
+func (h *RunSegmentExportTask) write(ctx context.Context, task *entity.Task, tenant *entity.Tenant, segment *entity.Segment,
+	tags []*entity.Tag, w io.Writer) (uint64, error) {
+	var (
+		cw      = csv.NewWriter(w)
+		maskPII = task.GetExtInfo().GetMaskPII()
+		size    = task.GetExtInfo().GetSize()
+
+		tagIDs = make([]uint64, 0, len(tags))
+		header = []string{"id", "id_type"}
+	)
+	for _, tag := range tags {
+		tagIDs = append(tagIDs, tag.GetID())
+		header = append(header, tag.GetName())
+	}
+
+	if err := cw.Write(header); err != nil {
+		return 0, err
+	}
+
+	var (
+		count        uint64
+		cursor       = ""
+		lastProgress = time.Now()
+	)
+	for {
+		docs, page, err := h.queryRepo.DownloadTagVals(ctx, tenant, segment.GetCriteria(), tagIDs, &repo.Pagination{
+			Limit:  goutil.Uint32(downloadSize),
+			Cursor: goutil.String(cursor),
+		})
+		if err != nil {
+			return count, fmt.Errorf("download tag values failed: %v", err)
+		}
+
+		for _, doc := range docs {
+			ud := doc.GetUd()
+			if maskPII && ud.IsPII() {
+				ud = ud.Mask()
+			}
+
+			vals := make(map[uint64]interface{}, len(doc.GetTagVals()))
+			for _, tagVal := range doc.GetTagVals() {
+				vals[tagVal.GetTagID()] = tagVal.GetTagVal()
+			}
+
+			row := []string{ud.GetID(), entity.IDTypes[ud.GetIDType()]}
+			for _, tag := range tags {
+				v := vals[tag.GetID()]
+				if maskPII && tag.IsPII() {
+					v = entity.MaskTagVal(v)
+				}
+				row = append(row, toCell(v))
+			}
+
+			if err := cw.Write(row); err != nil {
+				return count, err
+			}
+			count++
+		}
+
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return count, err
+		}
+
+		cursor = page.GetCursor()
+		if cursor == "" {
+			break
+		}
+
+		if size > 0 && time.Since(lastProgress) >= progressInterval {
+			lastProgress = time.Now()
+
+			task.Update(&entity.Task{
+				ExtInfo: &entity.TaskExtInfo{
+					Progress:     goutil.Uint64(min(count*100/size, 99)),
+					ExportedRows: goutil.Uint64(count),
+				},
+			})
+
+			// no need return err, let the next update to correct the error
+			if err := h.taskRepo.Update(ctx, task); err != nil {
+				log.Ctx(ctx).Error().Msgf("[task ID %d] set task progress err: %v", task.GetID(), err)
+			} else {
+				log.Ctx(ctx).Info().Msgf("task_id: %v, count: %v, size: %v", task.GetID(), count, size)
+			}
+		}
+	}
+
+	return count, nil
+}
+
+// toCell formats a tag value the way it is uploaded, so that an exported file can be uploaded again.
+func toCell(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case []interface{}:
+		items := make([]string, 0, len(val))
+		for _, item := range val {
+			items = append(items, toCell(item))
+		}
+		return strings.Join(items, entity.TagValueListSeparator)
+	case []string:
+		return strings.Join(val, entity.TagValueListSeparator)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func (h *RunSegmentExportTask) CleanUp(_ context.Context) error {
+	return nil
+}
@@ -0,0 +1,248 @@
+package run_segment_snapshot_tasks
+
+import (
+	"cdp/entity"
+	"cdp/pkg/goutil"
+	"cdp/pkg/service"
+	"cdp/repo"
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	downloadSize     = 3_000
+	progressInterval = 2 * time.Second
+)
+
+// RunSegmentSnapshotTask freezes the uds of a segment into a static segment, by marking their docs.
+type RunSegmentSnapshotTask struct {
+	taskRepo    repo.TaskRepo
+	queryRepo   repo.QueryRepo
+	tenantRepo  repo.TenantRepo
+	segmentRepo repo.SegmentRepo
+}
+
+func New(taskRepo repo.TaskRepo, queryRepo repo.QueryRepo, tenantRepo repo.TenantRepo, segmentRepo repo.SegmentRepo) service.Job {
+	return &RunSegmentSnapshotTask{
+		taskRepo:    taskRepo,
+		queryRepo:   queryRepo,
+		tenantRepo:  tenantRepo,
+		segmentRepo: segmentRepo,
+	}
+}
+
+func (h *RunSegmentSnapshotTask) Init(_ context.Context) error {
+	return nil
+}
+
+func (h *RunSegmentSnapshotTask) Run(ctx context.Context) error {
+	var (
+		g  = new(errgroup.Group)
+		c  = 10
+		ch = make(chan struct{}, c)
+	)
+
+	tasks, err := h.taskRepo.GetPendingSegmentSnapshotTasks(ctx)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get pending segment snapshot tasks failed: %v", err)
+		return err
+	}
+
+	log.Ctx(ctx).Info().Msgf("number of tasks to be processed: %d", len(tasks))
+
+	for _, task := range tasks {
+		select {
+		case ch <- struct{}{}:
+		}
+
+		task := task
+		g.Go(func() error {
+			// release go routine
+			defer func() {
+				<-ch
+			}()
+
+			if err := h.snapshot(ctx, task); err != nil {
+				log.Ctx(ctx).Error().Msgf("[task ID %d] error encountered: %v", task.GetID(), err)
+
+				task.Update(&entity.Task{
+					Status: entity.TaskStatusFailed,
+					ExtInfo: &entity.TaskExtInfo{
+						FailReason: goutil.String(err.Error()),
+					},
+				})
+				if err := h.taskRepo.Update(ctx, task); err != nil {
+					log.Ctx(ctx).Error().Msgf("[task ID %d] set task to failed err: %v", task.GetID(), err)
+				}
+
+				return err
+			}
+
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+func (h *RunSegmentSnapshotTask) snapshot(ctx context.Context, task *entity.Task) error {
+	tenant, err := h.tenantRepo.GetByID(ctx, task.GetTenantID())
+	if err != nil {
+		return fmt.Errorf("get tenant failed: %v", err)
+	}
+
+	segment, err := h.segmentRepo.GetByID(ctx, tenant.GetID(), task.GetResourceID())
+	if err != nil {
+		return fmt.Errorf("get segment failed: %v", err)
+	}
+
+	if !segment.IsStatic() {
+		return fmt.Errorf("segment %d is not static", segment.GetID())
+	}
+
+	source, err := h.segmentRepo.GetByID(ctx, tenant.GetID(), task.GetExtInfo().GetSourceSegmentID())
+	if err != nil {
+		return fmt.Errorf("get source segment failed: %v", err)
+	}
+
+	// the size is only used for the progress, the scroll below sees the uds as of when it starts
+	size, err := h.queryRepo.Count(ctx, tenant, source.GetCriteria())
+	if err != nil {
+		return fmt.Errorf("count source segment failed: %v", err)
+	}
+
+	task.Update(&entity.Task{
+		Status: entity.TaskStatusRunning,
+		ExtInfo: &entity.TaskExtInfo{
+			Size: goutil.Uint64(size),
+		},
+	})
+	if err := h.taskRepo.Update(ctx, task); err != nil {
+		return fmt.Errorf("set task to running failed: %v", err)
+	}
+
+	// upsert results arrive as the bulk indexer flushes, they are counted while the uds are scrolled
+	var (
+		upsertResChan = make(chan repo.UpsertResult, downloadSize*10)
+		doneChan      = make(chan struct{})
+		resG          = new(errgroup.Group)
+
+		upserted, failed atomic.Uint64
+		firstErr         atomic.Value
+	)
+	resG.Go(func() error {
+		for {
+			select {
+			case upsertRes := <-upsertResChan:
+				if upsertRes.Error != nil {
+					firstErr.CompareAndSwap(nil, upsertRes.Error.Error())
+					failed.Add(1)
+				}
+				upserted.Add(1)
+			case <-doneChan:
+				return nil
+			}
+		}
+	})
+	defer func() {
+		close(doneChan)
+		_ = resG.Wait()
+	}()
+
+	var (
+		written      uint64
+		cursor       = ""
+		lastProgress = time.Now()
+	)
+	for {
+		uds, page, err := h.queryRepo.Download(ctx, tenant, source.GetCriteria(), &repo.Pagination{
+			Limit:  goutil.Uint32(downloadSize),
+			Cursor: goutil.String(cursor),
+		})
+		if err != nil {
+			return fmt.Errorf("download uds failed: %v", err)
+		}
+
+		udTagVals := make([]*entity.UdTagVal, 0, len(uds))
+		for _, ud := range uds {
+			udTagVals = append(udTagVals, &entity.UdTagVal{
+				Ud:         ud,
+				SegmentIDs: []uint64{segment.GetID()},
+			})
+		}
+
+		if err := h.queryRepo.BatchUpsert(ctx, tenant.GetName(), udTagVals, upsertResChan); err != nil {
+			return fmt.Errorf("batch upsert err: %v", err)
+		}
+		written += uint64(len(udTagVals))
+
+		if time.Since(lastProgress) >= progressInterval {
+			lastProgress = time.Now()
+			h.updateProgress(ctx, task, upserted.Load(), size)
+		}
+
+		cursor = page.GetCursor()
+		if cursor == "" {
+			break
+		}
+	}
+
+	// wait for all upserts to be flushed
+	progressTicker := time.NewTicker(progressInterval)
+	defer progressTicker.Stop()
+
+	for upserted.Load() < written {
+		select {
+		case <-progressTicker.C:
+			h.updateProgress(ctx, task, upserted.Load(), size)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if n := failed.Load(); n > 0 {
+		return fmt.Errorf("%d of %d uds failed to be written, first err: %v", n, written, firstErr.Load())
+	}
+
+	task.Update(&entity.Task{
+		Status: entity.TaskStatusSuccess,
+		ExtInfo: &entity.TaskExtInfo{
+			Size:     goutil.Uint64(written),
+			Progress: goutil.Uint64(100),
+		},
+	})
+	if err := h.taskRepo.Update(ctx, task); err != nil {
+		return fmt.Errorf("set task to 100%% completion err: %v", err)
+	}
+
+	log.Ctx(ctx).Info().Msgf("task is success, task_id: %v, uds: %v", task.GetID(), written)
+
+	return nil
+}
+
+func (h *RunSegmentSnapshotTask) updateProgress(ctx context.Context, task *entity.Task, upserted, size uint64) {
+	if size == 0 {
+		return
+	}
+
+	task.Update(&entity.Task{
+		ExtInfo: &entity.TaskExtInfo{
+			Progress: goutil.Uint64(min(upserted*100/size, 99)),
+		},
+	})
+
+	// no need return err, let the next update to correct the error
+	if err := h.taskRepo.Update(ctx, task); err != nil {
+		log.Ctx(ctx).Error().Msgf("[task ID %d] set task progress err: %v", task.GetID(), err)
+	} else {
+		log.Ctx(ctx).Info().Msgf("task_id: %v, count: %v, size: %v", task.GetID(), upserted, size)
+	}
+}
+
+func (h *RunSegmentSnapshotTask) CleanUp(_ context.Context) error {
+	return nil
+}
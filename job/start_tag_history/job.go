@@ -0,0 +1,94 @@
+package start_tag_history
+
+import (
+	"cdp/entity"
+	"cdp/pkg/service"
+	"cdp/repo"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// maxAttempts is the number of times the history of a tag is started in a run while uds are written meanwhile,
+// a tag still conflicting is left to the next run.
+const maxAttempts = 3
+
+// StartTagHistory writes the first history entry of the values set before a tag kept history. It runs outside
+// of update_tag, as it rewrites every doc having a value of the tag.
+type StartTagHistory struct {
+	tagRepo    repo.TagRepo
+	tenantRepo repo.TenantRepo
+	queryRepo  repo.QueryRepo
+}
+
+func New(tagRepo repo.TagRepo, tenantRepo repo.TenantRepo, queryRepo repo.QueryRepo) service.Job {
+	return &StartTagHistory{
+		tagRepo:    tagRepo,
+		tenantRepo: tenantRepo,
+		queryRepo:  queryRepo,
+	}
+}
+
+func (h *StartTagHistory) Init(_ context.Context) error {
+	return nil
+}
+
+func (h *StartTagHistory) Run(ctx context.Context) error {
+	tags, err := h.tagRepo.GetTagsToStartHistory(ctx, 0)
+	if err != nil {
+		log.Ctx(ctx).Error().Msgf("get tags to start history failed: %v", err)
+		return err
+	}
+
+	log.Ctx(ctx).Info().Msgf("number of tags to start history: %d", len(tags))
+
+	// the tags are started one by one, as each update rewrites a large part of the store
+	var failed int
+	for _, tag := range tags {
+		if err := h.start(ctx, tag); err != nil {
+			log.Ctx(ctx).Error().Msgf("[tag ID %d] start tag history failed: %v", tag.GetID(), err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("start tag history failed for %d tag(s)", failed)
+	}
+
+	return nil
+}
+
+func (h *StartTagHistory) start(ctx context.Context, tag *entity.Tag) error {
+	tenant, err := h.tenantRepo.GetByID(ctx, tag.GetTenantID())
+	if err != nil {
+		return fmt.Errorf("get tenant failed: %v", err)
+	}
+
+	startTime := uint64(time.Now().Unix())
+
+	// docs skipped for a conflict are picked up by running it again, docs having history already are left as they are
+	for attempt := 1; ; attempt++ {
+		err = h.queryRepo.StartTagHistory(ctx, tenant.GetName(), tag.GetID())
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, repo.ErrHistoryConflicts) || attempt == maxAttempts {
+			return err
+		}
+		log.Ctx(ctx).Warn().Msgf("[tag ID %d] retry start tag history, attempt: %d, err: %v", tag.GetID(), attempt, err)
+	}
+
+	if err := h.tagRepo.SetHistoryStartTime(ctx, tag.GetTenantID(), tag.GetID(), startTime); err != nil {
+		return fmt.Errorf("set history start time failed: %v", err)
+	}
+
+	log.Ctx(ctx).Info().Msgf("tag history is started, tag_id: %v", tag.GetID())
+
+	return nil
+}
+
+func (h *StartTagHistory) CleanUp(_ context.Context) error {
+	return nil
+}
@@ -46,6 +46,9 @@ type server struct {
 	roleRepo        repo.RoleRepo
 	userRoleRepo    repo.UserRoleRepo
 	senderRepo      repo.SenderRepo
+	mappingIDRepo   repo.MappingIDRepo
+	erasureRepo     repo.ErasureRepo
+	segmentSizeRepo repo.SegmentSizeRepo
 
 	// services
 	emailService dep.EmailService
@@ -60,6 +63,7 @@ type server struct {
 	taskHandler     handler.TaskHandler
 	accountHandler  handler.AccountHandler
 	roleHandler     handler.RoleHandler
+	udHandler       handler.UdHandler
 }
 
 func main() {
@@ -109,7 +113,7 @@ func (s *server) Start() error {
 	}()
 
 	// query repo
-	s.queryRepo, err = repo.NewQueryRepo(s.ctx, s.cfg.QueryDB)
+	s.queryRepo, err = repo.NewQueryRepo(s.ctx, s.cfg, s.baseRepo)
 	if err != nil {
 		log.Ctx(s.ctx).Error().Msgf("init query repo failed, err: %v", err)
 		return err
@@ -141,6 +145,9 @@ func (s *server) Start() error {
 	// segment repo
 	s.segmentRepo = repo.NewSegmentRepo(s.ctx, s.baseRepo)
 
+	// segment size repo
+	s.segmentSizeRepo = repo.NewSegmentSizeRepo(s.ctx, s.baseRepo)
+
 	// email repo
 	s.emailRepo = repo.NewEmailRepo(s.ctx, s.baseRepo)
 
@@ -183,6 +190,16 @@ func (s *server) Start() error {
 	// sender repo
 	s.senderRepo = repo.NewSenderRepo(s.ctx, s.baseRepo)
 
+	// mapping id repo
+	s.mappingIDRepo = repo.NewMappingIDRepo(s.ctx, s.baseRepo)
+
+	// erasure repo
+	s.erasureRepo, err = repo.NewErasureRepo(s.ctx, s.baseRepo, s.cfg.UdHashSecret)
+	if err != nil {
+		log.Ctx(s.ctx).Error().Msgf("init erasure repo failed, err: %v", err)
+		return err
+	}
+
 	// role repo
 	s.roleRepo, err = repo.NewRoleRepo(s.ctx, s.baseRepo)
 	if err != nil {
@@ -215,19 +232,23 @@ func (s *server) Start() error {
 
 	// ===== init handlers ===== //
 
-	s.tagHandler = handler.NewTagHandler(s.tagRepo, s.queryRepo)
-	s.segmentHandler = handler.NewSegmentHandler(s.cfg, s.tagRepo, s.segmentRepo, s.queryRepo)
+	s.tagHandler = handler.NewTagHandler(s.baseRepo, s.tagRepo, s.segmentRepo, s.queryRepo)
+	s.segmentHandler = handler.NewSegmentHandler(s.cfg, s.baseRepo, s.tagRepo, s.segmentRepo, s.queryRepo,
+		s.campaignRepo, s.segmentSizeRepo, s.taskRepo)
 	s.emailHandler = handler.NewEmailHandler(s.emailRepo)
-	s.campaignHandler = handler.NewCampaignHandler(s.cfg, s.campaignRepo, s.emailService, s.segmentHandler,
-		s.campaignLogRepo, s.emailHandler, s.senderRepo)
+	s.campaignHandler = handler.NewCampaignHandler(s.cfg, s.baseRepo, s.campaignRepo, s.emailService, s.segmentHandler,
+		s.campaignLogRepo, s.emailHandler, s.senderRepo, s.segmentRepo)
 	s.userHandler = handler.NewUserHandler(s.cfg, s.baseRepo, s.emailService, s.userRepo, s.tenantRepo,
 		s.activationRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo)
 	s.tenantHandler = handler.NewTenantHandler(s.cfg, s.baseRepo, s.tenantRepo, s.fileRepo, s.queryRepo,
 		s.roleRepo, s.userRoleRepo, s.userHandler, s.emailService, s.senderRepo)
-	s.taskHandler = handler.NewTaskHandler(s.taskRepo, s.fileRepo, s.queryRepo, s.tenantRepo, s.tagRepo)
+	s.taskHandler = handler.NewTaskHandler(s.taskRepo, s.fileRepo, s.queryRepo, s.tenantRepo, s.tagRepo,
+		s.segmentRepo)
 	s.accountHandler = handler.NewAccountHandler(s.cfg, s.tenantHandler, s.userHandler, s.tagHandler, s.segmentHandler,
 		s.emailHandler, s.campaignRepo, s.queryRepo, s.taskRepo, s.campaignLogRepo)
 	s.roleHandler = handler.NewRoleHandler(s.userRepo, s.roleRepo)
+	s.udHandler = handler.NewUdHandler(s.baseRepo, s.tagRepo, s.queryRepo, s.mappingIDRepo, s.campaignRepo,
+		s.campaignLogRepo, s.erasureRepo)
 
 	// ===== start server ===== //
 
@@ -425,6 +446,134 @@ func (s *server) registerRoutes() http.Handler {
 		},
 	})
 
+	// update_segment
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathUpdateSegment,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.UpdateSegmentRequest),
+			Res: new(handler.UpdateSegmentResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.segmentHandler.UpdateSegment(ctx, req.(*handler.UpdateSegmentRequest), res.(*handler.UpdateSegmentResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// delete_segment
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathDeleteSegment,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.DeleteSegmentRequest),
+			Res: new(handler.DeleteSegmentResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.segmentHandler.DeleteSegment(ctx, req.(*handler.DeleteSegmentRequest), res.(*handler.DeleteSegmentResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// get_segment_versions
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathGetSegmentVersions,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.GetSegmentVersionsRequest),
+			Res: new(handler.GetSegmentVersionsResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.segmentHandler.GetSegmentVersions(ctx, req.(*handler.GetSegmentVersionsRequest), res.(*handler.GetSegmentVersionsResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// restore_segment
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathRestoreSegment,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.RestoreSegmentRequest),
+			Res: new(handler.RestoreSegmentResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.segmentHandler.RestoreSegment(ctx, req.(*handler.RestoreSegmentRequest), res.(*handler.RestoreSegmentResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// get_segment_size_history
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathGetSegmentSizes,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.GetSegmentSizeHistoryRequest),
+			Res: new(handler.GetSegmentSizeHistoryResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.segmentHandler.GetSegmentSizeHistory(ctx, req.(*handler.GetSegmentSizeHistoryRequest), res.(*handler.GetSegmentSizeHistoryResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// get_segment_overlaps
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathGetSegmentOverlaps,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.GetSegmentOverlapsRequest),
+			Res: new(handler.GetSegmentOverlapsResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.segmentHandler.GetSegmentOverlaps(ctx, req.(*handler.GetSegmentOverlapsRequest), res.(*handler.GetSegmentOverlapsResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// snapshot_segment
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathSnapshotSegment,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.SnapshotSegmentRequest),
+			Res: new(handler.SnapshotSegmentResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.segmentHandler.SnapshotSegment(ctx, req.(*handler.SnapshotSegmentRequest), res.(*handler.SnapshotSegmentResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// split_segment
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathSplitSegment,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.SplitSegmentRequest),
+			Res: new(handler.SplitSegmentResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.segmentHandler.SplitSegment(ctx, req.(*handler.SplitSegmentRequest), res.(*handler.SplitSegmentResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
 	// create_tag
 	r.RegisterHttpRoute(&router.HttpRoute{
 		Path:   config.PathCreateTag,
@@ -441,6 +590,138 @@ func (s *server) registerRoutes() http.Handler {
 		},
 	})
 
+	// update_tag
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathUpdateTag,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.UpdateTagRequest),
+			Res: new(handler.UpdateTagResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.tagHandler.UpdateTag(ctx, req.(*handler.UpdateTagRequest), res.(*handler.UpdateTagResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// delete_tag
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathDeleteTag,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.DeleteTagRequest),
+			Res: new(handler.DeleteTagResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.tagHandler.DeleteTag(ctx, req.(*handler.DeleteTagRequest), res.(*handler.DeleteTagResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// get_tag_stats
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathGetTagStats,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.GetTagStatsRequest),
+			Res: new(handler.GetTagStatsResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.tagHandler.GetTagStats(ctx, req.(*handler.GetTagStatsRequest), res.(*handler.GetTagStatsResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// get_tag_val_history
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathGetTagValHistory,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.GetTagValHistoryRequest),
+			Res: new(handler.GetTagValHistoryResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.tagHandler.GetTagValHistory(ctx, req.(*handler.GetTagValHistoryRequest), res.(*handler.GetTagValHistoryResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// get_ud_profile
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathGetUdProfile,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.GetUdProfileRequest),
+			Res: new(handler.GetUdProfileResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.udHandler.GetUdProfile(ctx, req.(*handler.GetUdProfileRequest), res.(*handler.GetUdProfileResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// upsert_uds
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathUpsertUds,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.UpsertUdsRequest),
+			Res: new(handler.UpsertUdsResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.udHandler.UpsertUds(ctx, req.(*handler.UpsertUdsRequest), res.(*handler.UpsertUdsResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// delete_ud
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathDeleteUd,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.DeleteUdRequest),
+			Res: new(handler.DeleteUdResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.udHandler.DeleteUd(ctx, req.(*handler.DeleteUdRequest), res.(*handler.DeleteUdResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, []entity.ActionCode{
+				entity.ActionEraseUd,
+			}),
+		},
+	})
+
+	// get_erasures
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathGetErasures,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.GetErasuresRequest),
+			Res: new(handler.GetErasuresResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.udHandler.GetErasures(ctx, req.(*handler.GetErasuresRequest), res.(*handler.GetErasuresResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, []entity.ActionCode{
+				entity.ActionEraseUd,
+			}),
+		},
+	})
+
 	// create_segment
 	r.RegisterHttpRoute(&router.HttpRoute{
 		Path:   config.PathCreateSegment,
@@ -617,6 +898,54 @@ func (s *server) registerRoutes() http.Handler {
 		},
 	})
 
+	// create_segment_export_task
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathCreateSegmentExport,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.CreateSegmentExportTaskRequest),
+			Res: new(handler.CreateSegmentExportTaskResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.taskHandler.CreateSegmentExportTask(ctx, req.(*handler.CreateSegmentExportTaskRequest), res.(*handler.CreateSegmentExportTaskResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// get_segment_export_tasks
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathGetSegmentExports,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.GetSegmentExportTasksRequest),
+			Res: new(handler.GetSegmentExportTasksResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.taskHandler.GetSegmentExportTasks(ctx, req.(*handler.GetSegmentExportTasksRequest), res.(*handler.GetSegmentExportTasksResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
+	// download_segment_export
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathDownloadSegmentExport,
+		Method: http.MethodGet,
+		Handler: router.Handler{
+			Req: new(handler.DownloadSegmentExportRequest),
+			Res: new(handler.DownloadSegmentExportResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.taskHandler.DownloadSegmentExport(ctx, req.(*handler.DownloadSegmentExportRequest), res.(*handler.DownloadSegmentExportResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, nil),
+		},
+	})
+
 	// on_email_action
 	r.RegisterHttpRoute(&router.HttpRoute{
 		Path:   config.PathOnEmailAction,
@@ -944,5 +1273,23 @@ func (s *server) registerRoutes() http.Handler {
 		},
 	})
 
+	// flush_query_cache
+	r.RegisterHttpRoute(&router.HttpRoute{
+		Path:   config.PathFlushQueryCache,
+		Method: http.MethodPost,
+		Handler: router.Handler{
+			Req: new(handler.FlushQueryCacheRequest),
+			Res: new(handler.FlushQueryCacheResponse),
+			HandleFunc: func(ctx context.Context, req, res interface{}) error {
+				return s.tenantHandler.FlushQueryCache(ctx, req.(*handler.FlushQueryCacheRequest), res.(*handler.FlushQueryCacheResponse))
+			},
+		},
+		Middlewares: []router.Middleware{
+			router.NewSessionMiddleware(s.userRepo, s.tenantRepo, s.sessionRepo, s.roleRepo, s.userRoleRepo, []entity.ActionCode{
+				entity.ActionFlushCache,
+			}),
+		},
+	})
+
 	return r
 }
@@ -1,6 +1,7 @@
 package goutil
 
 import (
+	"crypto/hmac"
 	cryptoRand "crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
@@ -56,6 +57,12 @@ func Sha256(s string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+func HmacSha256(key, s string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(s))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
 func BCrypt(s string) (string, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(s), bcrypt.DefaultCost)
 	if err != nil {
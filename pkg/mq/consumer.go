@@ -18,6 +18,9 @@ var (
 	ErrInvalidInitialOffset   = errors.New("invalid initial offset")
 )
 
+// HandlerFunc handles a consumed message. Once it returns nil, the handler owns the message and must
+// pass it to Commit after it is processed, so that its offset is committed only then.
+// A message failing the handler is not committed itself, its offset is committed with the next message after it.
 type HandlerFunc func(ctx context.Context, msg *Message) error
 
 var (
@@ -56,6 +59,11 @@ type ConsumerConfig struct {
 	ConsumerGroup   string   `json:"consumer_group,omitempty"`
 	BalanceStrategy string   `json:"balance_strategy,omitempty"`
 	InitialOffset   string   `json:"initial_offset,omitempty"`
+
+	// ChannelBufferSize is the number of messages buffered per partition ahead of the handler, 0 uses the sarama default.
+	ChannelBufferSize int `json:"channel_buffer_size,omitempty"`
+	// FetchDefaultBytes is the number of bytes fetched per request to the broker, 0 uses the sarama default.
+	FetchDefaultBytes int32 `json:"fetch_default_bytes,omitempty"`
 }
 
 var balanceStrategies = []string{"sticky", "roundrobin", "range"}
@@ -96,7 +104,16 @@ func NewConsumer(ctx context.Context, cfg ConsumerConfig) (*Consumer, error) {
 	}
 
 	saramaConfig := sarama.NewConfig()
-	saramaConfig.Consumer.Offsets.AutoCommit.Enable = true
+	// offsets are committed by Commit once the messages are processed
+	saramaConfig.Consumer.Offsets.AutoCommit.Enable = false
+
+	if cfg.ChannelBufferSize > 0 {
+		saramaConfig.ChannelBufferSize = cfg.ChannelBufferSize
+	}
+
+	if cfg.FetchDefaultBytes > 0 {
+		saramaConfig.Consumer.Fetch.Default = cfg.FetchDefaultBytes
+	}
 
 	if cfg.InitialOffset == "oldest" {
 		saramaConfig.Consumer.Offsets.Initial = sarama.OffsetOldest
@@ -199,12 +216,13 @@ func (c *Consumer) processMessage(ctx context.Context, session sarama.ConsumerGr
 
 	defer func() {
 		since := time.Now().Sub(start).Microseconds()
-		log.Ctx(ctx).Info().Msgf("message processed: value = %s, timestamp = %v, topic = %s, offset = %v, proctm: %vμs, err: %v",
-			string(consumerMessage.Value), consumerMessage.Timestamp, consumerMessage.Topic, consumerMessage.Offset, since, err)
-
-		c.markMessage(session, consumerMessage)
+		log.Ctx(ctx).Info().Msgf("message handled: timestamp = %v, topic = %s, partition = %v, offset = %v, proctm: %vμs, err: %v",
+			consumerMessage.Timestamp, consumerMessage.Topic, consumerMessage.Partition, consumerMessage.Offset, since, err)
 	}()
 
+	msg.session = session
+	msg.consumerMessage = consumerMessage
+
 	if err = json.Unmarshal(consumerMessage.Value, msg); err != nil {
 		err = fmt.Errorf("failed to unmarshal message: %w", err)
 		return
@@ -222,6 +240,19 @@ func (c *Consumer) processMessage(ctx context.Context, session sarama.ConsumerGr
 	}
 }
 
-func (c *Consumer) markMessage(session sarama.ConsumerGroupSession, consumerMessage *sarama.ConsumerMessage) {
-	session.MarkMessage(consumerMessage, "")
+// Commit marks the messages as processed and commits their offsets. Committing a message commits all messages
+// before it in the partition, so messages must be committed in the order they are consumed.
+func Commit(msgs []*Message) {
+	sessions := make(map[sarama.ConsumerGroupSession]struct{})
+	for _, msg := range msgs {
+		if msg.session == nil {
+			continue
+		}
+		msg.session.MarkMessage(msg.consumerMessage, "")
+		sessions[msg.session] = struct{}{}
+	}
+
+	for session := range sessions {
+		session.Commit()
+	}
 }
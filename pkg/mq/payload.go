@@ -1,14 +1,18 @@
 package mq
 
+import "cdp/entity"
+
 type Payload uint32
 
 const (
 	PayloadUnknown Payload = iota
 	PayloadNotifyCreateTask
+	PayloadUpsertUd
 )
 
 var Payloads = map[Payload]string{
 	PayloadNotifyCreateTask: "notify_create_task",
+	PayloadUpsertUd:         "upsert_ud",
 }
 
 type NotifyCreateTask struct {
@@ -21,3 +25,28 @@ func (m *NotifyCreateTask) GetTaskID() uint64 {
 	}
 	return 0
 }
+
+// UpsertUd writes the tag values of a ud in real time, messages should be keyed by the ud
+// so that updates of the same ud are consumed in order.
+type UpsertUd struct {
+	TenantID *uint64          `json:"tenant_id"`
+	Ud       *entity.Ud       `json:"ud"`
+	TagVals  []*entity.TagVal `json:"tag_vals"`
+}
+
+func (m *UpsertUd) GetTenantID() uint64 {
+	if m != nil && m.TenantID != nil {
+		return *m.TenantID
+	}
+	return 0
+}
+
+func (m *UpsertUd) ToUdTagVal() *entity.UdTagVal {
+	if m == nil {
+		return nil
+	}
+	return &entity.UdTagVal{
+		Ud:      m.Ud,
+		TagVals: m.TagVals,
+	}
+}
@@ -20,6 +20,18 @@ type Message struct {
 	Payload Payload     `json:"payload,omitempty"`
 	Key     string      `json:"key,omitempty"`
 	Body    interface{} `json:"body,omitempty"`
+
+	// set on consumed messages, to commit their offsets
+	session         sarama.ConsumerGroupSession
+	consumerMessage *sarama.ConsumerMessage
+}
+
+// GetOffset returns the offset of a consumed message.
+func (msg *Message) GetOffset() int64 {
+	if msg != nil && msg.consumerMessage != nil {
+		return msg.consumerMessage.Offset
+	}
+	return 0
 }
 
 func (msg *Message) ParseBody(dst interface{}) error {
@@ -0,0 +1,241 @@
+package querylang
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Error is an error at a position of the text, lines and columns start from 1.
+type Error struct {
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d, col %d: %s", e.Line, e.Col, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF    tokenKind = iota
+	tokenIdent            // bare identifier or keyword, e.g. Age, AND
+	tokenQuoted           // backquoted identifier, e.g. `Last Order`
+	tokenString           // double quoted string, e.g. "SG"
+	tokenNumber
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenOp // one of = > < >= <=
+)
+
+var tokenKinds = map[tokenKind]string{
+	tokenEOF:    "end of text",
+	tokenIdent:  "identifier",
+	tokenQuoted: "identifier",
+	tokenString: "string",
+	tokenNumber: "number",
+	tokenLParen: "'('",
+	tokenRParen: "')'",
+	tokenComma:  "','",
+	tokenOp:     "operator",
+}
+
+type token struct {
+	kind tokenKind
+	text string // unquoted for tokenQuoted and tokenString
+	pos  int    // byte offset in the text
+}
+
+// describe tells the token the way it appears in the text, for error messages.
+func (t token) describe() string {
+	switch t.kind {
+	case tokenEOF:
+		return tokenKinds[t.kind]
+	case tokenQuoted:
+		return fmt.Sprintf("`%s`", t.text)
+	case tokenString:
+		return fmt.Sprintf("%q", t.text)
+	default:
+		return fmt.Sprintf("'%s'", t.text)
+	}
+}
+
+type lexer struct {
+	text string
+	pos  int
+}
+
+// errorAt builds an Error at the byte offset pos of the text.
+func errorAt(text string, pos int, format string, args ...interface{}) *Error {
+	var (
+		line   = 1 + strings.Count(text[:pos], "\n")
+		lineAt = strings.LastIndex(text[:pos], "\n") + 1
+	)
+	return &Error{
+		Line: line,
+		Col:  1 + utf8.RuneCountInString(text[lineAt:pos]),
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+func (l *lexer) tokens() ([]token, error) {
+	tokens := make([]token, 0)
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+		if t.kind == tokenEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.text) {
+		r, size := utf8.DecodeRuneInString(l.text[l.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		l.pos += size
+	}
+
+	start := l.pos
+	if start >= len(l.text) {
+		return token{kind: tokenEOF, pos: start}, nil
+	}
+
+	r, size := utf8.DecodeRuneInString(l.text[start:])
+	switch {
+	case r == '(':
+		l.pos += size
+		return token{kind: tokenLParen, text: "(", pos: start}, nil
+	case r == ')':
+		l.pos += size
+		return token{kind: tokenRParen, text: ")", pos: start}, nil
+	case r == ',':
+		l.pos += size
+		return token{kind: tokenComma, text: ",", pos: start}, nil
+	case r == '=':
+		l.pos += size
+		return token{kind: tokenOp, text: "=", pos: start}, nil
+	case r == '>' || r == '<':
+		l.pos += size
+		if l.pos < len(l.text) && l.text[l.pos] == '=' {
+			l.pos++
+		}
+		return token{kind: tokenOp, text: l.text[start:l.pos], pos: start}, nil
+	case r == '"':
+		return l.lexString()
+	case r == '`':
+		end := strings.IndexByte(l.text[start+1:], '`')
+		if end < 0 {
+			return token{}, errorAt(l.text, start, "unterminated identifier")
+		}
+		l.pos = start + 1 + end + 1
+		name := l.text[start+1 : l.pos-1]
+		if name == "" {
+			return token{}, errorAt(l.text, start, "empty identifier")
+		}
+		return token{kind: tokenQuoted, text: name, pos: start}, nil
+	case r == '-' || isDigit(r):
+		return l.lexNumber()
+	case isIdentStart(r):
+		for l.pos < len(l.text) {
+			r, size := utf8.DecodeRuneInString(l.text[l.pos:])
+			if !isIdentPart(r) {
+				break
+			}
+			l.pos += size
+		}
+		return token{kind: tokenIdent, text: l.text[start:l.pos], pos: start}, nil
+	default:
+		return token{}, errorAt(l.text, start, "unexpected character %q", r)
+	}
+}
+
+func (l *lexer) lexString() (token, error) {
+	var (
+		start = l.pos
+		sb    strings.Builder
+	)
+	for l.pos++; l.pos < len(l.text); {
+		c := l.text[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return token{kind: tokenString, text: sb.String(), pos: start}, nil
+		case '\\':
+			if l.pos+1 >= len(l.text) {
+				return token{}, errorAt(l.text, start, "unterminated string")
+			}
+			switch e := l.text[l.pos+1]; e {
+			case '"', '\\':
+				sb.WriteByte(e)
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			default:
+				return token{}, errorAt(l.text, l.pos, "invalid escape '\\%c'", e)
+			}
+			l.pos += 2
+		default:
+			sb.WriteByte(c)
+			l.pos++
+		}
+	}
+	return token{}, errorAt(l.text, start, "unterminated string")
+}
+
+func (l *lexer) lexNumber() (token, error) {
+	start := l.pos
+	if l.text[l.pos] == '-' {
+		l.pos++
+	}
+
+	digits := func() int {
+		n := 0
+		for l.pos < len(l.text) && isDigit(rune(l.text[l.pos])) {
+			l.pos++
+			n++
+		}
+		return n
+	}
+
+	if digits() == 0 {
+		return token{}, errorAt(l.text, start, "invalid number")
+	}
+	if l.pos < len(l.text) && l.text[l.pos] == '.' {
+		l.pos++
+		if digits() == 0 {
+			return token{}, errorAt(l.text, start, "invalid number")
+		}
+	}
+
+	// a number running into letters, e.g. 30d, is a typo rather than two tokens
+	if l.pos < len(l.text) {
+		if r, _ := utf8.DecodeRuneInString(l.text[l.pos:]); isIdentPart(r) {
+			return token{}, errorAt(l.text, start, "invalid number")
+		}
+	}
+
+	return token{kind: tokenNumber, text: l.text[start:l.pos], pos: start}, nil
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentPart(r rune) bool {
+	return r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,504 @@
+// Package querylang is a text language for segment criteria, e.g.
+//
+//	Age >= 30 AND (Country IN ("SG", "MY") OR NOT Plan = "free")
+//
+// Tags are referenced by their names, backquoted if they are not plain identifiers, e.g. `Last Order`.
+// A lookup is a tag name followed by one of
+//
+//	= > < >= <= value
+//	IN (values), NOT IN (values), CONTAINS ANY (values)
+//	BETWEEN value AND value
+//	EXISTS, MISSING
+//	PREFIX "text", CONTAINS "text"
+//	CHANGED WITHIN days
+//
+// optionally followed by AS OF unix_time. Besides tag lookups, SEGMENT(id) matches the uds of another segment,
+// SPLIT(seed, from, to) matches a split of the uds, and ID_TYPE(email) limits the enclosing group to an ID type.
+// Values are "strings", numbers, TRUE or FALSE. Keywords are case-insensitive, AND binds tighter than OR.
+package querylang
+
+import (
+	"cdp/entity"
+	"cdp/pkg/goutil"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrUnknownTag is returned by a TagResolver for a name that is not a tag.
+var ErrUnknownTag = errors.New("unknown tag")
+
+// TagResolver gets the ID of a tag by its name.
+type TagResolver func(name string) (uint64, error)
+
+var keywords = map[string]bool{
+	"AND": true, "OR": true, "NOT": true,
+	"IN": true, "BETWEEN": true, "EXISTS": true, "MISSING": true, "PREFIX": true, "CONTAINS": true, "ANY": true,
+	"CHANGED": true, "WITHIN": true, "AS": true, "OF": true,
+	"SEGMENT": true, "SPLIT": true, "ID_TYPE": true, "TRUE": true, "FALSE": true,
+}
+
+func isKeyword(s string) bool {
+	return keywords[strings.ToUpper(s)]
+}
+
+// Parse parses the text into a query. Syntax errors, and names which resolveTag does not know,
+// are returned as an *Error telling where they are, other errors of resolveTag are returned as is.
+func Parse(text string, resolveTag TagResolver) (*entity.Query, error) {
+	tokens, err := (&lexer{text: text}).tokens()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{
+		text:       text,
+		tokens:     tokens,
+		resolveTag: resolveTag,
+	}
+
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorAt(t, "expected AND, OR or end of text, found %s", t.describe())
+	}
+
+	return p.toQuery(n)
+}
+
+// node is a parsed expression, either a group of nodes joined by op, a lookup or an ID type.
+type node struct {
+	pos int
+
+	op       entity.QueryOp
+	not      bool
+	children []*node
+
+	lookup *entity.Lookup
+	idType entity.IDType
+}
+
+func (n *node) isGroup() bool {
+	return n.lookup == nil && n.idType == entity.IDTypeUnknown
+}
+
+type parser struct {
+	text       string
+	tokens     []token
+	i          int
+	resolveTag TagResolver
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) advance() token {
+	t := p.tokens[p.i]
+	if t.kind != tokenEOF {
+		p.i++
+	}
+	return t
+}
+
+// isKeyword checks if the next token is the keyword.
+func (p *parser) isKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokenIdent && strings.EqualFold(t.text, keyword)
+}
+
+func (p *parser) acceptKeyword(keyword string) bool {
+	if p.isKeyword(keyword) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	if !p.acceptKeyword(keyword) {
+		t := p.peek()
+		return p.errorAt(t, "expected %s, found %s", keyword, t.describe())
+	}
+	return nil
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	t := p.peek()
+	if t.kind != kind {
+		return t, p.errorAt(t, "expected %s, found %s", tokenKinds[kind], t.describe())
+	}
+	return p.advance(), nil
+}
+
+func (p *parser) errorAt(t token, format string, args ...interface{}) *Error {
+	return errorAt(p.text, t.pos, format, args...)
+}
+
+func (p *parser) parseOr() (*node, error) {
+	return p.parseChain(entity.QueryOpOr, "OR", p.parseAnd)
+}
+
+func (p *parser) parseAnd() (*node, error) {
+	return p.parseChain(entity.QueryOpAnd, "AND", p.parseUnary)
+}
+
+// parseChain parses operands joined by the keyword into a group, a single operand is returned as is.
+func (p *parser) parseChain(op entity.QueryOp, keyword string, parseOperand func() (*node, error)) (*node, error) {
+	pos := p.peek().pos
+
+	first, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*node{first}
+	for p.acceptKeyword(keyword) {
+		n, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, n)
+	}
+
+	if len(children) == 1 {
+		return first, nil
+	}
+
+	return &node{pos: pos, op: op, children: children}, nil
+}
+
+func (p *parser) parseUnary() (*node, error) {
+	t := p.peek()
+	if !p.acceptKeyword("NOT") {
+		return p.parsePrimary()
+	}
+
+	n, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case n.lookup != nil:
+		// a lookup negated twice is left without Not, as it is written in JSON
+		if n.lookup.GetNot() {
+			n.lookup.Not = nil
+		} else {
+			n.lookup.Not = goutil.Bool(true)
+		}
+	case n.idType != entity.IDTypeUnknown:
+		return nil, p.errorAt(t, "NOT cannot be applied to ID_TYPE")
+	default:
+		n.not = !n.not
+	}
+
+	return n, nil
+}
+
+func (p *parser) parsePrimary() (*node, error) {
+	t := p.peek()
+
+	switch {
+	case t.kind == tokenLParen:
+		p.advance()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case p.isKeyword("SEGMENT"):
+		p.advance()
+		args, err := p.parseUintArgs(1)
+		if err != nil {
+			return nil, err
+		}
+		return &node{pos: t.pos, lookup: &entity.Lookup{SegmentID: goutil.Uint64(args[0])}}, nil
+	case p.isKeyword("SPLIT"):
+		p.advance()
+		args, err := p.parseUintArgs(3)
+		if err != nil {
+			return nil, err
+		}
+		for _, arg := range args {
+			if arg > math.MaxUint32 {
+				return nil, p.errorAt(t, "SPLIT arguments must be at most %d", uint32(math.MaxUint32))
+			}
+		}
+		return &node{pos: t.pos, lookup: &entity.Lookup{Split: &entity.Split{
+			Seed: goutil.Uint32(uint32(args[0])),
+			From: goutil.Uint32(uint32(args[1])),
+			To:   goutil.Uint32(uint32(args[2])),
+		}}}, nil
+	case p.isKeyword("ID_TYPE"):
+		p.advance()
+		return p.parseIDType(t)
+	case t.kind == tokenQuoted || (t.kind == tokenIdent && !isKeyword(t.text)):
+		return p.parseLookup()
+	default:
+		return nil, p.errorAt(t, "expected a lookup or '(', found %s", t.describe())
+	}
+}
+
+// parseUintArgs parses n comma separated unsigned integers in parentheses.
+func (p *parser) parseUintArgs(n int) ([]uint64, error) {
+	if _, err := p.expect(tokenLParen); err != nil {
+		return nil, err
+	}
+
+	args := make([]uint64, 0, n)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			if _, err := p.expect(tokenComma); err != nil {
+				return nil, err
+			}
+		}
+
+		arg, err := p.parseUint()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	if _, err := p.expect(tokenRParen); err != nil {
+		return nil, err
+	}
+
+	return args, nil
+}
+
+func (p *parser) parseUint() (uint64, error) {
+	t, err := p.expect(tokenNumber)
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := strconv.ParseUint(t.text, 10, 64)
+	if err != nil {
+		return 0, p.errorAt(t, "expected a non-negative integer, found %s", t.describe())
+	}
+
+	return v, nil
+}
+
+func (p *parser) parseIDType(at token) (*node, error) {
+	if _, err := p.expect(tokenLParen); err != nil {
+		return nil, err
+	}
+
+	t := p.advance()
+	if t.kind != tokenIdent && t.kind != tokenString {
+		return nil, p.errorAt(t, "expected an ID type, found %s", t.describe())
+	}
+
+	var idType entity.IDType
+	for k, v := range entity.IDTypes {
+		if strings.EqualFold(v, t.text) {
+			idType = k
+		}
+	}
+	if idType == entity.IDTypeUnknown {
+		return nil, p.errorAt(t, "unknown ID type %s", t.describe())
+	}
+
+	if _, err := p.expect(tokenRParen); err != nil {
+		return nil, err
+	}
+
+	return &node{pos: at.pos, idType: idType}, nil
+}
+
+func (p *parser) parseLookup() (*node, error) {
+	name := p.advance()
+
+	tagID, err := p.resolveTag(name.text)
+	if err != nil {
+		if errors.Is(err, ErrUnknownTag) {
+			return nil, p.errorAt(name, "unknown tag %s", name.describe())
+		}
+		return nil, err
+	}
+
+	lookup := &entity.Lookup{TagID: goutil.Uint64(tagID)}
+
+	t := p.peek()
+	switch {
+	case t.kind == tokenOp:
+		p.advance()
+		lookup.Op = entity.LookupOp(t.text)
+		if lookup.Val, err = p.parseValue(); err != nil {
+			return nil, err
+		}
+	case p.acceptKeyword("IN"):
+		lookup.Op = entity.LookupOpIn
+		if lookup.Val, err = p.parseValues(); err != nil {
+			return nil, err
+		}
+	case p.acceptKeyword("NOT"):
+		if err := p.expectKeyword("IN"); err != nil {
+			return nil, err
+		}
+		lookup.Op = entity.LookupOpNotIn
+		if lookup.Val, err = p.parseValues(); err != nil {
+			return nil, err
+		}
+	case p.acceptKeyword("CONTAINS"):
+		if p.acceptKeyword("ANY") {
+			lookup.Op = entity.LookupOpContainsAny
+			lookup.Val, err = p.parseValues()
+		} else {
+			lookup.Op = entity.LookupOpContains
+			lookup.Val, err = p.parseValue()
+		}
+		if err != nil {
+			return nil, err
+		}
+	case p.acceptKeyword("PREFIX"):
+		lookup.Op = entity.LookupOpPrefix
+		if lookup.Val, err = p.parseValue(); err != nil {
+			return nil, err
+		}
+	case p.acceptKeyword("BETWEEN"):
+		lookup.Op = entity.LookupOpBetween
+		from, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		to, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		lookup.Val = []interface{}{from, to}
+	case p.acceptKeyword("EXISTS"):
+		lookup.Op = entity.LookupOpExists
+	case p.acceptKeyword("MISSING"):
+		lookup.Op = entity.LookupOpMissing
+	case p.acceptKeyword("CHANGED"):
+		if err := p.expectKeyword("WITHIN"); err != nil {
+			return nil, err
+		}
+		lookup.Op = entity.LookupOpChangedWithin
+		days, err := p.parseUint()
+		if err != nil {
+			return nil, err
+		}
+		lookup.Val = float64(days)
+	default:
+		return nil, p.errorAt(t, "expected an operator after tag %s, found %s", name.describe(), t.describe())
+	}
+
+	if p.acceptKeyword("AS") {
+		if err := p.expectKeyword("OF"); err != nil {
+			return nil, err
+		}
+		asOf, err := p.parseUint()
+		if err != nil {
+			return nil, err
+		}
+		lookup.AsOf = goutil.Uint64(asOf)
+	}
+
+	return &node{pos: name.pos, lookup: lookup}, nil
+}
+
+// parseValue parses a value the way it is decoded from JSON, i.e. a string, a float64 or a bool.
+func (p *parser) parseValue() (interface{}, error) {
+	t := p.advance()
+	switch {
+	case t.kind == tokenString:
+		return t.text, nil
+	case t.kind == tokenNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorAt(t, "invalid number %s", t.describe())
+		}
+		return v, nil
+	case t.kind == tokenIdent && strings.EqualFold(t.text, "TRUE"):
+		return true, nil
+	case t.kind == tokenIdent && strings.EqualFold(t.text, "FALSE"):
+		return false, nil
+	default:
+		return nil, p.errorAt(t, "expected a value, found %s", t.describe())
+	}
+}
+
+func (p *parser) parseValues() ([]interface{}, error) {
+	if _, err := p.expect(tokenLParen); err != nil {
+		return nil, err
+	}
+
+	vals := make([]interface{}, 0)
+	for {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+
+		t := p.advance()
+		if t.kind == tokenRParen {
+			return vals, nil
+		}
+		if t.kind != tokenComma {
+			return nil, p.errorAt(t, "expected ',' or ')', found %s", t.describe())
+		}
+	}
+}
+
+// toQuery turns the node into a query. The lookups of a group go into the lookups of the query,
+// unless the group has sub-groups too, then they are gathered into a sub-query of their own.
+func (p *parser) toQuery(n *node) (*entity.Query, error) {
+	if !n.isGroup() {
+		n = &node{pos: n.pos, op: entity.QueryOpAnd, children: []*node{n}}
+	}
+
+	query := &entity.Query{
+		Op: n.op,
+	}
+	if n.not {
+		query.Not = goutil.Bool(true)
+	}
+
+	var (
+		lookups []*entity.Lookup
+		queries []*entity.Query
+	)
+	for _, child := range n.children {
+		switch {
+		case child.lookup != nil:
+			lookups = append(lookups, child.lookup)
+		case child.idType != entity.IDTypeUnknown:
+			if query.IDType != entity.IDTypeUnknown {
+				return nil, errorAt(p.text, child.pos, "ID_TYPE is given more than once in the same group")
+			}
+			query.IDType = child.idType
+		default:
+			subQuery, err := p.toQuery(child)
+			if err != nil {
+				return nil, err
+			}
+			queries = append(queries, subQuery)
+		}
+	}
+
+	if len(queries) == 0 {
+		query.Lookups = lookups
+	} else {
+		if len(lookups) > 0 {
+			queries = append([]*entity.Query{{Op: n.op, Lookups: lookups}}, queries...)
+		}
+		query.Queries = queries
+	}
+
+	return query, nil
+}
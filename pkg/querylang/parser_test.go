@@ -0,0 +1,57 @@
+package querylang
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseErrorPosition(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want Error
+	}{
+		{name: "empty", text: ``, want: Error{Line: 1, Col: 1, Msg: "expected a lookup or '(', found end of text"}},
+		{name: "missing value", text: `Age >`, want: Error{Line: 1, Col: 6, Msg: "expected a value, found end of text"}},
+		{name: "dangling AND", text: `Age = 1 AND`, want: Error{Line: 1, Col: 12, Msg: "expected a lookup or '(', found end of text"}},
+		{name: "missing operator", text: `Age 1`, want: Error{Line: 1, Col: 5, Msg: "expected an operator after tag 'Age', found '1'"}},
+		{name: "missing AND in BETWEEN", text: `Age BETWEEN 1 2`, want: Error{Line: 1, Col: 15, Msg: "expected AND, found '2'"}},
+		{name: "missing comma in list", text: `Country IN ("SG" "MY")`, want: Error{Line: 1, Col: 18, Msg: `expected ',' or ')', found "MY"`}},
+		{name: "missing AND between lookups", text: `Age = 1 Plan = 2`, want: Error{Line: 1, Col: 9, Msg: "expected AND, OR or end of text, found 'Plan'"}},
+		{name: "stray paren", text: `)`, want: Error{Line: 1, Col: 1, Msg: "expected a lookup or '(', found ')'"}},
+		{name: "unknown tag", text: `Unknown = 1`, want: Error{Line: 1, Col: 1, Msg: "unknown tag 'Unknown'"}},
+		{name: "unterminated string", text: `Age = "abc`, want: Error{Line: 1, Col: 7, Msg: "unterminated string"}},
+		{name: "invalid escape", text: `Age = "a\qb"`, want: Error{Line: 1, Col: 9, Msg: `invalid escape '\q'`}},
+		{name: "invalid number", text: `Age = 30d`, want: Error{Line: 1, Col: 7, Msg: "invalid number"}},
+		{name: "unterminated identifier", text: "`Last Order", want: Error{Line: 1, Col: 1, Msg: "unterminated identifier"}},
+		{name: "empty identifier", text: "`` = 1", want: Error{Line: 1, Col: 1, Msg: "empty identifier"}},
+		{name: "unexpected character", text: `Age @ 1`, want: Error{Line: 1, Col: 5, Msg: "unexpected character '@'"}},
+		{name: "unclosed group", text: "Age = 1\nAND (Plan = 2", want: Error{Line: 2, Col: 14, Msg: "expected ')', found end of text"}},
+		{name: "error on a later line", text: "Age = 1 AND\n  (Plan = 2 OR\n   Nope EXISTS)", want: Error{Line: 3, Col: 4, Msg: "unknown tag 'Nope'"}},
+		{name: "columns count runes", text: `名前 = "太郎" AND 名前 >`, want: Error{Line: 1, Col: 19, Msg: "expected a value, found end of text"}},
+		{name: "missing AS OF time", text: `Plan = 1 AS OF`, want: Error{Line: 1, Col: 15, Msg: "expected number, found end of text"}},
+		{name: "non-numeric segment", text: `SEGMENT(x)`, want: Error{Line: 1, Col: 9, Msg: "expected number, found 'x'"}},
+		{name: "missing split argument", text: `SPLIT(1, 2)`, want: Error{Line: 1, Col: 11, Msg: "expected ',', found ')'"}},
+		{name: "split argument out of range", text: `SPLIT(4294967296, 0, 1)`, want: Error{Line: 1, Col: 1, Msg: "SPLIT arguments must be at most 4294967295"}},
+		{name: "unknown ID type", text: `ID_TYPE(fax)`, want: Error{Line: 1, Col: 9, Msg: "unknown ID type 'fax'"}},
+		{name: "negated ID type", text: `NOT ID_TYPE(email)`, want: Error{Line: 1, Col: 1, Msg: "NOT cannot be applied to ID_TYPE"}},
+		{name: "repeated ID type", text: `ID_TYPE(email) AND ID_TYPE(phone)`, want: Error{Line: 1, Col: 20, Msg: "ID_TYPE is given more than once in the same group"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.text, resolveTestTag)
+			if err == nil {
+				t.Fatalf("Parse(%q) succeeded, want error %q", tt.text, tt.want.Error())
+			}
+
+			var got *Error
+			if !errors.As(err, &got) {
+				t.Fatalf("Parse(%q) failed with %T %v, want *Error", tt.text, err, err)
+			}
+			if *got != tt.want {
+				t.Errorf("Parse(%q) failed with %q, want %q", tt.text, got.Error(), tt.want.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package querylang
+
+import (
+	"cdp/entity"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// TagNamer gets the name of a tag by its ID.
+type TagNamer func(tagID uint64) (string, error)
+
+// Print turns the query into text which Parse turns back into an equivalent query, an empty query is printed as "".
+func Print(query *entity.Query, tagName TagNamer) (string, error) {
+	if query == nil {
+		return "", nil
+	}
+
+	pr := &printer{tagName: tagName}
+
+	terms, err := pr.printTerms(query)
+	if err != nil {
+		return "", err
+	}
+
+	if len(terms) == 0 {
+		return "", nil
+	}
+
+	text := strings.Join(terms, fmt.Sprintf(" %s ", pr.opOf(query)))
+	if query.GetNot() {
+		text = fmt.Sprintf("NOT (%s)", text)
+	}
+
+	return text, nil
+}
+
+type printer struct {
+	tagName TagNamer
+}
+
+func (pr *printer) opOf(query *entity.Query) entity.QueryOp {
+	if query.GetOp() == entity.QueryOpOr {
+		return entity.QueryOpOr
+	}
+	return entity.QueryOpAnd
+}
+
+// printTerms prints the operands joined by the op of the query. A sub-query is inlined if it has a single operand
+// or the same op, unless it is negated or has an ID type, otherwise it is parenthesized.
+func (pr *printer) printTerms(query *entity.Query) ([]string, error) {
+	terms := make([]string, 0, len(query.Lookups)+len(query.Queries)+1)
+
+	for _, lookup := range query.Lookups {
+		term, err := pr.printLookup(lookup)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+
+	if idType := query.GetIDType(); idType != entity.IDTypeUnknown {
+		name, ok := entity.IDTypes[idType]
+		if !ok {
+			return nil, fmt.Errorf("unknown id type %d", idType)
+		}
+		terms = append(terms, fmt.Sprintf("ID_TYPE(%s)", name))
+	}
+
+	for _, subQuery := range query.Queries {
+		if subQuery == nil {
+			continue
+		}
+
+		subTerms, err := pr.printTerms(subQuery)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case len(subTerms) == 0:
+			continue
+		case !subQuery.GetNot() && subQuery.GetIDType() == entity.IDTypeUnknown &&
+			(len(subTerms) == 1 || pr.opOf(subQuery) == pr.opOf(query)):
+			terms = append(terms, subTerms...)
+		default:
+			term := fmt.Sprintf("(%s)", strings.Join(subTerms, fmt.Sprintf(" %s ", pr.opOf(subQuery))))
+			if subQuery.GetNot() {
+				term = "NOT " + term
+			}
+			terms = append(terms, term)
+		}
+	}
+
+	return terms, nil
+}
+
+func (pr *printer) printLookup(lookup *entity.Lookup) (string, error) {
+	var (
+		term string
+		err  error
+	)
+	switch {
+	case lookup.IsSegmentRef():
+		term = fmt.Sprintf("SEGMENT(%d)", lookup.GetSegmentID())
+	case lookup.IsSplit():
+		term = fmt.Sprintf("SPLIT(%d, %d, %d)", lookup.Split.GetSeed(), lookup.Split.GetFrom(), lookup.Split.GetTo())
+	default:
+		if term, err = pr.printTagLookup(lookup); err != nil {
+			return "", err
+		}
+	}
+
+	if lookup.GetNot() {
+		term = "NOT " + term
+	}
+
+	return term, nil
+}
+
+func (pr *printer) printTagLookup(lookup *entity.Lookup) (string, error) {
+	name, err := pr.tagName(lookup.GetTagID())
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		sb  strings.Builder
+		val = lookup.GetVal()
+	)
+	sb.WriteString(printName(name))
+
+	switch lookup.Op {
+	case entity.LookupOpEq, entity.LookupOpGt, entity.LookupOpLt, entity.LookupOpGte, entity.LookupOpLte:
+		v, err := printValue(val)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(fmt.Sprintf(" %s %s", lookup.Op, v))
+	case entity.LookupOpIn, entity.LookupOpNotIn, entity.LookupOpContainsAny:
+		vals, ok := val.([]interface{})
+		if !ok {
+			return "", fmt.Errorf("op '%s' of tag %s expects an array", lookup.Op, name)
+		}
+
+		items := make([]string, 0, len(vals))
+		for _, item := range vals {
+			v, err := printValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+		}
+
+		keyword := map[entity.LookupOp]string{
+			entity.LookupOpIn:          "IN",
+			entity.LookupOpNotIn:       "NOT IN",
+			entity.LookupOpContainsAny: "CONTAINS ANY",
+		}[lookup.Op]
+		sb.WriteString(fmt.Sprintf(" %s (%s)", keyword, strings.Join(items, ", ")))
+	case entity.LookupOpBetween:
+		vals, ok := val.([]interface{})
+		if !ok || len(vals) != 2 {
+			return "", fmt.Errorf("op '%s' of tag %s expects an array of [from, to]", lookup.Op, name)
+		}
+
+		from, err := printValue(vals[0])
+		if err != nil {
+			return "", err
+		}
+		to, err := printValue(vals[1])
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(fmt.Sprintf(" BETWEEN %s AND %s", from, to))
+	case entity.LookupOpExists:
+		sb.WriteString(" EXISTS")
+	case entity.LookupOpMissing:
+		sb.WriteString(" MISSING")
+	case entity.LookupOpPrefix, entity.LookupOpContains:
+		v, err := printValue(val)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(fmt.Sprintf(" %s %s", strings.ToUpper(string(lookup.Op)), v))
+	case entity.LookupOpChangedWithin:
+		sb.WriteString(fmt.Sprintf(" CHANGED WITHIN %v", val))
+	default:
+		return "", fmt.Errorf("unknown lookup op '%s'", lookup.Op)
+	}
+
+	if lookup.AsOf != nil {
+		sb.WriteString(fmt.Sprintf(" AS OF %d", lookup.GetAsOf()))
+	}
+
+	return sb.String(), nil
+}
+
+// printName backquotes the name unless it is a plain identifier.
+func printName(name string) string {
+	plain := name != "" && !isKeyword(name)
+	for i, r := range name {
+		if (i == 0 && !isIdentStart(r)) || !isIdentPart(r) {
+			plain = false
+			break
+		}
+	}
+
+	if plain {
+		return name
+	}
+	return fmt.Sprintf("`%s`", name)
+}
+
+func printValue(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case string:
+		return printString(val), nil
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	case int, int32, int64, uint, uint32, uint64:
+		return fmt.Sprint(val), nil
+	case bool:
+		if val {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	default:
+		return "", fmt.Errorf("cannot print value %v", v)
+	}
+}
+
+// printString quotes the string with the escapes the lexer understands.
+func printString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			sb.WriteString(s[:size])
+		}
+		s = s[size:]
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,207 @@
+package querylang
+
+import (
+	"cdp/entity"
+	"cdp/pkg/goutil"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var testTags = map[string]uint64{
+	"Age":        1,
+	"Country":    2,
+	"Plan":       3,
+	"Last Order": 4,
+	"OR":         5,
+	"1st Visit":  6,
+	"city.name":  7,
+	"名前":         8,
+	"Note":       9,
+}
+
+func resolveTestTag(name string) (uint64, error) {
+	if tagID, ok := testTags[name]; ok {
+		return tagID, nil
+	}
+	return 0, ErrUnknownTag
+}
+
+func nameTestTag(tagID uint64) (string, error) {
+	for name, id := range testTags {
+		if id == tagID {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown tag %d", tagID)
+}
+
+func TestPrintParseRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		// want is the printed text, the same as text if empty. A text printed differently
+		// parses into a query of another shape, which then round-trips itself.
+		want string
+	}{
+		{name: "eq", text: `Age = 30`},
+		{name: "gt", text: `Age > 30`},
+		{name: "lt", text: `Age < 30.5`},
+		{name: "gte", text: `Age >= -1`},
+		{name: "lte", text: `Age <= 0`},
+		{name: "bool", text: `Plan = TRUE AND Plan = FALSE`},
+		{name: "in", text: `Country IN ("SG", "MY")`},
+		{name: "not in", text: `Country NOT IN ("SG")`},
+		{name: "contains any", text: `Country CONTAINS ANY ("SG", 1, TRUE)`},
+		{name: "between", text: `Age BETWEEN 18 AND 65`},
+		{name: "exists", text: `Plan EXISTS`},
+		{name: "missing", text: `Plan MISSING`},
+		{name: "prefix", text: `Note PREFIX "vip"`},
+		{name: "contains", text: `Note CONTAINS "vip"`},
+		{name: "changed within", text: `Plan CHANGED WITHIN 7`},
+		{name: "as of", text: `Plan = "pro" AS OF 1700000000`},
+		{name: "segment", text: `SEGMENT(12)`},
+		{name: "split", text: `SPLIT(42, 0, 5000)`},
+		{name: "id type", text: `Age > 30 AND ID_TYPE(email)`},
+		{name: "lowercase keywords", text: `Age between 18 and 65 or Plan exists`, want: `Age BETWEEN 18 AND 65 OR Plan EXISTS`},
+		{name: "not lookup", text: `NOT Age = 30`},
+		{name: "not not lookup", text: `NOT NOT Age = 30`, want: `Age = 30`},
+		{name: "not segment", text: `NOT SEGMENT(12)`},
+		{name: "not group", text: `NOT (Age = 30 OR Plan EXISTS)`},
+		{name: "not nested group", text: `Plan EXISTS AND NOT (Age = 30 OR Age = 40)`},
+		{name: "and binds tighter", text: `Age = 1 AND Plan = 2 OR Country = "SG"`, want: `Country = "SG" OR (Age = 1 AND Plan = 2)`},
+		{name: "nested or", text: `Age = 1 AND (Plan = 2 OR Country = "SG")`},
+		{name: "same op flattened", text: `Age = 1 AND (Plan = 2 AND Country = "SG")`, want: `Age = 1 AND Plan = 2 AND Country = "SG"`},
+		{name: "redundant parens", text: `((Age = 1))`, want: `Age = 1`},
+		{name: "deep nesting", text: `Age = 1 OR (Plan = 2 AND (Country = "SG" OR NOT (Age = 3 AND Age = 4)))`},
+		{name: "nested id type", text: `Age = 1 OR (Plan = 2 AND ID_TYPE(phone))`},
+		{name: "backquoted name", text: "`Last Order` > 1700000000"},
+		{name: "keyword name", text: "`OR` EXISTS"},
+		{name: "name starting with digit", text: "`1st Visit` EXISTS"},
+		{name: "name with dot", text: "city.name = \"Singapore\""},
+		{name: "unicode name", text: `名前 = "太郎"`},
+		{name: "needlessly backquoted name", text: "`Age` = 1", want: "Age = 1"},
+		{name: "string escapes", text: `Note = "say \"hi\"\\ to\nall\tnow"`},
+		{name: "unicode string", text: `Note CONTAINS "naïve ☕"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := Parse(tt.text, resolveTestTag)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", tt.text, err)
+			}
+
+			printed, err := Print(query, nameTestTag)
+			if err != nil {
+				t.Fatalf("Print failed: %v", err)
+			}
+
+			want := tt.want
+			if want == "" {
+				want = tt.text
+			}
+			if printed != want {
+				t.Errorf("Print(Parse(%q)) = %q, want %q", tt.text, printed, want)
+			}
+
+			if tt.want != "" {
+				if query, err = Parse(printed, resolveTestTag); err != nil {
+					t.Fatalf("Parse(%q) failed: %v", printed, err)
+				}
+				if printed, err = Print(query, nameTestTag); err != nil {
+					t.Fatalf("Print failed: %v", err)
+				}
+			}
+
+			reparsed, err := Parse(printed, resolveTestTag)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", printed, err)
+			}
+			if !reflect.DeepEqual(query, reparsed) {
+				got, _ := json.Marshal(reparsed)
+				want, _ := json.Marshal(query)
+				t.Errorf("Parse(Print(q)) = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestPrintQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query *entity.Query
+		want  string
+	}{
+		{
+			name:  "nil",
+			query: nil,
+			want:  "",
+		},
+		{
+			name:  "empty",
+			query: &entity.Query{},
+			want:  "",
+		},
+		{
+			name: "negated root",
+			query: &entity.Query{
+				Op:  entity.QueryOpOr,
+				Not: goutil.Bool(true),
+				Lookups: []*entity.Lookup{
+					{TagID: goutil.Uint64(1), Op: entity.LookupOpEq, Val: float64(1)},
+					{TagID: goutil.Uint64(3), Op: entity.LookupOpExists},
+				},
+			},
+			want: `NOT (Age = 1 OR Plan EXISTS)`,
+		},
+		{
+			name: "sub-query with id type",
+			query: &entity.Query{
+				Op: entity.QueryOpAnd,
+				Queries: []*entity.Query{
+					{
+						Op:      entity.QueryOpAnd,
+						Lookups: []*entity.Lookup{{SegmentID: goutil.Uint64(12)}},
+					},
+					{
+						Op:      entity.QueryOpAnd,
+						IDType:  entity.IDTypeEmail,
+						Lookups: []*entity.Lookup{{TagID: goutil.Uint64(1), Op: entity.LookupOpGt, Val: float64(30)}},
+					},
+				},
+			},
+			want: `SEGMENT(12) AND (Age > 30 AND ID_TYPE(email))`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Print(tt.query, nameTestTag)
+			if err != nil {
+				t.Fatalf("Print failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Print() = %q, want %q", got, tt.want)
+			}
+
+			if got == "" {
+				return
+			}
+
+			// the printed text parses back into a query printed the same way
+			reparsed, err := Parse(got, resolveTestTag)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", got, err)
+			}
+			again, err := Print(reparsed, nameTestTag)
+			if err != nil {
+				t.Fatalf("Print failed: %v", err)
+			}
+			if again != got {
+				t.Errorf("Print(Parse(%q)) = %q", got, again)
+			}
+		})
+	}
+}
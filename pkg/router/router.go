@@ -10,6 +10,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 	"github.com/rs/zerolog/log"
+	"io"
 	"mime"
 	"net/http"
 	"reflect"
@@ -28,6 +29,11 @@ type FileUpload interface {
 	SetFileMeta(m *entity.FileMeta)
 }
 
+// FileDownload is implemented by responses written as a file, errors are still returned as JSON.
+type FileDownload interface {
+	GetFileData() *entity.FileData
+}
+
 // to decode url params
 var decoder = schema.NewDecoder()
 
@@ -127,14 +133,36 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if tenantOk {
 			contextInfo.SetTenant(tenant)
 		}
+		contextInfo.SetViewPII(GetViewPIIFromContext(ctx))
 	}
 
 	err := h.HandleFunc(ctx, req, res)
+
+	if fileDownload, ok := res.(FileDownload); ok && err == nil {
+		writeFile(ctx, w, fileDownload.GetFileData())
+		return
+	}
+
 	httputil.ReturnServerResponse(w, res, err)
 
 	return
 }
 
+func writeFile(ctx context.Context, w http.ResponseWriter, file *entity.FileData) {
+	defer func() {
+		_ = file.Body.Close()
+	}()
+
+	w.Header().Set("Content-Type", file.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+	w.WriteHeader(http.StatusOK)
+
+	// the status is sent already, a failed copy can only be logged
+	if _, err := io.Copy(w, file.Body); err != nil {
+		log.Ctx(ctx).Error().Msgf("write file error: %v", err)
+	}
+}
+
 func getFileMeta(r *http.Request) (*entity.FileMeta, error) {
 	f, fh, err := r.FormFile("file")
 	if err != nil {
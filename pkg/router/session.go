@@ -15,13 +15,15 @@ import (
 type ContextInfo interface {
 	SetUser(user *entity.User)
 	SetTenant(tenant *entity.Tenant)
+	SetViewPII(viewPII bool)
 }
 
 type contextKey string
 
 const (
-	userKey   contextKey = "user"
-	tenantKey contextKey = "tenant"
+	userKey    contextKey = "user"
+	tenantKey  contextKey = "tenant"
+	viewPIIKey contextKey = "view_pii"
 )
 
 type sessionMiddleware struct {
@@ -133,6 +135,7 @@ func (m *sessionMiddleware) Handle(next http.Handler) http.Handler {
 
 		ctx = context.WithValue(ctx, userKey, user)
 		ctx = context.WithValue(ctx, tenantKey, tenant)
+		ctx = context.WithValue(ctx, viewPIIKey, role.HasAction(entity.ActionViewPII))
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -152,3 +155,8 @@ func GetTenantFromContext(ctx context.Context) (*entity.Tenant, bool) {
 	}
 	return nil, false
 }
+
+func GetViewPIIFromContext(ctx context.Context) bool {
+	viewPII, _ := ctx.Value(viewPIIKey).(bool)
+	return viewPII
+}
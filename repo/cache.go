@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/patrickmn/go-cache"
 	"math/rand"
+	"strings"
 	"time"
 )
 
@@ -12,6 +13,8 @@ type BaseCache interface {
 	Get(ctx context.Context, prefix string, tenantID uint64, uniqKey interface{}) (interface{}, bool)
 	Set(ctx context.Context, prefix string, tenantID uint64, uniqKey, value interface{})
 	Del(ctx context.Context, prefix string, tenantID uint64, uniqKey interface{})
+	// FlushTenant deletes all keys of a tenant, regardless of the prefix.
+	FlushTenant(ctx context.Context, tenantID uint64)
 	Flush(ctx context.Context)
 	Close(ctx context.Context) error
 }
@@ -40,6 +43,15 @@ func (bc *baseCache) Del(_ context.Context, prefix string, tenantID uint64, uniq
 	bc.cache.Delete(bc.getKey(prefix, tenantID, uniqKey))
 }
 
+func (bc *baseCache) FlushTenant(_ context.Context, tenantID uint64) {
+	tenantKey := fmt.Sprint(tenantID)
+	for key := range bc.cache.Items() {
+		if parts := strings.SplitN(key, ":", 3); len(parts) == 3 && parts[1] == tenantKey {
+			bc.cache.Delete(key)
+		}
+	}
+}
+
 func (bc *baseCache) getKey(prefix string, tenantID uint64, uniqKey interface{}) string {
 	return fmt.Sprintf("%s:%d:%v", prefix, tenantID, uniqKey)
 }
@@ -26,6 +26,13 @@ func (m *CampaignEmail) TableName() string {
 	return "campaign_email_tab"
 }
 
+func (m *CampaignEmail) GetCampaignID() uint64 {
+	if m != nil && m.CampaignID != nil {
+		return *m.CampaignID
+	}
+	return 0
+}
+
 type Campaign struct {
 	ID           *uint64
 	Name         *string
@@ -64,7 +71,11 @@ type CampaignRepo interface {
 	Create(ctx context.Context, campaign *entity.Campaign) (uint64, error)
 	GetManyByKeyword(ctx context.Context, tenantID uint64, keyword string, p *Pagination) ([]*entity.Campaign, *Pagination, error)
 	GetPendingCampaigns(ctx context.Context, schedule uint64) ([]*entity.Campaign, error)
+	// GetPendingBySegmentID gets the campaigns of a tenant that are yet to send to the segment.
+	GetPendingBySegmentID(ctx context.Context, tenantID, segmentID uint64) ([]*entity.Campaign, error)
 	GetByID(ctx context.Context, tenantID, campaignID uint64) (*entity.Campaign, error)
+	// GetManyByCampaignEmailIDs gets the campaigns of a tenant that own any of campaignEmailIDs.
+	GetManyByCampaignEmailIDs(ctx context.Context, tenantID uint64, campaignEmailIDs []uint64) ([]*entity.Campaign, error)
 	Update(ctx context.Context, tenant *entity.Campaign) error
 }
 
@@ -86,6 +97,43 @@ func (r *campaignRepo) GetByID(ctx context.Context, tenantID, campaignID uint64)
 	}, true)
 }
 
+func (r *campaignRepo) GetManyByCampaignEmailIDs(ctx context.Context, tenantID uint64, campaignEmailIDs []uint64) ([]*entity.Campaign, error) {
+	if len(campaignEmailIDs) == 0 {
+		return make([]*entity.Campaign, 0), nil
+	}
+
+	res, _, err := r.baseRepo.GetMany(ctx, new(CampaignEmail), &Filter{
+		Conditions: []*Condition{
+			{
+				Field: "id",
+				Value: campaignEmailIDs,
+				Op:    OpIn,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	campaignIDs := make([]uint64, 0, len(res))
+	for _, m := range res {
+		campaignIDs = append(campaignIDs, m.(*CampaignEmail).GetCampaignID())
+	}
+
+	campaigns, _, err := r.getMany(ctx, tenantID, []*Condition{
+		{
+			Field: "id",
+			Value: campaignIDs,
+			Op:    OpIn,
+		},
+	}, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return campaigns, nil
+}
+
 func (r *campaignRepo) Update(ctx context.Context, campaign *entity.Campaign) error {
 	return r.baseRepo.Update(ctx, ToCampaignModel(campaign))
 }
@@ -138,6 +186,26 @@ func (r *campaignRepo) GetPendingCampaigns(ctx context.Context, schedule uint64)
 	return campaigns, nil
 }
 
+func (r *campaignRepo) GetPendingBySegmentID(ctx context.Context, tenantID, segmentID uint64) ([]*entity.Campaign, error) {
+	campaigns, _, err := r.getMany(ctx, tenantID, []*Condition{
+		{
+			Field:         "status",
+			Op:            OpEq,
+			Value:         entity.CampaignStatusPending,
+			NextLogicalOp: LogicalOpAnd,
+		},
+		{
+			Field: "segment_id",
+			Op:    OpEq,
+			Value: segmentID,
+		},
+	}, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	return campaigns, nil
+}
+
 func (r *campaignRepo) GetManyByKeyword(ctx context.Context, tenantID uint64, keyword string, p *Pagination) ([]*entity.Campaign, *Pagination, error) {
 	return r.getMany(ctx, tenantID, []*Condition{
 		{
@@ -26,6 +26,10 @@ type CampaignLogRepo interface {
 	CountTotalUniqueOpen(ctx context.Context, campaignEmailID uint64) (uint64, error)
 	CountClicksByLink(ctx context.Context, campaignEmailID uint64) (map[string]uint64, error)
 	GetAvgOpenTime(ctx context.Context, campaignEmailID uint64) (uint64, error)
+	// GetManyByEmails gets the logs of emails in the campaigns of the tenant, the latest first.
+	GetManyByEmails(ctx context.Context, tenantID uint64, emails []string, p *Pagination) ([]*entity.CampaignLog, *Pagination, error)
+	// RedactByIDs removes the emails from the logs, the events are kept so that campaign results stay intact.
+	RedactByIDs(ctx context.Context, campaignLogIDs []uint64) error
 }
 
 type campaignLogRepo struct {
@@ -86,6 +90,62 @@ func (r *campaignLogRepo) GetAvgOpenTime(ctx context.Context, campaignEmailID ui
 	return uint64(math.Round(avgOpenTime)), nil
 }
 
+func (r *campaignLogRepo) GetManyByEmails(ctx context.Context, tenantID uint64, emails []string, p *Pagination) ([]*entity.CampaignLog, *Pagination, error) {
+	if len(emails) == 0 {
+		return make([]*entity.CampaignLog, 0), &Pagination{HasNext: goutil.Bool(false)}, nil
+	}
+
+	// logs have no tenant, it is the tenant of the campaign sending the email
+	res, pagination, err := r.baseRepo.GetMany(ctx, new(CampaignLog), &Filter{
+		Joins: []string{
+			"JOIN campaign_email_tab ON campaign_email_tab.id = campaign_log_tab.campaign_email_id",
+			"JOIN campaign_tab ON campaign_tab.id = campaign_email_tab.campaign_id",
+		},
+		Conditions: []*Condition{
+			{
+				Field:         "campaign_tab.tenant_id",
+				Value:         tenantID,
+				Op:            OpEq,
+				NextLogicalOp: LogicalOpAnd,
+			},
+			{
+				Field: "campaign_log_tab.email",
+				Value: emails,
+				Op:    OpIn,
+			},
+		},
+		Pagination: p,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	campaignLogs := make([]*entity.CampaignLog, 0, len(res))
+	for _, m := range res {
+		campaignLogs = append(campaignLogs, ToCampaignLog(m.(*CampaignLog)))
+	}
+
+	return campaignLogs, pagination, nil
+}
+
+func (r *campaignLogRepo) RedactByIDs(ctx context.Context, campaignLogIDs []uint64) error {
+	if len(campaignLogIDs) == 0 {
+		return nil
+	}
+
+	return r.baseRepo.UpdateMany(ctx, new(CampaignLog), &Filter{
+		Conditions: []*Condition{
+			{
+				Field: "id",
+				Value: campaignLogIDs,
+				Op:    OpIn,
+			},
+		},
+	}, map[string]interface{}{
+		"email": "",
+	})
+}
+
 type LinkCount struct {
 	Link  string
 	Count uint64
@@ -137,3 +197,20 @@ func ToCampaignLogModel(campaignLog *entity.CampaignLog) *CampaignLog {
 		CreateTime:      campaignLog.CreateTime,
 	}
 }
+
+func ToCampaignLog(campaignLog *CampaignLog) *entity.CampaignLog {
+	var event entity.Event
+	if campaignLog.Event != nil {
+		event = entity.Event(*campaignLog.Event)
+	}
+
+	return &entity.CampaignLog{
+		ID:              campaignLog.ID,
+		CampaignEmailID: campaignLog.CampaignEmailID,
+		Event:           event,
+		Link:            campaignLog.Link,
+		Email:           campaignLog.Email,
+		EventTime:       campaignLog.EventTime,
+		CreateTime:      campaignLog.CreateTime,
+	}
+}
@@ -0,0 +1,285 @@
+package repo
+
+import (
+	"cdp/entity"
+	"cdp/pkg/goutil"
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type Erasure struct {
+	ID         *uint64
+	TenantID   *uint64
+	IDType     *uint32
+	UdHash     *string
+	Status     *uint32
+	ExtInfo    *string
+	CreatorID  *uint64
+	EraseTime  *uint64
+	CreateTime *uint64
+	UpdateTime *uint64
+}
+
+func (m *Erasure) TableName() string {
+	return "erasure_tab"
+}
+
+func (m *Erasure) GetID() uint64 {
+	if m != nil && m.ID != nil {
+		return *m.ID
+	}
+	return 0
+}
+
+func (m *Erasure) GetIDType() uint32 {
+	if m != nil && m.IDType != nil {
+		return *m.IDType
+	}
+	return 0
+}
+
+func (m *Erasure) GetStatus() uint32 {
+	if m != nil && m.Status != nil {
+		return *m.Status
+	}
+	return 0
+}
+
+type SuppressedUd struct {
+	ID         *uint64
+	TenantID   *uint64
+	UdHash     *string
+	ErasureID  *uint64
+	CreateTime *uint64
+}
+
+func (m *SuppressedUd) TableName() string {
+	return "suppressed_ud_tab"
+}
+
+func (m *SuppressedUd) GetUdHash() string {
+	if m != nil && m.UdHash != nil {
+		return *m.UdHash
+	}
+	return ""
+}
+
+type ErasureRepo interface {
+	Create(ctx context.Context, erasure *entity.Erasure) (uint64, error)
+	Update(ctx context.Context, erasure *entity.Erasure) error
+	GetManyByTenantID(ctx context.Context, tenantID uint64, p *Pagination) ([]*entity.Erasure, *Pagination, error)
+	GetPendingErasures(ctx context.Context) ([]*entity.Erasure, error)
+
+	// HashUd returns the hash identifying the ud in erasures and the do-not-re-import list.
+	HashUd(ud *entity.Ud) string
+	// Suppress adds the uds to the do-not-re-import list of the tenant, uds already in the list are skipped.
+	Suppress(ctx context.Context, tenantID, erasureID uint64, uds []*entity.Ud) error
+	// GetSuppressedUds returns the doc IDs of uds that are in the do-not-re-import list of the tenant.
+	GetSuppressedUds(ctx context.Context, tenantID uint64, uds []*entity.Ud) (map[string]bool, error)
+}
+
+type erasureRepo struct {
+	baseRepo     BaseRepo
+	udHashSecret string
+}
+
+func NewErasureRepo(_ context.Context, baseRepo BaseRepo, udHashSecret string) (ErasureRepo, error) {
+	if udHashSecret == "" {
+		return nil, errors.New("empty ud hash secret")
+	}
+
+	return &erasureRepo{
+		baseRepo:     baseRepo,
+		udHashSecret: udHashSecret,
+	}, nil
+}
+
+func (r *erasureRepo) Create(ctx context.Context, erasure *entity.Erasure) (uint64, error) {
+	erasureModel, err := ToErasureModel(erasure)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := r.baseRepo.Create(ctx, erasureModel); err != nil {
+		return 0, err
+	}
+
+	return erasureModel.GetID(), nil
+}
+
+func (r *erasureRepo) Update(ctx context.Context, erasure *entity.Erasure) error {
+	erasureModel, err := ToErasureModel(erasure)
+	if err != nil {
+		return err
+	}
+
+	return r.baseRepo.Update(ctx, erasureModel)
+}
+
+func (r *erasureRepo) GetManyByTenantID(ctx context.Context, tenantID uint64, p *Pagination) ([]*entity.Erasure, *Pagination, error) {
+	return r.getMany(ctx, r.getBaseConditions(tenantID), p)
+}
+
+func (r *erasureRepo) GetPendingErasures(ctx context.Context) ([]*entity.Erasure, error) {
+	erasures, _, err := r.getMany(ctx, []*Condition{
+		{
+			Field: "status",
+			Value: entity.ErasureStatusPending,
+			Op:    OpEq,
+		},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return erasures, nil
+}
+
+func (r *erasureRepo) getMany(ctx context.Context, conditions []*Condition, p *Pagination) ([]*entity.Erasure, *Pagination, error) {
+	res, pNew, err := r.baseRepo.GetMany(ctx, new(Erasure), &Filter{
+		Conditions: conditions,
+		Pagination: p,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	erasures := make([]*entity.Erasure, 0, len(res))
+	for _, m := range res {
+		erasure, err := ToErasure(m.(*Erasure))
+		if err != nil {
+			return nil, nil, err
+		}
+		erasures = append(erasures, erasure)
+	}
+
+	return erasures, pNew, nil
+}
+
+func (r *erasureRepo) HashUd(ud *entity.Ud) string {
+	return ud.ToHash(r.udHashSecret)
+}
+
+func (r *erasureRepo) Suppress(ctx context.Context, tenantID, erasureID uint64, uds []*entity.Ud) error {
+	suppressed, err := r.GetSuppressedUds(ctx, tenantID, uds)
+	if err != nil {
+		return err
+	}
+
+	var (
+		now                = uint64(time.Now().Unix())
+		suppressedUdModels = make([]*SuppressedUd, 0, len(uds))
+	)
+	for _, ud := range uds {
+		if suppressed[ud.ToDocID()] {
+			continue
+		}
+		suppressed[ud.ToDocID()] = true
+
+		udHash := r.HashUd(ud)
+
+		suppressedUdModels = append(suppressedUdModels, &SuppressedUd{
+			TenantID:   goutil.Uint64(tenantID),
+			UdHash:     goutil.String(udHash),
+			ErasureID:  goutil.Uint64(erasureID),
+			CreateTime: goutil.Uint64(now),
+		})
+	}
+
+	if len(suppressedUdModels) == 0 {
+		return nil
+	}
+
+	return r.baseRepo.CreateMany(ctx, new(SuppressedUd), suppressedUdModels)
+}
+
+func (r *erasureRepo) GetSuppressedUds(ctx context.Context, tenantID uint64, uds []*entity.Ud) (map[string]bool, error) {
+	suppressed := make(map[string]bool)
+	if len(uds) == 0 {
+		return suppressed, nil
+	}
+
+	var (
+		udHashes = make([]string, 0, len(uds))
+		docIDs   = make(map[string]string, len(uds))
+	)
+	for _, ud := range uds {
+		udHash := r.HashUd(ud)
+		udHashes = append(udHashes, udHash)
+		docIDs[udHash] = ud.ToDocID()
+	}
+
+	res, _, err := r.baseRepo.GetMany(ctx, new(SuppressedUd), &Filter{
+		Conditions: append(r.getBaseConditions(tenantID), &Condition{
+			Field: "ud_hash",
+			Value: udHashes,
+			Op:    OpIn,
+		}),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range res {
+		suppressed[docIDs[m.(*SuppressedUd).GetUdHash()]] = true
+	}
+
+	return suppressed, nil
+}
+
+func (r *erasureRepo) getBaseConditions(tenantID uint64) []*Condition {
+	return []*Condition{
+		{
+			Field:         "tenant_id",
+			Value:         tenantID,
+			Op:            OpEq,
+			NextLogicalOp: LogicalOpAnd,
+		},
+	}
+}
+
+func ToErasureModel(erasure *entity.Erasure) (*Erasure, error) {
+	extInfo, err := erasure.GetExtInfo().ToString()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Erasure{
+		ID:         erasure.ID,
+		TenantID:   erasure.TenantID,
+		IDType:     goutil.Uint32(uint32(erasure.GetIDType())),
+		UdHash:     erasure.UdHash,
+		Status:     goutil.Uint32(uint32(erasure.GetStatus())),
+		ExtInfo:    goutil.String(extInfo),
+		CreatorID:  erasure.CreatorID,
+		EraseTime:  goutil.Uint64(erasure.GetEraseTime()),
+		CreateTime: erasure.CreateTime,
+		UpdateTime: erasure.UpdateTime,
+	}, nil
+}
+
+func ToErasure(erasure *Erasure) (*entity.Erasure, error) {
+	extInfo := new(entity.ErasureExtInfo)
+	if err := json.Unmarshal([]byte(*erasure.ExtInfo), extInfo); err != nil {
+		return nil, err
+	}
+
+	var eraseTime *uint64
+	if erasure.EraseTime != nil && *erasure.EraseTime != 0 {
+		eraseTime = erasure.EraseTime
+	}
+
+	return &entity.Erasure{
+		ID:         erasure.ID,
+		TenantID:   erasure.TenantID,
+		IDType:     entity.IDType(erasure.GetIDType()),
+		UdHash:     erasure.UdHash,
+		Status:     entity.ErasureStatus(erasure.GetStatus()),
+		ExtInfo:    extInfo,
+		CreatorID:  erasure.CreatorID,
+		EraseTime:  eraseTime,
+		CreateTime: erasure.CreateTime,
+		UpdateTime: erasure.UpdateTime,
+	}, nil
+}
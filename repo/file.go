@@ -17,6 +17,8 @@ type FileRepo interface {
 	CreateFile(ctx context.Context, parentID *string, fileName string, data io.Reader) (string, error)
 	CreateFolder(ctx context.Context, folderName string) (string, error)
 	DownloadFile(_ context.Context, fileID string) ([][]string, error)
+	// OpenFile streams the content of the file, the caller must close it.
+	OpenFile(ctx context.Context, fileID string) (io.ReadCloser, error)
 	Close(ctx context.Context) error
 }
 
@@ -131,6 +133,14 @@ func (r *fileRepo) DownloadFile(_ context.Context, fileID string) ([][]string, e
 	return records, nil
 }
 
+func (r *fileRepo) OpenFile(_ context.Context, fileID string) (io.ReadCloser, error) {
+	resp, err := r.srv.Files.Get(fileID).Download()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
 func (r *fileRepo) Close(_ context.Context) error {
 	return nil
 }
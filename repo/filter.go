@@ -64,6 +64,11 @@ func (p *Pagination) GetCursor() string {
 type Filter struct {
 	Conditions []*Condition
 	Pagination *Pagination
+	// Joins are JOIN clauses, only the columns of the model are read,
+	// and conditions on the joined tables must qualify their fields with the table name.
+	Joins []string
+	// Lock locks the rows read with SELECT ... FOR UPDATE until the transaction ends, it must be used in a transaction.
+	Lock bool
 }
 
 type Condition struct {
@@ -1,16 +1,18 @@
 package repo
 
 import (
-	"cdp/config"
 	"cdp/entity"
 	"context"
-	"gorm.io/driver/mysql"
-	"gorm.io/gorm"
+	"time"
 )
 
 type MappingID struct {
-	ID   *uint64
-	UdID *string
+	ID         *uint64
+	TenantID   *uint64
+	UdID       *string
+	ProfileID  *uint64
+	CreateTime *uint64
+	UpdateTime *uint64
 }
 
 func (m *MappingID) GetID() uint64 {
@@ -25,72 +27,185 @@ func (m *MappingID) TableName() string {
 }
 
 type MappingIDRepo interface {
-	GetMany(ctx context.Context, udIDs []string) ([]*entity.MappingID, error)
-	CreateMany(ctx context.Context, mappingIDs []*entity.MappingID) error
-	Close(ctx context.Context) error
+	GetManyByUdIDs(ctx context.Context, tenantID uint64, udIDs []string) ([]*entity.MappingID, error)
+	// GetProfileIDs returns the profile ID of each ud linked to a profile, keyed by the doc ID of the ud.
+	GetProfileIDs(ctx context.Context, tenantID uint64, uds []*entity.Ud) (map[string]uint64, error)
+	GetManyByProfileIDs(ctx context.Context, tenantID uint64, profileIDs []uint64) ([]*entity.MappingID, error)
+	CreateMany(ctx context.Context, mappingIDs []*entity.MappingID) ([]uint64, error)
+	// SetProfileID moves the mapping IDs of ids to profileID.
+	SetProfileID(ctx context.Context, tenantID uint64, ids []uint64, profileID uint64) error
+	// MergeProfiles moves all mapping IDs of fromProfileIDs to toProfileID.
+	MergeProfiles(ctx context.Context, tenantID uint64, fromProfileIDs []uint64, toProfileID uint64) error
+	DeleteMany(ctx context.Context, tenantID uint64, ids []uint64) error
 }
 
 type mappingIDRepo struct {
-	orm *gorm.DB
+	baseRepo BaseRepo
 }
 
-func NewMappingIDRepo(_ context.Context, mysqlCfg config.MySQL) (MappingIDRepo, error) {
-	orm, err := gorm.Open(mysql.Open(mysqlCfg.ToDSN()))
+func NewMappingIDRepo(_ context.Context, baseRepo BaseRepo) MappingIDRepo {
+	return &mappingIDRepo{baseRepo: baseRepo}
+}
+
+func (r *mappingIDRepo) GetManyByUdIDs(ctx context.Context, tenantID uint64, udIDs []string) ([]*entity.MappingID, error) {
+	if len(udIDs) == 0 {
+		return make([]*entity.MappingID, 0), nil
+	}
+
+	return r.getMany(ctx, tenantID, []*Condition{
+		{
+			Field: "ud_id",
+			Value: udIDs,
+			Op:    OpIn,
+		},
+	})
+}
+
+func (r *mappingIDRepo) GetProfileIDs(ctx context.Context, tenantID uint64, uds []*entity.Ud) (map[string]uint64, error) {
+	udIDs := make([]string, 0, len(uds))
+	for _, ud := range uds {
+		udIDs = append(udIDs, ud.ToDocID())
+	}
+
+	mappingIDs, err := r.GetManyByUdIDs(ctx, tenantID, udIDs)
 	if err != nil {
 		return nil, err
 	}
-	return &mappingIDRepo{orm: orm}, nil
+
+	profileIDs := make(map[string]uint64, len(mappingIDs))
+	for _, mappingID := range mappingIDs {
+		if mappingID.GetProfileID() != 0 {
+			profileIDs[mappingID.GetUdID()] = mappingID.GetProfileID()
+		}
+	}
+
+	return profileIDs, nil
 }
 
-func (r *mappingIDRepo) GetMany(_ context.Context, udIDs []string) ([]*entity.MappingID, error) {
-	mappingIDModels := make([]*MappingID, 0, len(udIDs))
+func (r *mappingIDRepo) GetManyByProfileIDs(ctx context.Context, tenantID uint64, profileIDs []uint64) ([]*entity.MappingID, error) {
+	if len(profileIDs) == 0 {
+		return make([]*entity.MappingID, 0), nil
+	}
+
+	return r.getMany(ctx, tenantID, []*Condition{
+		{
+			Field: "profile_id",
+			Value: profileIDs,
+			Op:    OpIn,
+		},
+	})
+}
 
-	if err := r.orm.Where("ud_id IN (?)", udIDs).Find(&mappingIDModels).Error; err != nil {
+func (r *mappingIDRepo) getMany(ctx context.Context, tenantID uint64, conditions []*Condition) ([]*entity.MappingID, error) {
+	res, _, err := r.baseRepo.GetMany(ctx, new(MappingID), &Filter{
+		Conditions: append(r.getBaseConditions(tenantID), conditions...),
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	mappingIDs := make([]*entity.MappingID, 0, len(mappingIDModels))
-	for _, mappingIDModel := range mappingIDModels {
-		mappingIDs = append(mappingIDs, ToMappingID(mappingIDModel))
+	mappingIDs := make([]*entity.MappingID, 0, len(res))
+	for _, m := range res {
+		mappingIDs = append(mappingIDs, ToMappingID(m.(*MappingID)))
 	}
 
 	return mappingIDs, nil
 }
 
-func (r *mappingIDRepo) CreateMany(_ context.Context, mappingIDs []*entity.MappingID) error {
+func (r *mappingIDRepo) CreateMany(ctx context.Context, mappingIDs []*entity.MappingID) ([]uint64, error) {
 	mappingIDModels := make([]*MappingID, 0, len(mappingIDs))
 	for _, mappingID := range mappingIDs {
 		mappingIDModels = append(mappingIDModels, ToMappingIDModel(mappingID))
 	}
 
-	return r.orm.Create(&mappingIDModels).Error
+	if err := r.baseRepo.CreateMany(ctx, new(MappingID), mappingIDModels); err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(mappingIDModels))
+	for _, mappingIDModel := range mappingIDModels {
+		ids = append(ids, mappingIDModel.GetID())
+	}
+
+	return ids, nil
 }
 
-func (r *mappingIDRepo) Close(_ context.Context) error {
-	if r.orm != nil {
-		sqlDB, err := r.orm.DB()
-		if err != nil {
-			return err
-		}
+func (r *mappingIDRepo) SetProfileID(ctx context.Context, tenantID uint64, ids []uint64, profileID uint64) error {
+	if len(ids) == 0 {
+		return nil
+	}
 
-		err = sqlDB.Close()
-		if err != nil {
-			return err
-		}
+	return r.updateProfileID(ctx, tenantID, &Condition{
+		Field: "id",
+		Value: ids,
+		Op:    OpIn,
+	}, profileID)
+}
+
+func (r *mappingIDRepo) MergeProfiles(ctx context.Context, tenantID uint64, fromProfileIDs []uint64, toProfileID uint64) error {
+	if len(fromProfileIDs) == 0 {
+		return nil
+	}
+
+	return r.updateProfileID(ctx, tenantID, &Condition{
+		Field: "profile_id",
+		Value: fromProfileIDs,
+		Op:    OpIn,
+	}, toProfileID)
+}
+
+func (r *mappingIDRepo) DeleteMany(ctx context.Context, tenantID uint64, ids []uint64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return r.baseRepo.Delete(ctx, new(MappingID), &Filter{
+		Conditions: append(r.getBaseConditions(tenantID), &Condition{
+			Field: "id",
+			Value: ids,
+			Op:    OpIn,
+		}),
+	})
+}
+
+func (r *mappingIDRepo) updateProfileID(ctx context.Context, tenantID uint64, condition *Condition, profileID uint64) error {
+	return r.baseRepo.UpdateMany(ctx, new(MappingID), &Filter{
+		Conditions: append(r.getBaseConditions(tenantID), condition),
+	}, map[string]interface{}{
+		"profile_id":  profileID,
+		"update_time": uint64(time.Now().Unix()),
+	})
+}
+
+func (r *mappingIDRepo) getBaseConditions(tenantID uint64) []*Condition {
+	return []*Condition{
+		{
+			Field:         "tenant_id",
+			Value:         tenantID,
+			Op:            OpEq,
+			NextLogicalOp: LogicalOpAnd,
+		},
 	}
-	return nil
 }
 
 func ToMappingIDModel(mappingID *entity.MappingID) *MappingID {
 	return &MappingID{
-		ID:   mappingID.ID,
-		UdID: mappingID.UdID,
+		ID:         mappingID.ID,
+		TenantID:   mappingID.TenantID,
+		UdID:       mappingID.UdID,
+		ProfileID:  mappingID.ProfileID,
+		CreateTime: mappingID.CreateTime,
+		UpdateTime: mappingID.UpdateTime,
 	}
 }
 
 func ToMappingID(mappingID *MappingID) *entity.MappingID {
 	return &entity.MappingID{
-		ID:   mappingID.ID,
-		UdID: mappingID.UdID,
+		ID:         mappingID.ID,
+		TenantID:   mappingID.TenantID,
+		UdID:       mappingID.UdID,
+		ProfileID:  mappingID.ProfileID,
+		CreateTime: mappingID.CreateTime,
+		UpdateTime: mappingID.UpdateTime,
 	}
 }
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"reflect"
 	"strings"
 )
@@ -31,6 +32,7 @@ type BaseRepo interface {
 	Avg(ctx context.Context, model interface{}, field string, f *Filter) (float64, error)
 	GroupBy(ctx context.Context, model, dest interface{}, groupByFields []string, aggregateFields map[string]string, f *Filter) ([]interface{}, error)
 	Update(ctx context.Context, model interface{}) error
+	UpdateMany(ctx context.Context, model interface{}, f *Filter, values map[string]interface{}) error
 	Close(ctx context.Context) error
 }
 
@@ -138,21 +140,34 @@ func (r *baseRepo) CreateMany(ctx context.Context, model, data interface{}) erro
 func (r *baseRepo) Get(ctx context.Context, model interface{}, f *Filter) error {
 	sqlQuery, args := ToSqlWithArgs(f)
 
-	return r.getDb(ctx).Model(model).Where(sqlQuery, args...).First(model).Error
+	query := r.getDb(ctx).Model(model)
+	if f.Lock {
+		query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+
+	return query.Where(sqlQuery, args...).First(model).Error
 }
 
 func (r *baseRepo) GetMany(ctx context.Context, model interface{}, f *Filter) ([]interface{}, *Pagination, error) {
 	var (
 		db             = r.getDb(ctx)
 		sqlQuery, args = ToSqlWithArgs(f)
-		query          = db.Model(model).Where(sqlQuery, args...)
+		query          = db.Model(model)
 	)
+	for _, join := range f.Joins {
+		query = query.Joins(join)
+	}
+	query = query.Where(sqlQuery, args...)
 
 	var count int64
 	if err := query.Count(&count).Error; err != nil {
 		return nil, nil, err
 	}
 
+	if len(f.Joins) > 0 {
+		query = query.Select("?.*", clause.Table{Name: clause.CurrentTable})
+	}
+
 	pagination := f.Pagination
 	if pagination == nil {
 		pagination = new(Pagination)
@@ -166,7 +181,10 @@ func (r *baseRepo) GetMany(ctx context.Context, model interface{}, f *Filter) ([
 		page = 1
 	}
 
-	query = query.Offset(int((page - 1) * limit)).Order("id DESC")
+	query = query.Offset(int((page - 1) * limit)).Order(clause.OrderByColumn{
+		Column: clause.Column{Table: clause.CurrentTable, Name: "id"},
+		Desc:   true,
+	})
 	if limit > 0 {
 		query = query.Limit(int(limit + 1))
 	}
@@ -205,6 +223,11 @@ func (r *baseRepo) Update(ctx context.Context, model interface{}) error {
 	return r.getDb(ctx).Updates(model).Error
 }
 
+func (r *baseRepo) UpdateMany(ctx context.Context, model interface{}, f *Filter, values map[string]interface{}) error {
+	sqlQuery, args := ToSqlWithArgs(f)
+	return r.getDb(ctx).Model(model).Where(sqlQuery, args...).Updates(values).Error
+}
+
 func (r *baseRepo) RunTx(ctx context.Context, fn func(ctx context.Context) error) error {
 	if r.hasTx(ctx) {
 		return fn(ctx)
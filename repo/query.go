@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"cdp/config"
 	"cdp/entity"
+	"cdp/pkg/errutil"
 	"cdp/pkg/goutil"
 	"context"
 	"encoding/json"
@@ -14,21 +15,62 @@ import (
 	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/elastic/go-elasticsearch/v7/esutil"
 	"github.com/rs/zerolog/log"
+	"math"
+	"math/bits"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 var (
 	errEmptyTenantName = errors.New("empty tenant name")
+
+	ErrUdNotFound = errutil.NotFoundError(errors.New("ud not found"))
+
+	// ErrHistoryConflicts tells that uds were written while the history of a tag was started.
+	ErrHistoryConflicts = errors.New("uds changed while starting tag history")
 )
 
 type QueryRepo interface {
 	CreateStore(_ context.Context, tenantName string) error
+	PutTagMapping(ctx context.Context, tenantName string, tag *entity.Tag) error
 	BatchUpsert(ctx context.Context, tenantName string, udTagVals []*entity.UdTagVal, onUpsert chan UpsertResult) error
-	Count(ctx context.Context, tenantName string, query *entity.Query) (uint64, error)
-	Download(ctx context.Context, tenantName string, query *entity.Query, page *Pagination) ([]*entity.Ud, *Pagination, error)
+	// Upsert writes udTagVals in one request and waits until they are searchable, unlike BatchUpsert it does not
+	// go through the shared bulk indexer. The returned errors are in the order of udTagVals, nil if the item is written.
+	Upsert(ctx context.Context, tenantName string, udTagVals []*entity.UdTagVal) ([]error, error)
+	// LinkProfiles sets the profile ID of the uds already stored, uds not stored yet are skipped
+	// and reported as upserted, their profile ID is written once they are upserted with tag values.
+	LinkProfiles(ctx context.Context, tenantName string, uds []*entity.Ud, onUpsert chan UpsertResult) error
+	Count(ctx context.Context, tenant *entity.Tenant, query *entity.Query) (uint64, error)
+	Download(ctx context.Context, tenant *entity.Tenant, query *entity.Query, page *Pagination) ([]*entity.Ud, *Pagination, error)
+	// CountProfiles and DownloadProfiles are similar to Count and Download,
+	// but uds linked into the same profile are counted or returned once.
+	CountProfiles(ctx context.Context, tenant *entity.Tenant, query *entity.Query) (uint64, error)
+	DownloadProfiles(ctx context.Context, tenant *entity.Tenant, query *entity.Query, page *Pagination) ([]*entity.Ud, *Pagination, error)
+	// GetSegmentOverlaps counts the profiles of every combination of the segments, in the order of the combination size.
+	GetSegmentOverlaps(ctx context.Context, tenant *entity.Tenant, segments []*entity.Segment) ([]*entity.SegmentOverlap, error)
+	// CountQueries counts the profiles matched by each query, in the order of the queries.
+	CountQueries(ctx context.Context, tenant *entity.Tenant, queries []*entity.Query) ([]uint64, error)
+	DownloadTagVals(ctx context.Context, tenant *entity.Tenant, query *entity.Query, tagIDs []uint64, page *Pagination) ([]*entity.UdTagVal, *Pagination, error)
+	// SampleTagVals returns up to size uds matching the query at random, with the values of tagIDs of each ud.
+	SampleTagVals(ctx context.Context, tenant *entity.Tenant, query *entity.Query, tagIDs []uint64, size uint32) ([]*entity.UdTagVal, error)
 	GetDistinctTagValues(ctx context.Context, tenantName string, tag *entity.Tag) ([]string, error)
+	GetTagStats(ctx context.Context, tenantName string, tag *entity.Tag, opt *TagStatsOption) (*entity.TagStats, error)
+	GetTagValHistory(ctx context.Context, tenantName string, ud *entity.Ud, tagID uint64) ([]*entity.TagValHistory, error)
+	// StartTagHistory writes a baseline history entry for each ud having a value of the tag but no history yet,
+	// so that history lookups see the values set before the tag kept history. It fails with ErrHistoryConflicts
+	// if uds were written meanwhile, which are left without history until it is run again.
+	StartTagHistory(ctx context.Context, tenantName string, tagID uint64) error
+	// GetUdTagVals gets all tag values stored for a ud, the returned ud carries its profile ID.
+	GetUdTagVals(ctx context.Context, tenantName string, ud *entity.Ud) (*entity.UdTagVal, error)
+	// DeleteUds deletes the docs of uds and returns the number of docs deleted, missing docs are skipped.
+	DeleteUds(ctx context.Context, tenantName string, uds []*entity.Ud) (uint64, error)
+	// InvalidateTagCache drops the cached query results of a tag.
+	InvalidateTagCache(ctx context.Context, tenantID, tagID uint64)
+	// FlushCache drops all cached query results of a tenant.
+	FlushCache(ctx context.Context, tenantID uint64)
 	Close(ctx context.Context) error
 }
 
@@ -37,6 +79,7 @@ type queryRepo struct {
 	bulkIndexer     esutil.BulkIndexer
 	scrollTimeout   time.Duration
 	baseCache       BaseCache
+	segmentRepo     SegmentRepo // to expand segment references in queries
 	onInsertSuccess chan struct{}
 	onInsertFailure chan error
 }
@@ -47,7 +90,15 @@ var (
 	defaultFlushIntervalSeconds = 5
 )
 
-func NewQueryRepo(ctx context.Context, cfg config.ElasticSearch) (QueryRepo, error) {
+// NewQueryRepo creates the query repo backed by Elasticsearch, or by in-process stores if the local query db is enabled.
+func NewQueryRepo(ctx context.Context, cfg *config.Config, baseRepo BaseRepo) (QueryRepo, error) {
+	if cfg.LocalQueryDB.Enabled {
+		return newLocalQueryRepo(ctx, cfg.LocalQueryDB, baseRepo)
+	}
+	return newElasticQueryRepo(ctx, cfg.QueryDB, baseRepo)
+}
+
+func newElasticQueryRepo(ctx context.Context, cfg config.ElasticSearch, baseRepo BaseRepo) (QueryRepo, error) {
 	retryBackOff := backoff.NewExponentialBackOff()
 
 	c, err := elasticsearch.NewClient(elasticsearch.Config{
@@ -101,6 +152,7 @@ func NewQueryRepo(ctx context.Context, cfg config.ElasticSearch) (QueryRepo, err
 		client:        c,
 		bulkIndexer:   indexer,
 		baseCache:     NewBaseCache(ctx),
+		segmentRepo:   NewSegmentRepo(ctx, baseRepo),
 		scrollTimeout: time.Duration(cfg.ScrollTimeoutSeconds) * time.Second,
 	}, nil
 }
@@ -112,6 +164,10 @@ func (r *queryRepo) CreateStore(ctx context.Context, tenantName string) error {
 
 	mapping := map[string]interface{}{
 		"mappings": map[string]interface{}{
+			"properties": map[string]interface{}{
+				entity.UdSegmentIDsField: map[string]interface{}{"type": "keyword"},
+				entity.UdSplitKeyField:   map[string]interface{}{"type": "keyword"},
+			},
 			"dynamic_templates": []map[string]interface{}{
 				{
 					"strings_as_keywords": map[string]interface{}{
@@ -155,7 +211,71 @@ func (r *queryRepo) CreateStore(ctx context.Context, tenantName string) error {
 	return nil
 }
 
+// PutTagMapping sets an explicit field mapping for the tag, so that the field type does not depend on the first value indexed.
+func (r *queryRepo) PutTagMapping(ctx context.Context, tenantName string, tag *entity.Tag) error {
+	if tenantName == "" {
+		return errEmptyTenantName
+	}
+
+	fieldMapping, err := r.getTagFieldMapping(tag)
+	if err != nil {
+		return err
+	}
+
+	properties := map[string]interface{}{
+		getTagField(tag.GetID()): fieldMapping,
+	}
+	if tag.KeepsHistory() {
+		timeMapping := map[string]interface{}{"type": "date", "format": "epoch_second"}
+
+		properties[getTagHistoryField(tag.GetID())] = map[string]interface{}{
+			"type": "nested",
+			"properties": map[string]interface{}{
+				"val":     fieldMapping,
+				"from":    timeMapping,
+				"to":      timeMapping,
+				"task_id": map[string]interface{}{"type": "long"},
+			},
+		}
+		properties[getTagChangedAtField(tag.GetID())] = timeMapping
+	}
+
+	mapping := map[string]interface{}{
+		"properties": properties,
+	}
+
+	mappingBody, err := json.Marshal(mapping)
+	if err != nil {
+		return fmt.Errorf("failed to marshal mapping: %w", err)
+	}
+
+	res, err := r.client.Indices.PutMapping(
+		bytes.NewReader(mappingBody),
+		r.client.Indices.PutMapping.WithIndex(tenantName),
+		r.client.Indices.PutMapping.WithContext(ctx),
+	)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	var putResp map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&putResp); err != nil {
+		return err
+	}
+
+	if err := r.extractElasticError(putResp); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 type UpsertResult struct {
+	Ud    *entity.Ud
 	Error error
 }
 
@@ -171,16 +291,17 @@ func (r *queryRepo) BatchUpsert(ctx context.Context, tenantName string, udTagVal
 			continue
 		}
 
-		docID := udTagVal.GetUd().ToDocID()
+		ud := udTagVal.GetUd()
+		docID := ud.ToDocID()
 
 		if docID == "" {
 			log.Ctx(ctx).Warn().Msg("empty doc ID found in batch upsert")
 			continue
 		}
 
-		data, err := udTagVal.ToDoc()
+		body, err := r.buildUpsertBody(udTagVal)
 		if err != nil {
-			log.Ctx(ctx).Error().Msgf("fail to convert udTagVal to doc: %v", err)
+			log.Ctx(ctx).Error().Msgf("fail to build upsert: %v, docID: %v", err, docID)
 			return err
 		}
 
@@ -188,11 +309,12 @@ func (r *queryRepo) BatchUpsert(ctx context.Context, tenantName string, udTagVal
 			Action:     "update",
 			Index:      tenantName,
 			DocumentID: docID,
-			Body:       strings.NewReader(fmt.Sprintf(`{"doc":%s, "doc_as_upsert": true}`, data)),
+			Body:       strings.NewReader(body),
 			OnSuccess: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem) {
 				if onUpsert != nil {
 					select {
 					case onUpsert <- UpsertResult{
+						Ud:    ud,
 						Error: nil,
 					}:
 					default:
@@ -207,6 +329,7 @@ func (r *queryRepo) BatchUpsert(ctx context.Context, tenantName string, udTagVal
 
 					select {
 					case onUpsert <- UpsertResult{
+						Ud:    ud,
 						Error: err,
 					}:
 					default:
@@ -214,7 +337,7 @@ func (r *queryRepo) BatchUpsert(ctx context.Context, tenantName string, udTagVal
 				}
 			},
 		}); err != nil {
-			log.Ctx(ctx).Error().Msgf("fail to add udTagVal to indexer: %v, docID: %v, data: %v", err, docID, data)
+			log.Ctx(ctx).Error().Msgf("fail to add udTagVal to indexer: %v, docID: %v, body: %v", err, docID, body)
 			return err
 		}
 	}
@@ -222,130 +345,257 @@ func (r *queryRepo) BatchUpsert(ctx context.Context, tenantName string, udTagVal
 	return nil
 }
 
-func (r *queryRepo) Download(ctx context.Context, tenantName string, query *entity.Query, page *Pagination) ([]*entity.Ud, *Pagination, error) {
+// buildUpsertBody builds the body of the update request writing udTagVal, the doc is created if missing.
+func (r *queryRepo) buildUpsertBody(udTagVal *entity.UdTagVal) (string, error) {
+	data, err := udTagVal.ToDoc()
+	if err != nil {
+		return "", err
+	}
+
+	// history entries and static segments are appended to the stored doc, which takes a script
+	if udTagVal.HasHistory() || len(udTagVal.SegmentIDs) > 0 {
+		return r.buildScriptedUpsertBody(udTagVal, data)
+	}
+
+	return fmt.Sprintf(`{"doc":%s, "doc_as_upsert": true}`, data), nil
+}
+
+func (r *queryRepo) Upsert(ctx context.Context, tenantName string, udTagVals []*entity.UdTagVal) ([]error, error) {
 	if tenantName == "" {
-		return nil, nil, errEmptyTenantName
+		return nil, errEmptyTenantName
 	}
 
 	var (
-		res *esapi.Response
-		err error
+		errs = make([]error, len(udTagVals))
+		buf  = new(bytes.Buffer)
+		// positions in udTagVals of the items sent, the response items are in the same order
+		positions = make([]int, 0, len(udTagVals))
 	)
-	if page.GetCursor() != "" {
-		res, err = r.client.Scroll(
-			r.client.Scroll.WithScroll(r.scrollTimeout),
-			r.client.Scroll.WithScrollID(page.GetCursor()),
-			r.client.Scroll.WithContext(ctx),
-		)
-	} else {
-		queryBody := r.buildElasticQuery(query)
-		if queryBody == nil {
-			return nil, nil, nil
+	for i, udTagVal := range udTagVals {
+		docID := udTagVal.GetUd().ToDocID()
+		if docID == "" {
+			errs[i] = errors.New("empty doc id")
+			continue
 		}
 
-		body, err := json.Marshal(map[string]interface{}{
-			"query":   queryBody,
-			"size":    page.GetLimit(),
-			"_source": false,
+		body, err := r.buildUpsertBody(udTagVal)
+		if err != nil {
+			return nil, err
+		}
+
+		meta, err := json.Marshal(map[string]interface{}{
+			"update": map[string]interface{}{"_index": tenantName, "_id": docID},
 		})
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 
-		res, err = r.client.Search(
-			r.client.Search.WithIndex(tenantName),
-			r.client.Search.WithBody(bytes.NewReader(body)),
-			r.client.Search.WithScroll(r.scrollTimeout),
-			r.client.Search.WithContext(ctx),
-		)
+		buf.Write(meta)
+		buf.WriteByte('\n')
+		buf.WriteString(body)
+		buf.WriteByte('\n')
+
+		positions = append(positions, i)
+	}
+
+	if len(positions) == 0 {
+		return errs, nil
 	}
+
+	res, err := r.client.Bulk(
+		buf,
+		r.client.Bulk.WithContext(ctx),
+		r.client.Bulk.WithRefresh("wait_for"),
+	)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+
 	defer func() {
 		_ = res.Body.Close()
 	}()
 
-	var searchResp map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&searchResp); err != nil {
-		return nil, nil, err
+	var bulkResp map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&bulkResp); err != nil {
+		return nil, err
 	}
 
-	if err := r.extractElasticError(searchResp); err != nil {
-		return nil, nil, err
+	if err := r.extractElasticError(bulkResp); err != nil {
+		return nil, err
 	}
 
-	hits, ok := searchResp["hits"].(map[string]interface{})["hits"].([]interface{})
-	if !ok {
-		return nil, nil, errors.New("no hits found in response")
+	items, _ := bulkResp["items"].([]interface{})
+	if len(items) != len(positions) {
+		return nil, fmt.Errorf("expect %d bulk items, got %d", len(positions), len(items))
 	}
 
-	uds := make([]*entity.Ud, 0)
-	for _, hit := range hits {
-		if doc, ok := hit.(map[string]interface{}); ok {
-			if id, exists := doc["_id"].(string); exists {
-				ud, err := entity.ToUd(id)
-				if err != nil {
-					return nil, nil, err
-				}
-				uds = append(uds, ud)
-			}
+	for i, item := range items {
+		m, _ := item.(map[string]interface{})
+		result, _ := m["update"].(map[string]interface{})
+
+		if e, ok := result["error"].(map[string]interface{}); ok {
+			errs[positions[i]] = fmt.Errorf("type: %v, reason: %v", e["type"], e["reason"])
 		}
 	}
 
-	newPage := &Pagination{
-		Limit:  page.Limit,
-		Cursor: goutil.String(""),
+	return errs, nil
+}
+
+func (r *queryRepo) LinkProfiles(ctx context.Context, tenantName string, uds []*entity.Ud, onUpsert chan UpsertResult) error {
+	if tenantName == "" {
+		return errEmptyTenantName
 	}
-	if sid, ok := searchResp["_scroll_id"].(string); ok {
-		if uint32(len(uds)) >= page.GetLimit() {
-			newPage.Cursor = goutil.String(sid)
-		} else {
-			res, err := r.client.ClearScroll(
-				r.client.ClearScroll.WithScrollID(sid),
-				r.client.ClearScroll.WithContext(ctx),
-			)
-			if err != nil || res.IsError() {
-				log.Ctx(ctx).Error().Msgf("fail to clear scroll id %s: %v", sid, err)
-			}
+
+	notify := func(ud *entity.Ud, err error) {
+		if onUpsert == nil {
+			return
+		}
+		select {
+		case onUpsert <- UpsertResult{
+			Ud:    ud,
+			Error: err,
+		}:
+		default:
 		}
 	}
 
-	return uds, newPage, nil
-}
+	for _, ud := range uds {
+		docID := ud.ToDocID()
+		if docID == "" || ud.ProfileID == nil {
+			log.Ctx(ctx).Warn().Msgf("ud without doc ID or profile ID found in link profiles, docID: %v", docID)
+			notify(ud, nil)
+			continue
+		}
 
-func (r *queryRepo) GetDistinctTagValues(ctx context.Context, tenantName string, tag *entity.Tag) ([]string, error) {
-	if tenantName == "" {
-		return nil, errEmptyTenantName
+		// no doc_as_upsert, so that no doc is created for a ud without tag values
+		body := fmt.Sprintf(`{"doc":{%q:%d,%q:%q}}`, entity.UdProfileIDField, ud.GetProfileID(),
+			entity.UdSplitKeyField, ud.ToSplitKey())
+
+		if err := r.bulkIndexer.Add(ctx, esutil.BulkIndexerItem{
+			Action:     "update",
+			Index:      tenantName,
+			DocumentID: docID,
+			Body:       strings.NewReader(body),
+			OnSuccess: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem) {
+				notify(ud, nil)
+			},
+			OnFailure: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+				if err == nil && res.Status == http.StatusNotFound {
+					notify(ud, nil)
+					return
+				}
+				if err == nil {
+					err = fmt.Errorf("type: %s, reason: %s", res.Error.Type, res.Error.Reason)
+				}
+				notify(ud, err)
+			},
+		}); err != nil {
+			log.Ctx(ctx).Error().Msgf("fail to add ud to indexer: %v, docID: %v", err, docID)
+			return err
+		}
 	}
 
-	const aggrName = "distinct_tag_values"
+	return nil
+}
 
-	if cachedTagValues, ok := r.baseCache.Get(ctx, aggrName, 0, tag.GetID()); ok {
-		return cachedTagValues.([]string), nil
+// MaxTagHistory is the max number of history entries kept per tag of a ud, the oldest entries are dropped first.
+const MaxTagHistory = 100
+
+// scriptedUpsertScript appends a history entry for each changed tag value, closing the previous entry,
+// adds the static segments missing from the doc, then updates the doc.
+// Numbers are compared by value, as the same number may be decoded as an Integer, a Long or a Double.
+const scriptedUpsertScript = `
+for (h in params.history) {
+	def old = ctx._source[h.field];
+	boolean same = false;
+	if (old instanceof Number && h.val instanceof Number) {
+		same = ((Number) old).doubleValue() == ((Number) h.val).doubleValue();
+	} else if (old != null) {
+		same = old.equals(h.val);
+	}
+	if (same) {
+		continue;
+	}
+	def historyField = h.field + '_history';
+	if (ctx._source[historyField] == null) {
+		ctx._source[historyField] = new ArrayList();
+	}
+	def entries = ctx._source[historyField];
+	if (entries.size() > 0) {
+		entries[entries.size() - 1].to = params.now;
+	}
+	Map entry = new HashMap();
+	entry.val = h.val;
+	entry.from = params.now;
+	entry.task_id = h.task_id;
+	entries.add(entry);
+	while (entries.size() > params.max_history) {
+		entries.remove(0);
+	}
+	ctx._source[h.field + '_changed_at'] = params.now;
+}
+if (params.segment_ids.size() > 0) {
+	if (ctx._source[params.segment_ids_field] == null) {
+		ctx._source[params.segment_ids_field] = new ArrayList();
+	}
+	def segmentIDs = ctx._source[params.segment_ids_field];
+	for (id in params.segment_ids) {
+		if (!segmentIDs.contains(id)) {
+			segmentIDs.add(id);
+		}
+	}
+}
+for (e in params.doc.entrySet()) {
+	ctx._source[e.getKey()] = e.getValue();
+}`
+
+func (r *queryRepo) buildScriptedUpsertBody(udTagVal *entity.UdTagVal, data string) (string, error) {
+	history := make([]map[string]interface{}, 0)
+	for _, tagVal := range udTagVal.TagVals {
+		if tagVal.KeepHistory {
+			history = append(history, map[string]interface{}{
+				"field":   getTagField(tagVal.GetTagID()),
+				"val":     tagVal.GetTagVal(),
+				"task_id": tagVal.GetTaskID(),
+			})
+		}
 	}
 
-	aggr := map[string]interface{}{
-		"size": 0,
-		"aggs": map[string]interface{}{
-			aggrName: map[string]interface{}{
-				"terms": map[string]interface{}{
-					"field": r.getTagField(tag.GetID()),
-				},
+	b, err := json.Marshal(map[string]interface{}{
+		"scripted_upsert": true,
+		"upsert":          map[string]interface{}{},
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"source": scriptedUpsertScript,
+			"params": map[string]interface{}{
+				"doc":               json.RawMessage(data),
+				"history":           history,
+				"now":               time.Now().Unix(),
+				"max_history":       MaxTagHistory,
+				"segment_ids":       udTagVal.GetSegmentKeys(),
+				"segment_ids_field": entity.UdSegmentIDsField,
 			},
 		},
+	})
+	if err != nil {
+		return "", err
 	}
 
-	aggrBody, err := json.Marshal(aggr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal aggr: %w", err)
+	return string(b), nil
+}
+
+func (r *queryRepo) GetTagValHistory(ctx context.Context, tenantName string, ud *entity.Ud, tagID uint64) ([]*entity.TagValHistory, error) {
+	if tenantName == "" {
+		return nil, errEmptyTenantName
 	}
 
-	res, err := r.client.Search(
-		r.client.Search.WithContext(ctx),
-		r.client.Search.WithIndex(tenantName),
-		r.client.Search.WithBody(bytes.NewReader(aggrBody)),
-		r.client.Search.WithTrackTotalHits(false),
+	historyField := getTagHistoryField(tagID)
+
+	res, err := r.client.Get(
+		tenantName,
+		ud.ToDocID(),
+		r.client.Get.WithSourceIncludes(historyField),
+		r.client.Get.WithContext(ctx),
 	)
 	if err != nil {
 		return nil, err
@@ -355,124 +605,1515 @@ func (r *queryRepo) GetDistinctTagValues(ctx context.Context, tenantName string,
 		_ = res.Body.Close()
 	}()
 
-	var aggrResp map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&aggrResp); err != nil {
-		return nil, err
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrUdNotFound
 	}
 
-	if err := r.extractElasticError(aggrResp); err != nil {
+	var getResp map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&getResp); err != nil {
 		return nil, err
 	}
 
-	buckets, ok := aggrResp["aggregations"].(map[string]interface{})[aggrName].(map[string]interface{})["buckets"].([]interface{})
-	if !ok {
-		return nil, errors.New("no buckets found in response")
+	if err := r.extractElasticError(getResp); err != nil {
+		return nil, err
 	}
 
-	values := make([]string, 0)
-	for _, b := range buckets {
-		bucket, ok := b.(map[string]interface{})
+	source, _ := getResp["_source"].(map[string]interface{})
+	entries, _ := source[historyField].([]interface{})
+
+	return toTagValHistory(entries), nil
+}
+
+// toTagValHistory reads the history entries stored in a doc.
+func toTagValHistory(entries []interface{}) []*entity.TagValHistory {
+	history := make([]*entity.TagValHistory, 0, len(entries))
+	for _, e := range entries {
+		entry, ok := e.(map[string]interface{})
 		if !ok {
-			return nil, errors.New("invalid bucket")
+			continue
 		}
-		values = append(values, fmt.Sprint(bucket["key"]))
-	}
 
-	r.baseCache.Set(ctx, aggrName, 0, tag.GetID(), values)
+		h := &entity.TagValHistory{
+			TagVal: entry["val"],
+		}
+		if from, ok := entry["from"].(float64); ok {
+			h.FromTime = goutil.Uint64(uint64(from))
+		}
+		if to, ok := entry["to"].(float64); ok {
+			h.ToTime = goutil.Uint64(uint64(to))
+		}
+		if taskID, ok := entry["task_id"].(float64); ok && taskID > 0 {
+			h.TaskID = goutil.Uint64(uint64(taskID))
+		}
+		history = append(history, h)
+	}
 
-	return values, nil
+	return history
 }
 
-func (r *queryRepo) Count(ctx context.Context, tenantName string, query *entity.Query) (uint64, error) {
+// startHistoryScript writes the current value as the first history entry. The time it was set is unknown,
+// so the entry starts from 0 and the changed time is left unset.
+const startHistoryScript = `
+def historyField = params.field + '_history';
+if (ctx._source[historyField] != null) {
+	ctx.op = 'noop';
+	return;
+}
+Map entry = new HashMap();
+entry.val = ctx._source[params.field];
+entry.from = 0;
+entry.task_id = 0;
+List entries = new ArrayList();
+entries.add(entry);
+ctx._source[historyField] = entries;`
+
+func (r *queryRepo) StartTagHistory(ctx context.Context, tenantName string, tagID uint64) error {
 	if tenantName == "" {
-		return 0, errEmptyTenantName
+		return errEmptyTenantName
 	}
 
-	queryBody := r.buildElasticQuery(query)
-	if queryBody == nil {
-		return 0, nil
-	}
+	field := getTagField(tagID)
 
-	body, err := json.Marshal(map[string]interface{}{"query": queryBody})
+	body, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{"exists": map[string]interface{}{"field": field}},
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"source": startHistoryScript,
+			"params": map[string]interface{}{"field": field},
+		},
+	})
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	res, err := r.client.Count(
-		r.client.Count.WithIndex(tenantName),
-		r.client.Count.WithBody(bytes.NewReader(body)),
-		r.client.Count.WithContext(ctx),
+	res, err := r.client.UpdateByQuery(
+		[]string{tenantName},
+		r.client.UpdateByQuery.WithBody(bytes.NewReader(body)),
+		r.client.UpdateByQuery.WithConflicts("proceed"),
+		r.client.UpdateByQuery.WithContext(ctx),
 	)
 	if err != nil {
-		return 0, err
+		return err
 	}
+
 	defer func() {
 		_ = res.Body.Close()
 	}()
 
-	var countResp map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&countResp); err != nil {
-		return 0, err
+	var updateResp map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&updateResp); err != nil {
+		return err
 	}
 
-	if err := r.extractElasticError(countResp); err != nil {
-		return 0, err
+	if err := r.extractElasticError(updateResp); err != nil {
+		return err
 	}
 
-	if count, ok := countResp["count"].(float64); ok {
-		return uint64(count), nil
+	if failures, ok := updateResp["failures"].([]interface{}); ok && len(failures) > 0 {
+		return fmt.Errorf("%d docs failed to start history", len(failures))
 	}
 
-	return 0, fmt.Errorf("unexpected response format")
-}
-
-func (r *queryRepo) extractElasticError(resp map[string]interface{}) error {
-	if errorResp, ok := resp["error"]; ok {
-		if m, ok := errorResp.(map[string]interface{}); ok {
-			var status int
-			if s, ok := m["status"].(int); ok {
-				status = s
-			}
-
-			var errType string
-			if s, ok := m["type"].(string); ok {
-				errType = s
-			}
-
-			var reason string
-			if s, ok := m["reason"].(string); ok {
-				reason = s
-			}
-			return fmt.Errorf("elasticsearch error: status=%d, type=%s, reason=%s", status, errType, reason)
-		}
+	// docs written while the update runs are skipped rather than failing the whole update
+	if conflicts, _ := updateResp["version_conflicts"].(float64); conflicts > 0 {
+		return fmt.Errorf("%w: %d docs", ErrHistoryConflicts, int(conflicts))
 	}
-	return nil
-}
 
-func (r *queryRepo) getTagField(tagID uint64) string {
-	return fmt.Sprintf("tag_%d", tagID)
+	return nil
 }
 
-func (r *queryRepo) buildElasticQuery(query *entity.Query) map[string]interface{} {
+func (r *queryRepo) GetUdTagVals(ctx context.Context, tenantName string, ud *entity.Ud) (*entity.UdTagVal, error) {
+	if tenantName == "" {
+		return nil, errEmptyTenantName
+	}
+
+	res, err := r.client.Get(
+		tenantName,
+		ud.ToDocID(),
+		r.client.Get.WithSourceExcludes("tag_*_history"),
+		r.client.Get.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrUdNotFound
+	}
+
+	var getResp map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&getResp); err != nil {
+		return nil, err
+	}
+
+	if err := r.extractElasticError(getResp); err != nil {
+		return nil, err
+	}
+
+	if found, _ := getResp["found"].(bool); !found {
+		return nil, ErrUdNotFound
+	}
+
+	source, _ := getResp["_source"].(map[string]interface{})
+
+	return toUdTagVal(ud, source), nil
+}
+
+// toUdTagVal reads the ud and all its tag values from the source of its doc.
+func toUdTagVal(ud *entity.Ud, source map[string]interface{}) *entity.UdTagVal {
+	udTagVal := &entity.UdTagVal{
+		Ud: &entity.Ud{
+			ID:     ud.ID,
+			IDType: ud.GetIDType(),
+		},
+		TagVals: make([]*entity.TagVal, 0),
+	}
+
+	if profileID, ok := source[entity.UdProfileIDField].(float64); ok && profileID > 0 {
+		udTagVal.Ud.ProfileID = goutil.Uint64(uint64(profileID))
+	}
+
+	for field, v := range source {
+		tagID, ok := parseTagField(field)
+		if !ok || v == nil {
+			continue
+		}
+		udTagVal.TagVals = append(udTagVal.TagVals, &entity.TagVal{
+			TagID:  goutil.Uint64(tagID),
+			TagVal: v,
+		})
+	}
+
+	return udTagVal
+}
+
+func (r *queryRepo) DeleteUds(ctx context.Context, tenantName string, uds []*entity.Ud) (uint64, error) {
+	if tenantName == "" {
+		return 0, errEmptyTenantName
+	}
+
+	var deleted uint64
+	for _, ud := range uds {
+		ok, err := r.deleteDoc(ctx, tenantName, ud.ToDocID())
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// deleteDoc deletes a doc and refreshes the index, so that the doc is gone from subsequent searches.
+func (r *queryRepo) deleteDoc(ctx context.Context, tenantName, docID string) (bool, error) {
+	res, err := r.client.Delete(
+		tenantName,
+		docID,
+		r.client.Delete.WithRefresh("true"),
+		r.client.Delete.WithContext(ctx),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	var deleteResp map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&deleteResp); err != nil {
+		return false, err
+	}
+
+	if err := r.extractElasticError(deleteResp); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (r *queryRepo) Download(ctx context.Context, tenant *entity.Tenant, query *entity.Query, page *Pagination) ([]*entity.Ud, *Pagination, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return nil, nil, errEmptyTenantName
+	}
+
+	var queryBody map[string]interface{}
+	if page.GetCursor() == "" {
+		var err error
+		if queryBody, err = r.buildElasticQuery(ctx, query, newSegmentRefs(tenant.GetID())); err != nil {
+			return nil, nil, err
+		}
+		if queryBody == nil {
+			return nil, nil, nil
+		}
+	}
+
+	docs, newPage, err := r.scroll(ctx, tenantName, queryBody, nil, nil, page)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uds := make([]*entity.Ud, 0, len(docs))
+	for _, doc := range docs {
+		if id, exists := doc["_id"].(string); exists {
+			ud, err := entity.ToUd(id)
+			if err != nil {
+				return nil, nil, err
+			}
+			uds = append(uds, ud)
+		}
+	}
+
+	return uds, newPage, nil
+}
+
+// profileSort puts uds of the same profile next to each other, uds identified by email first.
+var profileSort = []map[string]interface{}{
+	{entity.UdProfileIDField: map[string]interface{}{"order": "asc", "missing": "_last", "unmapped_type": "long"}},
+	{entity.UdIDTypeField: map[string]interface{}{"order": "asc", "missing": "_first", "unmapped_type": "long"}},
+}
+
+// profileCursorSeparator separates the last profile ID returned from the scroll ID in a DownloadProfiles cursor.
+const profileCursorSeparator = "|"
+
+func (r *queryRepo) DownloadProfiles(ctx context.Context, tenant *entity.Tenant, query *entity.Query, page *Pagination) ([]*entity.Ud, *Pagination, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return nil, nil, errEmptyTenantName
+	}
+
+	// the last profile of the previous page may continue in this page
+	var (
+		lastProfileID uint64
+		scrollID      = page.GetCursor()
+	)
+	if before, after, found := strings.Cut(scrollID, profileCursorSeparator); found {
+		id, err := strconv.ParseUint(before, 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid cursor: %v", err)
+		}
+		lastProfileID, scrollID = id, after
+	}
+
+	var queryBody map[string]interface{}
+	if scrollID == "" {
+		var err error
+		if queryBody, err = r.buildElasticQuery(ctx, query, newSegmentRefs(tenant.GetID())); err != nil {
+			return nil, nil, err
+		}
+		if queryBody == nil {
+			return nil, nil, nil
+		}
+	}
+
+	docs, newPage, err := r.scroll(ctx, tenantName, queryBody, []string{entity.UdProfileIDField}, profileSort, &Pagination{
+		Limit:  page.Limit,
+		Cursor: goutil.String(scrollID),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uds := make([]*entity.Ud, 0, len(docs))
+	for _, doc := range docs {
+		id, exists := doc["_id"].(string)
+		if !exists {
+			continue
+		}
+
+		ud, err := entity.ToUd(id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		source, _ := doc["_source"].(map[string]interface{})
+		if v, ok := source[entity.UdProfileIDField].(float64); ok {
+			profileID := uint64(v)
+			if profileID == lastProfileID {
+				continue
+			}
+			lastProfileID = profileID
+			ud.ProfileID = goutil.Uint64(profileID)
+		}
+
+		uds = append(uds, ud)
+	}
+
+	if newPage.GetCursor() != "" {
+		newPage.Cursor = goutil.String(fmt.Sprintf("%d%s%s", lastProfileID, profileCursorSeparator, newPage.GetCursor()))
+	}
+
+	return uds, newPage, nil
+}
+
+// DownloadTagVals is similar to Download, but also returns the values of tagIDs of each ud.
+// A nil query matches all uds.
+func (r *queryRepo) DownloadTagVals(ctx context.Context, tenant *entity.Tenant, query *entity.Query, tagIDs []uint64, page *Pagination) ([]*entity.UdTagVal, *Pagination, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return nil, nil, errEmptyTenantName
+	}
+
+	var queryBody map[string]interface{}
+	if page.GetCursor() == "" {
+		if query == nil {
+			queryBody = map[string]interface{}{"match_all": map[string]interface{}{}}
+		} else {
+			var err error
+			if queryBody, err = r.buildElasticQuery(ctx, query, newSegmentRefs(tenant.GetID())); err != nil {
+				return nil, nil, err
+			}
+			if queryBody == nil {
+				return nil, nil, nil
+			}
+		}
+	}
+
+	fields := make([]string, 0, len(tagIDs))
+	for _, tagID := range tagIDs {
+		fields = append(fields, getTagField(tagID))
+	}
+
+	docs, newPage, err := r.scroll(ctx, tenantName, queryBody, fields, nil, page)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	udTagVals, err := toUdTagVals(docs, tagIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return udTagVals, newPage, nil
+}
+
+func (r *queryRepo) SampleTagVals(ctx context.Context, tenant *entity.Tenant, query *entity.Query, tagIDs []uint64, size uint32) ([]*entity.UdTagVal, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return nil, errEmptyTenantName
+	}
+
+	queryBody, err := r.buildElasticQuery(ctx, query, newSegmentRefs(tenant.GetID()))
+	if err != nil {
+		return nil, err
+	}
+	if queryBody == nil {
+		return nil, nil
+	}
+
+	fields := []string{entity.UdProfileIDField}
+	for _, tagID := range tagIDs {
+		fields = append(fields, getTagField(tagID))
+	}
+
+	// the score of every match is replaced by a random one, so that the top hits are a random sample
+	body, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{"function_score": map[string]interface{}{
+			"query":        queryBody,
+			"random_score": map[string]interface{}{},
+			"boost_mode":   "replace",
+		}},
+		"size":    size,
+		"_source": fields,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := r.client.Search(
+		r.client.Search.WithIndex(tenantName),
+		r.client.Search.WithBody(bytes.NewReader(body)),
+		r.client.Search.WithTrackTotalHits(false),
+		r.client.Search.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	var searchResp map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&searchResp); err != nil {
+		return nil, err
+	}
+
+	if err := r.extractElasticError(searchResp); err != nil {
+		return nil, err
+	}
+
+	hits, ok := searchResp["hits"].(map[string]interface{})["hits"].([]interface{})
+	if !ok {
+		return nil, errors.New("no hits found in response")
+	}
+
+	docs := make([]map[string]interface{}, 0, len(hits))
+	for _, hit := range hits {
+		if doc, ok := hit.(map[string]interface{}); ok {
+			docs = append(docs, doc)
+		}
+	}
+
+	return toUdTagVals(docs, tagIDs)
+}
+
+// toUdTagVals reads the ud and the values of tagIDs from each doc, the ud carries its profile ID if it is in the source.
+func toUdTagVals(docs []map[string]interface{}, tagIDs []uint64) ([]*entity.UdTagVal, error) {
+	udTagVals := make([]*entity.UdTagVal, 0, len(docs))
+	for _, doc := range docs {
+		id, exists := doc["_id"].(string)
+		if !exists {
+			continue
+		}
+
+		ud, err := entity.ToUd(id)
+		if err != nil {
+			return nil, err
+		}
+
+		source, _ := doc["_source"].(map[string]interface{})
+		if v, ok := source[entity.UdProfileIDField].(float64); ok {
+			ud.ProfileID = goutil.Uint64(uint64(v))
+		}
+
+		tagVals := make([]*entity.TagVal, 0, len(tagIDs))
+		for _, tagID := range tagIDs {
+			if v, ok := source[getTagField(tagID)]; ok && v != nil {
+				tagVals = append(tagVals, &entity.TagVal{
+					TagID:  goutil.Uint64(tagID),
+					TagVal: v,
+				})
+			}
+		}
+
+		udTagVals = append(udTagVals, &entity.UdTagVal{
+			Ud:      ud,
+			TagVals: tagVals,
+		})
+	}
+
+	return udTagVals, nil
+}
+
+// scroll runs queryBody with a scroll cursor, or continues from the cursor in page if there is one.
+// Only the source fields are returned with each hit, no source is returned if fields is nil.
+func (r *queryRepo) scroll(ctx context.Context, tenantName string, queryBody map[string]interface{}, fields []string,
+	sort []map[string]interface{}, page *Pagination) ([]map[string]interface{}, *Pagination, error) {
+	var (
+		res *esapi.Response
+		err error
+	)
+	if page.GetCursor() != "" {
+		res, err = r.client.Scroll(
+			r.client.Scroll.WithScroll(r.scrollTimeout),
+			r.client.Scroll.WithScrollID(page.GetCursor()),
+			r.client.Scroll.WithContext(ctx),
+		)
+	} else {
+		var source interface{} = false
+		if fields != nil {
+			source = fields
+		}
+
+		searchBody := map[string]interface{}{
+			"query":   queryBody,
+			"size":    page.GetLimit(),
+			"_source": source,
+		}
+		if sort != nil {
+			searchBody["sort"] = sort
+		}
+
+		body, err := json.Marshal(searchBody)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		res, err = r.client.Search(
+			r.client.Search.WithIndex(tenantName),
+			r.client.Search.WithBody(bytes.NewReader(body)),
+			r.client.Search.WithScroll(r.scrollTimeout),
+			r.client.Search.WithContext(ctx),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	var searchResp map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&searchResp); err != nil {
+		return nil, nil, err
+	}
+
+	if err := r.extractElasticError(searchResp); err != nil {
+		return nil, nil, err
+	}
+
+	hits, ok := searchResp["hits"].(map[string]interface{})["hits"].([]interface{})
+	if !ok {
+		return nil, nil, errors.New("no hits found in response")
+	}
+
+	docs := make([]map[string]interface{}, 0, len(hits))
+	for _, hit := range hits {
+		if doc, ok := hit.(map[string]interface{}); ok {
+			docs = append(docs, doc)
+		}
+	}
+
+	newPage := &Pagination{
+		Limit:  page.Limit,
+		Cursor: goutil.String(""),
+	}
+	if sid, ok := searchResp["_scroll_id"].(string); ok {
+		if uint32(len(docs)) >= page.GetLimit() {
+			newPage.Cursor = goutil.String(sid)
+		} else {
+			res, err := r.client.ClearScroll(
+				r.client.ClearScroll.WithScrollID(sid),
+				r.client.ClearScroll.WithContext(ctx),
+			)
+			if err != nil || res.IsError() {
+				log.Ctx(ctx).Error().Msgf("fail to clear scroll id %s: %v", sid, err)
+			}
+		}
+	}
+
+	return docs, newPage, nil
+}
+
+const distinctTagValuesCachePrefix = "distinct_tag_values"
+
+type cachedTagValues struct {
+	updateTime uint64
+	values     []string
+}
+
+func (r *queryRepo) GetDistinctTagValues(ctx context.Context, tenantName string, tag *entity.Tag) ([]string, error) {
+	if tenantName == "" {
+		return nil, errEmptyTenantName
+	}
+
+	const aggrName = distinctTagValuesCachePrefix
+
+	// tag updates are made by other processes too, e.g. jobs, so a cached entry
+	// is only valid for the tag version it was computed from
+	if v, ok := r.baseCache.Get(ctx, aggrName, tag.GetTenantID(), tag.GetID()); ok {
+		if cached := v.(*cachedTagValues); cached.updateTime == tag.GetUpdateTime() {
+			return cached.values, nil
+		}
+	}
+
+	aggr := map[string]interface{}{
+		"size": 0,
+		"aggs": map[string]interface{}{
+			aggrName: map[string]interface{}{
+				"terms": map[string]interface{}{
+					"field": getTagField(tag.GetID()),
+				},
+			},
+		},
+	}
+
+	aggrBody, err := json.Marshal(aggr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal aggr: %w", err)
+	}
+
+	res, err := r.client.Search(
+		r.client.Search.WithContext(ctx),
+		r.client.Search.WithIndex(tenantName),
+		r.client.Search.WithBody(bytes.NewReader(aggrBody)),
+		r.client.Search.WithTrackTotalHits(false),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	var aggrResp map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&aggrResp); err != nil {
+		return nil, err
+	}
+
+	if err := r.extractElasticError(aggrResp); err != nil {
+		return nil, err
+	}
+
+	buckets, ok := aggrResp["aggregations"].(map[string]interface{})[aggrName].(map[string]interface{})["buckets"].([]interface{})
+	if !ok {
+		return nil, errors.New("no buckets found in response")
+	}
+
+	values := make([]string, 0)
+	for _, b := range buckets {
+		bucket, ok := b.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid bucket")
+		}
+		values = append(values, fmt.Sprint(bucket["key"]))
+	}
+
+	r.baseCache.Set(ctx, aggrName, tag.GetTenantID(), tag.GetID(), &cachedTagValues{
+		updateTime: tag.GetUpdateTime(),
+		values:     values,
+	})
+
+	return values, nil
+}
+
+func (r *queryRepo) InvalidateTagCache(ctx context.Context, tenantID, tagID uint64) {
+	r.baseCache.Del(ctx, distinctTagValuesCachePrefix, tenantID, tagID)
+}
+
+func (r *queryRepo) FlushCache(ctx context.Context, tenantID uint64) {
+	r.baseCache.FlushTenant(ctx, tenantID)
+}
+
+type TagStatsOption struct {
+	TopN             uint32 // number of top values of non-numeric tags
+	HistogramBuckets uint32 // number of histogram buckets of numeric tags
+}
+
+var defaultPercents = []float64{1, 5, 25, 50, 75, 95, 99}
+
+func (r *queryRepo) GetTagStats(ctx context.Context, tenantName string, tag *entity.Tag, opt *TagStatsOption) (*entity.TagStats, error) {
+	if tenantName == "" {
+		return nil, errEmptyTenantName
+	}
+
+	field := getTagField(tag.GetID())
+
+	aggs := map[string]interface{}{
+		"has_value": map[string]interface{}{
+			"filter": map[string]interface{}{"exists": map[string]interface{}{"field": field}},
+		},
+		"missing": map[string]interface{}{
+			"missing": map[string]interface{}{"field": field},
+		},
+	}
+	if tag.IsNumeric() {
+		aggs["stats"] = map[string]interface{}{
+			"stats": map[string]interface{}{"field": field},
+		}
+		aggs["percentiles"] = map[string]interface{}{
+			"percentiles": map[string]interface{}{"field": field, "percents": defaultPercents},
+		}
+	} else {
+		aggs["top_values"] = map[string]interface{}{
+			"terms": map[string]interface{}{"field": field, "size": opt.TopN},
+		}
+		aggs["cardinality"] = map[string]interface{}{
+			"cardinality": map[string]interface{}{"field": field},
+		}
+	}
+
+	aggsResp, err := r.aggregate(ctx, tenantName, nil, aggs)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &entity.TagStats{
+		Count:   goutil.Uint64(r.getDocCount(aggsResp["has_value"])),
+		Missing: goutil.Uint64(r.getDocCount(aggsResp["missing"])),
+	}
+
+	if !tag.IsNumeric() {
+		if m, ok := aggsResp["cardinality"].(map[string]interface{}); ok {
+			if v, ok := m["value"].(float64); ok {
+				stats.Cardinality = goutil.Uint64(uint64(v))
+			}
+		}
+
+		stats.TopValues = make([]*entity.TagValueCount, 0)
+		for _, bucket := range r.getBuckets(aggsResp["top_values"]) {
+			stats.TopValues = append(stats.TopValues, &entity.TagValueCount{
+				Value: goutil.String(fmt.Sprint(bucket["key"])),
+				Count: goutil.Uint64(r.getDocCount(bucket)),
+			})
+		}
+
+		return stats, nil
+	}
+
+	// no min and max if no ud has the tag
+	m, _ := aggsResp["stats"].(map[string]interface{})
+	minVal, hasMin := m["min"].(float64)
+	maxVal, hasMax := m["max"].(float64)
+	if !hasMin || !hasMax {
+		return stats, nil
+	}
+
+	stats.Min = goutil.Float64(minVal)
+	stats.Max = goutil.Float64(maxVal)
+	if avg, ok := m["avg"].(float64); ok {
+		stats.Avg = goutil.Float64(avg)
+	}
+
+	if m, ok := aggsResp["percentiles"].(map[string]interface{}); ok {
+		if values, ok := m["values"].(map[string]interface{}); ok {
+			stats.Percentiles = make(map[string]float64)
+			for k, v := range values {
+				if f, ok := v.(float64); ok {
+					stats.Percentiles[k] = f
+				}
+			}
+		}
+	}
+
+	histogram, err := r.getHistogram(ctx, tenantName, field, minVal, maxVal, opt.HistogramBuckets)
+	if err != nil {
+		return nil, err
+	}
+	stats.Histogram = histogram
+
+	return stats, nil
+}
+
+// getHistogram splits [min, max] into numBuckets buckets of equal width.
+func (r *queryRepo) getHistogram(ctx context.Context, tenantName, field string, minVal, maxVal float64, numBuckets uint32) ([]*entity.TagHistogramBucket, error) {
+	if numBuckets == 0 {
+		return nil, nil
+	}
+
+	interval := (maxVal - minVal) / float64(numBuckets)
+	if interval == 0 {
+		// all values are the same
+		interval, numBuckets = 1, 1
+	}
+
+	// align the buckets to min, offset has to be within [0, interval)
+	offset := math.Mod(minVal, interval)
+	if offset < 0 {
+		offset += interval
+	}
+
+	aggsResp, err := r.aggregate(ctx, tenantName, nil, map[string]interface{}{
+		"histogram": map[string]interface{}{
+			"histogram": map[string]interface{}{
+				"field":    field,
+				"interval": interval,
+				"offset":   offset,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	histogram := make([]*entity.TagHistogramBucket, 0, numBuckets)
+	for _, bucket := range r.getBuckets(aggsResp["histogram"]) {
+		var (
+			from, _ = bucket["key"].(float64)
+			count   = r.getDocCount(bucket)
+		)
+
+		// max falls into a bucket of its own, merge it into the last bucket
+		if uint32(len(histogram)) == numBuckets {
+			last := histogram[len(histogram)-1]
+			last.Count = goutil.Uint64(*last.Count + count)
+			continue
+		}
+
+		histogram = append(histogram, &entity.TagHistogramBucket{
+			From:  goutil.Float64(from),
+			To:    goutil.Float64(from + interval),
+			Count: goutil.Uint64(count),
+		})
+	}
+
+	return histogram, nil
+}
+
+// aggregate runs aggs over the uds matching queryBody, or all uds if queryBody is nil.
+func (r *queryRepo) aggregate(ctx context.Context, tenantName string, queryBody, aggs map[string]interface{}) (map[string]interface{}, error) {
+	body := map[string]interface{}{
+		"size": 0,
+		"aggs": aggs,
+	}
+	if queryBody != nil {
+		body["query"] = queryBody
+	}
+
+	aggrBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal aggr: %w", err)
+	}
+
+	res, err := r.client.Search(
+		r.client.Search.WithContext(ctx),
+		r.client.Search.WithIndex(tenantName),
+		r.client.Search.WithBody(bytes.NewReader(aggrBody)),
+		r.client.Search.WithTrackTotalHits(false),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	var aggrResp map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&aggrResp); err != nil {
+		return nil, err
+	}
+
+	if err := r.extractElasticError(aggrResp); err != nil {
+		return nil, err
+	}
+
+	aggregations, ok := aggrResp["aggregations"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("no aggregations found in response")
+	}
+
+	return aggregations, nil
+}
+
+func (r *queryRepo) getDocCount(aggr interface{}) uint64 {
+	if m, ok := aggr.(map[string]interface{}); ok {
+		if count, ok := m["doc_count"].(float64); ok {
+			return uint64(count)
+		}
+	}
+	return 0
+}
+
+func (r *queryRepo) getBuckets(aggr interface{}) []map[string]interface{} {
+	buckets := make([]map[string]interface{}, 0)
+	if m, ok := aggr.(map[string]interface{}); ok {
+		if bs, ok := m["buckets"].([]interface{}); ok {
+			for _, b := range bs {
+				if bucket, ok := b.(map[string]interface{}); ok {
+					buckets = append(buckets, bucket)
+				}
+			}
+		}
+	}
+	return buckets
+}
+
+func (r *queryRepo) Count(ctx context.Context, tenant *entity.Tenant, query *entity.Query) (uint64, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return 0, errEmptyTenantName
+	}
+
+	queryBody, err := r.buildElasticQuery(ctx, query, newSegmentRefs(tenant.GetID()))
+	if err != nil {
+		return 0, err
+	}
+	if queryBody == nil {
+		return 0, nil
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"query": queryBody})
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := r.client.Count(
+		r.client.Count.WithIndex(tenantName),
+		r.client.Count.WithBody(bytes.NewReader(body)),
+		r.client.Count.WithContext(ctx),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	var countResp map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&countResp); err != nil {
+		return 0, err
+	}
+
+	if err := r.extractElasticError(countResp); err != nil {
+		return 0, err
+	}
+
+	if count, ok := countResp["count"].(float64); ok {
+		return uint64(count), nil
+	}
+
+	return 0, fmt.Errorf("unexpected response format")
+}
+
+func (r *queryRepo) CountProfiles(ctx context.Context, tenant *entity.Tenant, query *entity.Query) (uint64, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return 0, errEmptyTenantName
+	}
+
+	queryBody, err := r.buildElasticQuery(ctx, query, newSegmentRefs(tenant.GetID()))
+	if err != nil {
+		return 0, err
+	}
+	if queryBody == nil {
+		return 0, nil
+	}
+
+	return r.countProfiles(ctx, tenantName, queryBody)
+}
+
+// profilePageSize is the number of profile IDs read per request when counting profiles.
+const profilePageSize = 10_000
+
+// countProfiles counts the profiles of the uds matching queryBody exactly, by paging through their profile IDs.
+// Uds not linked to any profile are profiles on their own.
+func (r *queryRepo) countProfiles(ctx context.Context, tenantName string, queryBody map[string]interface{}) (uint64, error) {
+	var count uint64
+
+	err := r.pageProfiles(ctx, tenantName, queryBody, nil, map[string]interface{}{
+		"unlinked": map[string]interface{}{
+			"missing": map[string]interface{}{"field": entity.UdProfileIDField},
+		},
+	}, func(aggsResp map[string]interface{}, buckets []interface{}) {
+		count += r.getDocCount(aggsResp["unlinked"]) + uint64(len(buckets))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// pageProfiles pages through the profile IDs of the uds matching queryBody with a composite aggregation,
+// and calls onPage with the response and the profile buckets of each page. profileAggs are sub aggregations
+// of each profile bucket, aggs are run along with the first page only.
+func (r *queryRepo) pageProfiles(ctx context.Context, tenantName string, queryBody, profileAggs, aggs map[string]interface{},
+	onPage func(aggsResp map[string]interface{}, buckets []interface{})) error {
+	var after map[string]interface{}
+	for {
+		composite := map[string]interface{}{
+			"size": profilePageSize,
+			"sources": []map[string]interface{}{
+				{
+					entity.UdProfileIDField: map[string]interface{}{
+						"terms": map[string]interface{}{"field": entity.UdProfileIDField},
+					},
+				},
+			},
+		}
+		if after != nil {
+			composite["after"] = after
+		}
+
+		profilesAgg := map[string]interface{}{"composite": composite}
+		if profileAggs != nil {
+			profilesAgg["aggs"] = profileAggs
+		}
+
+		pageAggs := map[string]interface{}{"profiles": profilesAgg}
+		if after == nil {
+			for name, agg := range aggs {
+				pageAggs[name] = agg
+			}
+		}
+
+		aggsResp, err := r.aggregate(ctx, tenantName, queryBody, pageAggs)
+		if err != nil {
+			return err
+		}
+
+		profiles, _ := aggsResp["profiles"].(map[string]interface{})
+		buckets, _ := profiles["buckets"].([]interface{})
+		onPage(aggsResp, buckets)
+
+		afterKey, ok := profiles["after_key"].(map[string]interface{})
+		if !ok || len(buckets) < profilePageSize {
+			return nil
+		}
+		after = afterKey
+	}
+}
+
+func (r *queryRepo) CountQueries(ctx context.Context, tenant *entity.Tenant, queries []*entity.Query) ([]uint64, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return nil, errEmptyTenantName
+	}
+
+	if len(queries) == 0 {
+		return nil, nil
+	}
+
+	refs := newSegmentRefs(tenant.GetID())
+
+	// profiles are counted exactly, which takes a composite aggregation per query
+	counts := make([]uint64, 0, len(queries))
+	for _, query := range queries {
+		clause, err := r.buildElasticQuery(ctx, query, refs)
+		if err != nil {
+			return nil, err
+		}
+
+		var count uint64
+		if clause != nil {
+			if count, err = r.countProfiles(ctx, tenantName, clause); err != nil {
+				return nil, err
+			}
+		}
+		counts = append(counts, count)
+	}
+
+	return counts, nil
+}
+
+// MaxOverlapSegments limits the segments compared by GetSegmentOverlaps, as the combinations grow exponentially.
+const MaxOverlapSegments = 4
+
+func (r *queryRepo) GetSegmentOverlaps(ctx context.Context, tenant *entity.Tenant, segments []*entity.Segment) ([]*entity.SegmentOverlap, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return nil, errEmptyTenantName
+	}
+
+	if len(segments) > MaxOverlapSegments {
+		return nil, fmt.Errorf("at most %d segments can be compared", MaxOverlapSegments)
+	}
+
+	clauses := make([]map[string]interface{}, 0, len(segments))
+	for _, segment := range segments {
+		clause, err := r.buildElasticQuery(ctx, segment.GetCriteria(), newSegmentRefs(tenant.GetID()))
+		if err != nil {
+			return nil, err
+		}
+
+		// a segment with empty criteria has no uds
+		if clause == nil {
+			clause = map[string]interface{}{"match_none": map[string]interface{}{}}
+		}
+
+		clauses = append(clauses, clause)
+	}
+
+	// each combination is a bit mask over the segments, bit i is set if segments[i] is in the combination
+	masks := make([]int, 0, 1<<len(segments))
+	for mask := 1; mask < 1<<len(segments); mask++ {
+		masks = append(masks, mask)
+	}
+	sort.SliceStable(masks, func(i, j int) bool {
+		return bits.OnesCount(uint(masks[i])) < bits.OnesCount(uint(masks[j]))
+	})
+
+	// each profile is in the segments any of its uds is in
+	segmentAggs := make(map[string]interface{}, len(clauses))
+	for i, clause := range clauses {
+		segmentAggs[fmt.Sprintf("segment_%d", i)] = map[string]interface{}{"filter": clause}
+	}
+
+	// an unlinked ud is a profile on its own, so it is counted by the combination of segments it is in
+	exclusiveFilters := make(map[string]interface{}, len(masks))
+	for _, mask := range masks {
+		var must, mustNot []map[string]interface{}
+		for i, clause := range clauses {
+			if mask&(1<<i) != 0 {
+				must = append(must, clause)
+			} else {
+				mustNot = append(mustNot, clause)
+			}
+		}
+
+		exclusiveFilters[fmt.Sprintf("exclusive_%d", mask)] = map[string]interface{}{
+			"bool": map[string]interface{}{"filter": must, "must_not": mustNot},
+		}
+	}
+
+	// only uds in any of the segments are aggregated
+	union := map[string]interface{}{
+		"bool": map[string]interface{}{"should": clauses, "minimum_should_match": 1},
+	}
+
+	// exclusive counts the profiles by the combination of segments they are in
+	exclusive := make(map[int]uint64, len(masks))
+	err := r.pageProfiles(ctx, tenantName, union, segmentAggs, map[string]interface{}{
+		"unlinked": map[string]interface{}{
+			"missing": map[string]interface{}{"field": entity.UdProfileIDField},
+			"aggs": map[string]interface{}{
+				"overlaps": map[string]interface{}{
+					"filters": map[string]interface{}{"filters": exclusiveFilters},
+				},
+			},
+		},
+	}, func(aggsResp map[string]interface{}, buckets []interface{}) {
+		for _, b := range buckets {
+			bucket, _ := b.(map[string]interface{})
+
+			var mask int
+			for i := range clauses {
+				if r.getDocCount(bucket[fmt.Sprintf("segment_%d", i)]) > 0 {
+					mask |= 1 << i
+				}
+			}
+			exclusive[mask]++
+		}
+
+		if unlinked, ok := aggsResp["unlinked"].(map[string]interface{}); ok {
+			var buckets map[string]interface{}
+			if aggr, ok := unlinked["overlaps"].(map[string]interface{}); ok {
+				buckets, _ = aggr["buckets"].(map[string]interface{})
+			}
+
+			for _, mask := range masks {
+				exclusive[mask] += r.getDocCount(buckets[fmt.Sprintf("exclusive_%d", mask)])
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	overlaps := make([]*entity.SegmentOverlap, 0, len(masks))
+	for _, mask := range masks {
+		segmentIDs := make([]uint64, 0, len(segments))
+		for i, segment := range segments {
+			if mask&(1<<i) != 0 {
+				segmentIDs = append(segmentIDs, segment.GetID())
+			}
+		}
+
+		// the profiles in all segments of the combination are those exactly in it or in any combination containing it
+		var intersection uint64
+		for m, count := range exclusive {
+			if m&mask == mask {
+				intersection += count
+			}
+		}
+
+		overlaps = append(overlaps, &entity.SegmentOverlap{
+			SegmentIDs:   segmentIDs,
+			Intersection: goutil.Uint64(intersection),
+			Exclusive:    goutil.Uint64(exclusive[mask]),
+		})
+	}
+
+	return overlaps, nil
+}
+
+func (r *queryRepo) extractElasticError(resp map[string]interface{}) error {
+	if errorResp, ok := resp["error"]; ok {
+		if m, ok := errorResp.(map[string]interface{}); ok {
+			var status int
+			if s, ok := m["status"].(int); ok {
+				status = s
+			}
+
+			var errType string
+			if s, ok := m["type"].(string); ok {
+				errType = s
+			}
+
+			var reason string
+			if s, ok := m["reason"].(string); ok {
+				reason = s
+			}
+			return fmt.Errorf("elasticsearch error: status=%d, type=%s, reason=%s", status, errType, reason)
+		}
+	}
+	return nil
+}
+
+func getTagField(tagID uint64) string {
+	return fmt.Sprintf("tag_%d", tagID)
+}
+
+// parseTagField returns the tag ID of a tag value field, other fields of the tag, e.g. the history, are not matched.
+func parseTagField(field string) (uint64, bool) {
+	if !strings.HasPrefix(field, "tag_") {
+		return 0, false
+	}
+
+	tagID, err := strconv.ParseUint(strings.TrimPrefix(field, "tag_"), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return tagID, true
+}
+
+func getTagHistoryField(tagID uint64) string {
+	return fmt.Sprintf("tag_%d_history", tagID)
+}
+
+func getTagChangedAtField(tagID uint64) string {
+	return fmt.Sprintf("tag_%d_changed_at", tagID)
+}
+
+func (r *queryRepo) getTagFieldMapping(tag *entity.Tag) (map[string]interface{}, error) {
+	switch tag.GetValueType() {
+	case entity.TagValueTypeInt:
+		return map[string]interface{}{"type": "long"}, nil
+	case entity.TagValueTypeFloat:
+		return map[string]interface{}{"type": "double"}, nil
+	case entity.TagValueTypeStr, entity.TagValueTypeStrList:
+		// ES has no array type, any field can hold multiple values
+		return map[string]interface{}{"type": "keyword"}, nil
+	case entity.TagValueTypeBool:
+		return map[string]interface{}{"type": "boolean"}, nil
+	case entity.TagValueTypeTimestamp:
+		// timestamps are indexed as unix seconds, but lookups may also use dates
+		return map[string]interface{}{
+			"type":   "date",
+			"format": "epoch_second||strict_date_optional_time||yyyy-MM-dd HH:mm:ss",
+		}, nil
+	default:
+		return nil, entity.ErrInvalidTagValueType
+	}
+}
+
+func (r *queryRepo) buildLookupClause(field string, lookup *entity.Lookup) map[string]interface{} {
+	switch lookup.Op {
+	case entity.LookupOpEq:
+		return map[string]interface{}{"term": map[string]interface{}{field: lookup.Val}}
+	case entity.LookupOpGt:
+		return map[string]interface{}{"range": map[string]interface{}{field: map[string]interface{}{"gt": lookup.Val}}}
+	case entity.LookupOpLt:
+		return map[string]interface{}{"range": map[string]interface{}{field: map[string]interface{}{"lt": lookup.Val}}}
+	case entity.LookupOpGte:
+		return map[string]interface{}{"range": map[string]interface{}{field: map[string]interface{}{"gte": lookup.Val}}}
+	case entity.LookupOpLte:
+		return map[string]interface{}{"range": map[string]interface{}{field: map[string]interface{}{"lte": lookup.Val}}}
+	case entity.LookupOpIn, entity.LookupOpContainsAny:
+		return map[string]interface{}{"terms": map[string]interface{}{field: lookup.Val}}
+	case entity.LookupOpNotIn:
+		return map[string]interface{}{"bool": map[string]interface{}{
+			"must":     map[string]interface{}{"exists": map[string]interface{}{"field": field}},
+			"must_not": map[string]interface{}{"terms": map[string]interface{}{field: lookup.Val}},
+		}}
+	case entity.LookupOpBetween:
+		vals, _ := lookup.Val.([]interface{})
+		if len(vals) != 2 {
+			return nil
+		}
+		return map[string]interface{}{"range": map[string]interface{}{field: map[string]interface{}{"gte": vals[0], "lte": vals[1]}}}
+	case entity.LookupOpExists:
+		return map[string]interface{}{"exists": map[string]interface{}{"field": field}}
+	case entity.LookupOpMissing:
+		return map[string]interface{}{"bool": map[string]interface{}{
+			"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": field}},
+		}}
+	case entity.LookupOpPrefix:
+		return map[string]interface{}{"prefix": map[string]interface{}{field: lookup.Val}}
+	case entity.LookupOpContains:
+		return map[string]interface{}{"wildcard": map[string]interface{}{field: map[string]interface{}{
+			"value": "*" + wildcardReplacer.Replace(fmt.Sprint(lookup.Val)) + "*",
+		}}}
+	default:
+		return nil
+	}
+}
+
+// wildcardReplacer escapes the wildcard characters in a value matched literally.
+var wildcardReplacer = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`)
+
+func (r *queryRepo) buildIDTypeClause(idType entity.IDType) map[string]interface{} {
+	clause := map[string]interface{}{"term": map[string]interface{}{entity.UdIDTypeField: idType}}
+
+	// docs indexed before the ID type field was added are all emails
+	if idType == entity.IDTypeEmail {
+		clause = map[string]interface{}{"bool": map[string]interface{}{
+			"should": []map[string]interface{}{
+				clause,
+				{"bool": map[string]interface{}{"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": entity.UdIDTypeField}}}},
+			},
+			"minimum_should_match": 1,
+		}}
+	}
+
+	return clause
+}
+
+// splitScript matches the docs in a split, it must hash the same way as entity.SplitPoint.
+// The split key is stored in the doc at index time, docs indexed before it was added fall in no split.
+const splitScript = `if (doc[params.field].size() == 0) {
+	return false;
+}
+int h = doc[params.field].value.hashCode() ^ params.seed;
+h ^= h >>> 16;
+h *= -2048144789;
+h ^= h >>> 13;
+h *= -1028477387;
+h ^= h >>> 16;
+long point = (h & 0xffffffffL) % params.scale;
+return point >= params.from && point < params.to;`
+
+// MaxSegmentRefDepth is the max number of segments expanded into each other along a chain of references.
+const MaxSegmentRefDepth = 5
+
+// segmentRefs holds the segments referenced while building a query, so that each segment is fetched once.
+type segmentRefs struct {
+	tenantID uint64
+	segments map[uint64]*entity.Segment
+	path     []uint64 // segments being expanded, to detect cycles
+}
+
+func newSegmentRefs(tenantID uint64) *segmentRefs {
+	return &segmentRefs{
+		tenantID: tenantID,
+		segments: make(map[uint64]*entity.Segment),
+	}
+}
+
+// fetch gets the segments referenced by the query which are not fetched yet.
+func (refs *segmentRefs) fetch(ctx context.Context, segmentRepo SegmentRepo, query *entity.Query) error {
+	segmentIDs := make([]uint64, 0)
+	for _, segmentID := range query.GetSegmentIDs() {
+		if _, ok := refs.segments[segmentID]; !ok {
+			segmentIDs = append(segmentIDs, segmentID)
+		}
+	}
+
+	if len(segmentIDs) == 0 {
+		return nil
+	}
+
+	segments, err := segmentRepo.GetManyByIDs(ctx, refs.tenantID, segmentIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		refs.segments[segment.GetID()] = segment
+	}
+
+	return nil
+}
+
+// enter marks the segment as being expanded, it fails if the segment references itself or the references are too deep.
+// Call leave once the criteria of the segment is expanded.
+func (refs *segmentRefs) enter(segmentID uint64) error {
+	for _, id := range refs.path {
+		if id == segmentID {
+			return fmt.Errorf("segment %d references itself", segmentID)
+		}
+	}
+
+	if len(refs.path) >= MaxSegmentRefDepth {
+		return fmt.Errorf("segment references exceed max depth (%d)", MaxSegmentRefDepth)
+	}
+
+	refs.path = append(refs.path, segmentID)
+
+	return nil
+}
+
+func (refs *segmentRefs) leave() {
+	refs.path = refs.path[:len(refs.path)-1]
+}
+
+func (r *queryRepo) buildSegmentRefClause(ctx context.Context, segmentID uint64, refs *segmentRefs) (map[string]interface{}, error) {
+	segment, ok := refs.segments[segmentID]
+	if !ok {
+		return nil, ErrSegmentNotFound
+	}
+
+	// the uds of a static segment are marked in their docs, there is no criteria to expand
+	if segment.IsStatic() {
+		return map[string]interface{}{"term": map[string]interface{}{entity.UdSegmentIDsField: entity.StaticSegmentKey(segmentID)}}, nil
+	}
+
+	if err := refs.enter(segmentID); err != nil {
+		return nil, err
+	}
+	defer refs.leave()
+
+	clause, err := r.buildElasticQuery(ctx, segment.GetCriteria(), refs)
+	if err != nil {
+		return nil, err
+	}
+
+	// a segment with empty criteria has no uds
+	if clause == nil {
+		clause = map[string]interface{}{"match_none": map[string]interface{}{}}
+	}
+
+	return clause, nil
+}
+
+func (r *queryRepo) buildElasticQuery(ctx context.Context, query *entity.Query, refs *segmentRefs) (map[string]interface{}, error) {
 	var queries []map[string]interface{}
 
+	if err := refs.fetch(ctx, r.segmentRepo, query); err != nil {
+		return nil, err
+	}
+
 	for _, lookup := range query.Lookups {
-		field := r.getTagField(lookup.GetTagID())
-		var clause map[string]interface{}
-
-		switch lookup.Op {
-		case entity.LookupOpEq:
-			clause = map[string]interface{}{"term": map[string]interface{}{field: lookup.Val}}
-		case entity.LookupOpGt:
-			clause = map[string]interface{}{"range": map[string]interface{}{field: map[string]interface{}{"gt": lookup.Val}}}
-		case entity.LookupOpLt:
-			clause = map[string]interface{}{"range": map[string]interface{}{field: map[string]interface{}{"lt": lookup.Val}}}
-		case entity.LookupOpGte:
-			clause = map[string]interface{}{"range": map[string]interface{}{field: map[string]interface{}{"gte": lookup.Val}}}
-		case entity.LookupOpLte:
-			clause = map[string]interface{}{"range": map[string]interface{}{field: map[string]interface{}{"lte": lookup.Val}}}
-		case entity.LookupOpIn:
-			clause = map[string]interface{}{"terms": map[string]interface{}{field: lookup.Val}}
+		var (
+			tagID  = lookup.GetTagID()
+			clause map[string]interface{}
+		)
+
+		switch {
+		case lookup.IsSegmentRef():
+			var err error
+			if clause, err = r.buildSegmentRefClause(ctx, lookup.GetSegmentID(), refs); err != nil {
+				return nil, err
+			}
+		case lookup.IsSplit():
+			split := lookup.Split
+			clause = map[string]interface{}{"script": map[string]interface{}{
+				"script": map[string]interface{}{
+					"source": splitScript,
+					"params": map[string]interface{}{
+						// passed as an int, the script mixes it in Java int arithmetic
+						"field": entity.UdSplitKeyField,
+						"seed":  int32(split.GetSeed()),
+						"scale": entity.SplitScale,
+						"from":  split.GetFrom(),
+						"to":    split.GetTo(),
+					},
+				},
+			}}
+		case lookup.Op == entity.LookupOpChangedWithin:
+			clause = map[string]interface{}{"range": map[string]interface{}{
+				getTagChangedAtField(tagID): map[string]interface{}{"gte": fmt.Sprintf("now-%vd", lookup.Val)},
+			}}
+		case lookup.AsOf != nil:
+			// match the history entry valid at AsOf, i.e. from <= AsOf < to
+			var (
+				historyField = getTagHistoryField(tagID)
+				asOf         = lookup.GetAsOf()
+			)
+			clause = map[string]interface{}{"nested": map[string]interface{}{
+				"path": historyField,
+				"query": map[string]interface{}{"bool": map[string]interface{}{
+					"must": []map[string]interface{}{
+						r.buildLookupClause(historyField+".val", lookup),
+						{"range": map[string]interface{}{historyField + ".from": map[string]interface{}{"lte": asOf}}},
+						{"bool": map[string]interface{}{
+							"should": []map[string]interface{}{
+								{"range": map[string]interface{}{historyField + ".to": map[string]interface{}{"gt": asOf}}},
+								{"bool": map[string]interface{}{"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": historyField + ".to"}}}},
+							},
+							"minimum_should_match": 1,
+						}},
+					},
+				}},
+			}}
+		default:
+			clause = r.buildLookupClause(getTagField(tagID), lookup)
 		}
 
 		if lookup.Not != nil && lookup.GetNot() {
@@ -481,9 +2122,16 @@ func (r *queryRepo) buildElasticQuery(query *entity.Query) map[string]interface{
 		queries = append(queries, clause)
 	}
 
+	if query.IDType != entity.IDTypeUnknown {
+		queries = append(queries, r.buildIDTypeClause(query.GetIDType()))
+	}
+
 	// Process Sub-Queries
 	for _, subQuery := range query.Queries {
-		subClause := r.buildElasticQuery(subQuery)
+		subClause, err := r.buildElasticQuery(ctx, subQuery, refs)
+		if err != nil {
+			return nil, err
+		}
 		if subClause != nil {
 			queries = append(queries, subClause)
 		}
@@ -491,7 +2139,7 @@ func (r *queryRepo) buildElasticQuery(query *entity.Query) map[string]interface{
 
 	// Combine Queries
 	if len(queries) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	var result map[string]interface{}
@@ -505,7 +2153,7 @@ func (r *queryRepo) buildElasticQuery(query *entity.Query) map[string]interface{
 		result = map[string]interface{}{"bool": map[string]interface{}{"must_not": result}}
 	}
 
-	return result
+	return result, nil
 }
 
 func (r *queryRepo) Close(ctx context.Context) error {
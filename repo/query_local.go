@@ -0,0 +1,1485 @@
+package repo
+
+import (
+	"cdp/config"
+	"cdp/entity"
+	"cdp/pkg/goutil"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"math"
+	"math/bits"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errStoreNotFound = errors.New("store not found")
+
+// localStoreExt is the extension of the files the local stores are persisted into.
+const localStoreExt = ".json"
+
+// localQueryRepo keeps the tenant stores in memory and evaluates queries by scanning the docs of a store,
+// so it only suits the small stores of local development. Docs have the same source as in Elasticsearch.
+type localQueryRepo struct {
+	mu          sync.RWMutex
+	stores      map[string]*localStore
+	dir         string
+	segmentRepo SegmentRepo // to expand segment references in queries
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+// localStore holds the source of each doc by doc ID. A source is never modified once stored, an upsert
+// replaces it with a new one, so that it can be read without holding the lock.
+type localStore struct {
+	docs  map[string]map[string]interface{}
+	dirty bool // changed since it was last persisted
+}
+
+// localHit is a doc matched by a query, hits are returned in the order of their keys.
+type localHit struct {
+	key    string
+	id     string
+	source map[string]interface{}
+}
+
+// docMatcher tells if a doc matches a query.
+type docMatcher func(docID string, source map[string]interface{}) bool
+
+func matchAll(string, map[string]interface{}) bool {
+	return true
+}
+
+func matchNone(string, map[string]interface{}) bool {
+	return false
+}
+
+func newLocalQueryRepo(ctx context.Context, cfg config.LocalQueryDB, baseRepo BaseRepo) (QueryRepo, error) {
+	r := &localQueryRepo{
+		stores:      make(map[string]*localStore),
+		dir:         cfg.Dir,
+		segmentRepo: NewSegmentRepo(ctx, baseRepo),
+		done:        make(chan struct{}),
+	}
+
+	if r.dir == "" {
+		return r, nil
+	}
+
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	r.wg.Add(1)
+	go r.flushLoop(ctx)
+
+	return r, nil
+}
+
+func (r *localQueryRepo) storePath(tenantName string) string {
+	return filepath.Join(r.dir, url.PathEscape(tenantName)+localStoreExt)
+}
+
+// load reads the stores persisted in dir.
+func (r *localQueryRepo) load() error {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), localStoreExt) {
+			continue
+		}
+
+		tenantName, err := url.PathUnescape(strings.TrimSuffix(entry.Name(), localStoreExt))
+		if err != nil {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(r.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		docs := make(map[string]map[string]interface{})
+		if err := json.Unmarshal(b, &docs); err != nil {
+			return fmt.Errorf("invalid store file %s: %w", entry.Name(), err)
+		}
+
+		r.stores[tenantName] = &localStore{docs: docs}
+	}
+
+	return nil
+}
+
+func (r *localQueryRepo) flushLoop(ctx context.Context) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(defaultFlushIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			if err := r.flush(); err != nil {
+				log.Ctx(ctx).Error().Msgf("flush local stores failed: %v", err)
+			}
+		}
+	}
+}
+
+// flush persists the stores changed since they were last persisted.
+func (r *localQueryRepo) flush() error {
+	r.mu.Lock()
+	data := make(map[string][]byte)
+	for tenantName, store := range r.stores {
+		if !store.dirty {
+			continue
+		}
+
+		b, err := json.Marshal(store.docs)
+		if err != nil {
+			r.mu.Unlock()
+			return err
+		}
+
+		data[tenantName] = b
+		store.dirty = false
+	}
+	r.mu.Unlock()
+
+	var firstErr error
+	for tenantName, b := range data {
+		if err := r.writeStore(tenantName, b); err != nil {
+			// try again on the next flush
+			r.mu.Lock()
+			r.stores[tenantName].dirty = true
+			r.mu.Unlock()
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// writeStore replaces the store file through a rename, so that a crash never leaves a partial file behind.
+func (r *localQueryRepo) writeStore(tenantName string, b []byte) error {
+	path := r.storePath(tenantName)
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func (r *localQueryRepo) CreateStore(_ context.Context, tenantName string) error {
+	if tenantName == "" {
+		return errEmptyTenantName
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.stores[tenantName]; ok {
+		return fmt.Errorf("store %s already exists", tenantName)
+	}
+
+	r.stores[tenantName] = &localStore{
+		docs:  make(map[string]map[string]interface{}),
+		dirty: true,
+	}
+
+	return nil
+}
+
+// PutTagMapping only checks the store exists, values are compared by their own types rather than a mapping.
+func (r *localQueryRepo) PutTagMapping(_ context.Context, tenantName string, _ *entity.Tag) error {
+	if tenantName == "" {
+		return errEmptyTenantName
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.stores[tenantName]; !ok {
+		return errStoreNotFound
+	}
+
+	return nil
+}
+
+// BatchUpsert writes the docs right away, the store is created on the first write like an Elasticsearch index.
+func (r *localQueryRepo) BatchUpsert(ctx context.Context, tenantName string, udTagVals []*entity.UdTagVal, onUpsert chan UpsertResult) error {
+	if tenantName == "" {
+		return errEmptyTenantName
+	}
+
+	r.mu.Lock()
+
+	store, ok := r.stores[tenantName]
+	if !ok {
+		store = &localStore{docs: make(map[string]map[string]interface{})}
+		r.stores[tenantName] = store
+	}
+
+	now := float64(time.Now().Unix())
+
+	uds := make([]*entity.Ud, 0, len(udTagVals))
+	for _, udTagVal := range udTagVals {
+		if udTagVal == nil {
+			log.Ctx(ctx).Warn().Msg("nil udTagVal found in batch upsert")
+			continue
+		}
+
+		ud := udTagVal.GetUd()
+		docID := ud.ToDocID()
+
+		if docID == "" {
+			log.Ctx(ctx).Warn().Msg("empty doc ID found in batch upsert")
+			continue
+		}
+
+		data, err := udTagVal.ToDoc()
+		if err != nil {
+			r.mu.Unlock()
+			log.Ctx(ctx).Error().Msgf("fail to convert udTagVal to doc: %v", err)
+			return err
+		}
+
+		// decoded from JSON, so that values have the same types as the ones loaded from disk
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &doc); err != nil {
+			r.mu.Unlock()
+			return err
+		}
+
+		store.docs[docID] = r.upsertSource(store.docs[docID], doc, udTagVal, now)
+		store.dirty = true
+
+		uds = append(uds, ud)
+	}
+
+	r.mu.Unlock()
+
+	if onUpsert != nil {
+		for _, ud := range uds {
+			select {
+			case onUpsert <- UpsertResult{
+				Ud:    ud,
+				Error: nil,
+			}:
+			default:
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *localQueryRepo) Upsert(ctx context.Context, tenantName string, udTagVals []*entity.UdTagVal) ([]error, error) {
+	// writes to the local store are visible right away
+	if err := r.BatchUpsert(ctx, tenantName, udTagVals, nil); err != nil {
+		return nil, err
+	}
+
+	return make([]error, len(udTagVals)), nil
+}
+
+func (r *localQueryRepo) LinkProfiles(ctx context.Context, tenantName string, uds []*entity.Ud, onUpsert chan UpsertResult) error {
+	if tenantName == "" {
+		return errEmptyTenantName
+	}
+
+	r.mu.Lock()
+
+	if store, ok := r.stores[tenantName]; ok {
+		for _, ud := range uds {
+			docID := ud.ToDocID()
+			if docID == "" || ud.ProfileID == nil {
+				log.Ctx(ctx).Warn().Msgf("ud without doc ID or profile ID found in link profiles, docID: %v", docID)
+				continue
+			}
+
+			old, ok := store.docs[docID]
+			if !ok {
+				continue
+			}
+
+			source := make(map[string]interface{}, len(old)+2)
+			for k, v := range old {
+				source[k] = v
+			}
+			source[entity.UdProfileIDField] = float64(ud.GetProfileID())
+			source[entity.UdSplitKeyField] = ud.ToSplitKey()
+
+			store.docs[docID] = source
+			store.dirty = true
+		}
+	}
+
+	r.mu.Unlock()
+
+	if onUpsert != nil {
+		for _, ud := range uds {
+			select {
+			case onUpsert <- UpsertResult{
+				Ud:    ud,
+				Error: nil,
+			}:
+			default:
+			}
+		}
+	}
+
+	return nil
+}
+
+// upsertSource merges doc into a copy of the old source. Like scriptedUpsertScript, a changed value of a tag
+// keeping history closes the previous history entry and appends a new one, and static segments are added to the old ones.
+func (r *localQueryRepo) upsertSource(old, doc map[string]interface{}, udTagVal *entity.UdTagVal, now float64) map[string]interface{} {
+	source := make(map[string]interface{}, len(old)+len(doc))
+	for k, v := range old {
+		source[k] = v
+	}
+
+	for _, tagVal := range udTagVal.TagVals {
+		if !tagVal.KeepHistory {
+			continue
+		}
+
+		field := getTagField(tagVal.GetTagID())
+		if v, ok := source[field]; ok && v != nil && reflect.DeepEqual(v, doc[field]) {
+			continue
+		}
+
+		historyField := getTagHistoryField(tagVal.GetTagID())
+		oldEntries, _ := source[historyField].([]interface{})
+
+		entries := make([]interface{}, 0, len(oldEntries)+1)
+		entries = append(entries, oldEntries...)
+		if n := len(entries); n > 0 {
+			if last, ok := entries[n-1].(map[string]interface{}); ok {
+				closed := make(map[string]interface{}, len(last)+1)
+				for k, v := range last {
+					closed[k] = v
+				}
+				closed["to"] = now
+				entries[n-1] = closed
+			}
+		}
+		entries = append(entries, map[string]interface{}{
+			"val":     doc[field],
+			"from":    now,
+			"task_id": float64(tagVal.GetTaskID()),
+		})
+		if len(entries) > MaxTagHistory {
+			entries = entries[len(entries)-MaxTagHistory:]
+		}
+
+		source[historyField] = entries
+		source[getTagChangedAtField(tagVal.GetTagID())] = now
+	}
+
+	if keys := udTagVal.GetSegmentKeys(); len(keys) > 0 {
+		oldKeys, _ := source[entity.UdSegmentIDsField].([]interface{})
+
+		segmentKeys := make([]interface{}, 0, len(oldKeys)+len(keys))
+		segmentKeys = append(segmentKeys, oldKeys...)
+		for _, key := range keys {
+			found := false
+			for _, k := range segmentKeys {
+				if k == key {
+					found = true
+					break
+				}
+			}
+			if !found {
+				segmentKeys = append(segmentKeys, key)
+			}
+		}
+
+		source[entity.UdSegmentIDsField] = segmentKeys
+	}
+
+	for k, v := range doc {
+		source[k] = v
+	}
+
+	return source
+}
+
+// getSource returns the source of the doc of a ud, or ErrUdNotFound.
+func (r *localQueryRepo) getSource(tenantName string, ud *entity.Ud) (map[string]interface{}, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	store, ok := r.stores[tenantName]
+	if !ok {
+		return nil, ErrUdNotFound
+	}
+
+	source, ok := store.docs[ud.ToDocID()]
+	if !ok {
+		return nil, ErrUdNotFound
+	}
+
+	return source, nil
+}
+
+func (r *localQueryRepo) GetTagValHistory(_ context.Context, tenantName string, ud *entity.Ud, tagID uint64) ([]*entity.TagValHistory, error) {
+	if tenantName == "" {
+		return nil, errEmptyTenantName
+	}
+
+	source, err := r.getSource(tenantName, ud)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, _ := source[getTagHistoryField(tagID)].([]interface{})
+
+	return toTagValHistory(entries), nil
+}
+
+func (r *localQueryRepo) StartTagHistory(_ context.Context, tenantName string, tagID uint64) error {
+	if tenantName == "" {
+		return errEmptyTenantName
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	store, ok := r.stores[tenantName]
+	if !ok {
+		return errStoreNotFound
+	}
+
+	var (
+		field        = getTagField(tagID)
+		historyField = getTagHistoryField(tagID)
+	)
+	for docID, old := range store.docs {
+		if v, ok := old[field]; !ok || v == nil {
+			continue
+		}
+		if _, ok := old[historyField]; ok {
+			continue
+		}
+
+		source := make(map[string]interface{}, len(old)+1)
+		for k, v := range old {
+			source[k] = v
+		}
+		source[historyField] = []interface{}{
+			map[string]interface{}{"val": old[field], "from": float64(0), "task_id": float64(0)},
+		}
+
+		store.docs[docID] = source
+		store.dirty = true
+	}
+
+	return nil
+}
+
+func (r *localQueryRepo) GetUdTagVals(_ context.Context, tenantName string, ud *entity.Ud) (*entity.UdTagVal, error) {
+	if tenantName == "" {
+		return nil, errEmptyTenantName
+	}
+
+	source, err := r.getSource(tenantName, ud)
+	if err != nil {
+		return nil, err
+	}
+
+	return toUdTagVal(ud, source), nil
+}
+
+func (r *localQueryRepo) DeleteUds(_ context.Context, tenantName string, uds []*entity.Ud) (uint64, error) {
+	if tenantName == "" {
+		return 0, errEmptyTenantName
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	store, ok := r.stores[tenantName]
+	if !ok {
+		return 0, nil
+	}
+
+	var deleted uint64
+	for _, ud := range uds {
+		docID := ud.ToDocID()
+		if _, ok := store.docs[docID]; ok {
+			delete(store.docs, docID)
+			deleted++
+		}
+	}
+
+	if deleted > 0 {
+		store.dirty = true
+	}
+
+	return deleted, nil
+}
+
+// search returns the docs matched in the order of their IDs, which are also the keys of the hits.
+func (r *localQueryRepo) search(tenantName string, match docMatcher) ([]*localHit, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	store, ok := r.stores[tenantName]
+	if !ok {
+		return nil, errStoreNotFound
+	}
+
+	hits := make([]*localHit, 0)
+	for id, source := range store.docs {
+		if match(id, source) {
+			hits = append(hits, &localHit{key: id, id: id, source: source})
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		return hits[i].key < hits[j].key
+	})
+
+	return hits, nil
+}
+
+// pageHits returns the hits after the cursor, the cursor of a page is the key of its last hit.
+// Unlike a scroll, a page sees the changes made since the previous page.
+func (r *localQueryRepo) pageHits(hits []*localHit, page *Pagination) ([]*localHit, *Pagination) {
+	start := 0
+	if cursor := page.GetCursor(); cursor != "" {
+		start = sort.Search(len(hits), func(i int) bool {
+			return hits[i].key > cursor
+		})
+	}
+
+	end := len(hits)
+	if limit := int(page.GetLimit()); limit > 0 && start+limit < end {
+		end = start + limit
+	}
+
+	newPage := &Pagination{
+		Limit:  page.Limit,
+		Cursor: goutil.String(""),
+	}
+	if end < len(hits) {
+		newPage.Cursor = goutil.String(hits[end-1].key)
+	}
+
+	return hits[start:end], newPage
+}
+
+// toDocs turns the hits into docs in the format of search hits.
+func (r *localQueryRepo) toDocs(hits []*localHit) []map[string]interface{} {
+	docs := make([]map[string]interface{}, 0, len(hits))
+	for _, hit := range hits {
+		docs = append(docs, map[string]interface{}{
+			"_id":     hit.id,
+			"_source": hit.source,
+		})
+	}
+	return docs
+}
+
+func (r *localQueryRepo) Download(ctx context.Context, tenant *entity.Tenant, query *entity.Query, page *Pagination) ([]*entity.Ud, *Pagination, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return nil, nil, errEmptyTenantName
+	}
+
+	match, err := r.compileQuery(ctx, query, newSegmentRefs(tenant.GetID()))
+	if err != nil {
+		return nil, nil, err
+	}
+	if match == nil {
+		return nil, nil, nil
+	}
+
+	hits, err := r.search(tenantName, match)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hits, newPage := r.pageHits(hits, page)
+
+	uds := make([]*entity.Ud, 0, len(hits))
+	for _, hit := range hits {
+		ud, err := entity.ToUd(hit.id)
+		if err != nil {
+			return nil, nil, err
+		}
+		uds = append(uds, ud)
+	}
+
+	return uds, newPage, nil
+}
+
+// DownloadProfiles returns the first ud of each profile in the order of profileSort, unlinked uds come last.
+func (r *localQueryRepo) DownloadProfiles(ctx context.Context, tenant *entity.Tenant, query *entity.Query, page *Pagination) ([]*entity.Ud, *Pagination, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return nil, nil, errEmptyTenantName
+	}
+
+	match, err := r.compileQuery(ctx, query, newSegmentRefs(tenant.GetID()))
+	if err != nil {
+		return nil, nil, err
+	}
+	if match == nil {
+		return nil, nil, nil
+	}
+
+	hits, err := r.search(tenantName, match)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// hits are keyed by profile, so that the cursor stays valid while uds of earlier profiles change
+	byKey := make(map[string]*localHit)
+	for _, hit := range hits {
+		key := "1" + hit.id
+		if v, ok := hit.source[entity.UdProfileIDField].(float64); ok {
+			key = fmt.Sprintf("0%020d", uint64(v))
+		}
+
+		if first, ok := byKey[key]; ok && r.idTypeOrder(hit.source) >= r.idTypeOrder(first.source) {
+			continue
+		}
+		byKey[key] = &localHit{key: key, id: hit.id, source: hit.source}
+	}
+
+	profiles := make([]*localHit, 0, len(byKey))
+	for _, hit := range byKey {
+		profiles = append(profiles, hit)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].key < profiles[j].key
+	})
+
+	profiles, newPage := r.pageHits(profiles, page)
+
+	uds := make([]*entity.Ud, 0, len(profiles))
+	for _, hit := range profiles {
+		ud, err := entity.ToUd(hit.id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if v, ok := hit.source[entity.UdProfileIDField].(float64); ok {
+			ud.ProfileID = goutil.Uint64(uint64(v))
+		}
+		uds = append(uds, ud)
+	}
+
+	return uds, newPage, nil
+}
+
+// idTypeOrder orders uds of a profile like profileSort, docs without an ID type come first.
+func (r *localQueryRepo) idTypeOrder(source map[string]interface{}) float64 {
+	if v, ok := source[entity.UdIDTypeField].(float64); ok {
+		return v
+	}
+	return -1
+}
+
+// DownloadTagVals is similar to Download, but also returns the values of tagIDs of each ud.
+// A nil query matches all uds.
+func (r *localQueryRepo) DownloadTagVals(ctx context.Context, tenant *entity.Tenant, query *entity.Query, tagIDs []uint64, page *Pagination) ([]*entity.UdTagVal, *Pagination, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return nil, nil, errEmptyTenantName
+	}
+
+	match := docMatcher(matchAll)
+	if query != nil {
+		var err error
+		if match, err = r.compileQuery(ctx, query, newSegmentRefs(tenant.GetID())); err != nil {
+			return nil, nil, err
+		}
+		if match == nil {
+			return nil, nil, nil
+		}
+	}
+
+	hits, err := r.search(tenantName, match)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hits, newPage := r.pageHits(hits, page)
+
+	udTagVals, err := toUdTagVals(r.toDocs(hits), tagIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return udTagVals, newPage, nil
+}
+
+func (r *localQueryRepo) SampleTagVals(ctx context.Context, tenant *entity.Tenant, query *entity.Query, tagIDs []uint64, size uint32) ([]*entity.UdTagVal, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return nil, errEmptyTenantName
+	}
+
+	match, err := r.compileQuery(ctx, query, newSegmentRefs(tenant.GetID()))
+	if err != nil {
+		return nil, err
+	}
+	if match == nil {
+		return nil, nil
+	}
+
+	hits, err := r.search(tenantName, match)
+	if err != nil {
+		return nil, err
+	}
+
+	rand.Shuffle(len(hits), func(i, j int) {
+		hits[i], hits[j] = hits[j], hits[i]
+	})
+	if uint32(len(hits)) > size {
+		hits = hits[:size]
+	}
+
+	return toUdTagVals(r.toDocs(hits), tagIDs)
+}
+
+// countValues counts the docs having each value of the field, by the value formatted as a string.
+func (r *localQueryRepo) countValues(hits []*localHit, field string) map[string]uint64 {
+	counts := make(map[string]uint64)
+	for _, hit := range hits {
+		seen := make(map[string]bool)
+		for _, v := range fieldValues(hit.source[field]) {
+			key := formatValue(v)
+			if !seen[key] {
+				seen[key] = true
+				counts[key]++
+			}
+		}
+	}
+	return counts
+}
+
+// topValues returns up to size values of counts, by count then value, like a terms aggregation.
+func (r *localQueryRepo) topValues(counts map[string]uint64, size int) []string {
+	values := make([]string, 0, len(counts))
+	for v := range counts {
+		values = append(values, v)
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		if counts[values[i]] != counts[values[j]] {
+			return counts[values[i]] > counts[values[j]]
+		}
+		return values[i] < values[j]
+	})
+
+	if len(values) > size {
+		values = values[:size]
+	}
+
+	return values
+}
+
+// defaultDistinctTagValues is the number of values GetDistinctTagValues returns, the default size of a terms aggregation.
+const defaultDistinctTagValues = 10
+
+// GetDistinctTagValues is not cached, as the values are counted in memory.
+func (r *localQueryRepo) GetDistinctTagValues(_ context.Context, tenantName string, tag *entity.Tag) ([]string, error) {
+	if tenantName == "" {
+		return nil, errEmptyTenantName
+	}
+
+	hits, err := r.search(tenantName, matchAll)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := r.countValues(hits, getTagField(tag.GetID()))
+
+	return r.topValues(counts, defaultDistinctTagValues), nil
+}
+
+func (r *localQueryRepo) InvalidateTagCache(_ context.Context, _, _ uint64) {}
+
+func (r *localQueryRepo) FlushCache(_ context.Context, _ uint64) {}
+
+func (r *localQueryRepo) GetTagStats(_ context.Context, tenantName string, tag *entity.Tag, opt *TagStatsOption) (*entity.TagStats, error) {
+	if tenantName == "" {
+		return nil, errEmptyTenantName
+	}
+
+	hits, err := r.search(tenantName, matchAll)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		field     = getTagField(tag.GetID())
+		withValue = make([]*localHit, 0, len(hits))
+	)
+	for _, hit := range hits {
+		if len(fieldValues(hit.source[field])) > 0 {
+			withValue = append(withValue, hit)
+		}
+	}
+
+	stats := &entity.TagStats{
+		Count:   goutil.Uint64(uint64(len(withValue))),
+		Missing: goutil.Uint64(uint64(len(hits) - len(withValue))),
+	}
+
+	if !tag.IsNumeric() {
+		counts := r.countValues(withValue, field)
+
+		stats.Cardinality = goutil.Uint64(uint64(len(counts)))
+		stats.TopValues = make([]*entity.TagValueCount, 0)
+		for _, v := range r.topValues(counts, int(opt.TopN)) {
+			stats.TopValues = append(stats.TopValues, &entity.TagValueCount{
+				Value: goutil.String(v),
+				Count: goutil.Uint64(counts[v]),
+			})
+		}
+
+		return stats, nil
+	}
+
+	nums := make([]float64, 0, len(withValue))
+	for _, hit := range withValue {
+		for _, v := range fieldValues(hit.source[field]) {
+			if f, ok := toFloat(v); ok {
+				nums = append(nums, f)
+			}
+		}
+	}
+
+	// no min and max if no ud has the tag
+	if len(nums) == 0 {
+		return stats, nil
+	}
+
+	sort.Float64s(nums)
+
+	var sum float64
+	for _, f := range nums {
+		sum += f
+	}
+
+	minVal, maxVal := nums[0], nums[len(nums)-1]
+	stats.Min = goutil.Float64(minVal)
+	stats.Max = goutil.Float64(maxVal)
+	stats.Avg = goutil.Float64(sum / float64(len(nums)))
+
+	// keyed the same way as the percentiles aggregation, e.g. "50.0"
+	stats.Percentiles = make(map[string]float64, len(defaultPercents))
+	for _, p := range defaultPercents {
+		stats.Percentiles[strconv.FormatFloat(p, 'f', 1, 64)] = r.percentile(nums, p)
+	}
+
+	stats.Histogram = r.getHistogram(nums, minVal, maxVal, opt.HistogramBuckets)
+
+	return stats, nil
+}
+
+// percentile interpolates between the closest ranks of the sorted nums.
+func (r *localQueryRepo) percentile(nums []float64, p float64) float64 {
+	rank := p / 100 * float64(len(nums)-1)
+	lo, hi := int(math.Floor(rank)), int(math.Ceil(rank))
+	return nums[lo] + (nums[hi]-nums[lo])*(rank-float64(lo))
+}
+
+// getHistogram splits [min, max] into numBuckets buckets of equal width, max falls into the last bucket.
+func (r *localQueryRepo) getHistogram(nums []float64, minVal, maxVal float64, numBuckets uint32) []*entity.TagHistogramBucket {
+	if numBuckets == 0 {
+		return nil
+	}
+
+	interval := (maxVal - minVal) / float64(numBuckets)
+	if interval == 0 {
+		// all values are the same
+		interval, numBuckets = 1, 1
+	}
+
+	counts := make([]uint64, numBuckets)
+	for _, f := range nums {
+		i := uint32((f - minVal) / interval)
+		if i >= numBuckets {
+			i = numBuckets - 1
+		}
+		counts[i]++
+	}
+
+	histogram := make([]*entity.TagHistogramBucket, 0, numBuckets)
+	for i, count := range counts {
+		from := minVal + float64(i)*interval
+		histogram = append(histogram, &entity.TagHistogramBucket{
+			From:  goutil.Float64(from),
+			To:    goutil.Float64(from + interval),
+			Count: goutil.Uint64(count),
+		})
+	}
+
+	return histogram
+}
+
+func (r *localQueryRepo) Count(ctx context.Context, tenant *entity.Tenant, query *entity.Query) (uint64, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return 0, errEmptyTenantName
+	}
+
+	match, err := r.compileQuery(ctx, query, newSegmentRefs(tenant.GetID()))
+	if err != nil {
+		return 0, err
+	}
+	if match == nil {
+		return 0, nil
+	}
+
+	hits, err := r.search(tenantName, match)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(len(hits)), nil
+}
+
+func (r *localQueryRepo) CountProfiles(ctx context.Context, tenant *entity.Tenant, query *entity.Query) (uint64, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return 0, errEmptyTenantName
+	}
+
+	match, err := r.compileQuery(ctx, query, newSegmentRefs(tenant.GetID()))
+	if err != nil {
+		return 0, err
+	}
+	if match == nil {
+		return 0, nil
+	}
+
+	hits, err := r.search(tenantName, match)
+	if err != nil {
+		return 0, err
+	}
+
+	return r.countProfiles(hits), nil
+}
+
+// countProfiles counts the profiles of the hits, uds not linked to any profile are profiles on their own.
+func (r *localQueryRepo) countProfiles(hits []*localHit) uint64 {
+	var (
+		profiles = make(map[float64]bool)
+		unlinked uint64
+	)
+	for _, hit := range hits {
+		if v, ok := hit.source[entity.UdProfileIDField].(float64); ok {
+			profiles[v] = true
+		} else {
+			unlinked++
+		}
+	}
+	return uint64(len(profiles)) + unlinked
+}
+
+func (r *localQueryRepo) CountQueries(ctx context.Context, tenant *entity.Tenant, queries []*entity.Query) ([]uint64, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return nil, errEmptyTenantName
+	}
+
+	if len(queries) == 0 {
+		return nil, nil
+	}
+
+	refs := newSegmentRefs(tenant.GetID())
+
+	matchers := make([]docMatcher, 0, len(queries))
+	for _, query := range queries {
+		match, err := r.compileQuery(ctx, query, refs)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, match)
+	}
+
+	hits, err := r.search(tenantName, matchAll)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]uint64, 0, len(queries))
+	for _, match := range matchers {
+		// an empty query matches no uds, like in the Elasticsearch repo
+		if match == nil {
+			counts = append(counts, 0)
+			continue
+		}
+
+		matched := make([]*localHit, 0)
+		for _, hit := range hits {
+			if match(hit.id, hit.source) {
+				matched = append(matched, hit)
+			}
+		}
+		counts = append(counts, r.countProfiles(matched))
+	}
+
+	return counts, nil
+}
+
+func (r *localQueryRepo) GetSegmentOverlaps(ctx context.Context, tenant *entity.Tenant, segments []*entity.Segment) ([]*entity.SegmentOverlap, error) {
+	tenantName := tenant.GetName()
+	if tenantName == "" {
+		return nil, errEmptyTenantName
+	}
+
+	if len(segments) > MaxOverlapSegments {
+		return nil, fmt.Errorf("at most %d segments can be compared", MaxOverlapSegments)
+	}
+
+	matchers := make([]docMatcher, 0, len(segments))
+	for _, segment := range segments {
+		match, err := r.compileQuery(ctx, segment.GetCriteria(), newSegmentRefs(tenant.GetID()))
+		if err != nil {
+			return nil, err
+		}
+
+		// a segment with empty criteria has no uds
+		if match == nil {
+			match = matchNone
+		}
+
+		matchers = append(matchers, match)
+	}
+
+	hits, err := r.search(tenantName, matchAll)
+	if err != nil {
+		return nil, err
+	}
+
+	// the bit mask of the segments each profile is in, bit i is set if any ud of the profile is in segments[i],
+	// an unlinked ud is a profile on its own
+	var (
+		profileMasks  = make(map[float64]int)
+		unlinkedMasks = make([]int, 0)
+	)
+	for _, hit := range hits {
+		var docMask int
+		for i, match := range matchers {
+			if match(hit.id, hit.source) {
+				docMask |= 1 << i
+			}
+		}
+		if docMask == 0 {
+			continue
+		}
+
+		if v, ok := hit.source[entity.UdProfileIDField].(float64); ok {
+			profileMasks[v] |= docMask
+		} else {
+			unlinkedMasks = append(unlinkedMasks, docMask)
+		}
+	}
+
+	profiles := unlinkedMasks
+	for _, profileMask := range profileMasks {
+		profiles = append(profiles, profileMask)
+	}
+
+	masks := make([]int, 0, 1<<len(segments))
+	for mask := 1; mask < 1<<len(segments); mask++ {
+		masks = append(masks, mask)
+	}
+	sort.SliceStable(masks, func(i, j int) bool {
+		return bits.OnesCount(uint(masks[i])) < bits.OnesCount(uint(masks[j]))
+	})
+
+	overlaps := make([]*entity.SegmentOverlap, 0, len(masks))
+	for _, mask := range masks {
+		var intersection, exclusive uint64
+		for _, profileMask := range profiles {
+			if profileMask&mask == mask {
+				intersection++
+			}
+			if profileMask == mask {
+				exclusive++
+			}
+		}
+
+		segmentIDs := make([]uint64, 0, len(segments))
+		for i, segment := range segments {
+			if mask&(1<<i) != 0 {
+				segmentIDs = append(segmentIDs, segment.GetID())
+			}
+		}
+
+		overlaps = append(overlaps, &entity.SegmentOverlap{
+			SegmentIDs:   segmentIDs,
+			Intersection: goutil.Uint64(intersection),
+			Exclusive:    goutil.Uint64(exclusive),
+		})
+	}
+
+	return overlaps, nil
+}
+
+func (r *localQueryRepo) compileSegmentRef(ctx context.Context, segmentID uint64, refs *segmentRefs) (docMatcher, error) {
+	segment, ok := refs.segments[segmentID]
+	if !ok {
+		return nil, ErrSegmentNotFound
+	}
+
+	// the uds of a static segment are marked in their docs, there is no criteria to expand
+	if segment.IsStatic() {
+		key := entity.StaticSegmentKey(segmentID)
+		return func(_ string, source map[string]interface{}) bool {
+			keys, _ := source[entity.UdSegmentIDsField].([]interface{})
+			for _, k := range keys {
+				if k == key {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	if err := refs.enter(segmentID); err != nil {
+		return nil, err
+	}
+	defer refs.leave()
+
+	match, err := r.compileQuery(ctx, segment.GetCriteria(), refs)
+	if err != nil {
+		return nil, err
+	}
+
+	// a segment with empty criteria has no uds
+	if match == nil {
+		match = matchNone
+	}
+
+	return match, nil
+}
+
+// compileQuery turns the query into a docMatcher with the same semantics as buildElasticQuery,
+// a query without any clause compiles to nil.
+func (r *localQueryRepo) compileQuery(ctx context.Context, query *entity.Query, refs *segmentRefs) (docMatcher, error) {
+	var matchers []docMatcher
+
+	if err := refs.fetch(ctx, r.segmentRepo, query); err != nil {
+		return nil, err
+	}
+
+	for _, lookup := range query.Lookups {
+		var (
+			tagID = lookup.GetTagID()
+			match docMatcher
+		)
+
+		switch {
+		case lookup.IsSegmentRef():
+			var err error
+			if match, err = r.compileSegmentRef(ctx, lookup.GetSegmentID(), refs); err != nil {
+				return nil, err
+			}
+		case lookup.IsSplit():
+			split := lookup.Split
+			match = func(_ string, source map[string]interface{}) bool {
+				splitKey, ok := source[entity.UdSplitKeyField].(string)
+				return ok && split.Contains(splitKey)
+			}
+		case lookup.Op == entity.LookupOpChangedWithin:
+			var (
+				field   = getTagChangedAtField(tagID)
+				days, _ = toFloat(lookup.Val)
+				since   = float64(time.Now().Unix()) - days*24*60*60
+			)
+			match = func(_ string, source map[string]interface{}) bool {
+				changedAt, ok := source[field].(float64)
+				return ok && changedAt >= since
+			}
+		case lookup.AsOf != nil:
+			// match the history entry valid at AsOf, i.e. from <= AsOf < to
+			var (
+				historyField = getTagHistoryField(tagID)
+				asOf         = float64(lookup.GetAsOf())
+			)
+			match = func(_ string, source map[string]interface{}) bool {
+				entries, _ := source[historyField].([]interface{})
+				for _, e := range entries {
+					entry, ok := e.(map[string]interface{})
+					if !ok {
+						continue
+					}
+					if from, ok := entry["from"].(float64); !ok || from > asOf {
+						continue
+					}
+					if to, ok := entry["to"].(float64); ok && to <= asOf {
+						continue
+					}
+					if matchValues(lookup.Op, lookup.Val, fieldValues(entry["val"])) {
+						return true
+					}
+				}
+				return false
+			}
+		default:
+			field := getTagField(tagID)
+			match = func(_ string, source map[string]interface{}) bool {
+				return matchValues(lookup.Op, lookup.Val, fieldValues(source[field]))
+			}
+		}
+
+		if lookup.Not != nil && lookup.GetNot() {
+			m := match
+			match = func(docID string, source map[string]interface{}) bool {
+				return !m(docID, source)
+			}
+		}
+		matchers = append(matchers, match)
+	}
+
+	if query.IDType != entity.IDTypeUnknown {
+		idType := float64(query.GetIDType())
+		matchers = append(matchers, func(_ string, source map[string]interface{}) bool {
+			v, ok := source[entity.UdIDTypeField].(float64)
+			// docs indexed before the ID type field was added are all emails
+			if !ok {
+				return idType == float64(entity.IDTypeEmail)
+			}
+			return v == idType
+		})
+	}
+
+	for _, subQuery := range query.Queries {
+		match, err := r.compileQuery(ctx, subQuery, refs)
+		if err != nil {
+			return nil, err
+		}
+		if match != nil {
+			matchers = append(matchers, match)
+		}
+	}
+
+	if len(matchers) == 0 {
+		return nil, nil
+	}
+
+	var (
+		isOr = query.Op == entity.QueryOpOr
+		not  = query.Not != nil && query.GetNot()
+	)
+	return func(docID string, source map[string]interface{}) bool {
+		// an OR matches on the first match, an AND fails on the first mismatch
+		matched := !isOr
+		for _, match := range matchers {
+			if match(docID, source) == isOr {
+				matched = isOr
+				break
+			}
+		}
+		return matched != not
+	}, nil
+}
+
+// matchValues tells if the values of a field match the lookup op and val. Like a multi-valued
+// Elasticsearch field, the field matches if any of its values matches.
+func matchValues(op entity.LookupOp, val interface{}, values []interface{}) bool {
+	switch op {
+	case entity.LookupOpExists:
+		return len(values) > 0
+	case entity.LookupOpMissing:
+		return len(values) == 0
+	case entity.LookupOpNotIn:
+		return len(values) > 0 && !matchValues(entity.LookupOpIn, val, values)
+	}
+
+	for _, v := range values {
+		if matchValue(op, val, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchValue(op entity.LookupOp, val, v interface{}) bool {
+	switch op {
+	case entity.LookupOpEq:
+		c, ok := compareValues(v, val)
+		return ok && c == 0
+	case entity.LookupOpGt:
+		c, ok := compareValues(v, val)
+		return ok && c > 0
+	case entity.LookupOpLt:
+		c, ok := compareValues(v, val)
+		return ok && c < 0
+	case entity.LookupOpGte:
+		c, ok := compareValues(v, val)
+		return ok && c >= 0
+	case entity.LookupOpLte:
+		c, ok := compareValues(v, val)
+		return ok && c <= 0
+	case entity.LookupOpIn, entity.LookupOpContainsAny:
+		vals, _ := val.([]interface{})
+		for _, item := range vals {
+			if c, ok := compareValues(v, item); ok && c == 0 {
+				return true
+			}
+		}
+		return false
+	case entity.LookupOpBetween:
+		vals, _ := val.([]interface{})
+		if len(vals) != 2 {
+			return false
+		}
+		from, ok := compareValues(v, vals[0])
+		if !ok {
+			return false
+		}
+		to, ok := compareValues(v, vals[1])
+		return ok && from >= 0 && to <= 0
+	case entity.LookupOpPrefix:
+		s, ok := v.(string)
+		return ok && strings.HasPrefix(s, formatValue(val))
+	case entity.LookupOpContains:
+		s, ok := v.(string)
+		return ok && strings.Contains(s, formatValue(val))
+	default:
+		return false
+	}
+}
+
+// fieldValues returns the values of a field, which may hold an array of values, or none if it is missing.
+func fieldValues(v interface{}) []interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		values := make([]interface{}, 0, len(val))
+		for _, item := range val {
+			if item != nil {
+				values = append(values, item)
+			}
+		}
+		return values
+	default:
+		return []interface{}{val}
+	}
+}
+
+// compareValues compares a stored value to a lookup value, which is converted to the type of the stored value
+// the way Elasticsearch converts query values to the field type. It fails if the lookup value cannot be converted.
+func compareValues(v, val interface{}) (int, bool) {
+	switch x := v.(type) {
+	case float64:
+		y, ok := toFloat(val)
+		if !ok {
+			return 0, false
+		}
+		return cmp.Compare(x, y), true
+	case string:
+		return strings.Compare(x, formatValue(val)), true
+	case bool:
+		y, ok := toBool(val)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x == y:
+			return 0, true
+		case y:
+			return -1, true
+		default:
+			return 1, true
+		}
+	default:
+		return 0, false
+	}
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case int:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case uint64:
+		return float64(val), true
+	case string:
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return f, true
+		}
+		// lookups on timestamps may use dates
+		if ts, err := entity.ParseTimestamp(val); err == nil {
+			return float64(ts), true
+		}
+	}
+	return 0, false
+}
+
+func toBool(v interface{}) (bool, bool) {
+	switch val := v.(type) {
+	case bool:
+		return val, true
+	case string:
+		if b, err := strconv.ParseBool(val); err == nil {
+			return b, true
+		}
+	}
+	return false, false
+}
+
+// formatValue formats a value the way it is matched against keyword fields, numbers never in exponent form.
+func formatValue(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// Close persists the stores changed since the last flush.
+func (r *localQueryRepo) Close(_ context.Context) error {
+	if r.dir == "" {
+		return nil
+	}
+
+	close(r.done)
+	r.wg.Wait()
+
+	return r.flush()
+}
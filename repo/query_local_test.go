@@ -0,0 +1,459 @@
+package repo
+
+import (
+	"cdp/entity"
+	"cdp/pkg/goutil"
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const (
+	testTagAge       = 1
+	testTagCountry   = 2
+	testTagInterests = 3
+	testTagVIP       = 4
+	testTagName      = 5
+)
+
+// stubSegmentRepo serves the segments referenced by queries from memory, the other methods are not used by query repos.
+type stubSegmentRepo struct {
+	SegmentRepo
+	segments map[uint64]*entity.Segment
+}
+
+func (r *stubSegmentRepo) GetManyByIDs(_ context.Context, tenantID uint64, segmentIDs []uint64) ([]*entity.Segment, error) {
+	segments := make([]*entity.Segment, 0, len(segmentIDs))
+	for _, segmentID := range segmentIDs {
+		if segment, ok := r.segments[segmentID]; ok && segment.GetTenantID() == tenantID {
+			segments = append(segments, segment)
+		}
+	}
+	return segments, nil
+}
+
+var testQueryTenant = &entity.Tenant{ID: goutil.Uint64(1), Name: goutil.String("test")}
+
+// testSegments are the segments referenced by the test queries:
+//   - 10 is dynamic, the uds in SG
+//   - 11 is dynamic and references 10, the uds in SG aged 30 or more
+//   - 12 references itself
+//   - 13 has empty criteria
+//   - 20 is static, alice and carol were added to it
+var testSegments = map[uint64]*entity.Segment{
+	10: {
+		ID:          goutil.Uint64(10),
+		TenantID:    goutil.Uint64(1),
+		SegmentType: entity.SegmentTypeDynamic,
+		Criteria:    andQuery(tagLookup(testTagCountry, entity.LookupOpEq, "SG")),
+	},
+	11: {
+		ID:          goutil.Uint64(11),
+		TenantID:    goutil.Uint64(1),
+		SegmentType: entity.SegmentTypeDynamic,
+		Criteria:    andQuery(segmentLookup(10), tagLookup(testTagAge, entity.LookupOpGte, float64(30))),
+	},
+	12: {
+		ID:          goutil.Uint64(12),
+		TenantID:    goutil.Uint64(1),
+		SegmentType: entity.SegmentTypeDynamic,
+		Criteria:    andQuery(segmentLookup(12)),
+	},
+	13: {
+		ID:          goutil.Uint64(13),
+		TenantID:    goutil.Uint64(1),
+		SegmentType: entity.SegmentTypeDynamic,
+		Criteria:    &entity.Query{},
+	},
+	20: {
+		ID:          goutil.Uint64(20),
+		TenantID:    goutil.Uint64(1),
+		SegmentType: entity.SegmentTypeStatic,
+	},
+}
+
+// testUdTagVals are the uds of the test store, in 4 profiles: alice and her phone are linked in profile 100,
+// carol is alone in profile 200, bob and dave are not linked.
+var testUdTagVals = []*entity.UdTagVal{
+	{
+		Ud: &entity.Ud{ID: goutil.String("alice@example.com"), IDType: entity.IDTypeEmail, ProfileID: goutil.Uint64(100)},
+		TagVals: []*entity.TagVal{
+			{TagID: goutil.Uint64(testTagAge), TagVal: 30},
+			{TagID: goutil.Uint64(testTagCountry), TagVal: "SG"},
+			{TagID: goutil.Uint64(testTagInterests), TagVal: []string{"sports", "music"}},
+			{TagID: goutil.Uint64(testTagVIP), TagVal: true},
+			{TagID: goutil.Uint64(testTagName), TagVal: "Alice Tan"},
+		},
+		SegmentIDs: []uint64{20},
+	},
+	{
+		Ud: &entity.Ud{ID: goutil.String("+6591234567"), IDType: entity.IDTypePhone, ProfileID: goutil.Uint64(100)},
+		TagVals: []*entity.TagVal{
+			{TagID: goutil.Uint64(testTagAge), TagVal: 31},
+			{TagID: goutil.Uint64(testTagCountry), TagVal: "SG"},
+		},
+	},
+	{
+		Ud: &entity.Ud{ID: goutil.String("bob@example.com"), IDType: entity.IDTypeEmail},
+		TagVals: []*entity.TagVal{
+			{TagID: goutil.Uint64(testTagAge), TagVal: 45},
+			{TagID: goutil.Uint64(testTagCountry), TagVal: "MY"},
+			{TagID: goutil.Uint64(testTagInterests), TagVal: []string{"music"}},
+			{TagID: goutil.Uint64(testTagVIP), TagVal: false},
+			{TagID: goutil.Uint64(testTagName), TagVal: "Bob Lim"},
+		},
+	},
+	{
+		Ud: &entity.Ud{ID: goutil.String("carol@example.com"), IDType: entity.IDTypeEmail, ProfileID: goutil.Uint64(200)},
+		TagVals: []*entity.TagVal{
+			{TagID: goutil.Uint64(testTagAge), TagVal: 18},
+			{TagID: goutil.Uint64(testTagCountry), TagVal: "ID"},
+			{TagID: goutil.Uint64(testTagName), TagVal: "Carol Tan"},
+		},
+		SegmentIDs: []uint64{20},
+	},
+	{
+		Ud: &entity.Ud{ID: goutil.String("dave@example.com"), IDType: entity.IDTypeEmail},
+		TagVals: []*entity.TagVal{
+			{TagID: goutil.Uint64(testTagCountry), TagVal: "SG"},
+		},
+	},
+}
+
+const (
+	alice = "alice@example.com:1"
+	phone = "+6591234567:2"
+	bob   = "bob@example.com:1"
+	carol = "carol@example.com:1"
+	dave  = "dave@example.com:1"
+)
+
+func tagLookup(tagID uint64, op entity.LookupOp, val interface{}) *entity.Lookup {
+	return &entity.Lookup{TagID: goutil.Uint64(tagID), Op: op, Val: val}
+}
+
+func segmentLookup(segmentID uint64) *entity.Lookup {
+	return &entity.Lookup{SegmentID: goutil.Uint64(segmentID)}
+}
+
+func splitLookup(seed, from, to uint32) *entity.Lookup {
+	return &entity.Lookup{Split: &entity.Split{Seed: goutil.Uint32(seed), From: goutil.Uint32(from), To: goutil.Uint32(to)}}
+}
+
+func notLookup(lookup *entity.Lookup) *entity.Lookup {
+	lookup.Not = goutil.Bool(true)
+	return lookup
+}
+
+func andQuery(lookups ...*entity.Lookup) *entity.Query {
+	return &entity.Query{Op: entity.QueryOpAnd, Lookups: lookups}
+}
+
+func orQuery(lookups ...*entity.Lookup) *entity.Query {
+	return &entity.Query{Op: entity.QueryOpOr, Lookups: lookups}
+}
+
+// queryRepoTests are shared by the QueryRepo implementations, see testQueryRepo, so that they evaluate queries
+// over testUdTagVals the same way. wantDocIDs are sorted, wantProfiles counts the profiles of the uds.
+var queryRepoTests = []struct {
+	name         string
+	query        *entity.Query
+	wantDocIDs   []string
+	wantProfiles uint64
+	wantErr      bool
+	errIs        error // the error expected, if any specific one
+}{
+	{name: "empty query", query: &entity.Query{}, wantDocIDs: nil, wantProfiles: 0},
+
+	// lookup ops
+	{name: "eq number", query: andQuery(tagLookup(testTagAge, entity.LookupOpEq, float64(30))), wantDocIDs: []string{alice}, wantProfiles: 1},
+	{name: "eq string", query: andQuery(tagLookup(testTagCountry, entity.LookupOpEq, "SG")), wantDocIDs: []string{phone, alice, dave}, wantProfiles: 2},
+	{name: "eq bool", query: andQuery(tagLookup(testTagVIP, entity.LookupOpEq, true)), wantDocIDs: []string{alice}, wantProfiles: 1},
+	{name: "eq array element", query: andQuery(tagLookup(testTagInterests, entity.LookupOpEq, "music")), wantDocIDs: []string{alice, bob}, wantProfiles: 2},
+	{name: "gt", query: andQuery(tagLookup(testTagAge, entity.LookupOpGt, float64(30))), wantDocIDs: []string{phone, bob}, wantProfiles: 2},
+	{name: "lt", query: andQuery(tagLookup(testTagAge, entity.LookupOpLt, float64(30))), wantDocIDs: []string{carol}, wantProfiles: 1},
+	{name: "gte", query: andQuery(tagLookup(testTagAge, entity.LookupOpGte, float64(30))), wantDocIDs: []string{phone, alice, bob}, wantProfiles: 2},
+	{name: "lte", query: andQuery(tagLookup(testTagAge, entity.LookupOpLte, float64(30))), wantDocIDs: []string{alice, carol}, wantProfiles: 2},
+	{name: "in", query: andQuery(tagLookup(testTagCountry, entity.LookupOpIn, []interface{}{"SG", "ID"})), wantDocIDs: []string{phone, alice, carol, dave}, wantProfiles: 3},
+	{name: "not in", query: andQuery(tagLookup(testTagCountry, entity.LookupOpNotIn, []interface{}{"SG"})), wantDocIDs: []string{bob, carol}, wantProfiles: 2},
+	{name: "between", query: andQuery(tagLookup(testTagAge, entity.LookupOpBetween, []interface{}{float64(18), float64(30)})), wantDocIDs: []string{alice, carol}, wantProfiles: 2},
+	{name: "exists", query: andQuery(tagLookup(testTagInterests, entity.LookupOpExists, nil)), wantDocIDs: []string{alice, bob}, wantProfiles: 2},
+	{name: "missing", query: andQuery(tagLookup(testTagAge, entity.LookupOpMissing, nil)), wantDocIDs: []string{dave}, wantProfiles: 1},
+	{name: "prefix", query: andQuery(tagLookup(testTagName, entity.LookupOpPrefix, "Bob")), wantDocIDs: []string{bob}, wantProfiles: 1},
+	{name: "contains", query: andQuery(tagLookup(testTagName, entity.LookupOpContains, "Tan")), wantDocIDs: []string{alice, carol}, wantProfiles: 2},
+	{name: "contains any", query: andQuery(tagLookup(testTagInterests, entity.LookupOpContainsAny, []interface{}{"sports", "reading"})), wantDocIDs: []string{alice}, wantProfiles: 1},
+
+	// negation, nesting and ID types
+	{name: "not lookup", query: andQuery(notLookup(tagLookup(testTagCountry, entity.LookupOpEq, "SG"))), wantDocIDs: []string{bob, carol}, wantProfiles: 2},
+	{
+		name:         "or",
+		query:        orQuery(tagLookup(testTagAge, entity.LookupOpGt, float64(40)), tagLookup(testTagCountry, entity.LookupOpEq, "ID")),
+		wantDocIDs:   []string{bob, carol},
+		wantProfiles: 2,
+	},
+	{
+		name: "not or",
+		query: &entity.Query{
+			Op:      entity.QueryOpOr,
+			Not:     goutil.Bool(true),
+			Lookups: []*entity.Lookup{tagLookup(testTagAge, entity.LookupOpGt, float64(40)), tagLookup(testTagCountry, entity.LookupOpEq, "ID")},
+		},
+		wantDocIDs:   []string{phone, alice, dave},
+		wantProfiles: 2,
+	},
+	{
+		name: "nested",
+		query: &entity.Query{
+			Op:      entity.QueryOpAnd,
+			Lookups: []*entity.Lookup{tagLookup(testTagName, entity.LookupOpContains, "Tan")},
+			Queries: []*entity.Query{orQuery(tagLookup(testTagVIP, entity.LookupOpEq, true), tagLookup(testTagAge, entity.LookupOpLt, float64(20)))},
+		},
+		wantDocIDs:   []string{alice, carol},
+		wantProfiles: 2,
+	},
+	{name: "id type", query: &entity.Query{Op: entity.QueryOpAnd, IDType: entity.IDTypePhone}, wantDocIDs: []string{phone}, wantProfiles: 1},
+	{
+		name:         "id type and lookup",
+		query:        &entity.Query{Op: entity.QueryOpAnd, IDType: entity.IDTypeEmail, Lookups: []*entity.Lookup{tagLookup(testTagCountry, entity.LookupOpEq, "SG")}},
+		wantDocIDs:   []string{alice, dave},
+		wantProfiles: 2,
+	},
+
+	// segment refs
+	{name: "dynamic segment", query: andQuery(segmentLookup(10)), wantDocIDs: []string{phone, alice, dave}, wantProfiles: 2},
+	{name: "nested segment refs", query: andQuery(segmentLookup(11)), wantDocIDs: []string{phone, alice}, wantProfiles: 1},
+	{name: "static segment", query: andQuery(segmentLookup(20)), wantDocIDs: []string{alice, carol}, wantProfiles: 2},
+	{name: "not static segment", query: andQuery(notLookup(segmentLookup(20))), wantDocIDs: []string{phone, bob, dave}, wantProfiles: 3},
+	{name: "segments combined", query: andQuery(segmentLookup(10), segmentLookup(20)), wantDocIDs: []string{alice}, wantProfiles: 1},
+	{name: "segment with empty criteria", query: andQuery(segmentLookup(13)), wantDocIDs: nil, wantProfiles: 0},
+	{name: "unknown segment", query: andQuery(segmentLookup(99)), wantErr: true, errIs: ErrSegmentNotFound},
+	{name: "segment referencing itself", query: andQuery(segmentLookup(12)), wantErr: true},
+
+	// splits, see TestLocalQueryRepoSplits for partial ones
+	{name: "whole split", query: andQuery(splitLookup(42, 0, entity.SplitScale)), wantDocIDs: []string{phone, alice, bob, carol, dave}, wantProfiles: 4},
+	{name: "empty split", query: andQuery(splitLookup(42, 0, 0)), wantDocIDs: nil, wantProfiles: 0},
+}
+
+func newTestLocalQueryRepo(t *testing.T) *localQueryRepo {
+	t.Helper()
+
+	r := &localQueryRepo{
+		stores:      make(map[string]*localStore),
+		segmentRepo: &stubSegmentRepo{segments: testSegments},
+		done:        make(chan struct{}),
+	}
+
+	ctx := context.Background()
+	if err := r.CreateStore(ctx, testQueryTenant.GetName()); err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	if _, err := r.Upsert(ctx, testQueryTenant.GetName(), testUdTagVals); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+
+	return r
+}
+
+// testQueryRepo runs queryRepoTests against the repo, which holds testUdTagVals for testQueryTenant.
+func testQueryRepo(t *testing.T, r QueryRepo) {
+	ctx := context.Background()
+
+	for _, tt := range queryRepoTests {
+		t.Run(tt.name, func(t *testing.T) {
+			count, err := r.Count(ctx, testQueryTenant, tt.query)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Count() succeeded, want error")
+				}
+				if tt.errIs != nil && !errors.Is(err, tt.errIs) {
+					t.Fatalf("Count() failed with %v, want %v", err, tt.errIs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Count() failed: %v", err)
+			}
+			if count != uint64(len(tt.wantDocIDs)) {
+				t.Errorf("Count() = %d, want %d", count, len(tt.wantDocIDs))
+			}
+
+			uds, _, err := r.Download(ctx, testQueryTenant, tt.query, &Pagination{Limit: goutil.Uint32(100)})
+			if err != nil {
+				t.Fatalf("Download() failed: %v", err)
+			}
+			var docIDs []string
+			for _, ud := range uds {
+				docIDs = append(docIDs, ud.ToDocID())
+			}
+			sort.Strings(docIDs)
+			if !reflect.DeepEqual(docIDs, tt.wantDocIDs) {
+				t.Errorf("Download() = %v, want %v", docIDs, tt.wantDocIDs)
+			}
+
+			profiles, err := r.CountProfiles(ctx, testQueryTenant, tt.query)
+			if err != nil {
+				t.Fatalf("CountProfiles() failed: %v", err)
+			}
+			if profiles != tt.wantProfiles {
+				t.Errorf("CountProfiles() = %d, want %d", profiles, tt.wantProfiles)
+			}
+		})
+	}
+
+	t.Run("count queries", func(t *testing.T) {
+		var (
+			queries = make([]*entity.Query, 0, len(queryRepoTests))
+			want    = make([]uint64, 0, len(queryRepoTests))
+		)
+		for _, tt := range queryRepoTests {
+			if !tt.wantErr {
+				queries = append(queries, tt.query)
+				want = append(want, tt.wantProfiles)
+			}
+		}
+
+		counts, err := r.CountQueries(ctx, testQueryTenant, queries)
+		if err != nil {
+			t.Fatalf("CountQueries() failed: %v", err)
+		}
+		if !reflect.DeepEqual(counts, want) {
+			t.Errorf("CountQueries() = %v, want %v", counts, want)
+		}
+	})
+}
+
+func TestLocalQueryRepo(t *testing.T) {
+	testQueryRepo(t, newTestLocalQueryRepo(t))
+}
+
+func TestLocalQueryRepoSplits(t *testing.T) {
+	var (
+		ctx = context.Background()
+		r   = newTestLocalQueryRepo(t)
+	)
+
+	for _, seed := range []uint32{0, 1, 42, 0xdeadbeef} {
+		for _, at := range []uint32{1, entity.SplitScale / 3, entity.SplitScale / 2, entity.SplitScale - 1} {
+			var (
+				lower = andQuery(splitLookup(seed, 0, at))
+				upper = andQuery(splitLookup(seed, at, entity.SplitScale))
+			)
+
+			lowerUds, _, err := r.Download(ctx, testQueryTenant, lower, &Pagination{})
+			if err != nil {
+				t.Fatalf("Download() failed: %v", err)
+			}
+			upperUds, _, err := r.Download(ctx, testQueryTenant, upper, &Pagination{})
+			if err != nil {
+				t.Fatalf("Download() failed: %v", err)
+			}
+
+			// the splits partition the uds, by the split point of their split key
+			inLower := make(map[string]bool)
+			for _, ud := range lowerUds {
+				inLower[ud.ToDocID()] = true
+			}
+			for _, ud := range upperUds {
+				if inLower[ud.ToDocID()] {
+					t.Errorf("seed %d, at %d: %s is in both splits", seed, at, ud.ToDocID())
+				}
+			}
+			if n := len(lowerUds) + len(upperUds); n != len(testUdTagVals) {
+				t.Errorf("seed %d, at %d: splits hold %d uds, want %d", seed, at, n, len(testUdTagVals))
+			}
+
+			for _, udTagVal := range testUdTagVals {
+				ud := udTagVal.GetUd()
+				if want := entity.SplitPoint(ud.ToSplitKey(), seed) < at; inLower[ud.ToDocID()] != want {
+					t.Errorf("seed %d, at %d: %s in lower split = %v, want %v", seed, at, ud.ToDocID(), !want, want)
+				}
+			}
+
+			// the uds of a profile are not torn across splits
+			if inLower[alice] != inLower[phone] {
+				t.Errorf("seed %d, at %d: linked uds %s and %s are in different splits", seed, at, alice, phone)
+			}
+
+			lowerProfiles, err := r.CountProfiles(ctx, testQueryTenant, lower)
+			if err != nil {
+				t.Fatalf("CountProfiles() failed: %v", err)
+			}
+			upperProfiles, err := r.CountProfiles(ctx, testQueryTenant, upper)
+			if err != nil {
+				t.Fatalf("CountProfiles() failed: %v", err)
+			}
+			if n := lowerProfiles + upperProfiles; n != 4 {
+				t.Errorf("seed %d, at %d: splits hold %d profiles, want 4", seed, at, n)
+			}
+		}
+	}
+}
+
+func TestLocalQueryRepoSplitFollowsLink(t *testing.T) {
+	var (
+		ctx = context.Background()
+		r   = newTestLocalQueryRepo(t)
+	)
+
+	// link bob into the profile of alice, the split of bob then follows the profile
+	linked := &entity.Ud{ID: goutil.String("bob@example.com"), IDType: entity.IDTypeEmail, ProfileID: goutil.Uint64(100)}
+	if err := r.LinkProfiles(ctx, testQueryTenant.GetName(), []*entity.Ud{linked}, nil); err != nil {
+		t.Fatalf("LinkProfiles() failed: %v", err)
+	}
+
+	for _, seed := range []uint32{0, 1, 42, 0xdeadbeef} {
+		at := entity.SplitPoint(linked.ToSplitKey(), seed)
+		for _, query := range []*entity.Query{andQuery(splitLookup(seed, 0, at)), andQuery(splitLookup(seed, at, at+1))} {
+			uds, _, err := r.Download(ctx, testQueryTenant, query, &Pagination{})
+			if err != nil {
+				t.Fatalf("Download() failed: %v", err)
+			}
+
+			in := make(map[string]bool)
+			for _, ud := range uds {
+				in[ud.ToDocID()] = true
+			}
+			if in[alice] != in[bob] || in[alice] != in[phone] {
+				t.Errorf("seed %d: uds of profile 100 are in different splits: %v", seed, in)
+			}
+		}
+	}
+}
+
+func TestLocalQueryRepoSegmentOverlaps(t *testing.T) {
+	r := newTestLocalQueryRepo(t)
+
+	segments := []*entity.Segment{
+		{ID: goutil.Uint64(1), Criteria: andQuery(segmentLookup(10))},
+		{ID: goutil.Uint64(2), Criteria: andQuery(segmentLookup(20))},
+		{ID: goutil.Uint64(3), Criteria: andQuery(tagLookup(testTagAge, entity.LookupOpGt, float64(40)))},
+	}
+
+	overlaps, err := r.GetSegmentOverlaps(context.Background(), testQueryTenant, segments)
+	if err != nil {
+		t.Fatalf("GetSegmentOverlaps() failed: %v", err)
+	}
+
+	// profile 100 is in 1 by both its uds and in 2 by alice, it is counted once in each overlap
+	want := []*entity.SegmentOverlap{
+		{SegmentIDs: []uint64{1}, Intersection: goutil.Uint64(2), Exclusive: goutil.Uint64(1)},
+		{SegmentIDs: []uint64{2}, Intersection: goutil.Uint64(2), Exclusive: goutil.Uint64(1)},
+		{SegmentIDs: []uint64{3}, Intersection: goutil.Uint64(1), Exclusive: goutil.Uint64(1)},
+		{SegmentIDs: []uint64{1, 2}, Intersection: goutil.Uint64(1), Exclusive: goutil.Uint64(1)},
+		{SegmentIDs: []uint64{1, 3}, Intersection: goutil.Uint64(0), Exclusive: goutil.Uint64(0)},
+		{SegmentIDs: []uint64{2, 3}, Intersection: goutil.Uint64(0), Exclusive: goutil.Uint64(0)},
+		{SegmentIDs: []uint64{1, 2, 3}, Intersection: goutil.Uint64(0), Exclusive: goutil.Uint64(0)},
+	}
+
+	if len(overlaps) != len(want) {
+		t.Fatalf("GetSegmentOverlaps() returned %d overlaps, want %d", len(overlaps), len(want))
+	}
+	for i, overlap := range overlaps {
+		if !reflect.DeepEqual(overlap, want[i]) {
+			t.Errorf("overlap %v = %d/%d, want %v = %d/%d", overlap.SegmentIDs, overlap.GetIntersection(), overlap.GetExclusive(),
+				want[i].SegmentIDs, want[i].GetIntersection(), want[i].GetExclusive())
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package repo
+
+import (
+	"cdp/entity"
+	"cdp/pkg/goutil"
+	"context"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+	"unicode/utf16"
+)
+
+// javaHashCode is Java's String.hashCode, on the UTF-16 code units of s with int overflow.
+func javaHashCode(s string) int32 {
+	var h int32
+	for _, c := range utf16.Encode([]rune(s)) {
+		h = 31*h + int32(c)
+	}
+	return h
+}
+
+// painlessSplitPoint runs splitScript the way painless does, with Java int arithmetic. The multipliers
+// are read from the script, so that a change to the script which SplitPoint does not follow is caught.
+func painlessSplitPoint(t *testing.T, splitKey string, seed uint32) int64 {
+	t.Helper()
+
+	matches := regexp.MustCompile(`h \*= (-?\d+);`).FindAllStringSubmatch(splitScript, -1)
+	if len(matches) != 2 {
+		t.Fatalf("expected 2 multipliers in splitScript, got %d", len(matches))
+	}
+
+	multipliers := make([]int32, 0, len(matches))
+	for _, m := range matches {
+		v, err := strconv.ParseInt(m[1], 10, 32)
+		if err != nil {
+			t.Fatalf("parse multiplier %s: %v", m[1], err)
+		}
+		multipliers = append(multipliers, int32(v))
+	}
+
+	// the seed is passed to the script as a Java int, see buildElasticQuery
+	h := javaHashCode(splitKey) ^ int32(seed)
+	h ^= int32(uint32(h) >> 16)
+	h *= multipliers[0]
+	h ^= int32(uint32(h) >> 13)
+	h *= multipliers[1]
+	h ^= int32(uint32(h) >> 16)
+
+	return (int64(h) & 0xffffffff) % entity.SplitScale
+}
+
+func TestJavaHashCode(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int32
+	}{
+		{s: "", want: 0},
+		{s: "hello", want: 99162322},
+		{s: "Aa", want: 2112},
+		{s: "BB", want: 2112},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			if got := javaHashCode(tt.s); got != tt.want {
+				t.Errorf("javaHashCode(%q) = %d, want %d", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitScriptMatchesSplitPoint(t *testing.T) {
+	var (
+		linked   = &entity.Ud{ID: goutil.String("alice@example.com"), IDType: entity.IDTypeEmail, ProfileID: goutil.Uint64(4_294_967_311)}
+		unlinked = &entity.Ud{ID: goutil.String("+6591234567"), IDType: entity.IDTypePhone}
+	)
+
+	splitKeys := []string{
+		"",
+		"1",
+		linked.ToSplitKey(),
+		unlinked.ToSplitKey(),
+		"bob@example.com:1",
+		"zoë@exämple.com:1",
+		"😀@example.com:1",
+		"a-very-long-external-id-which-overflows-the-hash-many-times-over:3",
+	}
+	seeds := []uint32{0, 1, 42, 1 << 31, 0xdeadbeef, 0xffffffff}
+
+	for _, splitKey := range splitKeys {
+		for _, seed := range seeds {
+			t.Run(splitKey+"/"+strconv.FormatUint(uint64(seed), 10), func(t *testing.T) {
+				got := int64(entity.SplitPoint(splitKey, seed))
+				if want := painlessSplitPoint(t, splitKey, seed); got != want {
+					t.Errorf("SplitPoint(%q, %d) = %d, splitScript gives %d", splitKey, seed, got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestSplitKey(t *testing.T) {
+	tests := []struct {
+		name string
+		ud   *entity.Ud
+		want string
+	}{
+		{
+			name: "linked ud is keyed by its profile",
+			ud:   &entity.Ud{ID: goutil.String("alice@example.com"), IDType: entity.IDTypeEmail, ProfileID: goutil.Uint64(7)},
+			want: "7",
+		},
+		{
+			name: "unlinked ud is keyed by its doc id",
+			ud:   &entity.Ud{ID: goutil.String("alice@example.com"), IDType: entity.IDTypeEmail},
+			want: "alice@example.com:1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ud.ToSplitKey(); got != tt.want {
+				t.Errorf("ToSplitKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+type m = map[string]interface{}
+
+func TestBuildLookupClause(t *testing.T) {
+	tests := []struct {
+		name   string
+		lookup *entity.Lookup
+		want   map[string]interface{}
+	}{
+		{
+			name:   "between",
+			lookup: &entity.Lookup{Op: entity.LookupOpBetween, Val: []interface{}{float64(1), float64(5)}},
+			want:   m{"range": m{"tag_1": m{"gte": float64(1), "lte": float64(5)}}},
+		},
+		{
+			name:   "between with one bound",
+			lookup: &entity.Lookup{Op: entity.LookupOpBetween, Val: []interface{}{float64(1)}},
+			want:   nil,
+		},
+		{
+			name:   "between with no list",
+			lookup: &entity.Lookup{Op: entity.LookupOpBetween, Val: float64(1)},
+			want:   nil,
+		},
+		{
+			name:   "exists",
+			lookup: &entity.Lookup{Op: entity.LookupOpExists},
+			want:   m{"exists": m{"field": "tag_1"}},
+		},
+		{
+			name:   "missing",
+			lookup: &entity.Lookup{Op: entity.LookupOpMissing},
+			want:   m{"bool": m{"must_not": m{"exists": m{"field": "tag_1"}}}},
+		},
+		{
+			name:   "prefix",
+			lookup: &entity.Lookup{Op: entity.LookupOpPrefix, Val: "go"},
+			want:   m{"prefix": m{"tag_1": "go"}},
+		},
+		{
+			name:   "contains",
+			lookup: &entity.Lookup{Op: entity.LookupOpContains, Val: "old"},
+			want:   m{"wildcard": m{"tag_1": m{"value": "*old*"}}},
+		},
+		{
+			name:   "contains escapes wildcards",
+			lookup: &entity.Lookup{Op: entity.LookupOpContains, Val: `a*b?c\d`},
+			want:   m{"wildcard": m{"tag_1": m{"value": `*a\*b\?c\\d*`}}},
+		},
+		{
+			name:   "contains number",
+			lookup: &entity.Lookup{Op: entity.LookupOpContains, Val: float64(42)},
+			want:   m{"wildcard": m{"tag_1": m{"value": "*42*"}}},
+		},
+		{
+			name:   "not in",
+			lookup: &entity.Lookup{Op: entity.LookupOpNotIn, Val: []interface{}{"a", "b"}},
+			want: m{"bool": m{
+				"must":     m{"exists": m{"field": "tag_1"}},
+				"must_not": m{"terms": m{"tag_1": []interface{}{"a", "b"}}},
+			}},
+		},
+		{
+			name:   "contains any",
+			lookup: &entity.Lookup{Op: entity.LookupOpContainsAny, Val: []interface{}{"a", "b"}},
+			want:   m{"terms": m{"tag_1": []interface{}{"a", "b"}}},
+		},
+		{
+			name:   "unknown op",
+			lookup: &entity.Lookup{Op: "like", Val: "a"},
+			want:   nil,
+		},
+	}
+
+	r := new(queryRepo)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.buildLookupClause("tag_1", tt.lookup); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildLookupClause() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildElasticQueryNotLookup(t *testing.T) {
+	tests := []struct {
+		name   string
+		lookup *entity.Lookup
+		want   map[string]interface{}
+	}{
+		{
+			name:   "not prefix",
+			lookup: &entity.Lookup{TagID: goutil.Uint64(1), Op: entity.LookupOpPrefix, Val: "go", Not: goutil.Bool(true)},
+			want:   m{"bool": m{"must_not": m{"prefix": m{"tag_1": "go"}}}},
+		},
+		{
+			name:   "not missing",
+			lookup: &entity.Lookup{TagID: goutil.Uint64(1), Op: entity.LookupOpMissing, Not: goutil.Bool(true)},
+			want:   m{"bool": m{"must_not": m{"bool": m{"must_not": m{"exists": m{"field": "tag_1"}}}}}},
+		},
+		{
+			name:   "not false",
+			lookup: &entity.Lookup{TagID: goutil.Uint64(1), Op: entity.LookupOpExists, Not: goutil.Bool(false)},
+			want:   m{"exists": m{"field": "tag_1"}},
+		},
+	}
+
+	r := new(queryRepo)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := &entity.Query{Lookups: []*entity.Lookup{tt.lookup}}
+
+			got, err := r.buildElasticQuery(context.Background(), query, newSegmentRefs(1))
+			if err != nil {
+				t.Fatalf("buildElasticQuery() failed: %v", err)
+			}
+
+			want := m{"bool": m{"must": []map[string]interface{}{tt.want}}}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("buildElasticQuery() = %v, want %v", got, want)
+			}
+		})
+	}
+}
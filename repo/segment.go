@@ -12,7 +12,8 @@ import (
 )
 
 var (
-	ErrSegmentNotFound = errutil.NotFoundError(errors.New("segment not found"))
+	ErrSegmentNotFound        = errutil.NotFoundError(errors.New("segment not found"))
+	ErrSegmentVersionNotFound = errutil.NotFoundError(errors.New("segment version not found"))
 )
 
 type Segment struct {
@@ -20,7 +21,9 @@ type Segment struct {
 	Name        *string
 	SegmentDesc *string
 	Criteria    *string
+	SegmentType *uint32
 	Status      *uint32
+	Version     *uint32
 	CreatorID   *uint64
 	TenantID    *uint64
 	CreateTime  *uint64
@@ -45,6 +48,13 @@ func (m *Segment) GetCriteria() string {
 	return ""
 }
 
+func (m *Segment) GetSegmentType() uint32 {
+	if m != nil && m.SegmentType != nil {
+		return *m.SegmentType
+	}
+	return 0
+}
+
 func (m *Segment) GetStatus() uint32 {
 	if m != nil && m.Status != nil {
 		return *m.Status
@@ -52,12 +62,46 @@ func (m *Segment) GetStatus() uint32 {
 	return 0
 }
 
+type SegmentVersion struct {
+	ID           *uint64
+	SegmentID    *uint64
+	Version      *uint32
+	Criteria     *string
+	RestoredFrom *uint32
+	CreatorID    *uint64
+	TenantID     *uint64
+	CreateTime   *uint64
+}
+
+func (m *SegmentVersion) TableName() string {
+	return "segment_version_tab"
+}
+
+func (m *SegmentVersion) GetCriteria() string {
+	if m != nil && m.Criteria != nil {
+		return *m.Criteria
+	}
+	return ""
+}
+
 type SegmentRepo interface {
+	// Create creates the segment together with its first version.
 	Create(ctx context.Context, segment *entity.Segment) (uint64, error)
+	// Update updates the segment, and records the versions of its criteria if any.
+	Update(ctx context.Context, segment *entity.Segment, versions ...*entity.SegmentVersion) error
 	GetByID(ctx context.Context, tenantID, segmentID uint64) (*entity.Segment, error)
+	// LockByID gets the segment and locks its row until the transaction ends, so that it is not deleted
+	// while being referenced. It must be called in a transaction.
+	LockByID(ctx context.Context, tenantID, segmentID uint64) (*entity.Segment, error)
 	GetByName(ctx context.Context, tenantID uint64, name string) (*entity.Segment, error)
 	GetManyByKeyword(ctx context.Context, tenantID uint64, keyword string, p *Pagination) ([]*entity.Segment, *Pagination, error)
+	// GetManyByTenantID gets segments of a tenant, or of all tenants if tenantID is 0.
+	GetManyByTenantID(ctx context.Context, tenantID uint64) ([]*entity.Segment, error)
+	// GetManyByIDs gets segments of a tenant, or of all tenants if tenantID is 0.
+	GetManyByIDs(ctx context.Context, tenantID uint64, segmentIDs []uint64) ([]*entity.Segment, error)
 	CountByTenantID(ctx context.Context, tenantID uint64) (uint64, error)
+	GetVersion(ctx context.Context, tenantID, segmentID uint64, version uint32) (*entity.SegmentVersion, error)
+	GetVersions(ctx context.Context, tenantID, segmentID uint64, p *Pagination) ([]*entity.SegmentVersion, *Pagination, error)
 }
 
 type segmentRepo struct {
@@ -98,6 +142,19 @@ func (r *segmentRepo) GetByID(ctx context.Context, tenantID, segmentID uint64) (
 	}, true)
 }
 
+func (r *segmentRepo) LockByID(ctx context.Context, tenantID, segmentID uint64) (*entity.Segment, error) {
+	return r.getByFilter(ctx, &Filter{
+		Conditions: append(r.getBaseConditions(tenantID), r.mayAddDeleteFilter([]*Condition{
+			{
+				Field: "id",
+				Value: segmentID,
+				Op:    OpEq,
+			},
+		}, true)...),
+		Lock: true,
+	})
+}
+
 func (r *segmentRepo) GetManyByKeyword(ctx context.Context, tenantID uint64, keyword string, p *Pagination) ([]*entity.Segment, *Pagination, error) {
 	return r.getMany(ctx, tenantID, []*Condition{
 		{
@@ -116,9 +173,41 @@ func (r *segmentRepo) GetManyByKeyword(ctx context.Context, tenantID uint64, key
 	}, true, p)
 }
 
+func (r *segmentRepo) GetManyByTenantID(ctx context.Context, tenantID uint64) ([]*entity.Segment, error) {
+	segments, _, err := r.getMany(ctx, tenantID, nil, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
+func (r *segmentRepo) GetManyByIDs(ctx context.Context, tenantID uint64, segmentIDs []uint64) ([]*entity.Segment, error) {
+	if len(segmentIDs) == 0 {
+		return make([]*entity.Segment, 0), nil
+	}
+
+	segments, _, err := r.getMany(ctx, tenantID, []*Condition{
+		{
+			Field:         "id",
+			Value:         segmentIDs,
+			Op:            OpIn,
+			NextLogicalOp: LogicalOpAnd,
+		},
+	}, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
+
 func (r *segmentRepo) getMany(ctx context.Context, tenantID uint64, conditions []*Condition, filterDelete bool, p *Pagination) ([]*entity.Segment, *Pagination, error) {
+	baseConditions := make([]*Condition, 0)
+	if tenantID != 0 {
+		baseConditions = append(baseConditions, r.getBaseConditions(tenantID)...)
+	}
+
 	res, pNew, err := r.baseRepo.GetMany(ctx, new(Segment), &Filter{
-		Conditions: append(r.getBaseConditions(tenantID), r.mayAddDeleteFilter(conditions, filterDelete)...),
+		Conditions: append(baseConditions, r.mayAddDeleteFilter(conditions, filterDelete)...),
 		Pagination: p,
 	})
 	if err != nil {
@@ -138,11 +227,15 @@ func (r *segmentRepo) getMany(ctx context.Context, tenantID uint64, conditions [
 }
 
 func (r *segmentRepo) get(ctx context.Context, tenantID uint64, conditions []*Condition, filterDelete bool) (*entity.Segment, error) {
+	return r.getByFilter(ctx, &Filter{
+		Conditions: append(r.getBaseConditions(tenantID), r.mayAddDeleteFilter(conditions, filterDelete)...),
+	})
+}
+
+func (r *segmentRepo) getByFilter(ctx context.Context, f *Filter) (*entity.Segment, error) {
 	segment := new(Segment)
 
-	if err := r.baseRepo.Get(ctx, segment, &Filter{
-		Conditions: append(r.getBaseConditions(tenantID), r.mayAddDeleteFilter(conditions, filterDelete)...),
-	}); err != nil {
+	if err := r.baseRepo.Get(ctx, segment, f); err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return nil, ErrSegmentNotFound
 		}
@@ -181,15 +274,114 @@ func (r *segmentRepo) Create(ctx context.Context, segment *entity.Segment) (uint
 		return 0, err
 	}
 
-	if err := r.baseRepo.Create(ctx, segmentModel); err != nil {
+	if err := r.baseRepo.RunTx(ctx, func(ctx context.Context) error {
+		if err := r.baseRepo.Create(ctx, segmentModel); err != nil {
+			return err
+		}
+
+		return r.createVersions(ctx, segmentModel.GetID(), &entity.SegmentVersion{
+			Version:    segment.Version,
+			Criteria:   segment.Criteria,
+			CreatorID:  segment.CreatorID,
+			TenantID:   segment.TenantID,
+			CreateTime: segment.CreateTime,
+		})
+	}); err != nil {
 		return 0, err
 	}
 
 	return segmentModel.GetID(), nil
 }
 
+func (r *segmentRepo) Update(ctx context.Context, segment *entity.Segment, versions ...*entity.SegmentVersion) error {
+	segmentModel, err := ToSegmentModel(segment)
+	if err != nil {
+		return err
+	}
+
+	return r.baseRepo.RunTx(ctx, func(ctx context.Context) error {
+		if err := r.baseRepo.Update(ctx, segmentModel); err != nil {
+			return err
+		}
+
+		return r.createVersions(ctx, segment.GetID(), versions...)
+	})
+}
+
+func (r *segmentRepo) createVersions(ctx context.Context, segmentID uint64, versions ...*entity.SegmentVersion) error {
+	if len(versions) == 0 {
+		return nil
+	}
+
+	versionModels := make([]*SegmentVersion, 0, len(versions))
+	for _, version := range versions {
+		version.SegmentID = goutil.Uint64(segmentID)
+
+		versionModel, err := ToSegmentVersionModel(version)
+		if err != nil {
+			return err
+		}
+		versionModels = append(versionModels, versionModel)
+	}
+
+	return r.baseRepo.CreateMany(ctx, new(SegmentVersion), versionModels)
+}
+
+func (r *segmentRepo) GetVersion(ctx context.Context, tenantID, segmentID uint64, version uint32) (*entity.SegmentVersion, error) {
+	versionModel := new(SegmentVersion)
+
+	if err := r.baseRepo.Get(ctx, versionModel, &Filter{
+		Conditions: append(r.getBaseConditions(tenantID), []*Condition{
+			{
+				Field:         "segment_id",
+				Value:         segmentID,
+				Op:            OpEq,
+				NextLogicalOp: LogicalOpAnd,
+			},
+			{
+				Field: "version",
+				Value: version,
+				Op:    OpEq,
+			},
+		}...),
+	}); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSegmentVersionNotFound
+		}
+		return nil, err
+	}
+
+	return ToSegmentVersion(versionModel)
+}
+
+func (r *segmentRepo) GetVersions(ctx context.Context, tenantID, segmentID uint64, p *Pagination) ([]*entity.SegmentVersion, *Pagination, error) {
+	res, pNew, err := r.baseRepo.GetMany(ctx, new(SegmentVersion), &Filter{
+		Conditions: append(r.getBaseConditions(tenantID), &Condition{
+			Field: "segment_id",
+			Value: segmentID,
+			Op:    OpEq,
+		}),
+		Pagination: p,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	versions := make([]*entity.SegmentVersion, 0, len(res))
+	for _, m := range res {
+		version, err := ToSegmentVersion(m.(*SegmentVersion))
+		if err != nil {
+			return nil, nil, err
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, pNew, nil
+}
+
 func ToSegmentModel(segment *entity.Segment) (*Segment, error) {
-	query, err := segment.GetCriteria().ToString()
+	// the criteria of a static segment is not stored, see entity.Segment.GetCriteria
+	query, err := segment.Criteria.ToString()
 	if err != nil {
 		return nil, err
 	}
@@ -199,7 +391,9 @@ func ToSegmentModel(segment *entity.Segment) (*Segment, error) {
 		Name:        segment.Name,
 		SegmentDesc: segment.SegmentDesc,
 		Status:      goutil.Uint32(uint32(segment.GetStatus())),
+		Version:     segment.Version,
 		Criteria:    goutil.String(query),
+		SegmentType: goutil.Uint32(uint32(segment.GetSegmentType())),
 		TenantID:    segment.TenantID,
 		CreatorID:   segment.CreatorID,
 		CreateTime:  segment.CreateTime,
@@ -218,10 +412,48 @@ func ToSegment(segment *Segment) (*entity.Segment, error) {
 		Name:        segment.Name,
 		SegmentDesc: segment.SegmentDesc,
 		Criteria:    query,
+		SegmentType: entity.SegmentType(segment.GetSegmentType()),
 		Status:      entity.SegmentStatus(segment.GetStatus()),
+		Version:     segment.Version,
 		TenantID:    segment.TenantID,
 		CreatorID:   segment.CreatorID,
 		CreateTime:  segment.CreateTime,
 		UpdateTime:  segment.UpdateTime,
 	}, nil
 }
+
+func ToSegmentVersionModel(version *entity.SegmentVersion) (*SegmentVersion, error) {
+	query, err := version.GetCriteria().ToString()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SegmentVersion{
+		ID:           version.ID,
+		SegmentID:    version.SegmentID,
+		Version:      version.Version,
+		Criteria:     goutil.String(query),
+		RestoredFrom: version.RestoredFrom,
+		CreatorID:    version.CreatorID,
+		TenantID:     version.TenantID,
+		CreateTime:   version.CreateTime,
+	}, nil
+}
+
+func ToSegmentVersion(version *SegmentVersion) (*entity.SegmentVersion, error) {
+	query := new(entity.Query)
+	if err := json.Unmarshal([]byte(version.GetCriteria()), query); err != nil {
+		return nil, err
+	}
+
+	return &entity.SegmentVersion{
+		ID:           version.ID,
+		SegmentID:    version.SegmentID,
+		Version:      version.Version,
+		Criteria:     query,
+		RestoredFrom: version.RestoredFrom,
+		CreatorID:    version.CreatorID,
+		TenantID:     version.TenantID,
+		CreateTime:   version.CreateTime,
+	}, nil
+}
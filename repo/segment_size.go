@@ -0,0 +1,151 @@
+package repo
+
+import (
+	"cdp/entity"
+	"cdp/pkg/goutil"
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"sort"
+	"time"
+)
+
+type SegmentSize struct {
+	ID         *uint64
+	TenantID   *uint64
+	SegmentID  *uint64
+	Size       *uint64
+	Day        *uint64
+	CreateTime *uint64
+	UpdateTime *uint64
+}
+
+func (m *SegmentSize) TableName() string {
+	return "segment_size_tab"
+}
+
+func (m *SegmentSize) GetID() uint64 {
+	if m != nil && m.ID != nil {
+		return *m.ID
+	}
+	return 0
+}
+
+type SegmentSizeRepo interface {
+	// Record saves the size of the segment on the day, replacing the size recorded earlier on the same day.
+	Record(ctx context.Context, segmentSize *entity.SegmentSize) error
+	// GetManyBySegmentID gets the sizes of the segment recorded within [fromDay, toDay], oldest first.
+	GetManyBySegmentID(ctx context.Context, tenantID, segmentID, fromDay, toDay uint64) ([]*entity.SegmentSize, error)
+}
+
+type segmentSizeRepo struct {
+	baseRepo BaseRepo
+}
+
+func NewSegmentSizeRepo(_ context.Context, baseRepo BaseRepo) SegmentSizeRepo {
+	return &segmentSizeRepo{baseRepo: baseRepo}
+}
+
+func (r *segmentSizeRepo) Record(ctx context.Context, segmentSize *entity.SegmentSize) error {
+	now := goutil.Uint64(uint64(time.Now().Unix()))
+
+	existing := new(SegmentSize)
+	err := r.baseRepo.Get(ctx, existing, &Filter{
+		Conditions: []*Condition{
+			{
+				Field:         "segment_id",
+				Value:         segmentSize.GetSegmentID(),
+				Op:            OpEq,
+				NextLogicalOp: LogicalOpAnd,
+			},
+			{
+				Field: "day",
+				Value: segmentSize.GetDay(),
+				Op:    OpEq,
+			},
+		},
+	})
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	if err == nil {
+		existing.Size = segmentSize.Size
+		existing.UpdateTime = now
+		return r.baseRepo.Update(ctx, existing)
+	}
+
+	segmentSizeModel := ToSegmentSizeModel(segmentSize)
+	segmentSizeModel.CreateTime = now
+	segmentSizeModel.UpdateTime = now
+
+	return r.baseRepo.Create(ctx, segmentSizeModel)
+}
+
+func (r *segmentSizeRepo) GetManyBySegmentID(ctx context.Context, tenantID, segmentID, fromDay, toDay uint64) ([]*entity.SegmentSize, error) {
+	res, _, err := r.baseRepo.GetMany(ctx, new(SegmentSize), &Filter{
+		Conditions: []*Condition{
+			{
+				Field:         "tenant_id",
+				Value:         tenantID,
+				Op:            OpEq,
+				NextLogicalOp: LogicalOpAnd,
+			},
+			{
+				Field:         "segment_id",
+				Value:         segmentID,
+				Op:            OpEq,
+				NextLogicalOp: LogicalOpAnd,
+			},
+			{
+				Field:         "day",
+				Value:         fromDay,
+				Op:            OpGte,
+				NextLogicalOp: LogicalOpAnd,
+			},
+			{
+				Field: "day",
+				Value: toDay,
+				Op:    OpLte,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	segmentSizes := make([]*entity.SegmentSize, 0, len(res))
+	for _, m := range res {
+		segmentSizes = append(segmentSizes, ToSegmentSize(m.(*SegmentSize)))
+	}
+
+	sort.Slice(segmentSizes, func(i, j int) bool {
+		return segmentSizes[i].GetDay() < segmentSizes[j].GetDay()
+	})
+
+	return segmentSizes, nil
+}
+
+func ToSegmentSizeModel(segmentSize *entity.SegmentSize) *SegmentSize {
+	return &SegmentSize{
+		ID:         segmentSize.ID,
+		TenantID:   segmentSize.TenantID,
+		SegmentID:  segmentSize.SegmentID,
+		Size:       segmentSize.Size,
+		Day:        segmentSize.Day,
+		CreateTime: segmentSize.CreateTime,
+		UpdateTime: segmentSize.UpdateTime,
+	}
+}
+
+func ToSegmentSize(segmentSize *SegmentSize) *entity.SegmentSize {
+	return &entity.SegmentSize{
+		ID:         segmentSize.ID,
+		TenantID:   segmentSize.TenantID,
+		SegmentID:  segmentSize.SegmentID,
+		Size:       segmentSize.Size,
+		Day:        segmentSize.Day,
+		CreateTime: segmentSize.CreateTime,
+		UpdateTime: segmentSize.UpdateTime,
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"gorm.io/gorm"
+	"time"
 )
 
 var (
@@ -21,6 +22,7 @@ type Tag struct {
 	TagDesc    *string
 	Enum       *string
 	ValueType  *uint32
+	Kind       *uint32
 	Status     *uint32
 	ExtInfo    *string
 	CreatorID  *uint64
@@ -54,6 +56,13 @@ func (m *Tag) GetValueType() uint32 {
 	return 0
 }
 
+func (m *Tag) GetKind() uint32 {
+	if m != nil && m.Kind != nil {
+		return *m.Kind
+	}
+	return 0
+}
+
 func (m *Tag) GetEnum() string {
 	if m != nil && m.Enum != nil {
 		return *m.Enum
@@ -70,10 +79,22 @@ func (m *Tag) GetExtInfo() string {
 
 type TagRepo interface {
 	Create(ctx context.Context, tag *entity.Tag) (uint64, error)
+	Update(ctx context.Context, tag *entity.Tag) error
 	GetByID(ctx context.Context, tenantID, tagID uint64) (*entity.Tag, error)
 	CountByTenantID(ctx context.Context, tenantID uint64) (uint64, error)
 	GetManyByKeyword(ctx context.Context, tenantID uint64, keyword string, p *Pagination) ([]*entity.Tag, *Pagination, error)
 	GetByName(ctx context.Context, tenantID uint64, name string) (*entity.Tag, error)
+	GetDerivedTags(ctx context.Context, tenantID uint64) ([]*entity.Tag, error)
+	GetManyByIDs(ctx context.Context, tenantID uint64, tagIDs []uint64) ([]*entity.Tag, error)
+	// GetTagsToStartHistory gets tags keeping history whose values set before have no history yet,
+	// of a tenant, or of all tenants if tenantID is 0.
+	GetTagsToStartHistory(ctx context.Context, tenantID uint64) ([]*entity.Tag, error)
+	// SetLastMaterializeTime sets the last materialize time of a derived tag, leaving the other fields as they are.
+	SetLastMaterializeTime(ctx context.Context, tenantID, tagID, materializeTime uint64) error
+	// SetLastUploadTime sets the last upload time of a tag, leaving the other fields as they are.
+	SetLastUploadTime(ctx context.Context, tenantID, tagID, uploadTime uint64) error
+	// SetHistoryStartTime sets the time the history of a tag is started, leaving the other fields as they are.
+	SetHistoryStartTime(ctx context.Context, tenantID, tagID, startTime uint64) error
 }
 
 type tagRepo struct {
@@ -114,6 +135,58 @@ func (r *tagRepo) GetByID(ctx context.Context, tenantID, tagID uint64) (*entity.
 	}, true)
 }
 
+// GetDerivedTags gets derived tags of a tenant, or of all tenants if tenantID is 0.
+func (r *tagRepo) GetDerivedTags(ctx context.Context, tenantID uint64) ([]*entity.Tag, error) {
+	tags, _, err := r.getMany(ctx, tenantID, []*Condition{
+		{
+			Field:         "kind",
+			Value:         entity.TagKindDerived,
+			Op:            OpEq,
+			NextLogicalOp: LogicalOpAnd,
+		},
+	}, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (r *tagRepo) GetTagsToStartHistory(ctx context.Context, tenantID uint64) ([]*entity.Tag, error) {
+	// ext_info is not indexed, so the tags are picked after they are read
+	tags, _, err := r.getMany(ctx, tenantID, nil, true, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	toStart := make([]*entity.Tag, 0)
+	for _, tag := range tags {
+		if tag.KeepsHistory() && tag.GetExtInfo().GetHistoryStartTime() == 0 {
+			toStart = append(toStart, tag)
+		}
+	}
+
+	return toStart, nil
+}
+
+func (r *tagRepo) GetManyByIDs(ctx context.Context, tenantID uint64, tagIDs []uint64) ([]*entity.Tag, error) {
+	if len(tagIDs) == 0 {
+		return make([]*entity.Tag, 0), nil
+	}
+
+	tags, _, err := r.getMany(ctx, tenantID, []*Condition{
+		{
+			Field:         "id",
+			Value:         tagIDs,
+			Op:            OpIn,
+			NextLogicalOp: LogicalOpAnd,
+		},
+	}, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
 func (r *tagRepo) GetManyByKeyword(ctx context.Context, tenantID uint64, keyword string, p *Pagination) ([]*entity.Tag, *Pagination, error) {
 	return r.getMany(ctx, tenantID, []*Condition{
 		{
@@ -133,8 +206,13 @@ func (r *tagRepo) GetManyByKeyword(ctx context.Context, tenantID uint64, keyword
 }
 
 func (r *tagRepo) getMany(ctx context.Context, tenantID uint64, conditions []*Condition, filterDelete bool, p *Pagination) ([]*entity.Tag, *Pagination, error) {
+	baseConditions := make([]*Condition, 0)
+	if tenantID != 0 {
+		baseConditions = append(baseConditions, r.getBaseConditions(tenantID)...)
+	}
+
 	res, pNew, err := r.baseRepo.GetMany(ctx, new(Tag), &Filter{
-		Conditions: append(r.getBaseConditions(tenantID), r.mayAddDeleteFilter(conditions, filterDelete)...),
+		Conditions: append(baseConditions, r.mayAddDeleteFilter(conditions, filterDelete)...),
 		Pagination: p,
 	})
 	if err != nil {
@@ -204,6 +282,42 @@ func (r *tagRepo) Create(ctx context.Context, tag *entity.Tag) (uint64, error) {
 	return tagModel.GetID(), nil
 }
 
+func (r *tagRepo) Update(ctx context.Context, tag *entity.Tag) error {
+	tagModel, err := ToTagModel(tag)
+	if err != nil {
+		return err
+	}
+
+	return r.baseRepo.Update(ctx, tagModel)
+}
+
+func (r *tagRepo) SetLastMaterializeTime(ctx context.Context, tenantID, tagID, materializeTime uint64) error {
+	return r.setExtInfoField(ctx, tenantID, tagID, "last_materialize_time", materializeTime)
+}
+
+func (r *tagRepo) SetLastUploadTime(ctx context.Context, tenantID, tagID, uploadTime uint64) error {
+	return r.setExtInfoField(ctx, tenantID, tagID, "last_upload_time", uploadTime)
+}
+
+func (r *tagRepo) SetHistoryStartTime(ctx context.Context, tenantID, tagID, startTime uint64) error {
+	return r.setExtInfoField(ctx, tenantID, tagID, "history_start_time", startTime)
+}
+
+// setExtInfoField writes a field of ext_info in place, so that a job holding the tag for long does not
+// write back a stale copy of the row over the changes made since, e.g. a rename or a delete.
+func (r *tagRepo) setExtInfoField(ctx context.Context, tenantID, tagID uint64, field string, value interface{}) error {
+	return r.baseRepo.UpdateMany(ctx, new(Tag), &Filter{
+		Conditions: append(r.getBaseConditions(tenantID), &Condition{
+			Field: "id",
+			Value: tagID,
+			Op:    OpEq,
+		}),
+	}, map[string]interface{}{
+		"ext_info":    gorm.Expr("JSON_SET(ext_info, ?, ?)", "$."+field, value),
+		"update_time": uint64(time.Now().Unix()),
+	})
+}
+
 func ToTagModel(tag *entity.Tag) (*Tag, error) {
 	extInfo, err := tag.GetExtInfo().ToString()
 	if err != nil {
@@ -220,6 +334,7 @@ func ToTagModel(tag *entity.Tag) (*Tag, error) {
 		Name:       tag.Name,
 		TagDesc:    tag.TagDesc,
 		ValueType:  goutil.Uint32(uint32(tag.GetValueType())),
+		Kind:       goutil.Uint32(uint32(tag.GetKind())),
 		Status:     goutil.Uint32(uint32(tag.GetStatus())),
 		ExtInfo:    goutil.String(extInfo),
 		Enum:       goutil.String(string(enum)),
@@ -247,6 +362,7 @@ func ToTag(tag *Tag) (*entity.Tag, error) {
 		TagDesc:    tag.TagDesc,
 		Status:     entity.TagStatus(tag.GetStatus()),
 		ValueType:  entity.TagValueType(tag.GetValueType()),
+		Kind:       entity.TagKind(tag.GetKind()),
 		Enum:       enum,
 		ExtInfo:    extInfo,
 		CreatorID:  tag.CreatorID,
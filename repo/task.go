@@ -2,9 +2,16 @@ package repo
 
 import (
 	"cdp/entity"
+	"cdp/pkg/errutil"
 	"cdp/pkg/goutil"
 	"context"
 	"encoding/json"
+	"errors"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrTaskNotFound = errutil.NotFoundError(errors.New("task not found"))
 )
 
 type Task struct {
@@ -55,8 +62,15 @@ func (m *Task) GetResourceType() uint32 {
 type TaskRepo interface {
 	Create(ctx context.Context, task *entity.Task) (uint64, error)
 	Update(ctx context.Context, task *entity.Task) error
-	GetByResourceIDAndType(ctx context.Context, resourceID uint64, resourceType entity.ResourceType, p *Pagination) ([]*entity.Task, *Pagination, error)
+	GetByID(ctx context.Context, tenantID, taskID uint64) (*entity.Task, error)
+	GetByResourceIDAndType(ctx context.Context, tenantID, resourceID uint64, resourceType entity.ResourceType, taskType entity.TaskType,
+		p *Pagination) ([]*entity.Task, *Pagination, error)
 	GetPendingFileUploadTasks(ctx context.Context, resourceType entity.ResourceType) ([]*entity.Task, error)
+	GetPendingSegmentExportTasks(ctx context.Context) ([]*entity.Task, error)
+	GetPendingSegmentSnapshotTasks(ctx context.Context) ([]*entity.Task, error)
+	// CountByResource counts the tasks of a resource in any of the task types and statuses.
+	CountByResource(ctx context.Context, resourceID uint64, resourceType entity.ResourceType, taskTypes []entity.TaskType,
+		statuses []entity.TaskStatus) (uint64, error)
 }
 
 func NewTaskRepo(_ context.Context, baseRepo BaseRepo) TaskRepo {
@@ -95,8 +109,125 @@ func (r *taskRepo) GetPendingFileUploadTasks(ctx context.Context, resourceType e
 	return tasks, nil
 }
 
-func (r *taskRepo) GetByResourceIDAndType(ctx context.Context, resourceID uint64, resourceType entity.ResourceType, p *Pagination) ([]*entity.Task, *Pagination, error) {
+func (r *taskRepo) GetPendingSegmentExportTasks(ctx context.Context) ([]*entity.Task, error) {
+	tasks, _, err := r.getMany(ctx, []*Condition{
+		{
+			Field:         "resource_type",
+			Value:         entity.ResourceTypeSegment,
+			Op:            OpEq,
+			NextLogicalOp: LogicalOpAnd,
+		},
+		{
+			Field:         "task_type",
+			Value:         entity.TaskTypeSegmentExport,
+			Op:            OpEq,
+			NextLogicalOp: LogicalOpAnd,
+		},
+		{
+			Field: "status",
+			Value: entity.TaskStatusPending,
+			Op:    OpEq,
+		},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func (r *taskRepo) GetPendingSegmentSnapshotTasks(ctx context.Context) ([]*entity.Task, error) {
+	tasks, _, err := r.getMany(ctx, []*Condition{
+		{
+			Field:         "resource_type",
+			Value:         entity.ResourceTypeSegment,
+			Op:            OpEq,
+			NextLogicalOp: LogicalOpAnd,
+		},
+		{
+			Field:         "task_type",
+			Value:         entity.TaskTypeSegmentSnapshot,
+			Op:            OpEq,
+			NextLogicalOp: LogicalOpAnd,
+		},
+		{
+			Field: "status",
+			Value: entity.TaskStatusPending,
+			Op:    OpEq,
+		},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+func (r *taskRepo) CountByResource(ctx context.Context, resourceID uint64, resourceType entity.ResourceType, taskTypes []entity.TaskType,
+	statuses []entity.TaskStatus) (uint64, error) {
+	return r.baseRepo.Count(ctx, new(Task), &Filter{
+		Conditions: []*Condition{
+			{
+				Field:         "resource_id",
+				Value:         resourceID,
+				Op:            OpEq,
+				NextLogicalOp: LogicalOpAnd,
+			},
+			{
+				Field:         "resource_type",
+				Value:         resourceType,
+				Op:            OpEq,
+				NextLogicalOp: LogicalOpAnd,
+			},
+			{
+				Field:         "task_type",
+				Value:         taskTypes,
+				Op:            OpIn,
+				NextLogicalOp: LogicalOpAnd,
+			},
+			{
+				Field: "status",
+				Value: statuses,
+				Op:    OpIn,
+			},
+		},
+	})
+}
+
+func (r *taskRepo) GetByID(ctx context.Context, tenantID, taskID uint64) (*entity.Task, error) {
+	task := new(Task)
+
+	if err := r.baseRepo.Get(ctx, task, &Filter{
+		Conditions: []*Condition{
+			{
+				Field:         "tenant_id",
+				Value:         tenantID,
+				Op:            OpEq,
+				NextLogicalOp: LogicalOpAnd,
+			},
+			{
+				Field: "id",
+				Value: taskID,
+				Op:    OpEq,
+			},
+		},
+	}); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrTaskNotFound
+		}
+		return nil, err
+	}
+
+	return ToTask(task)
+}
+
+func (r *taskRepo) GetByResourceIDAndType(ctx context.Context, tenantID, resourceID uint64, resourceType entity.ResourceType, taskType entity.TaskType,
+	p *Pagination) ([]*entity.Task, *Pagination, error) {
 	return r.getMany(ctx, []*Condition{
+		{
+			Field:         "tenant_id",
+			Value:         tenantID,
+			Op:            OpEq,
+			NextLogicalOp: LogicalOpAnd,
+		},
 		{
 			Field:         "resource_id",
 			Value:         resourceID,
@@ -104,8 +235,14 @@ func (r *taskRepo) GetByResourceIDAndType(ctx context.Context, resourceID uint64
 			NextLogicalOp: LogicalOpAnd,
 		},
 		{
-			Field: "resource_type",
-			Value: resourceType,
+			Field:         "resource_type",
+			Value:         resourceType,
+			Op:            OpEq,
+			NextLogicalOp: LogicalOpAnd,
+		},
+		{
+			Field: "task_type",
+			Value: taskType,
 			Op:    OpEq,
 		},
 	}, p)
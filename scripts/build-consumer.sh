@@ -0,0 +1,3 @@
+#!/bin/bash
+
+go build -o bin/mirror-consumer ./consumer
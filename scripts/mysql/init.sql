@@ -11,6 +11,7 @@ CREATE TABLE IF NOT EXISTS tag_tab (
     `tag_desc` VARCHAR(256) NOT NULL,
     `enum` TEXT NOT NULL,
     `value_type` TINYINT UNSIGNED NOT NULL,
+    `kind` TINYINT UNSIGNED NOT NULL DEFAULT '1',
     `status` TINYINT UNSIGNED NOT NULL DEFAULT '1',
     `ext_info` TEXT NOT NULL,
     `creator_id` BIGINT UNSIGNED NOT NULL,
@@ -18,7 +19,8 @@ CREATE TABLE IF NOT EXISTS tag_tab (
     `update_time` BIGINT UNSIGNED NOT NULL,
     PRIMARY KEY (`id`),
     UNIQUE KEY `idx_tenant_id_name_status` (`tenant_id`, `name`, `status`),
-    KEY `idx_tag_desc` (`tag_desc`)
+    KEY `idx_tag_desc` (`tag_desc`),
+    KEY `idx_kind` (`kind`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE IF NOT EXISTS segment_tab (
@@ -27,7 +29,9 @@ CREATE TABLE IF NOT EXISTS segment_tab (
     `name` VARCHAR(64) NOT NULL,
     `segment_desc` VARCHAR(256) NOT NULL,
     `criteria` TEXT NOT NULL,
+    `segment_type` TINYINT UNSIGNED NOT NULL DEFAULT '1',
     `status` TINYINT UNSIGNED NOT NULL DEFAULT '1',
+    `version` INT UNSIGNED NOT NULL DEFAULT '1',
     `creator_id` BIGINT UNSIGNED NOT NULL,
     `create_time` BIGINT UNSIGNED NOT NULL,
     `update_time` BIGINT UNSIGNED NOT NULL,
@@ -36,6 +40,32 @@ CREATE TABLE IF NOT EXISTS segment_tab (
     KEY `idx_segment_desc` (`segment_desc`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+CREATE TABLE IF NOT EXISTS segment_version_tab (
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    `tenant_id` BIGINT UNSIGNED NOT NULL,
+    `segment_id` BIGINT UNSIGNED NOT NULL,
+    `version` INT UNSIGNED NOT NULL,
+    `criteria` TEXT NOT NULL,
+    `restored_from` INT UNSIGNED DEFAULT NULL,
+    `creator_id` BIGINT UNSIGNED NOT NULL,
+    `create_time` BIGINT UNSIGNED NOT NULL,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `idx_tenant_id_segment_id_version` (`tenant_id`, `segment_id`, `version`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS segment_size_tab (
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    `tenant_id` BIGINT UNSIGNED NOT NULL,
+    `segment_id` BIGINT UNSIGNED NOT NULL,
+    `size` BIGINT UNSIGNED NOT NULL,
+    `day` BIGINT UNSIGNED NOT NULL,
+    `create_time` BIGINT UNSIGNED NOT NULL,
+    `update_time` BIGINT UNSIGNED NOT NULL,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `idx_segment_id_day` (`segment_id`, `day`),
+    KEY `idx_tenant_id_segment_id` (`tenant_id`, `segment_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
 CREATE TABLE IF NOT EXISTS email_tab (
     `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
     `tenant_id` BIGINT UNSIGNED NOT NULL,
@@ -88,7 +118,8 @@ CREATE TABLE IF NOT EXISTS campaign_log_tab (
     `event_time` BIGINT UNSIGNED NOT NULL,
     `create_time` BIGINT UNSIGNED NOT NULL,
     PRIMARY KEY (`id`),
-    KEY `idx_campaign_id` (`campaign_email_id`)
+    KEY `idx_campaign_id` (`campaign_email_id`),
+    KEY `idx_email` (`email`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE IF NOT EXISTS tenant_tab (
@@ -189,3 +220,41 @@ CREATE TABLE IF NOT EXISTS sender_tab (
     PRIMARY KEY (`id`),
     UNIQUE KEY `idx_tenant_id_name_local_part` (`tenant_id`, `name`, `local_part`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS mapping_id_tab (
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    `tenant_id` BIGINT UNSIGNED NOT NULL,
+    `ud_id` VARCHAR(256) NOT NULL,
+    `profile_id` BIGINT UNSIGNED NOT NULL,
+    `create_time` BIGINT UNSIGNED NOT NULL,
+    `update_time` BIGINT UNSIGNED NOT NULL,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `idx_tenant_id_ud_id` (`tenant_id`, `ud_id`),
+    KEY `idx_tenant_id_profile_id` (`tenant_id`, `profile_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS erasure_tab (
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    `tenant_id` BIGINT UNSIGNED NOT NULL,
+    `id_type` TINYINT UNSIGNED NOT NULL,
+    `ud_hash` CHAR(64) NOT NULL,
+    `status` TINYINT UNSIGNED NOT NULL,
+    `ext_info` TEXT NOT NULL,
+    `creator_id` BIGINT UNSIGNED NOT NULL,
+    `erase_time` BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    `create_time` BIGINT UNSIGNED NOT NULL,
+    `update_time` BIGINT UNSIGNED NOT NULL,
+    PRIMARY KEY (`id`),
+    KEY `idx_tenant_id` (`tenant_id`),
+    KEY `idx_status` (`status`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS suppressed_ud_tab (
+    `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,
+    `tenant_id` BIGINT UNSIGNED NOT NULL,
+    `ud_hash` CHAR(64) NOT NULL,
+    `erasure_id` BIGINT UNSIGNED NOT NULL,
+    `create_time` BIGINT UNSIGNED NOT NULL,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `idx_tenant_id_ud_hash` (`tenant_id`, `ud_hash`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
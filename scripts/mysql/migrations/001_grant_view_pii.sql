@@ -0,0 +1,9 @@
+USE mirrorcdp_db;
+
+-- roles created before view_pii existed never received it, so grant it to the
+-- existing Admin roles to keep admins seeing unmasked data
+UPDATE role_tab
+SET `actions`     = IF(`actions` = '', 'view_pii', CONCAT(`actions`, ',view_pii')),
+    `update_time` = UNIX_TIMESTAMP()
+WHERE `name` = 'Admin'
+  AND FIND_IN_SET('view_pii', `actions`) = 0;
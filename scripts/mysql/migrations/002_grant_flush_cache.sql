@@ -0,0 +1,9 @@
+USE mirrorcdp_db;
+
+-- roles created before flush_cache existed never received it, so grant it to the
+-- existing Admin roles to keep admins able to flush the query cache of their tenant
+UPDATE role_tab
+SET `actions`     = IF(`actions` = '', 'flush_cache', CONCAT(`actions`, ',flush_cache')),
+    `update_time` = UNIX_TIMESTAMP()
+WHERE `name` = 'Admin'
+  AND FIND_IN_SET('flush_cache', `actions`) = 0;